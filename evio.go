@@ -5,13 +5,63 @@
 package evio
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
 	"io"
+	"math"
 	"net"
 	"os"
+	"runtime/pprof"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
+// ErrHandshakeTimeout is passed to the Closed event when a connection did
+// not complete its handshake within Options.HandshakeTimeout.
+var ErrHandshakeTimeout = errors.New("handshake timeout")
+
+// ErrNotSupported is returned when an operation is not available for the
+// connection, such as socket options for UDP connections.
+var ErrNotSupported = errors.New("operation not supported")
+
+// ErrConnClosed is returned when the connection has been closed or detached.
+var ErrConnClosed = errors.New("connection closed")
+
+// ErrResponseTimeout is returned by CorrelationTracker.Await when no
+// response is delivered within the timeout, and is passed to the Closed
+// event when the ack of SendThenAwaitClose does not arrive in time.
+var ErrResponseTimeout = errors.New("response timeout")
+
+// ErrWriteBufferOverflow is passed to the Closed event when the outbound
+// data of a connection exceeds Options.MaxWriteBuffer.
+var ErrWriteBufferOverflow = errors.New("write buffer overflow")
+
+// ErrWakeQueueFull is returned by WakeWithMessage when the connection has
+// Options.MaxPendingWakes pending wakes.
+var ErrWakeQueueFull = errors.New("wake queue full")
+
+// ErrAckWindowFull is returned by QueueWrite while the loop of the
+// connection runs an event, when its AckWindow is full.
+var ErrAckWindowFull = errors.New("ack window full")
+
+// ErrOnLoop is returned by Flush while the loop of the connection runs an
+// event, which the loop would wait for itself.
+var ErrOnLoop = errors.New("called on the event loop")
+
+// ErrLoopDrained is returned by Server.DrainLoop when the loop is already
+// drained, or there is no other loop to migrate the connections to.
+var ErrLoopDrained = errors.New("loop drained")
+
+// ErrServerClosed is returned by Server.DrainLoop when the server stops
+// before the loop is drained.
+var ErrServerClosed = errors.New("server closed")
+
 // Action is an action that occurs after the completion of an event.
 type Action int
 
@@ -26,26 +76,476 @@ const (
 	Shutdown
 )
 
+// ReadBufferPolicy sets how the read buffer of a connection is sized.
+type ReadBufferPolicy int
+
+const (
+	// FixedReadBuffer always reads with Options.ReadBufferSize.
+	FixedReadBuffer ReadBufferPolicy = iota
+	// DoublingReadBuffer doubles the read buffer up to MaxReadBufferSize when
+	// a read fills it, and halves it down to ReadBufferSize when a read uses
+	// less than half of it.
+	DoublingReadBuffer
+)
+
+// WriteOverflowPolicy sets what happens when the pending outbound data of a
+// connection would exceed Options.MaxWriteBuffer.
+type WriteOverflowPolicy int
+
+const (
+	// CloseOnOverflow discards the pending data and closes the connection
+	// with ErrWriteBufferOverflow.
+	CloseOnOverflow WriteOverflowPolicy = iota
+	// DropOldest discards the oldest buffers until the new one fits. A
+	// buffer which is partially written already is kept, so the peer never
+	// gets a cut one, which suits a stream of the latest states.
+	DropOldest
+	// DropNewest discards the new buffer.
+	DropNewest
+)
+
+const (
+	defaultReadBufferSize    = 0xFFFF
+	defaultMaxReadBufferSize = 1024 * 1024
+)
+
 // Options are set when the client opens.
 type Options struct {
 	// TCPKeepAlive (SO_KEEPALIVE) socket option.
 	TCPKeepAlive time.Duration
+	// KeepAliveInterval (TCP_KEEPINTVL) is the time between the keepalive
+	// probes, and KeepAliveProbes (TCP_KEEPCNT) is the number of the
+	// unanswered probes before the connection is dropped. They are applied
+	// along with TCPKeepAlive only, and are logged as unsupported on the
+	// platforms without them, such as OpenBSD.
+	// Default value is zero, which means the default of the system.
+	KeepAliveInterval time.Duration
+	KeepAliveProbes   int
 	// ReuseInputBuffer will forces the connection to share and reuse the
 	// same input packet buffer with all other connections that also use
 	// this option.
 	// Default value is false, which means that all input data which is
 	// passed to the Data event will be a uniquely copied []byte slice.
 	ReuseInputBuffer bool
+	// HandshakeTimeout closes the connection with ErrHandshakeTimeout when
+	// CompleteHandshake is not called within the duration after Opened.
+	// Default value is zero, which means that there is no timeout.
+	HandshakeTimeout time.Duration
+	// RecvBuf sets the SO_RCVBUF socket option of the connection.
+	// Default value is zero, which means that the system default is used.
+	// The kernel usually doubles the value to allow space for bookkeeping
+	// overhead, and on Linux it's clamped to net.core.rmem_max.
+	RecvBuf int
+	// SendBuf sets the SO_SNDBUF socket option of the connection.
+	// Default value is zero, which means that the system default is used.
+	// The kernel usually doubles the value to allow space for bookkeeping
+	// overhead, and on Linux it's clamped to net.core.wmem_max.
+	SendBuf int
+	// Linger sets the SO_LINGER socket option of the connection in seconds,
+	// which is how long the close waits for the pending output to be sent.
+	// Zero resets the connection on close, so it skips TIME_WAIT, which
+	// saves the ports of a server that closes many short connections, but
+	// the unsent data is lost and the peer gets ECONNRESET instead of EOF.
+	// Default value is nil, which means the system default, a graceful
+	// close in the background.
+	Linger *int
+	// ReadBufferSize is the size of the buffer for reading the connection.
+	// Default value is zero, which means 64KB.
+	ReadBufferSize int
+	// ReadBufferPolicy sets how the read buffer grows and shrinks.
+	// Default value is FixedReadBuffer.
+	ReadBufferPolicy ReadBufferPolicy
+	// MaxReadBufferSize is the cap of a DoublingReadBuffer.
+	// Default value is zero, which means 1MB.
+	MaxReadBufferSize int
+	// EdgeTriggered sets the connection to edge-triggered epoll or kqueue,
+	// that reports the readiness once, instead of for as long as the socket
+	// is ready. The loop reads and writes until EAGAIN on every readiness,
+	// which saves the syscalls for rearming the socket, but a connection that
+	// keeps sending data delays the other connections of the loop.
+	// Default value is false, which means level-triggered. It's ignored by
+	// the stdlib backend.
+	EdgeTriggered bool
+	// EagerDelivery reads the connection while its output is pending, so
+	// every read is passed to the Data event as the bytes arrive, instead
+	// of after the output is written. It lowers the latency of interactive
+	// protocols, such as terminals, at the cost of a read syscall for every
+	// write, and a peer which does not read can still send more data, so a
+	// protocol decoder of the connection still has to reassemble its frames
+	// from the partial reads.
+	// Default value is false. It's ignored by the stdlib backend, which
+	// always reads on a separate goroutine.
+	EagerDelivery bool
+	// MaxPendingWakes limits the pending WakeWithMessage messages and the
+	// pending Wake calls of the connection, which are not taken by the loop
+	// yet. Over the limit, WakeWithMessage returns ErrWakeQueueFull, and Wake
+	// is dropped, since the pending wakes fire the Send event anyway.
+	// Default value is zero, which means that there is no limit.
+	MaxPendingWakes int
+	// CompressWrites compresses the outgoing buffers of the connection
+	// from the size, including the out return value of the Opened event.
+	// Default value is the zero value, which means no compression.
+	CompressWrites CompressWrites
+	// RateWindow is the averaging window of Conn.RateRxBps and RateTxBps.
+	// Default value is zero, which means one second.
+	RateWindow time.Duration
+	// MaxWriteBuffer is the hard cap of the pending outbound bytes of the
+	// connection, which are not written to the socket yet. The data over the
+	// cap is handled by WriteOverflowPolicy and reported to the
+	// Events.WriteOverflow. Unlike the soft throttle of WriteQueueLen, it
+	// bounds the memory of a stuck connection.
+	// Default value is zero, which means that there is no cap.
+	MaxWriteBuffer int
+	// WriteOverflowPolicy sets what happens over MaxWriteBuffer.
+	// Default value is CloseOnOverflow.
+	WriteOverflowPolicy WriteOverflowPolicy
+	// DeferSession defers the session of the connection until the first
+	// incoming data, when Events.FirstData produces the session, which is
+	// bound before the Data event. So a connection which is closed before
+	// sending anything, such as a port scanner, never gets a session.
+	// Default value is false, the session is usually bound in Opened then.
+	DeferSession bool
+	// Trace is called with every incoming read and every outgoing write of
+	// the connection on the loop goroutine, such as to capture the bytes of
+	// a protocol while debugging. The writes are traced after the
+	// compression, as they are on the wire, the poll loops trace the bytes
+	// which are written to the socket, and the stdlib loops the bytes which
+	// are about to be written. The b is only valid during the call, and must
+	// not be modified, copy it to keep it.
+	// Default value is nil, which means no tracing and no cost.
+	Trace func(c Conn, dir Direction, b []byte)
+	// CaptureRing keeps the last CaptureRing bytes of the reads and the
+	// writes of the connection in a ring, which is taken by
+	// Conn.DumpCapture, such as for the post-mortem of a misbehaving
+	// connection without tracing all of them. The bytes are the ones of
+	// Trace, and the ring is allocated once for the connection.
+	// Default value is zero, which means no capture.
+	CaptureRing int
+	// LogCapture logs the capture by log.Printf when the connection is
+	// closed by an error other than EOF, before the Closed event.
+	LogCapture bool
+	// AutoPong replies to the pings of a heartbeat protocol on the loop,
+	// without firing the Data event. It's off when PingMatch is nil.
+	AutoPong AutoPong
+}
+
+// AutoPong is Options.AutoPong. The incoming data which PingMatch matches is
+// answered by Pong, which is written as it is, so it must not be changed
+// after. The ping counts as the incoming data for ExpectWithin and the
+// counters, the other data reaches the Data event.
+type AutoPong struct {
+	PingMatch func(in []byte) bool
+	Pong      []byte
 }
 
+// Direction is the direction of the bytes of Options.Trace.
+type Direction int
+
+const (
+	// Inbound is the data which is read from the connection.
+	Inbound Direction = iota
+	// Outbound is the data which is written to the connection.
+	Outbound
+)
+
 // Server represents a server context which provides information about the
 // running server and has control functions for managing state.
 type Server struct {
 	// The addrs parameter is an array of listening addresses that align
 	// with the addr strings passed to the Serve function.
+	// These are the actual bound addresses, such as the port that has been
+	// assigned by the kernel when binding to port 0.
 	Addrs []net.Addr
 	// NumLoops is the number of loops that the server is using.
 	NumLoops int
+	// LoopStats returns a summary of every loop, which reveals the skew of
+	// connections and traffic between the loops. It's safe to call from any
+	// goroutine, and the values are read without locking.
+	LoopStats func() []LoopStat
+	// LoopStatsAndReset is LoopStats which also resets the counters of the
+	// bytes and the wakes of every loop, such as for a scraper which reports
+	// the activity of every interval. The values are subtracted from the
+	// counters, so nothing counted meanwhile is lost, it's reported by the
+	// next call. The gauges, such as ActiveConns, are kept.
+	LoopStatsAndReset func() []LoopStat
+	// Veto aborts the startup from the Serving event, such as when a
+	// required dependency is not ready. The loops are stopped before
+	// accepting any connection and Serve returns the reason.
+	Veto func(reason error)
+	// DrainLoop stops accepting onto the loop of the index, such as a
+	// misbehaving one, without affecting the other loops. Its connections
+	// are migrated to the other loops when migrate is true, otherwise they
+	// are closed after their pending output is written, and the ones still
+	// open after the timeout are closed forcibly. The loop stays idle until
+	// the server stops. It blocks until the loop is drained, so call it
+	// from a goroutine other than the loops, once the server is serving.
+	// Migrating is not supported by the stdlib loops.
+	DrainLoop func(index int, migrate bool, timeout time.Duration) (DrainStats, error)
+	// SetLoopCount changes the number of the loops which accept the
+	// connections to n, such as for the load of the day. The retired loops
+	// are revived, or new loops are added, which take their share by the
+	// load balancing. The extra loops are retired from the last index by
+	// DrainLoop, their connections are migrated to the other loops, and
+	// they stay idle until they are revived. The indexes of the loops never
+	// change. The loops drained by DrainLoop are not counted or revived.
+	// It returns an error when n is below one. Not supported by the stdlib
+	// loops, which cannot migrate the connections.
+	SetLoopCount func(n int) error
+	// AcceptsThrottled returns the number of times that the accepting was
+	// paused by Events.MaxAcceptsPerSec.
+	AcceptsThrottled func() uint64
+	// FlushAll wakes every loop to write the pending output of all of its
+	// connections in one pass, without waiting for each socket to be
+	// reported writable. The loops do it anyway after the commands of a
+	// wake, such as of Broadcast, so it's for the output which is queued
+	// otherwise. It returns without waiting for the writes. The stdlib loops
+	// write synchronously, so it does nothing.
+	FlushAll func()
+	// TotalOutboundBuffered returns the bytes of the write buffers of all
+	// of the connections, which are queued but not written to the sockets
+	// yet, such as for a server-wide backpressure check. It's a sum of the
+	// counters of the loops, so it's cheap to call from any goroutine. The
+	// writes which are scheduled by Broadcast are counted once they are
+	// queued by the loops. The stdlib loops write synchronously, so only
+	// the writes held by Cork are counted. See Events.MaxTotalOutbound.
+	TotalOutboundBuffered func() uint64
+}
+
+// DrainStats is the result of Server.DrainLoop.
+type DrainStats struct {
+	Migrated int // connections moved to the other loops
+	Closed   int // connections closed, including at the timeout
+}
+
+// LoopStat is a summary of an event loop.
+type LoopStat struct {
+	Index        int    // loop index
+	ActiveConns  int    // number of open connections of the loop
+	BytesRead    uint64 // total bytes read by the loop
+	BytesWritten uint64 // total bytes written by the loop
+	Draining     bool   // the loop is drained by Server.DrainLoop
+	Retired      bool   // the loop is retired by Server.SetLoopCount
+
+	// The WakeWithMessage messages which are taken by the loop, and the time
+	// they were queued for in total and at most, such as when the pushes are
+	// delayed by a busy loop. The average is WakeLatency / Wakes.
+	Wakes          uint64
+	WakeLatency    time.Duration
+	MaxWakeLatency time.Duration
+
+	// The waits of the poll which returned events, the events they returned
+	// in total and at most, and the saturated ones which filled the batch of
+	// 64 events on Linux and 128 on BSD, so more of the ready connections
+	// were left to the next wait. The average is Events / Cycles. Many
+	// saturated cycles after a broadcast mean the loops are too few. They
+	// are zero with the stdlib, which has no poll.
+	Cycles            uint64
+	Events            uint64
+	MaxEventsPerCycle int
+	SaturatedCycles   uint64
+
+	// RegisterFailures are the accepted or migrated connections which the
+	// poll failed to add, such as at the limit of the watched fds. They are
+	// closed, an accepted one without firing Opened, and a migrated one by
+	// Closed with the error. It's zero with the stdlib, which has no poll.
+	RegisterFailures uint64
+
+	// UDPReadFailures are the reads of the UDP listeners which failed, such
+	// as by an ICMP error which is reported to the socket. The listener goes
+	// on with the next datagram. It's zero with the stdlib, which stops the
+	// listener on an error.
+	UDPReadFailures uint64
+}
+
+// serving fires the Serving event, and returns true with the reason of
+// Server.Veto when the server must not start.
+func serving(events Events, svr Server) (shutdown bool, reason error) {
+	var vetoed bool
+	svr.Veto = func(err error) { vetoed, reason = true, err }
+	action := events.Serving(svr)
+	return action == Shutdown || vetoed, reason
+}
+
+// The pprof label of the goroutines and the registry work of evio, such as
+// evio=loop or evio=broadcast, which attributes their CPU in the profiles.
+const labelKey = "evio"
+
+// goLabeled runs fn on a new goroutine with the pprof label.
+func goLabeled(name string, fn func()) {
+	go labeled(name, fn)()
+}
+
+// labeled returns fn which runs with the pprof label, such as for the
+// goroutine of a timer.
+func labeled(name string, fn func()) func() {
+	return func() {
+		pprof.Do(context.Background(), pprof.Labels(labelKey, name), func(context.Context) {
+			fn()
+		})
+	}
+}
+
+// loopStats are the counters of a loop, which are accessed atomically.
+type loopStats struct {
+	read     uint64
+	written  uint64
+	outbytes int64 // write buffers of the connections which are accepted by the loop
+	conns    int32
+	draining int32 // no more connections, see Server.DrainLoop
+	retired  int32 // drained by Server.SetLoopCount
+	wakes    uint64
+	wakesum  int64 // nanoseconds of the wakes
+	wakemax  int64
+	running  int32  // events which run on the loop, see onLoop
+	prio     int32  // a connection of the loop has a priority class, see SetPriority
+	cycles   uint64 // waits of the poll which returned events
+	events   uint64
+	eventmax int64
+	filled   uint64 // waits which filled the batch
+	regfails uint64 // connections which the poll failed to add
+	udpfails uint64 // reads of the udp listeners which failed
+}
+
+func (st *loopStats) isDraining() bool { return atomic.LoadInt32(&st.draining) == 1 }
+
+func (st *loopStats) isRetired() bool { return atomic.LoadInt32(&st.retired) == 1 }
+
+func (st *loopStats) addRead(n int) {
+	if n > 0 {
+		atomic.AddUint64(&st.read, uint64(n))
+	}
+}
+
+func (st *loopStats) addWritten(n int) {
+	if n > 0 {
+		atomic.AddUint64(&st.written, uint64(n))
+	}
+}
+
+// addWake counts a WakeWithMessage message which was queued for d before
+// the loop took it.
+func (st *loopStats) addWake(d time.Duration) {
+	atomic.AddUint64(&st.wakes, 1)
+	atomic.AddInt64(&st.wakesum, int64(d))
+	for {
+		max := atomic.LoadInt64(&st.wakemax)
+		if int64(d) <= max || atomic.CompareAndSwapInt64(&st.wakemax, max, int64(d)) {
+			return
+		}
+	}
+}
+
+// addCycle counts a wait of the poll which returned n events.
+func (st *loopStats) addCycle(n int, full bool) {
+	atomic.AddUint64(&st.cycles, 1)
+	atomic.AddUint64(&st.events, uint64(n))
+	if full {
+		atomic.AddUint64(&st.filled, 1)
+	}
+	for {
+		max := atomic.LoadInt64(&st.eventmax)
+		if int64(n) <= max || atomic.CompareAndSwapInt64(&st.eventmax, max, int64(n)) {
+			return
+		}
+	}
+}
+
+// summary returns the counters of the loop. When reset is true, the values
+// of the bytes, the wakes and the cycles are subtracted from the counters, so the ones
+// which are counted meanwhile are kept for the next summary.
+func (st *loopStats) summary(index int, reset bool) LoopStat {
+	counter := func(p *uint64) uint64 {
+		v := atomic.LoadUint64(p)
+		if reset && v > 0 {
+			atomic.AddUint64(p, ^(v - 1))
+		}
+		return v
+	}
+	wakesum := atomic.LoadInt64(&st.wakesum)
+	wakemax := atomic.LoadInt64(&st.wakemax)
+	eventmax := atomic.LoadInt64(&st.eventmax)
+	if reset {
+		atomic.AddInt64(&st.wakesum, -wakesum)
+		wakemax = atomic.SwapInt64(&st.wakemax, 0)
+		eventmax = atomic.SwapInt64(&st.eventmax, 0)
+	}
+	return LoopStat{
+		Index:        index,
+		ActiveConns:  int(atomic.LoadInt32(&st.conns)),
+		BytesRead:    counter(&st.read),
+		BytesWritten: counter(&st.written),
+		Draining:     st.isDraining(),
+		Retired:      st.isRetired(),
+
+		Wakes:          counter(&st.wakes),
+		WakeLatency:    time.Duration(wakesum),
+		MaxWakeLatency: time.Duration(wakemax),
+
+		Cycles:            counter(&st.cycles),
+		Events:            counter(&st.events),
+		MaxEventsPerCycle: int(eventmax),
+		SaturatedCycles:   counter(&st.filled),
+
+		RegisterFailures: counter(&st.regfails),
+		UDPReadFailures:  counter(&st.udpfails),
+	}
+}
+
+// totalOutbound returns the Server.TotalOutboundBuffered function of the
+// counters.
+func totalOutbound(loops func() []*loopStats) func() uint64 {
+	return func() uint64 {
+		var total uint64
+		for _, st := range loops() {
+			total += uint64(atomic.LoadInt64(&st.outbytes))
+		}
+		return total
+	}
+}
+
+// outboundCeiling fires Events.OutboundCeiling once the write buffers of all
+// of the connections cross Events.MaxTotalOutbound, and again after they
+// drop to it.
+type outboundCeiling struct {
+	max   uint64
+	fn    func(total uint64)
+	total func() uint64
+	over  int32 // above the ceiling, accessed atomically
+}
+
+// newOutboundCeiling returns nil when there is no ceiling or callback.
+func newOutboundCeiling(max int, fn func(total uint64), loops func() []*loopStats) *outboundCeiling {
+	if max <= 0 || fn == nil {
+		return nil
+	}
+	return &outboundCeiling{max: uint64(max), fn: fn, total: totalOutbound(loops)}
+}
+
+// check is called after n bytes are added to the total, or removed when n is
+// negative. The total is only summed when it may cross the ceiling, which is
+// on the additions below it and on the removals above it.
+func (oc *outboundCeiling) check(n int) {
+	if oc == nil || (n > 0) == (atomic.LoadInt32(&oc.over) == 1) {
+		return
+	}
+	if total := oc.total(); total <= oc.max {
+		atomic.StoreInt32(&oc.over, 0)
+	} else if atomic.CompareAndSwapInt32(&oc.over, 0, 1) {
+		oc.fn(total)
+	}
+}
+
+// summarizeLoops returns the LoopStats function of the counters, or the
+// LoopStatsAndReset function when reset is true.
+func summarizeLoops(loops func() []*loopStats, reset bool) func() []LoopStat {
+	return func() []LoopStat {
+		stats := loops()
+		summary := make([]LoopStat, len(stats))
+		for i := range stats {
+			summary[i] = stats[i].summary(i, reset)
+		}
+		return summary
+	}
 }
 
 // Conn is an evio connection.
@@ -56,12 +556,1576 @@ type Conn interface {
 	SetContext(interface{})
 	// AddrIndex is the index of server address that was passed to the Serve call.
 	AddrIndex() int
+	// ListenerAddr is the address of the listener which accepted the
+	// connection, which is Server.Addrs[AddrIndex()], so one Events can
+	// tell the ports or vhosts apart, such as in the Opened event.
+	ListenerAddr() net.Addr
 	// LocalAddr is the connection's local socket address.
 	LocalAddr() net.Addr
 	// RemoteAddr is the connection's remote peer address.
 	RemoteAddr() net.Addr
 	// Wake triggers a Data event for this connection.
 	Wake()
+	// SetSendBuffer sets the SO_SNDBUF socket option of the connection.
+	// See Options.SendBuf for details.
+	SetSendBuffer(n int) error
+	// SetRecvBuffer sets the SO_RCVBUF socket option of the connection.
+	// See Options.RecvBuf for details.
+	SetRecvBuffer(n int) error
+	// SetReuseInputBuffer changes Options.ReuseInputBuffer of the
+	// connection, such as to opt out of the shared buffer when a handler
+	// keeps the bytes. It's called from an event after Opened, which sets
+	// the option. The stdlib copies the input always, so it does nothing.
+	SetReuseInputBuffer(reuse bool)
+	// DumpCapture returns the recent reads and writes of the connection,
+	// which are kept by Options.CaptureRing, the oldest first. It's safe to
+	// call from any goroutine, such as in the Closed event, and it's nil
+	// without a ring.
+	DumpCapture() []CaptureRecord
+	// Cork holds the writes of the connection until Uncork, such as during
+	// a response of many writes, so they are sent as full segments. It's
+	// TCP_CORK on Linux, the other platforms and the stdlib hold the write
+	// buffers and write them at once by Uncork. A Close or Detach action
+	// uncorks the connection. It's called from an event of the connection,
+	// ErrNotSupported is returned for UDP.
+	Cork() error
+	// Uncork sends the writes which are held by Cork.
+	Uncork() error
+	// SetNoDelay sets the TCP_NODELAY socket option of the connection, so
+	// the small writes of an interactive phase are not delayed by Nagle.
+	SetNoDelay(noDelay bool) error
+	// SetLinger sets the SO_LINGER socket option of the connection, such as
+	// zero to reset it rather than close it gracefully. A negative sec
+	// restores the system default. See Options.Linger for details.
+	SetLinger(sec int) error
+	// AcceptToOpenLatency is the time from accepting the connection to
+	// firing the Opened event.
+	AcceptToOpenLatency() time.Duration
+	// FirstByteLatency is the time from the Opened event to the first
+	// incoming data, which is zero until the first data arrives.
+	FirstByteLatency() time.Duration
+	// RateRxBps is the incoming bytes per second, a moving average over
+	// Options.RateWindow. The average is sampled by the loops at every Tick
+	// event, so it stays zero without a Tick. It's safe to call from any
+	// goroutine, and the calls do not change it.
+	RateRxBps() float64
+	// RateTxBps is the outgoing bytes per second, like RateRxBps.
+	RateTxBps() float64
+	// OutSeq is the number of outgoing writes which have been queued, so
+	// the order of writes can be checked while debugging a protocol.
+	OutSeq() uint64
+	// OutboundBytes is the number of bytes which are queued for writing to
+	// the connection but not written to the socket yet, see WriteQueueLen.
+	OutboundBytes() int
+	// OutboundMessages is the number of the queued write buffers, such as
+	// the frames of a protocol, which are not completely written yet. Both
+	// are safe to call from any goroutine, such as for the flow control of
+	// a producer.
+	OutboundMessages() int
+	// InOffset is the total number of incoming bytes which have been
+	// delivered to the connection.
+	InOffset() uint64
+	// PeerClosed returns true once the peer has closed the connection
+	// (EOF), which is set before the Closed event. An empty read, such as
+	// a zero-length datagram, is delivered to Data and never closes.
+	PeerClosed() bool
+	// PeerReset returns true once the peer has reset the connection
+	// (ECONNRESET), such as a crashed client, which is set before the
+	// Closed event with the error. A graceful close is a PeerClosed with a
+	// nil error instead.
+	PeerReset() bool
+	// SetPriority sets the priority class of the connection, such as for
+	// the admin and monitoring connections. The ready events of the higher
+	// classes are processed first within every cycle of the loop, which
+	// applies to the incoming data and the wakes. Within a class it's fair
+	// and FIFO. The low classes may starve under a sustained overload.
+	// Default class is zero, the loops rank the events once any class is set.
+	SetPriority(class int)
+	// CloseInitiator returns the side which closed the connection, it's set
+	// before the Closed event, and Unknown until then.
+	CloseInitiator() Initiator
+	// LastError returns the most recent non-fatal error of the connection,
+	// such as a write which is dropped by Options.WriteOverflowPolicy, a
+	// full wake queue, or an error of RecordError. It's cleared by the next
+	// successful operation of the kind, and it's safe to call from any
+	// goroutine, such as in the Closed event.
+	LastError() error
+	// Congested reports whether the send buffer of the socket was full at
+	// the last write, so the output waits for the peer to read, such as for
+	// a producer to slow down between the chunks. It's cleared once the
+	// output is written. The stdlib loops report it while a write blocks.
+	// It's safe to call from any goroutine.
+	Congested() bool
+}
+
+// RecordError records a non-fatal error of the connection, such as a parse
+// error which the protocol recovers from, which is returned by LastError.
+// A nil err clears it.
+func RecordError(c Conn, err error) {
+	if cs, ok := c.(interface{ state() *connState }); ok {
+		cs.state().noteError(err)
+	}
+}
+
+// Initiator is the side which closed a connection.
+type Initiator int
+
+const (
+	// Unknown is the initiator of a connection which is not closed yet.
+	Unknown Initiator = iota
+	// Local is a close by the server, such as by the Close action, a
+	// timeout or the shutdown of server. The socket enters TIME_WAIT.
+	Local
+	// Remote is a close by the peer, such as by a FIN or a RST.
+	Remote
+)
+
+// CompleteHandshake marks the handshake of the connection as completed,
+// which stops the Options.HandshakeTimeout timer. This is usually called by
+// a protocol wrapper, such as TLS or WebSocket, once the connection has been
+// established.
+func CompleteHandshake(c Conn) {
+	if cs, ok := c.(interface{ state() *connState }); ok {
+		cs.state().completeHandshake()
+	}
+}
+
+// WriteAll writes the buffers to the connection once the current event
+// returns, preceding the out return value of the event. The buffers are not
+// concatenated or copied, and should not be modified until they are written.
+// For UDP connections each buffer is sent as a separate datagram.
+// This must be called from an event of the connection.
+func WriteAll(c Conn, bufs [][]byte) {
+	if cs, ok := c.(interface{ state() *connState }); ok {
+		cs.state().queue(bufs...)
+	}
+}
+
+// ExpectWithin arms a one-shot deadline for the next Data event of the
+// connection. When no data arrives within the duration, onTimeout is called
+// on the loop goroutine and its action is applied to the connection.
+// The deadline is cancelled when the next Data event is delivered, or by
+// calling the returned cancel function.
+func ExpectWithin(c Conn, d time.Duration, onTimeout func(c Conn) (action Action)) (cancel func()) {
+	lc, ok := c.(loopConn)
+	if !ok {
+		return func() {}
+	}
+	cs := lc.state()
+	seq := atomic.AddUint64(&cs.expectseq, 1)
+	timer := time.AfterFunc(d, labeled("timer", func() {
+		lc.run(func() Action {
+			if !atomic.CompareAndSwapUint64(&cs.expectseq, seq, seq+1) || lc.shut() {
+				return None
+			}
+			return onTimeout(c)
+		})
+	}))
+	return func() {
+		if atomic.CompareAndSwapUint64(&cs.expectseq, seq, seq+1) {
+			timer.Stop()
+		}
+	}
+}
+
+// RetryData holds the data of the Data event, and passes it to the event
+// again after the delay, such as when the handler waits for a resource which
+// is unavailable for a moment, instead of blocking the loop or starting a
+// goroutine. The data which arrives meanwhile is held too, appended to it.
+// The handler may call it again on the retry, but every retry costs a timer
+// and an event, so use it sparingly and with a backoff, or the loop keeps
+// busy with the retries. The held data is dropped when the connection is
+// closed or detached. This must be called from the Data event.
+func RetryData(c Conn, in []byte, d time.Duration) {
+	lc, ok := c.(loopConn)
+	if !ok {
+		return
+	}
+	cs := lc.state()
+	if len(in) == 0 || cs.retrytimer != nil {
+		return
+	}
+	cs.retryin = append([]byte{}, in...)
+	cs.retrytimer = time.AfterFunc(d, labeled("timer", func() {
+		lc.run(func() Action {
+			if cs.retrytimer == nil || lc.shut() {
+				return None
+			}
+			in := cs.retryin
+			cs.retryin, cs.retrytimer = nil, nil
+			if cs.receive == nil {
+				return None
+			}
+			out, action := cs.receive(c, in)
+			cs.queue(append([]byte{}, out...))
+			return action
+		})
+	}))
+}
+
+// held keeps the incoming data while a retry of RetryData is pending, and
+// returns true then.
+func (cs *connState) held(in []byte) bool {
+	if cs.retrytimer == nil {
+		return false
+	}
+	cs.retryin = append(cs.retryin, in...)
+	return true
+}
+
+// Flush blocks until the write buffers of the connection are written to the
+// socket, or the connection is closed. It's intended for goroutines other than
+// the event loop, such as after staging data and calling Wake. While the loop
+// of the connection runs an event, such as Data of any of its connections,
+// Flush cannot wait for the loop and returns ErrOnLoop. The loop is not told
+// from the other goroutines then, so a goroutine calls it again after the
+// event.
+func Flush(c Conn) error {
+	lc, ok := c.(loopConn)
+	if !ok {
+		return ErrNotSupported
+	}
+	cs := lc.state()
+	if onLoop(cs) {
+		return ErrOnLoop
+	}
+	ch := make(chan error, 1)
+	cs.mu.Lock()
+	if cs.closed {
+		cs.mu.Unlock()
+		return ErrConnClosed
+	}
+	cs.flushes = append(cs.flushes, ch)
+	cs.mu.Unlock()
+	lc.run(func() Action {
+		if len(cs.out) == 0 {
+			cs.flushed()
+		}
+		return None
+	})
+	return <-ch
+}
+
+// QueueWriteCB queues p to the write buffers of the connection, like a write
+// from Wake, and calls done on the loop goroutine once p is fully written to
+// the socket, or with an error when it's not. The error is
+// ErrWriteBufferOverflow when p is dropped by Options.MaxWriteBuffer, or
+// ErrConnClosed when the connection is closed or detached before the flush.
+// The done is called exactly once, it's called on the calling goroutine when
+// the connection is already closed.
+func QueueWriteCB(c Conn, p []byte, done func(err error)) {
+	lc, ok := c.(loopConn)
+	if !ok {
+		done(ErrNotSupported)
+		return
+	}
+	cs := lc.state()
+	r := &writeReceipt{done: done}
+	cs.mu.Lock()
+	if cs.closed {
+		cs.mu.Unlock()
+		done(ErrConnClosed)
+		return
+	}
+	cs.receipts = append(cs.receipts, r)
+	cs.mu.Unlock()
+	lc.run(func() Action {
+		seq := atomic.LoadUint64(&cs.outseq)
+		cs.queue(p)
+		if len(p) > 0 && atomic.LoadUint64(&cs.outseq) == seq {
+			if cs.unreceipt(r) {
+				done(ErrWriteBufferOverflow)
+			}
+			return None
+		}
+		cs.mu.Lock()
+		r.seq, r.queued = atomic.LoadUint64(&cs.outseq), true
+		cs.mu.Unlock()
+		cs.settle(nil) // nothing to write for an empty p
+		return None
+	})
+}
+
+// QueueWrite queues p to the write buffers of the connection, like
+// QueueWriteCB, and blocks until the loop has queued it. The buffered is
+// true when p cannot go straight to the socket, because the former buffers
+// are still pending, or the send buffer was full at the last write, which
+// is the onset of the backpressure, see Conn.Congested. The error is
+// ErrWriteBufferOverflow when p is dropped by Options.MaxWriteBuffer, or
+// ErrConnClosed when the connection is closed or detached. It's intended
+// for goroutines other than the event loop. While the loop of the
+// connection runs an event, of any of its connections, it cannot wait for
+// the loop, so p is queued once the event returns, like QueueWriteCB, and
+// the buffered is true. The stdlib loops write synchronously, so it blocks
+// while a write blocks. With an AckWindow, it first waits for a slot of the
+// window.
+func QueueWrite(c Conn, p []byte) (buffered bool, err error) {
+	lc, ok := c.(loopConn)
+	if !ok {
+		return false, ErrNotSupported
+	}
+	cs := lc.state()
+	wait := !onLoop(cs) // once it waits, the caller is not the loop
+	reserved, err := cs.reserveWindow(wait)
+	if err != nil {
+		return false, err
+	}
+	settle := func(queued bool) {
+		if reserved {
+			cs.settleWindow(queued)
+		}
+	}
+	type result struct {
+		buffered bool
+		err      error
+	}
+	ch := make(chan result, 2) // the queueing, and a close after it
+	r := &writeReceipt{done: func(err error) {
+		if err != nil {
+			ch <- result{err: err}
+		}
+	}}
+	cs.mu.Lock()
+	if cs.closed {
+		cs.mu.Unlock()
+		settle(false)
+		return false, ErrConnClosed
+	}
+	cs.receipts = append(cs.receipts, r)
+	cs.mu.Unlock()
+	queue := func() Action {
+		buffered := len(cs.out) > 0 || cs.Congested()
+		seq := atomic.LoadUint64(&cs.outseq)
+		cs.queue(p)
+		if len(p) > 0 && atomic.LoadUint64(&cs.outseq) == seq {
+			settle(false)
+			if cs.unreceipt(r) {
+				cs.afterEvent(func() { ch <- result{err: ErrWriteBufferOverflow} })
+			}
+			return None
+		}
+		settle(true)
+		cs.mu.Lock()
+		r.seq, r.queued = atomic.LoadUint64(&cs.outseq), true
+		cs.mu.Unlock()
+		cs.afterEvent(func() { ch <- result{buffered: buffered} })
+		cs.settle(nil) // nothing to write for an empty p
+		return None
+	}
+	lc.run(queue)
+	if !wait {
+		return true, nil // the result is dropped by the ch
+	}
+	v := <-ch
+	return v.buffered, v.err
+}
+
+// ConnWriter returns an io.Writer of the connection, such as for the
+// encoders of the standard library, so a large output is streamed without
+// building it in one []byte. Every Write copies p. While the loop of the
+// connection runs an event, such as Data of any of its connections, a Write
+// cannot wait for the loop, so the writes are gathered and queued once the
+// event returns, after its out, and an overflow of them fails the next
+// Write. Out of the events a Write is a QueueWrite, which blocks until the
+// write buffers are flushed when they are buffered, so the writer follows
+// the pace of the peer. It never blocks over Options.MaxWriteBuffer, the
+// Write returns ErrWriteBufferOverflow instead, and ErrConnClosed once the
+// connection is closed.
+func ConnWriter(c Conn) io.Writer { return &connWriter{c: c} }
+
+type connWriter struct {
+	c       Conn
+	mu      sync.Mutex
+	pending []byte // writes which are queued after the event
+	queued  bool   // the pending writes are scheduled on the loop
+	err     error  // overflow of the pending writes
+}
+
+func (w *connWriter) Write(p []byte) (int, error) {
+	lc, ok := w.c.(loopConn)
+	if !ok {
+		return 0, ErrNotSupported
+	}
+	cs := lc.state()
+	w.mu.Lock()
+	if w.err != nil {
+		defer w.mu.Unlock()
+		return 0, w.err
+	}
+	if w.queued || onLoop(cs) {
+		// the next writes follow the pending ones until they are queued
+		defer w.mu.Unlock()
+		cs.mu.Lock()
+		closed := cs.closed
+		cs.mu.Unlock()
+		if closed {
+			return 0, ErrConnClosed
+		}
+		if !w.queued {
+			w.queued = true
+			lc.run(func() Action { return w.queuePending(cs) })
+		}
+		w.pending = append(w.pending, p...)
+		return len(p), nil
+	}
+	w.mu.Unlock()
+	b := append([]byte(nil), p...) // p is not kept by a Write
+	buffered, err := QueueWrite(w.c, b)
+	if err == nil && buffered {
+		err = Flush(w.c)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// queuePending queues the writes which are gathered in an event, on the
+// loop.
+func (w *connWriter) queuePending(cs *connState) Action {
+	w.mu.Lock()
+	b := w.pending
+	w.pending, w.queued = nil, false
+	seq := atomic.LoadUint64(&cs.outseq)
+	cs.queue(b)
+	if len(b) > 0 && atomic.LoadUint64(&cs.outseq) == seq {
+		w.err = ErrWriteBufferOverflow
+	}
+	w.mu.Unlock()
+	return None
+}
+
+// writeReceipt is a callback of QueueWriteCB, the seq is the position of
+// its buffer in the write buffers, which is known once it's queued.
+type writeReceipt struct {
+	seq    uint64
+	queued bool
+	done   func(err error)
+}
+
+// unreceipt removes the receipt, and returns false when it's already fired.
+func (cs *connState) unreceipt(r *writeReceipt) bool {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	for i, v := range cs.receipts {
+		if v == r {
+			cs.receipts = append(cs.receipts[:i], cs.receipts[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// settle fires the receipts of the buffers which left the write buffers,
+// the err is nil when they are written.
+func (cs *connState) settle(err error) {
+	cs.mu.Lock()
+	if len(cs.receipts) == 0 {
+		cs.mu.Unlock()
+		return
+	}
+	var fired []*writeReceipt
+	pending := cs.receipts[:0]
+	for _, r := range cs.receipts {
+		if r.queued && r.seq <= atomic.LoadUint64(&cs.outhead) {
+			fired = append(fired, r)
+		} else {
+			pending = append(pending, r)
+		}
+	}
+	cs.receipts = pending
+	cs.mu.Unlock()
+	for _, r := range fired {
+		r.done(err)
+	}
+}
+
+// wakeMessage queues the message for the WokenMessage event of the
+// connection.
+func wakeMessage(c Conn, msg interface{}) error {
+	lc, ok := c.(loopConn)
+	if !ok {
+		return ErrNotSupported
+	}
+	if err := lc.state().pushMessage(msg); err != nil {
+		lc.state().noteError(err)
+		return err
+	}
+	lc.state().clearError(ErrWakeQueueFull)
+	lc.wakeMessages()
+	return nil
+}
+
+// PendingWakes returns the number of the WakeWithMessage messages and the
+// Wake calls of the connection, which are not taken by the loop yet.
+func PendingWakes(c Conn) int {
+	if cs, ok := c.(interface{ state() *connState }); ok {
+		return cs.state().pendingWakes()
+	}
+	return 0
+}
+
+// CancelPendingWakes discards the WakeWithMessage messages and the Wake calls
+// of the connection, which are not taken by the loop yet, such as when the
+// client cancels a server push. It returns the number of discarded wakes.
+// It's safe to call from any goroutine, every wake is either taken by the
+// loop or discarded.
+func CancelPendingWakes(c Conn) int {
+	if cs, ok := c.(interface{ state() *connState }); ok {
+		return cs.state().cancelWakes()
+	}
+	return 0
+}
+
+// SetReadWatermark arms a one-shot callback which fires once the connection
+// has read n bytes since the call, which lets a streaming protocol start
+// processing a message early, or abort an oversized one. The fn is called on
+// the loop goroutine with the total bytes read so far, just before the Data
+// event of the data that crosses the watermark. Calling it again replaces
+// the watermark, and a non-positive n removes it.
+// This must be called from an event of the connection.
+func SetReadWatermark(c Conn, n int, fn func(c Conn, soFar int)) {
+	if cs, ok := c.(interface{ state() *connState }); ok {
+		st := cs.state()
+		st.rmark, st.rmarkfn, st.rcount = n, fn, 0
+		if n <= 0 {
+			st.rmarkfn = nil
+		}
+	}
+}
+
+// SendThenAwaitClose writes the final data to the connection, and then
+// closes the connection once ackMatch returns true for the incoming data,
+// or once the timeout elapses, which passes ErrResponseTimeout to the Closed
+// event. While awaiting the ack, the incoming data is passed to ackMatch
+// instead of the Data event. It's safe to call from any goroutine.
+func SendThenAwaitClose(c Conn, final []byte, ackMatch func(in []byte) bool, timeout time.Duration) {
+	lc, ok := c.(loopConn)
+	if !ok {
+		return
+	}
+	cs := lc.state()
+	lc.run(func() Action {
+		cs.queue(final)
+		cs.ackMatch = ackMatch
+		cs.acktimer = time.AfterFunc(timeout, labeled("timer", func() {
+			lc.run(func() Action {
+				if cs.ackMatch == nil {
+					return None // acked
+				}
+				cs.ackMatch = nil
+				cs.cerr = ErrResponseTimeout
+				return Close
+			})
+		}))
+		return None
+	})
+}
+
+// closeAfter schedules the connection to be closed on its loop, after the
+// data and the write buffers are written.
+func closeAfter(c Conn, data []byte) bool {
+	lc, ok := c.(loopConn)
+	if !ok {
+		return false
+	}
+	lc.run(func() Action {
+		lc.state().queue(data)
+		return Close
+	})
+	return true
+}
+
+// CloseConn closes the connection after its pending writes are flushed, such
+// as a connection which is found by FindConnById. It's safe to call from any
+// goroutine, and returns once the close is scheduled on the loop. The close
+// runs on the loop between the events, so it never races a callback of the
+// connection, and no event but Closed fires once the loop has processed it. The pending
+// writes are discarded when they are not flushed within the linger, such as
+// for a stalled peer, zero waits for them without a limit. The calls after
+// the first one do nothing, and ErrConnClosed is returned when the connection
+// is closed already. Events.Closing fires before the close.
+func CloseConn(c Conn, linger time.Duration) error {
+	lc, ok := c.(loopConn)
+	if !ok {
+		return ErrNotSupported
+	}
+	cs := lc.state()
+	cs.mu.Lock()
+	closed := cs.closed
+	cs.mu.Unlock()
+	if closed {
+		return ErrConnClosed
+	}
+	if !atomic.CompareAndSwapInt32(&cs.closing, 0, 1) {
+		return nil // closing already
+	}
+	var closeFn func() Action
+	closeFn = func() Action {
+		if lc.shut() {
+			return None
+		}
+		if cs.closingfn != nil {
+			out, ok := cs.closingfn(c)
+			cs.queue(append([]byte{}, out...))
+			if !ok {
+				timer := time.AfterFunc(closingDelay, labeled("timer", func() {
+					lc.run(closeFn)
+				}))
+				if !cs.onRelease(func() { timer.Stop() }) {
+					timer.Stop()
+				}
+				return None
+			}
+		}
+		if linger > 0 && len(cs.out) > 0 {
+			timer := time.AfterFunc(linger, labeled("timer", func() {
+				lc.run(func() Action {
+					cs.takeOut() // not flushed within the linger
+					return Close
+				})
+			}))
+			if !cs.onRelease(func() { timer.Stop() }) {
+				timer.Stop()
+			}
+		}
+		return Close
+	}
+	lc.run(closeFn)
+	return nil
+}
+
+// closingDelay is the delay of a close which Events.Closing defers.
+const closingDelay = time.Second / 10
+
+// WriteQueueLen returns the number of bytes which are queued for writing to
+// the connection but not written to the socket yet, including the writes
+// scheduled by Broadcast. It's safe to call from any goroutine.
+func WriteQueueLen(c Conn) int {
+	if cs, ok := c.(interface{ state() *connState }); ok {
+		return int(atomic.LoadInt64(&cs.state().outbytes))
+	}
+	return 0
+}
+
+// loopConn is a connection which is owned by an event loop.
+type loopConn interface {
+	Conn
+	state() *connState
+	// run schedules fn to run on the loop of the connection, and applies
+	// the returned action to the connection.
+	run(fn func() Action)
+	// shut returns true once the loop has processed a close of the
+	// connection, no event but Closed fires for it since, called on the loop.
+	shut() bool
+	// wakeMessages schedules the WokenMessage events for the pending
+	// messages of the connection.
+	wakeMessages()
+}
+
+// onLoop returns true while the loop of the connection runs an event of any
+// of its connections, when a call from the loop would wait for the loop
+// itself. The other goroutines are not told from the loop then, so the calls
+// which would wait do not. Out of the events, the caller is not the loop.
+func onLoop(cs *connState) bool {
+	st := cs.loopstats.Load()
+	return st != nil && atomic.LoadInt32(&st.running) > 0
+}
+
+// connState is the state that is shared by the poll and stdlib connections.
+type connState struct {
+	expectseq  uint64                                // sequence of the ExpectWithin deadline, first for 64-bit alignment
+	openlat    int64                                 // accept to open latency, accessed atomically
+	firstlat   int64                                 // first byte latency, accessed atomically
+	outbytes   int64                                 // bytes of the write buffers and the scheduled writes, accessed atomically
+	outsum     *int64                                // outbytes of the loop without the scheduled writes, see addOut
+	outceil    *outboundCeiling                      // Events.MaxTotalOutbound
+	rxbytes    uint64                                // incoming bytes, accessed atomically
+	txbytes    uint64                                // outgoing bytes, accessed atomically
+	outseq     uint64                                // queued write buffers, accessed atomically
+	peereof    int32                                 // the peer closed the connection, accessed atomically
+	peerrst    int32                                 // the peer reset the connection, accessed atomically
+	congested  int32                                 // the send buffer was full at the last write, accessed atomically
+	initiator  int32                                 // the side which closed the connection, accessed atomically
+	lasterr    atomic.Pointer[error]                 // the last non-fatal error, nil when cleared
+	trace      func(c Conn, dir Direction, b []byte) // Options.Trace
+	capture    *captureRing                          // Options.CaptureRing
+	logcapture bool                                  // Options.LogCapture
+	prio       int32                                 // priority class of SetPriority, accessed atomically
+	acceptedAt time.Time                             // time of accepting
+	openedAt   time.Time                             // time of the Opened event
+	out        [][]byte                              // write buffers
+	handshaked int32                                 // handshake completed
+	hstimer    *time.Timer                           // handshake timeout timer
+	loopstats  atomic.Pointer[loopStats]             // counters of the loop, see onLoop
+	inevent    int                                   // running events of the connection, on the loop
+	wakeups    []func()                              // wakes of the waiters which are released after the event
+	rsize      int32                                 // read buffer size, accessed atomically
+	rmin, rmax int                                   // read buffer size range of DoublingReadBuffer
+	idletimer  *time.Timer                           // idle timer of virtual udp connection
+	seen       time.Time                             // last datagram time of virtual udp connection
+	ipkey      string                                // remote ip counted by the ipLimiter
+	wakes      int32                                 // pending Wake calls, accessed atomically
+	maxwakes   int32                                 // limit of pending wakes, accessed atomically
+	cerr       error                                 // error passed to Closed for closed connection
+	ackMatch   func(in []byte) bool                  // ack awaited by SendThenAwaitClose
+	acktimer   *time.Timer                           // timeout of the awaited ack
+	comp       *compressor                           // compressor of the write buffers
+	wcap       *writeCap                             // Options.MaxWriteBuffer
+	meter      rateMeter                             // RateRxBps and RateTxBps
+	rmark      int                                   // read watermark of SetReadWatermark
+	rcount     int                                   // bytes read since the watermark is set
+	rmarkfn    func(c Conn, soFar int)               // callback of the read watermark
+	deferred   bool                                  // session is deferred to Events.FirstData
+	lineseen   bool                                  // Events.FirstLine has fired
+	corked     bool                                  // the write buffers are held by Cork
+	linebuf    []byte                                // data before the first line is complete
+	closing    int32                                 // CloseConn is called, accessed atomically
+	outhead    uint64                                // write buffers which were written or dropped, accessed atomically
+	outpart    bool                                  // the first write buffer is partially written
+	receive    DataHandler                           // Events.Receive, for RetryData
+	retryin    []byte                                // data held by RetryData
+	retrytimer *time.Timer                           // pending retry of RetryData
+	closingfn  func(c Conn) (out []byte, ok bool)    // Events.Closing
+	handler    DataHandler                           // data handler selected by Events.Negotiate
+	pong       *AutoPong                             // Options.AutoPong, nil when it's off
+
+	mu       sync.Mutex      // guards the fields below
+	closed   bool            // connection is closed or detached
+	flushes  []chan error    // waiters of Flush
+	receipts []*writeReceipt // callbacks of QueueWriteCB
+	msgs     []interface{}   // pending messages of WakeWithMessage
+	msgsat   []time.Time     // times when the msgs are queued
+	onclose  []func()        // called once the connection is released
+	ackwin   *ackWindow      // AckWindow, nil when it's off
+}
+
+func (cs *connState) state() *connState { return cs }
+
+// queue appends non-empty buffers to the write buffers, which are
+// compressed from the CompressWrites.MinSize.
+func (cs *connState) queue(bufs ...[]byte) {
+	for _, b := range bufs {
+		if len(b) > 0 {
+			if cs.comp != nil && len(b) >= cs.comp.min {
+				b = cs.comp.compress(b)
+			}
+			cs.push(b)
+		}
+	}
+}
+
+// traceIn passes the incoming data to Options.Trace and the capture.
+func (cs *connState) traceIn(c Conn, b []byte) {
+	if cs.trace != nil {
+		cs.trace(c, Inbound, b)
+	}
+	if cs.capture != nil {
+		cs.capture.add(Inbound, b)
+	}
+}
+
+// traceOut passes the first n bytes of the buffers to Options.Trace and the
+// capture, or all of them when n is negative.
+func (cs *connState) traceOut(c Conn, bufs [][]byte, n int) {
+	if cs.trace == nil && cs.capture == nil {
+		return
+	}
+	for _, b := range bufs {
+		if n == 0 {
+			break
+		}
+		if n > 0 {
+			if len(b) > n {
+				b = b[:n]
+			}
+			n -= len(b)
+		}
+		if cs.trace != nil {
+			cs.trace(c, Outbound, b)
+		}
+		if cs.capture != nil {
+			cs.capture.add(Outbound, b)
+		}
+	}
+}
+
+// push appends the buffer to the write buffers as it is.
+func (cs *connState) push(b []byte) {
+	if cs.wcap != nil && !cs.fits(len(b)) {
+		return
+	}
+	cs.out = append(cs.out, b)
+	cs.addOut(len(b))
+	atomic.AddUint64(&cs.outseq, 1)
+}
+
+// addOut counts n bytes which are added to the write buffers, or removed
+// when n is negative, for WriteQueueLen and the loop total.
+func (cs *connState) addOut(n int) {
+	atomic.AddInt64(&cs.outbytes, int64(n))
+	if cs.outsum != nil {
+		atomic.AddInt64(cs.outsum, int64(n))
+		cs.outceil.check(n)
+	}
+}
+
+// writeCap is the hard cap of the write buffers.
+type writeCap struct {
+	max    int
+	policy WriteOverflowPolicy
+	report func(dropped int) // Events.WriteOverflow
+	close  func()            // schedules the close of CloseOnOverflow
+}
+
+// setWriteCap applies the MaxWriteBuffer options of the connection.
+func (cs *connState) setWriteCap(opts Options, lc loopConn, report func(c Conn, dropped int)) {
+	if opts.MaxWriteBuffer <= 0 {
+		return
+	}
+	cs.wcap = &writeCap{
+		max:    opts.MaxWriteBuffer,
+		policy: opts.WriteOverflowPolicy,
+		report: func(dropped int) {
+			if report != nil {
+				report(lc, dropped)
+			}
+		},
+		close: func() {
+			lc.run(func() Action { return Close })
+		},
+	}
+}
+
+// fits returns true when n bytes can be appended to the write buffers,
+// otherwise the overflow is handled by the policy.
+func (cs *connState) fits(n int) bool {
+	w := cs.wcap
+	if cs.cerr == ErrWriteBufferOverflow {
+		return false // closing
+	}
+	pending := int(atomic.LoadInt64(&cs.outbytes))
+	if pending+n <= w.max {
+		cs.clearError(ErrWriteBufferOverflow)
+		return true
+	}
+	switch w.policy {
+	case DropNewest:
+		cs.noteError(ErrWriteBufferOverflow)
+		w.report(n)
+		return false
+	case DropOldest:
+		var keep int
+		if cs.outpart {
+			keep = 1 // the buffer would be cut in the middle
+		}
+		var dropped, k int
+		for keep+k < len(cs.out) && pending+n > w.max {
+			size := len(cs.out[keep+k])
+			cs.out[keep+k] = nil
+			k++
+			cs.addOut(-size)
+			pending -= size
+			dropped += size
+		}
+		if keep == 0 {
+			cs.out = cs.out[k:]
+			atomic.AddUint64(&cs.outhead, uint64(k))
+		} else if k > 0 {
+			cs.out = append(cs.out[:1], cs.out[1+k:]...)
+			cs.skipAfterFront(k)
+		}
+		cs.settle(ErrWriteBufferOverflow)
+		cs.noteError(ErrWriteBufferOverflow)
+		fits := pending+n <= w.max
+		if !fits {
+			dropped += n
+		}
+		w.report(dropped)
+		return fits
+	default:
+		var dropped int
+		for _, b := range cs.takeOut() {
+			dropped += len(b)
+		}
+		cs.settle(ErrWriteBufferOverflow)
+		cs.cerr = ErrWriteBufferOverflow
+		w.report(dropped + n)
+		w.close()
+		return false
+	}
+}
+
+// skipAfterFront settles the receipts of the k buffers which are dropped
+// after the first one, and counts them as removed. The first buffer takes
+// the position of the last dropped one, so the positions of the rest hold.
+func (cs *connState) skipAfterFront(k int) {
+	cs.mu.Lock()
+	head := atomic.LoadUint64(&cs.outhead)
+	last := head + 1 + uint64(k)
+	var fired []*writeReceipt
+	pending := cs.receipts[:0]
+	for _, r := range cs.receipts {
+		switch {
+		case r.queued && r.seq == head+1:
+			r.seq = last
+		case r.queued && r.seq > head+1 && r.seq <= last:
+			fired = append(fired, r)
+			continue
+		}
+		pending = append(pending, r)
+	}
+	cs.receipts = pending
+	atomic.AddUint64(&cs.outhead, uint64(k))
+	cs.mu.Unlock()
+	for _, r := range fired {
+		r.done(ErrWriteBufferOverflow)
+	}
+}
+
+// takeOut removes all of the write buffers, which are written at once. The
+// caller settles the receipts of the buffers.
+func (cs *connState) takeOut() [][]byte {
+	bufs := cs.out
+	cs.out = nil
+	cs.outpart = false
+	atomic.AddUint64(&cs.outhead, uint64(len(bufs)))
+	var n int
+	for _, b := range bufs {
+		n += len(b)
+	}
+	cs.addOut(-n)
+	return bufs
+}
+
+// consume removes n written bytes from the front of the write buffers.
+func (cs *connState) consume(n int) {
+	cs.addOut(-n)
+	for n > 0 && len(cs.out) > 0 {
+		if n < len(cs.out[0]) {
+			cs.out[0] = cs.out[0][n:]
+			cs.outpart = true
+			return
+		}
+		n -= len(cs.out[0])
+		cs.out[0] = nil
+		cs.out = cs.out[1:]
+		cs.outpart = false
+		atomic.AddUint64(&cs.outhead, 1)
+	}
+	if len(cs.out) == 0 {
+		cs.out = nil
+	}
+	cs.settle(nil)
+}
+
+func (cs *connState) completeHandshake() {
+	if atomic.CompareAndSwapInt32(&cs.handshaked, 0, 1) && cs.hstimer != nil {
+		cs.hstimer.Stop()
+	}
+}
+
+// handshakeExpired returns true when the handshake has not been completed.
+func (cs *connState) handshakeExpired() bool {
+	return atomic.LoadInt32(&cs.handshaked) == 0
+}
+
+// received cancels the ExpectWithin deadline and counts the n incoming
+// bytes, called before Data event.
+func (cs *connState) received(n int) {
+	atomic.AddUint64(&cs.expectseq, 1)
+	atomic.AddUint64(&cs.rxbytes, uint64(n))
+	if !cs.openedAt.IsZero() && atomic.LoadInt64(&cs.firstlat) == 0 {
+		atomic.StoreInt64(&cs.firstlat, int64(time.Since(cs.openedAt)))
+	}
+}
+
+// accepted records the time of accepting the connection.
+func (cs *connState) accepted() { cs.acceptedAt = time.Now() }
+
+// opening records the time of the Opened event, called before it fires.
+func (cs *connState) opening() {
+	cs.openedAt = time.Now()
+	atomic.StoreInt64(&cs.openlat, int64(cs.openedAt.Sub(cs.acceptedAt)))
+}
+
+func (cs *connState) AcceptToOpenLatency() time.Duration {
+	return time.Duration(atomic.LoadInt64(&cs.openlat))
+}
+
+func (cs *connState) FirstByteLatency() time.Duration {
+	return time.Duration(atomic.LoadInt64(&cs.firstlat))
+}
+
+// sent counts the n outgoing bytes which are written to the socket.
+func (cs *connState) sent(n int) {
+	if n > 0 {
+		atomic.AddUint64(&cs.txbytes, uint64(n))
+	}
+}
+
+func (cs *connState) RateRxBps() float64 {
+	rx, _ := cs.meter.rates()
+	return rx
+}
+
+func (cs *connState) RateTxBps() float64 {
+	_, tx := cs.meter.rates()
+	return tx
+}
+
+// sampleRates takes a sample of the byte counters for the rates, called on
+// the loop at every tick.
+func (cs *connState) sampleRates(now time.Time) {
+	cs.meter.sample(now, atomic.LoadUint64(&cs.rxbytes), atomic.LoadUint64(&cs.txbytes))
+}
+
+// peerClosed marks the connection as closed by the peer, called on EOF.
+func (cs *connState) peerClosed() {
+	atomic.StoreInt32(&cs.peereof, 1)
+	cs.closedBy(Remote)
+}
+
+func (cs *connState) PeerClosed() bool { return atomic.LoadInt32(&cs.peereof) == 1 }
+
+// peerReset marks the connection as reset by the peer, called on
+// ECONNRESET of a read or a write.
+func (cs *connState) peerReset() {
+	atomic.StoreInt32(&cs.peerrst, 1)
+	cs.closedBy(Remote)
+}
+
+func (cs *connState) PeerReset() bool { return atomic.LoadInt32(&cs.peerrst) == 1 }
+
+func (cs *connState) Congested() bool { return atomic.LoadInt32(&cs.congested) == 1 }
+
+// congest sets Conn.Congested after a write.
+func (cs *connState) congest(on bool) {
+	var v int32
+	if on {
+		v = 1
+	}
+	atomic.StoreInt32(&cs.congested, v)
+}
+
+// closedBy sets the initiator of the close, unless it's already set.
+func (cs *connState) closedBy(who Initiator) {
+	atomic.CompareAndSwapInt32(&cs.initiator, int32(Unknown), int32(who))
+}
+
+func (cs *connState) CloseInitiator() Initiator { return Initiator(atomic.LoadInt32(&cs.initiator)) }
+
+// noteError records the non-fatal error, a nil err clears it.
+func (cs *connState) noteError(err error) {
+	if err == nil {
+		cs.lasterr.Store(nil)
+	} else {
+		cs.lasterr.Store(&err)
+	}
+}
+
+// clearError clears the last error when it's err, after a successful
+// operation of the kind.
+func (cs *connState) clearError(err error) {
+	if p := cs.lasterr.Load(); p != nil && *p == err {
+		cs.lasterr.CompareAndSwap(p, nil)
+	}
+}
+
+func (cs *connState) LastError() error {
+	if p := cs.lasterr.Load(); p != nil {
+		return *p
+	}
+	return nil
+}
+
+// Cork and Uncork hold the write buffers, where the socket can't be corked.
+func (cs *connState) Cork() error   { cs.corked = true; return nil }
+func (cs *connState) Uncork() error { cs.corked = false; return nil }
+
+func (cs *connState) OutSeq() uint64 { return atomic.LoadUint64(&cs.outseq) }
+
+func (cs *connState) OutboundBytes() int { return int(atomic.LoadInt64(&cs.outbytes)) }
+
+func (cs *connState) OutboundMessages() int {
+	head := atomic.LoadUint64(&cs.outhead)
+	return int(atomic.LoadUint64(&cs.outseq) - head)
+}
+
+func (cs *connState) SetPriority(class int) {
+	atomic.StoreInt32(&cs.prio, int32(class))
+	if st := cs.loopstats.Load(); st != nil && class != 0 {
+		atomic.StoreInt32(&st.prio, 1)
+	}
+}
+
+// setLoop moves the connection to the counters of a loop, which is ranked
+// by the priority classes once any of its connections has one, until then
+// the loop keeps the order of the ready events.
+func (cs *connState) setLoop(st *loopStats) {
+	cs.loopstats.Store(st)
+	if cs.priority() != 0 {
+		atomic.StoreInt32(&st.prio, 1)
+	}
+}
+
+func (st *loopStats) prioritized() bool { return atomic.LoadInt32(&st.prio) == 1 }
+
+func (cs *connState) priority() int { return int(atomic.LoadInt32(&cs.prio)) }
+
+func (cs *connState) InOffset() uint64 { return atomic.LoadUint64(&cs.rxbytes) }
+
+// rateMeter is an exponential moving average of the byte counters, which
+// is sampled by the loop at every tick, so all of the readers get the same
+// rates between the ticks.
+type rateMeter struct {
+	mu     sync.Mutex
+	window time.Duration
+	at     time.Time // time of the last sample
+	rx, tx uint64    // counters of the last sample
+	rxBps  float64
+	txBps  float64
+}
+
+// start starts the average from the Opened event.
+func (m *rateMeter) start(opts Options) {
+	m.mu.Lock()
+	m.window = opts.RateWindow
+	m.at = time.Now()
+	m.mu.Unlock()
+}
+
+// rates returns the average of the last sample.
+func (m *rateMeter) rates() (rxBps, txBps float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.rxBps, m.txBps
+}
+
+// sample adds the counters at the time now to the average.
+func (m *rateMeter) sample(now time.Time, rx, tx uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.at.IsZero() {
+		m.at, m.rx, m.tx = now, rx, tx
+		return
+	}
+	elapsed := now.Sub(m.at)
+	if elapsed <= 0 {
+		return
+	}
+	window := m.window
+	if window <= 0 {
+		window = time.Second
+	}
+	// the weight of the new sample grows with its elapsed time, so the
+	// average does not depend on the tick interval
+	alpha := 1 - math.Exp(-float64(elapsed)/float64(window))
+	secs := elapsed.Seconds()
+	m.rxBps += alpha * (float64(rx-m.rx)/secs - m.rxBps)
+	m.txBps += alpha * (float64(tx-m.tx)/secs - m.txBps)
+	m.at, m.rx, m.tx = now, rx, tx
+}
+
+// setReadBuffer applies the read buffer options.
+func (cs *connState) setReadBuffer(opts Options) {
+	size := opts.ReadBufferSize
+	if size <= 0 {
+		size = defaultReadBufferSize
+	}
+	atomic.StoreInt32(&cs.rsize, int32(size))
+	if opts.ReadBufferPolicy == DoublingReadBuffer {
+		cs.rmin, cs.rmax = size, opts.MaxReadBufferSize
+		if cs.rmax <= 0 {
+			cs.rmax = defaultMaxReadBufferSize
+		}
+		if cs.rmax < cs.rmin {
+			cs.rmax = cs.rmin
+		}
+	}
+}
+
+// readSize returns the size of the next read.
+func (cs *connState) readSize() int {
+	if size := atomic.LoadInt32(&cs.rsize); size > 0 {
+		return int(size)
+	}
+	return defaultReadBufferSize
+}
+
+// readDone adjusts the read buffer after reading n bytes.
+func (cs *connState) readDone(n int) {
+	if cs.rmax == 0 {
+		return
+	}
+	size := cs.readSize()
+	switch {
+	case n >= size && size < cs.rmax:
+		size *= 2
+		if size > cs.rmax {
+			size = cs.rmax
+		}
+	case n < size/2 && size > cs.rmin:
+		size /= 2
+		if size < cs.rmin {
+			size = cs.rmin
+		}
+	default:
+		return
+	}
+	atomic.StoreInt32(&cs.rsize, int32(size))
+}
+
+// watchIdle starts the idle timer of a virtual UDP connection, and fn is
+// called when it fires.
+func (cs *connState) watchIdle(d time.Duration, fn func()) {
+	cs.seen = time.Now()
+	cs.idletimer = time.AfterFunc(d, labeled("reaper", fn))
+}
+
+// touch records the arrival of a datagram for a virtual UDP connection.
+func (cs *connState) touch() { cs.seen = time.Now() }
+
+// idleExpired returns true when no datagram has arrived within d, otherwise
+// the idle timer is rearmed for the remaining time.
+func (cs *connState) idleExpired(d time.Duration) bool {
+	if remain := d - time.Since(cs.seen); remain > 0 {
+		cs.idletimer.Reset(remain)
+		return false
+	}
+	return true
+}
+
+// readMark counts the incoming data of the connection, and fires the read
+// watermark once it's crossed.
+func (cs *connState) readMark(c Conn, n int) {
+	if cs.rmarkfn == nil {
+		return
+	}
+	if cs.rcount += n; cs.rcount >= cs.rmark {
+		fn := cs.rmarkfn
+		cs.rmarkfn = nil
+		fn(c, cs.rcount)
+	}
+}
+
+// setAutoPong applies Options.AutoPong of the connection.
+func (cs *connState) setAutoPong(opts Options) {
+	if opts.AutoPong.PingMatch != nil {
+		pong := opts.AutoPong
+		cs.pong = &pong
+	}
+}
+
+// autoPong queues the pong of Options.AutoPong when the incoming data is a
+// ping, and returns true then.
+func (cs *connState) autoPong(in []byte) bool {
+	if cs.pong == nil || !cs.pong.PingMatch(in) {
+		return false
+	}
+	cs.queue(cs.pong.Pong)
+	return true
+}
+
+// awaitAck passes the incoming data to the ackMatch of SendThenAwaitClose,
+// and returns false when no ack is awaited.
+func (cs *connState) awaitAck(in []byte) (awaiting bool, action Action) {
+	if cs.ackMatch == nil {
+		return false, None
+	}
+	if cs.ackMatch(in) {
+		cs.ackMatch = nil
+		cs.acktimer.Stop()
+		return true, Close
+	}
+	return true, None
+}
+
+// enter and leave mark the running of an event of the connection, which is
+// counted by its loop too, see onLoop.
+func (cs *connState) enter() {
+	cs.inevent++
+	if st := cs.loopstats.Load(); st != nil {
+		atomic.AddInt32(&st.running, 1)
+	}
+}
+
+func (cs *connState) leave() {
+	if st := cs.loopstats.Load(); st != nil {
+		atomic.AddInt32(&st.running, -1)
+	}
+	if cs.inevent--; cs.inevent == 0 && len(cs.wakeups) > 0 {
+		wakeups := cs.wakeups
+		cs.wakeups = nil
+		for _, fn := range wakeups {
+			fn()
+		}
+	}
+}
+
+// afterEvent calls fn once the running event of the connection returns, or
+// at once out of the events. It wakes the waiters of the loop, so their next
+// call does not see the loop in the event which woke them.
+func (cs *connState) afterEvent(fn func()) {
+	if cs.inevent > 0 {
+		cs.wakeups = append(cs.wakeups, fn)
+		return
+	}
+	fn()
+}
+
+// flushed wakes the Flush waiters after the write buffers are written.
+func (cs *connState) flushed() {
+	cs.settle(nil)
+	cs.mu.Lock()
+	flushes := cs.flushes
+	cs.flushes = nil
+	cs.mu.Unlock()
+	cs.afterEvent(func() {
+		for _, ch := range flushes {
+			ch <- nil
+		}
+	})
+}
+
+// pushMessage appends a pending message.
+func (cs *connState) pushMessage(msg interface{}) error {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if cs.closed {
+		return ErrConnClosed
+	}
+	if max := atomic.LoadInt32(&cs.maxwakes); max > 0 && len(cs.msgs) >= int(max) {
+		return ErrWakeQueueFull
+	}
+	cs.msgs = append(cs.msgs, msg)
+	cs.msgsat = append(cs.msgsat, time.Now())
+	return nil
+}
+
+// setMaxWakes applies the limit of pending wakes.
+func (cs *connState) setMaxWakes(opts Options) {
+	atomic.StoreInt32(&cs.maxwakes, int32(opts.MaxPendingWakes))
+}
+
+// wake counts a pending Wake call, and returns false when it's over the
+// limit. The loop calls woke once it takes the wake.
+func (cs *connState) wake() bool {
+	n := atomic.AddInt32(&cs.wakes, 1)
+	if max := atomic.LoadInt32(&cs.maxwakes); max > 0 && n > max {
+		atomic.AddInt32(&cs.wakes, -1)
+		return false
+	}
+	return true
+}
+
+// woke takes a pending wake, and returns false when it's cancelled.
+func (cs *connState) woke() bool {
+	for {
+		n := atomic.LoadInt32(&cs.wakes)
+		if n <= 0 {
+			return false
+		}
+		if atomic.CompareAndSwapInt32(&cs.wakes, n, n-1) {
+			return true
+		}
+	}
+}
+
+// cancelWakes discards the pending wakes and messages, and returns the
+// number of them.
+func (cs *connState) cancelWakes() int {
+	n := int(atomic.SwapInt32(&cs.wakes, 0))
+	cs.mu.Lock()
+	n += len(cs.msgs)
+	cs.msgs, cs.msgsat = nil, nil
+	cs.mu.Unlock()
+	return n
+}
+
+func (cs *connState) pendingWakes() int {
+	cs.mu.Lock()
+	n := len(cs.msgs)
+	cs.mu.Unlock()
+	return n + int(atomic.LoadInt32(&cs.wakes))
+}
+
+// takeMessages removes and returns all of the pending messages, the time
+// they were queued for is added to the wake latency of st when it's not nil.
+func (cs *connState) takeMessages(st *loopStats) (msgs []interface{}) {
+	cs.mu.Lock()
+	msgs, cs.msgs = cs.msgs, nil
+	at := cs.msgsat
+	cs.msgsat = nil
+	cs.mu.Unlock()
+	if st != nil && len(at) > 0 {
+		now := time.Now()
+		for _, t := range at {
+			st.addWake(now.Sub(t))
+		}
+	}
+	return
+}
+
+// onRelease registers fn to be called once the connection is closed or
+// detached, and returns false when it's already released.
+func (cs *connState) onRelease(fn func()) bool {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if cs.closed {
+		return false
+	}
+	cs.onclose = append(cs.onclose, fn)
+	return true
+}
+
+// release stops all pending timers of the connection, and wakes the
+// waiters, when the connection is closed or detached.
+func (cs *connState) release() {
+	if cs.hstimer != nil {
+		cs.hstimer.Stop()
+	}
+	if cs.idletimer != nil {
+		cs.idletimer.Stop()
+	}
+	if cs.acktimer != nil {
+		cs.acktimer.Stop()
+	}
+	if cs.retrytimer != nil {
+		cs.retrytimer.Stop()
+	}
+	if cs.outsum != nil {
+		// the remaining write buffers are dropped from the loop total
+		var n int
+		for _, b := range cs.out {
+			n += len(b)
+		}
+		atomic.AddInt64(cs.outsum, -int64(n))
+		cs.outceil.check(-n)
+		cs.outsum = nil
+	}
+	cs.mu.Lock()
+	cs.closed = true
+	if cs.ackwin != nil {
+		cs.ackwin.wake()
+	}
+	for _, ch := range cs.flushes {
+		ch <- ErrConnClosed
+	}
+	cs.flushes = nil
+	cs.msgs, cs.msgsat = nil, nil
+	receipts := cs.receipts
+	cs.receipts = nil
+	onclose := cs.onclose
+	cs.onclose = nil
+	cs.mu.Unlock()
+	for _, r := range receipts {
+		r.done(ErrConnClosed)
+	}
+	for _, fn := range onclose {
+		fn()
+	}
+}
+
+// acceptLimiter is the token bucket of Events.MaxAcceptsPerSec.
+type acceptLimiter struct {
+	rate      float64 // tokens per second
+	burst     float64 // max tokens
+	mu        sync.Mutex
+	tokens    float64
+	last      time.Time // time of the last refill
+	throttled uint64    // pauses of the accepting, updated atomically
+}
+
+func newAcceptLimiter(rate int) *acceptLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	burst := float64(rate) / 10
+	if burst < 1 {
+		burst = 1
+	}
+	return &acceptLimiter{rate: float64(rate), burst: burst, tokens: burst, last: time.Now()}
+}
+
+// wait takes a token for an accept, it returns zero when there is one,
+// otherwise the time until the next one, and the accepting is paused.
+func (lim *acceptLimiter) wait() time.Duration {
+	if lim == nil {
+		return 0
+	}
+	lim.mu.Lock()
+	defer lim.mu.Unlock()
+	now := time.Now()
+	lim.tokens += now.Sub(lim.last).Seconds() * lim.rate
+	if lim.tokens > lim.burst {
+		lim.tokens = lim.burst
+	}
+	lim.last = now
+	if lim.tokens >= 1 {
+		lim.tokens--
+		return 0
+	}
+	atomic.AddUint64(&lim.throttled, 1)
+	return time.Duration((1 - lim.tokens) / lim.rate * float64(time.Second))
+}
+
+// count returns the pauses of the accepting, for Server.AcceptsThrottled.
+func (lim *acceptLimiter) count() uint64 {
+	if lim == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&lim.throttled)
+}
+
+// ipLimiter counts the connections of each remote IP.
+type ipLimiter struct {
+	max    int
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+func newIPLimiter(max int) *ipLimiter {
+	if max <= 0 {
+		return nil
+	}
+	return &ipLimiter{max: max, counts: make(map[string]int)}
+}
+
+// acquire counts the connection, and returns false when the remote IP is
+// over the limit. Connections without an IP, such as unix sockets, are
+// not limited.
+func (lim *ipLimiter) acquire(cs *connState, addr net.Addr) bool {
+	if lim == nil {
+		return true
+	}
+	tcpaddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return true
+	}
+	key := tcpaddr.IP.String()
+	lim.mu.Lock()
+	defer lim.mu.Unlock()
+	if lim.counts[key] >= lim.max {
+		return false
+	}
+	lim.counts[key]++
+	cs.ipkey = key
+	return true
+}
+
+// release uncounts the connection, the entry of the IP is deleted when the
+// count drops to zero.
+func (lim *ipLimiter) release(cs *connState) {
+	if lim == nil || cs.ipkey == "" {
+		return
+	}
+	lim.mu.Lock()
+	if lim.counts[cs.ipkey]--; lim.counts[cs.ipkey] <= 0 {
+		delete(lim.counts, cs.ipkey)
+	}
+	lim.mu.Unlock()
+	cs.ipkey = ""
 }
 
 // LoadBalance sets the load balancing method.
@@ -93,8 +2157,47 @@ type Events struct {
 	// best effort to attempt to distribute the incoming connections between
 	// multiple loops. This option is only works when NumLoops is set.
 	LoadBalance LoadBalance
-	// Serving fires when the server can accept connections. The server
-	// parameter has information and various utilities.
+	// LoopSelector picks the loop of a newly accepted stream connection
+	// instead of LoadBalance, such as the same loop for a remote IP or a
+	// tenant for the cache locality. The numLoops excludes the loops which
+	// are removed by Server.SetLoopCount. LoadBalance is used when the index
+	// is out of range or the loop is drained. The datagrams and the virtual
+	// UDP connections are not selected.
+	LoopSelector func(remote net.Addr, numLoops int) int
+	// AcceptLoops sets the number of goroutines which accept the stream
+	// connections, separate from the loops, so a burst of new connections
+	// does not delay the loops serving the data, and the loops are not woken
+	// for every accept. The accepted connections are handed to the loops by
+	// LoadBalance. Setting to 0 accepts the connections on the loops.
+	AcceptLoops int
+	// PinLoops locks each loop to an OS thread and sets the CPU affinity of
+	// the thread to the loop index modulo runtime.NumCPU(), which reduces
+	// cache misses and cross-socket traffic. This option only works on Linux,
+	// otherwise a warning is logged and the loops are not pinned.
+	PinLoops bool
+	// MaxConnsPerIP limits the number of concurrent connections from the
+	// same remote IP. The connections over the limit are closed at accept
+	// time, before the Opened event.
+	// Default value is zero, which means that there is no limit.
+	MaxConnsPerIP int
+	// MaxAcceptsPerSec limits the rate of accepting the stream connections,
+	// in bursts of up to a tenth of it. The connections over the rate are
+	// left in the backlog of the listener, where the kernel completes their
+	// handshakes, and they are accepted once the rate allows. It trades the
+	// setup latency of the new connections for the stability of the loops
+	// under a flood of connections, the loops keep serving the accepted
+	// ones. See Server.AcceptsThrottled.
+	// Default value is zero, which means that there is no limit.
+	MaxAcceptsPerSec int
+	// MaxTotalOutbound is the ceiling of Server.TotalOutboundBuffered,
+	// which fires the OutboundCeiling event, such as to shed the load of
+	// the whole server, unlike Options.MaxWriteBuffer of one connection.
+	// Default value is zero, which means that there is no ceiling.
+	MaxTotalOutbound int
+	// Serving fires once when the server can accept connections, before
+	// any Opened event. The server parameter has information and various
+	// utilities. Returning Shutdown or calling server.Veto stops the server
+	// without accepting any connection.
 	Serving func(server Server) (action Action)
 	// Opened fires when a new connection has opened.
 	// The info parameter has information about the connection such as
@@ -102,9 +2205,44 @@ type Events struct {
 	// Use the out return value to write data to the connection.
 	// The opts return value is used to set connection options.
 	Opened func(c Conn) (out []byte, opts Options, action Action)
+	// FirstData fires before the first Data event of a connection which
+	// has been opened with Options.DeferSession. The returned session is
+	// bound by BindSession, unless it's nil. Unlike binding in Opened, the
+	// Closed event may fire for a connection without a session.
+	FirstData func(c Conn, in []byte) ISession
+	// FirstLine fires once with the first line of a connection, without the
+	// \r\n, before the data reaches the Receive or Data event, such as the
+	// request line of HTTP. The data is held until the line is complete, and
+	// then passed on with the line, unless the action is not None, such as
+	// Close for a malformed or unauthorized line. A connection which sends
+	// more than MaxFirstLine bytes without a line is closed.
+	FirstLine func(c Conn, line []byte) (action Action)
+	// Negotiate fires with the first data of a connection, such as the
+	// hello of a versioned protocol, instead of the Data event. The
+	// returned handlerKey selects the handler in Handlers which receives
+	// the following data of the connection, so one port serves several
+	// versions of a protocol. The out is written either way, and a key
+	// without a handler closes the connection after it, such as for a
+	// version which is not supported. The Data event is not used once
+	// Negotiate is set.
+	Negotiate func(c Conn, hello []byte) (handlerKey string, out []byte, action Action)
+	// Handlers are the data handlers of Negotiate by their keys, which are
+	// used as the Data event of the negotiated connections.
+	Handlers map[string]DataHandler
 	// Closed fires when a connection has closed.
 	// The err parameter is the last known connection error.
+	// The closes from other goroutines, such as CloseConn, DestroyMatching
+	// or the idle timeout of UDP, run on the loop of the connection. Once
+	// the loop has processed a close, no event but Closed fires for the
+	// connection, and the incoming data which is still read is discarded.
 	Closed func(c Conn, err error) (action Action)
+	// Closing fires on the loop when CloseConn closes a connection, before
+	// the close, while the connection is still writable. The out is written
+	// before the FIN, such as a closing frame of the protocol. Returning
+	// false for ok defers the close by a tenth of a second and fires
+	// Closing again, such as until a goroutine has saved the session state. The
+	// closes of an action or of the peer don't fire it.
+	Closing func(c Conn) (out []byte, ok bool)
 	// Detached fires when a connection has been previously detached.
 	// Once detached it's up to the receiver of this event to manage the
 	// state of the connection. The Closed event will not be called for
@@ -123,9 +2261,61 @@ type Events struct {
 	Receive func(c Conn, in []byte) (out []byte, action Action)
 	Send    func(c Conn) (out []byte, action Action)
 
+	// WokenMessage fires for each message passed to WakeWithMessage, in the
+	// order of the calls. Use the out return value to write data to the
+	// connection.
+	WokenMessage func(c Conn, msg interface{}) (out []byte, action Action)
+
+	// WriteOverflow fires when the outbound data of a connection exceeds
+	// Options.MaxWriteBuffer, with the number of the discarded bytes. It's
+	// called on the loop as the data is queued, so it may fire inside other
+	// events of the connection.
+	WriteOverflow func(c Conn, dropped int)
+
+	// Control fires with the TCP urgent data of a connection, such as the
+	// interrupts of Telnet and FTP, which is sent with MSG_OOB. It's one
+	// byte, and it's kept out of the Data event, since SO_OOBINLINE is not
+	// set. Only the epoll loops on Linux read it, the kqueue and the stdlib
+	// loops never report it, so the byte is dropped there.
+	Control func(c Conn, b []byte)
+
+	// OutboundCeiling fires once the write buffers of all of the
+	// connections cross Events.MaxTotalOutbound, and again only after they
+	// drop to it. It's called on the loop as the data is queued, so it may
+	// fire inside other events, and it must not block.
+	OutboundCeiling func(total uint64)
+
+	// Migrated fires on the destination loop after a connection is moved
+	// from another loop, such as by Server.DrainLoop, so the handlers can
+	// set up the loop-local state of the connection again. The Conn is the
+	// same value after the move, so the registry still maps the session id
+	// to it, and its session, groups, tags, indexes and counters are kept.
+	// Its pending output is written by the destination loop, and the wakes
+	// and the messages which are queued before the move are delivered
+	// there. It's not fired by the stdlib loops, which never move a
+	// connection.
+	Migrated func(c Conn, fromLoop, toLoop int)
+	// DrainNotice fires for every connection which is closed by
+	// Server.DrainLoop, such as to tell the client to reconnect elsewhere.
+	// The notice is written to the connection, which is then kept open for
+	// the client to act until the timeout of DrainLoop, and closed at the
+	// timeout. A virtual UDP connection is closed right after the notice.
+	// The migrated connections are not notified.
+	DrainNotice func(c Conn) (notice []byte)
+
 	// Tick fires immediately after the server starts and will fire again
 	// following the duration specified by the delay return value.
 	Tick func() (delay time.Duration, action Action)
+
+	// UDPIdleTimeout enables virtual connections for UDP listeners. Each
+	// remote address gets its own connection, which fires Opened on the
+	// first datagram, Data for every datagram, and Closed once no datagram
+	// has been received within the duration. Wake sends the output of the
+	// Data event to the remote address, and the session functions, such as
+	// BindSessionByAddr, work as they do for TCP connections.
+	// Default value is zero, which means that every datagram is passed to
+	// the Data event with a transient connection.
+	UDPIdleTimeout time.Duration
 }
 
 // Serve starts handling events for the specified addresses.
@@ -133,15 +2323,25 @@ type Events struct {
 // Addresses should use a scheme prefix and be formatted
 // like `tcp://192.168.0.10:9851` or `unix://socket`.
 // Valid network schemes:
-//  tcp   - bind to both IPv4 and IPv6
-//  tcp4  - IPv4
-//  tcp6  - IPv6
-//  udp   - bind to both IPv4 and IPv6
-//  udp4  - IPv4
-//  udp6  - IPv6
-//  unix  - Unix Domain Socket
 //
-// The "tcp" network scheme is assumed when one is not specified.
+//	tcp   - bind to both IPv4 and IPv6
+//	tcp4  - IPv4
+//	tcp6  - IPv6
+//	udp   - bind to both IPv4 and IPv6
+//	udp4  - IPv4
+//	udp6  - IPv6
+//	unix  - Unix Domain Socket
+//	fd    - inherited listener, such as `fd://3` of ListenFdAddrs
+//
+// The "tcp" network scheme is assumed when one is not specified. The stream
+// and the datagram addresses can be mixed, they deliver to the same events.
+// An inherited fd is adopted instead of listening, it must be a listening
+// stream socket or a bound UDP socket, and it's closed once the server
+// stops.
+//
+// Serve returns nil once the server is shut down, the listeners which are
+// closed by the shutdown are not a failure. It returns the error of the
+// first listener which fails to accept while serving.
 func Serve(events Events, addr ...string) error {
 	var lns []*listener
 	defer func() {
@@ -161,7 +2361,9 @@ func Serve(events Events, addr ...string) error {
 			os.RemoveAll(ln.addr)
 		}
 		var err error
-		if ln.network == "udp" {
+		if ln.network == "fd" {
+			err = ln.inherit()
+		} else if ln.network == "udp" {
 			if ln.opts.reusePort {
 				ln.pconn, err = reuseportListenPacket(ln.network, ln.addr)
 			} else {
@@ -175,7 +2377,7 @@ func Serve(events Events, addr ...string) error {
 			}
 		}
 		if err != nil {
-			return err
+			return fmt.Errorf("evio: cannot bind %s: %w", addr, err)
 		}
 		if ln.pconn != nil {
 			ln.lnaddr = ln.pconn.LocalAddr()
@@ -184,7 +2386,7 @@ func Serve(events Events, addr ...string) error {
 		}
 		if !stdlib {
 			if err := ln.system(); err != nil {
-				return err
+				return fmt.Errorf("evio: cannot bind %s: %w", addr, err)
 			}
 		}
 		lns = append(lns, &ln)
@@ -195,6 +2397,41 @@ func Serve(events Events, addr ...string) error {
 	return serve(events, lns)
 }
 
+// ServeAddrs is Serve with a comma-separated list of the addresses, such as
+// "tcp://:80,tcp://:443,unix:///tmp/app.sock". All of the addresses are bound
+// before serving, and the bound ones are closed when a later one fails, so
+// the server never runs on a part of them. The error names the address
+// which failed.
+func ServeAddrs(events Events, addrs string) error {
+	var list []string
+	for _, addr := range strings.Split(addrs, ",") {
+		if addr = strings.TrimSpace(addr); addr == "" {
+			return fmt.Errorf("evio: empty address in %q", addrs)
+		}
+		list = append(list, addr)
+	}
+	return Serve(events, list...)
+}
+
+// ListenFdAddrs returns the fd addresses of the listeners which are passed
+// by the systemd socket activation, see sd_listen_fds(3). It's empty when
+// the LISTEN_PID is not of this process.
+func ListenFdAddrs() []string {
+	if pid, err := strconv.Atoi(os.Getenv("LISTEN_PID")); err != nil || pid != os.Getpid() {
+		return nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil {
+		return nil
+	}
+	const firstFd = 3 // SD_LISTEN_FDS_START
+	var addrs []string
+	for i := 0; i < n; i++ {
+		addrs = append(addrs, "fd://"+strconv.Itoa(firstFd+i))
+	}
+	return addrs
+}
+
 // InputStream is a helper type for managing input streams from inside
 // the Data event.
 type InputStream struct{ b []byte }
@@ -232,6 +2469,13 @@ type listener struct {
 	addr    string
 }
 
+// listenerClosed reports whether the err of an accept or a read is from a
+// closed listener, like the ones closed by the shutdown.
+func listenerClosed(err error) bool {
+	return errors.Is(err, net.ErrClosed) || errors.Is(err, os.ErrClosed) ||
+		errors.Is(err, syscall.EBADF) || errors.Is(err, syscall.EINVAL)
+}
+
 type addrOpts struct {
 	reusePort bool
 }
@@ -271,8 +2515,31 @@ func parseAddr(addr string) (network, address string, opts addrOpts, stdlib bool
 	return
 }
 
+// MaxFirstLine is the limit of the first line of Events.FirstLine.
+const MaxFirstLine = 8192
+
 // Use Receive() and Send() instead of Data()
 func DispatchEvents(events Events) Events {
+	if events.Negotiate != nil {
+		events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+			sc, ok := c.(interface{ state() *connState })
+			if !ok {
+				return nil, Close
+			}
+			cs := sc.state()
+			if cs.handler != nil {
+				return cs.handler(c, in)
+			}
+			if in == nil {
+				return nil, None // woken before the negotiation
+			}
+			key, out, action := events.Negotiate(c, in)
+			if cs.handler = events.Handlers[key]; cs.handler == nil && action == None {
+				action = Close // not a supported version
+			}
+			return out, action
+		}
+	}
 	if events.Send == nil && events.Data != nil {
 		events.Send = func(c Conn) (out []byte, action Action) {
 			out, action = events.Data(c, nil)
@@ -282,5 +2549,48 @@ func DispatchEvents(events Events) Events {
 	if events.Receive == nil {
 		events.Receive = events.Data
 	}
+	if events.FirstData != nil && events.Opened != nil && events.Receive != nil {
+		opened, receive := events.Opened, events.Receive
+		events.Opened = func(c Conn) (out []byte, opts Options, action Action) {
+			out, opts, action = opened(c)
+			if cs, ok := c.(interface{ state() *connState }); ok && opts.DeferSession {
+				cs.state().deferred = true
+			}
+			return
+		}
+		events.Receive = func(c Conn, in []byte) (out []byte, action Action) {
+			if cs, ok := c.(interface{ state() *connState }); ok && cs.state().deferred {
+				cs.state().deferred = false
+				if sess := events.FirstData(c, in); sess != nil {
+					BindSession(c, sess)
+				}
+			}
+			return receive(c, in)
+		}
+	}
+	if events.FirstLine != nil && events.Receive != nil {
+		receive := events.Receive
+		events.Receive = func(c Conn, in []byte) (out []byte, action Action) {
+			sc, ok := c.(interface{ state() *connState })
+			if !ok || sc.state().lineseen {
+				return receive(c, in)
+			}
+			cs := sc.state()
+			cs.linebuf = append(cs.linebuf, in...)
+			i := bytes.Index(cs.linebuf, []byte("\r\n"))
+			if i > MaxFirstLine || i < 0 && len(cs.linebuf) > MaxFirstLine {
+				cs.linebuf = nil
+				return nil, Close
+			}
+			if i < 0 {
+				return nil, None
+			}
+			in, cs.linebuf, cs.lineseen = cs.linebuf, nil, true
+			if action = events.FirstLine(c, in[:i]); action != None {
+				return nil, action
+			}
+			return receive(c, in)
+		}
+	}
 	return events
 }
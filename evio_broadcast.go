@@ -0,0 +1,56 @@
+// Copyright 2018 Ryan Liu. All rights reserved.
+// Broadcast to the sessions, which skips the slow consumers
+
+package evio
+
+import (
+	"errors"
+	"sync/atomic"
+)
+
+// ErrSlowConsumer is passed to the Closed event when a connection is closed
+// by Broadcast, because its write queue is over the limit
+var ErrSlowConsumer = errors.New("slow consumer")
+
+// Write the payload to the connections of all of the bound sessions, the
+// payload is shared and written as it is, so it must not be changed after.
+// A connection which WriteQueueLen() is over maxQueued is skipped, or closed
+// with ErrSlowConsumer when closeSlow is true, so one stalled client can not
+// grow the memory of a fan-out, there is no limit when maxQueued <= 0.
+// A stalled connection blocks its stdlib loop, which writes synchronously,
+// so it's closed after the blocked write returns
+func Broadcast(payload []byte, maxQueued int, closeSlow bool) (delivered, skipped []string) {
+	labeled("broadcast", func() {
+		RangeSessions(func(id string, c Conn) bool {
+			lc, ok := c.(loopConn)
+			if !ok {
+				return true
+			}
+			if maxQueued > 0 && WriteQueueLen(c) > maxQueued {
+				if closeSlow {
+					lc.run(func() Action {
+						cs := lc.state()
+						cs.takeOut() // do not wait for the stalled writes
+						cs.cerr = ErrSlowConsumer
+						return Close
+					})
+				}
+				skipped = append(skipped, id)
+				return true
+			}
+			// count the scheduled bytes now, so the next broadcast sees them
+			cs := lc.state()
+			atomic.AddInt64(&cs.outbytes, int64(len(payload)))
+			lc.run(func() Action {
+				atomic.AddInt64(&cs.outbytes, -int64(len(payload)))
+				if cs.cerr != ErrSlowConsumer { // not closing
+					cs.push(payload)
+				}
+				return None
+			})
+			delivered = append(delivered, id)
+			return true
+		})
+	})()
+	return
+}
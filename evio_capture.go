@@ -0,0 +1,124 @@
+// Copyright 2018 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package evio
+
+import (
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+// CaptureRecord is a read or a write of a connection which is kept by
+// Options.CaptureRing.
+type CaptureRecord struct {
+	Time time.Time // time of the read or the write
+	Dir  Direction
+	Data []byte
+}
+
+// captureRing keeps the last bytes of the traffic of a connection. The bytes
+// are in a ring which is allocated once, so the records only keep the
+// positions of their bytes, and the oldest ones are trimmed or dropped when
+// the ring wraps over them.
+type captureRing struct {
+	mu   sync.Mutex // guards the ring from DumpCapture
+	buf  []byte
+	end  int64 // bytes which are added to the ring in total
+	recs []captureRec
+}
+
+type captureRec struct {
+	at  time.Time
+	dir Direction
+	off int64 // position of the first byte, which is end-based
+	n   int
+}
+
+// newCaptureRing returns the ring of Options.CaptureRing, nil when it's
+// zero.
+func newCaptureRing(size int) *captureRing {
+	if size <= 0 {
+		return nil
+	}
+	return &captureRing{buf: make([]byte, size)}
+}
+
+// add copies the bytes to the ring, only the last ones are kept when they
+// are longer than the ring.
+func (r *captureRing) add(dir Direction, b []byte) {
+	if len(b) == 0 {
+		return
+	}
+	if len(b) > len(r.buf) {
+		b = b[len(b)-len(r.buf):]
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	rec := captureRec{at: time.Now(), dir: dir, off: r.end, n: len(b)}
+	for len(b) > 0 {
+		i := int(r.end % int64(len(r.buf)))
+		n := copy(r.buf[i:], b)
+		b = b[n:]
+		r.end += int64(n)
+	}
+	// trim the records which are overwritten
+	start := r.end - int64(len(r.buf))
+	for len(r.recs) > 0 && r.recs[0].off < start {
+		first := &r.recs[0]
+		if first.off+int64(first.n) > start {
+			first.n -= int(start - first.off)
+			first.off = start
+			break
+		}
+		r.recs = r.recs[1:]
+	}
+	r.recs = append(r.recs, rec)
+}
+
+// dump copies the records out of the ring, the oldest first.
+func (r *captureRing) dump() []CaptureRecord {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	records := make([]CaptureRecord, len(r.recs))
+	for k, rec := range r.recs {
+		data := make([]byte, 0, rec.n)
+		for off := rec.off; off < rec.off+int64(rec.n); {
+			i := int(off % int64(len(r.buf)))
+			j := i + int(rec.off+int64(rec.n)-off)
+			if j > len(r.buf) {
+				j = len(r.buf)
+			}
+			data = append(data, r.buf[i:j]...)
+			off += int64(j - i)
+		}
+		records[k] = CaptureRecord{Time: rec.at, Dir: rec.dir, Data: data}
+	}
+	return records
+}
+
+// DumpCapture copies the records out of the ring.
+func (cs *connState) DumpCapture() []CaptureRecord {
+	if cs.capture == nil {
+		return nil
+	}
+	return cs.capture.dump()
+}
+
+// logCapture logs the capture by Options.LogCapture when the connection is
+// closed by an error, called before the Closed event.
+func (cs *connState) logCapture(c Conn, err error) {
+	if !cs.logcapture || cs.capture == nil || err == nil || err == io.EOF {
+		return
+	}
+	log.Printf("evio: %v closed by %v, capture:", c.RemoteAddr(), err)
+	for _, rec := range cs.capture.dump() {
+		dir := "in"
+		if rec.Dir == Outbound {
+			dir = "out"
+		}
+		log.Printf("evio:   %s %-3s %q", rec.Time.Format("15:04:05.000000"), dir, rec.Data)
+	}
+}
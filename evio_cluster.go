@@ -0,0 +1,109 @@
+// Copyright 2018 Ryan Liu. All rights reserved.
+// Session affinity of cluster nodes by consistent hashing
+
+package evio
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// Number of points of every member on the hash ring
+const clusterReplicas = 160
+
+// Max ids tried by NewLocalSessionId, a node of 100 members misses all of
+// them once in 30000 calls
+const localIdAttempts = 1024
+
+// A router to find the node which owns a session id,
+// every node should have the same member list
+type ClusterRouter struct {
+	self   string
+	mu     sync.RWMutex
+	ring   []uint64          // sorted points of the members
+	owners map[uint64]string // member of every point
+}
+
+// Create a router, self is the name of this node in members
+func NewClusterRouter(self string, members []string) *ClusterRouter {
+	r := &ClusterRouter{self: self}
+	r.UpdateMembers(members)
+	return r
+}
+
+// Replace the members, only the ids of the changed members are remapped
+func (r *ClusterRouter) UpdateMembers(members []string) {
+	ring := make([]uint64, 0, len(members)*clusterReplicas)
+	owners := make(map[uint64]string, len(members)*clusterReplicas)
+	for _, m := range members {
+		for i := 0; i < clusterReplicas; i++ {
+			point := clusterHash(m + "#" + strconv.Itoa(i))
+			if _, ok := owners[point]; !ok {
+				ring = append(ring, point)
+			}
+			owners[point] = m
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool { return ring[i] < ring[j] })
+	r.mu.Lock()
+	r.ring, r.owners = ring, owners
+	r.mu.Unlock()
+}
+
+// Get the member which owns the session id, empty when there is no member
+func (r *ClusterRouter) OwnerOf(id string) string {
+	point := clusterHash(id)
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if len(r.ring) == 0 {
+		return ""
+	}
+	i := sort.Search(len(r.ring), func(i int) bool { return r.ring[i] >= point })
+	if i == len(r.ring) {
+		i = 0
+	}
+	return r.owners[r.ring[i]]
+}
+
+// Whether the session id belongs to this node, usually checked in
+// Events.Opened() to decide binding the session or redirecting the client
+func (r *ClusterRouter) Owns(id string) bool {
+	owner := r.OwnerOf(id)
+	return owner != "" && owner == r.self
+}
+
+// Generate a random session id which this node owns, so a new session is
+// bound locally without proxying. The ids are tried up to localIdAttempts
+// times, the last one is returned even when it's owned by another node,
+// such as when this node is not in the members, check it by Owns() then
+func NewLocalSessionId(r *ClusterRouter) string {
+	var id string
+	buf := make([]byte, 16)
+	for i := 0; i < localIdAttempts; i++ {
+		if _, err := rand.Read(buf); err != nil {
+			panic(err)
+		}
+		id = hex.EncodeToString(buf)
+		if r.Owns(id) {
+			break
+		}
+	}
+	return id
+}
+
+func clusterHash(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	// mix the bits, the fnv hashes of similar keys are close
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
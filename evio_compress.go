@@ -0,0 +1,85 @@
+// Copyright 2018 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package evio
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"sync"
+)
+
+// CompressWrites sets the compression of the outgoing data of a connection.
+// Each compressed buffer is a complete gzip member or deflate stream, so the
+// protocol must tell the peer which messages are compressed, such as with a
+// flag that is negotiated when the connection opens.
+type CompressWrites struct {
+	// MinSize is the size from which a buffer is compressed, which avoids
+	// compressing the tiny messages. Each buffer has a fixed cost of a few
+	// microseconds, while the saved bytes grow with the size, see
+	// BenchmarkCompressWrites for the CPU time and the saved percentage.
+	MinSize int
+	// Codec is the compression codec, "gzip" or "deflate".
+	// Default value is empty, which means that nothing is compressed.
+	Codec string
+}
+
+// WriteCompressed writes the buffer to the connection like WriteAll, but it
+// forces or skips the compression regardless of CompressWrites.MinSize.
+// The buffer is not compressed when the connection has no codec.
+// This must be called from an event of the connection.
+func WriteCompressed(c Conn, b []byte, compress bool) {
+	cs, ok := c.(interface{ state() *connState })
+	if !ok || len(b) == 0 {
+		return
+	}
+	st := cs.state()
+	if compress && st.comp != nil {
+		b = st.comp.compress(b)
+	}
+	st.push(b)
+}
+
+// compressWriter is implemented by both gzip.Writer and flate.Writer.
+type compressWriter interface {
+	io.WriteCloser
+	Reset(w io.Writer)
+}
+
+var compressPools = map[string]*sync.Pool{
+	"gzip": {New: func() interface{} {
+		return gzip.NewWriter(nil)
+	}},
+	"deflate": {New: func() interface{} {
+		w, _ := flate.NewWriter(nil, flate.DefaultCompression)
+		return w
+	}},
+}
+
+type compressor struct {
+	min  int        // CompressWrites.MinSize
+	pool *sync.Pool // writers of the codec
+}
+
+// newCompressor returns nil when the codec is empty or unknown.
+func newCompressor(opts CompressWrites) *compressor {
+	pool, ok := compressPools[opts.Codec]
+	if !ok {
+		return nil
+	}
+	return &compressor{min: opts.MinSize, pool: pool}
+}
+
+func (cp *compressor) compress(b []byte) []byte {
+	var buf bytes.Buffer
+	w := cp.pool.Get().(compressWriter)
+	w.Reset(&buf)
+	w.Write(b)
+	w.Close()
+	w.Reset(nil)
+	cp.pool.Put(w)
+	return buf.Bytes()
+}
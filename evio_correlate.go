@@ -0,0 +1,117 @@
+// Copyright 2018 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package evio
+
+import (
+	"sync"
+	"time"
+)
+
+// CorrelationTracker matches the responses of connections to the awaiting
+// requests by a correlation id, which is extracted from the data by the
+// protocol. The zero value is ready to use.
+//
+// A typical use is to call Expect, write the request with Wake or
+// WakeWithMessage, and then Await the response from a goroutine other than
+// the event loop, while the Data event calls Deliver for every response.
+type CorrelationTracker struct {
+	mu    sync.Mutex
+	conns map[Conn]map[uint64]chan correlated
+}
+
+type correlated struct {
+	resp []byte
+	err  error
+}
+
+// Expect registers a waiter for the request of the connection, so that a
+// response which arrives before Await is called is not lost. The waiter is
+// kept until Await is called or the connection is closed.
+func (t *CorrelationTracker) Expect(c Conn, reqID uint64) error {
+	_, err := t.waiter(c, reqID)
+	return err
+}
+
+// Await waits for the response of the request of the connection. It returns
+// ErrResponseTimeout when no response is delivered within the timeout, and
+// ErrConnClosed when the connection is closed.
+func (t *CorrelationTracker) Await(c Conn, reqID uint64, timeout time.Duration) (resp []byte, err error) {
+	ch, err := t.waiter(c, reqID)
+	if err != nil {
+		return nil, err
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	defer t.remove(c, reqID, ch)
+	select {
+	case v := <-ch:
+		return v.resp, v.err
+	case <-timer.C:
+		return nil, ErrResponseTimeout
+	}
+}
+
+// Deliver passes the response to the waiter of the request, and returns false
+// when there is no waiter, such as after the timeout. The response is passed
+// as it is, so it must be copied when Options.ReuseInputBuffer is set.
+func (t *CorrelationTracker) Deliver(c Conn, reqID uint64, resp []byte) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if ch, ok := t.conns[c][reqID]; ok {
+		select {
+		case ch <- correlated{resp: resp}:
+			return true
+		default: // already delivered
+		}
+	}
+	return false
+}
+
+// waiter returns the waiter of the request, which is created when missing.
+func (t *CorrelationTracker) waiter(c Conn, reqID uint64) (chan correlated, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	waiters, ok := t.conns[c]
+	if !ok {
+		cs, ok := c.(interface{ state() *connState })
+		if !ok || !cs.state().onRelease(func() { t.release(c) }) {
+			return nil, ErrConnClosed
+		}
+		if t.conns == nil {
+			t.conns = make(map[Conn]map[uint64]chan correlated)
+		}
+		waiters = make(map[uint64]chan correlated)
+		t.conns[c] = waiters
+	}
+	ch, ok := waiters[reqID]
+	if !ok {
+		ch = make(chan correlated, 1)
+		waiters[reqID] = ch
+	}
+	return ch, nil
+}
+
+// remove removes the waiter of the request, if it's not replaced.
+func (t *CorrelationTracker) remove(c Conn, reqID uint64, ch chan correlated) {
+	t.mu.Lock()
+	if waiters := t.conns[c]; waiters[reqID] == ch {
+		delete(waiters, reqID)
+	}
+	t.mu.Unlock()
+}
+
+// release fails all of the waiters of the closed connection.
+func (t *CorrelationTracker) release(c Conn) {
+	t.mu.Lock()
+	waiters := t.conns[c]
+	delete(t.conns, c)
+	t.mu.Unlock()
+	for _, ch := range waiters {
+		select {
+		case ch <- correlated{err: ErrConnClosed}:
+		default: // already delivered
+		}
+	}
+}
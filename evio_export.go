@@ -0,0 +1,94 @@
+// Copyright 2018 Ryan Liu. All rights reserved.
+// Export and import of the registry, such as for a blue-green deploy
+
+package evio
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"unicode/utf8"
+)
+
+// A session which can be imported, the data is from IMarshalSession.Marshal()
+type IUnmarshalSession interface {
+	ISession
+	Unmarshal(data []byte) error
+}
+
+// An exported session, the data is nil when it isn't a IMarshalSession.
+// A binary id is in raw, which JSON keeps intact unlike an invalid string
+type registryEntry struct {
+	Id   string `json:"id,omitempty"`
+	Raw  []byte `json:"raw,omitempty"`
+	Data []byte `json:"data,omitempty"`
+}
+
+func (entry registryEntry) id() string {
+	if entry.Raw != nil {
+		return string(entry.Raw)
+	}
+	return entry.Id
+}
+
+// Serialize all of the bound sessions, which are sorted by id.
+// Stop accepting before it, so no session is bound after the export
+func ExportRegistry() ([]byte, error) {
+	var entries []registryEntry
+	var err error
+	labeled("registry", func() {
+		RangeSessions(func(id string, c Conn) bool {
+			sess, ok := GetSession(c).(ISession)
+			if !ok || sess.GetId() != id {
+				return true // not bound or stale, see ReconcileRegistry()
+			}
+			entry := registryEntry{Id: id}
+			if !utf8.ValidString(id) {
+				entry.Id, entry.Raw = "", []byte(id)
+			}
+			if ms, ok := sess.(IMarshalSession); ok {
+				if entry.Data, err = ms.Marshal(); err != nil {
+					err = fmt.Errorf("evio: cannot marshal session %q: %v", id, err)
+					return false
+				}
+			}
+			entries = append(entries, entry)
+			return true
+		})
+	})()
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].id() < entries[j].id() })
+	return json.Marshal(entries)
+}
+
+// Load the sessions of ExportRegistry() and bind them to the connections,
+// which are mapped from the ids by resolve, the ids without a connection
+// are skipped. The session of connection is set by Events.Opened() as
+// usual, it's unmarshaled when it's a IUnmarshalSession.
+// Import the fds first, so resolve can find the adopted connections
+func ImportRegistry(data []byte, resolve func(id string) Conn) error {
+	var entries []registryEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return fmt.Errorf("evio: bad registry data: %v", err)
+	}
+	for _, entry := range entries {
+		entry.Id = entry.id()
+		c := resolve(entry.Id)
+		if c == nil {
+			continue
+		}
+		sess, ok := GetSession(c).(ISession)
+		if !ok {
+			return fmt.Errorf("evio: no session of connection for %q", entry.Id)
+		}
+		if us, ok := sess.(IUnmarshalSession); ok && entry.Data != nil {
+			if err := us.Unmarshal(entry.Data); err != nil {
+				return fmt.Errorf("evio: cannot unmarshal session %q: %v", entry.Id, err)
+			}
+		}
+		RebindSessionId(c, entry.Id) // the new id of Opened is replaced
+	}
+	return nil
+}
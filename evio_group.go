@@ -0,0 +1,208 @@
+// Copyright 2018 Ryan Liu. All rights reserved.
+// Groups and tags of connections, which are removed when closed
+
+package evio
+
+import (
+	"errors"
+	"sort"
+	"sync"
+)
+
+// ErrNotInGroup is returned by MoveGroup when the session is not in the group
+var ErrNotInGroup = errors.New("not in group")
+
+var membership struct {
+	sync.RWMutex
+	conns  map[Conn]*connMembers        // memberships of every connection
+	groups map[string]map[Conn]struct{} // connections of every group
+	tags   map[string]map[Conn]struct{} // connections of every tag
+}
+
+type connMembers struct {
+	groups map[string]struct{}
+	tags   map[string]struct{}
+}
+
+// Join the connection to the group, it fails when the connection is closed
+func Join(c Conn, group string) (success bool) {
+	return addMembership(c, group, false)
+}
+
+// Leave the group
+func Leave(c Conn, group string) (found bool) {
+	return delMembership(c, group, false)
+}
+
+// Move the connection of the session id from a group to another in one step,
+// so it's never in both or neither of them for GroupMembers, such as when a
+// player switches the rooms. It does nothing when the groups are the same.
+// ErrNotInGroup is returned when the session is not in the from group, and
+// ErrConnClosed when no connection has the id
+func MoveGroup(id string, fromGroup, toGroup string) error {
+	c := FindConnById(id)
+	if c == nil {
+		return ErrConnClosed
+	}
+	if fromGroup == toGroup {
+		return nil
+	}
+	membership.Lock()
+	defer membership.Unlock()
+	m, ok := membership.conns[c]
+	if !ok {
+		return ErrNotInGroup
+	}
+	if _, ok = m.groups[fromGroup]; !ok {
+		return ErrNotInGroup
+	}
+	delete(m.groups, fromGroup)
+	unindex(membership.groups, fromGroup, c)
+	m.groups[toGroup] = struct{}{}
+	index(membership.groups, toGroup, c)
+	return nil
+}
+
+// Tag the connection, it fails when the connection is closed
+func Tag(c Conn, tag string) (success bool) {
+	return addMembership(c, tag, true)
+}
+
+// Remove the tag from the connection
+func Untag(c Conn, tag string) (found bool) {
+	return delMembership(c, tag, true)
+}
+
+// Get the connections of the group
+func GroupMembers(group string) []Conn {
+	membership.RLock()
+	defer membership.RUnlock()
+	return connsOf(membership.groups[group])
+}
+
+// Get the connections with the tag
+func Tagged(tag string) []Conn {
+	membership.RLock()
+	defer membership.RUnlock()
+	return connsOf(membership.tags[tag])
+}
+
+// Get the sorted groups of the connection, it's a copy, which can be used
+// to join the same groups after a reconnect
+func Groups(c Conn) []string {
+	membership.RLock()
+	defer membership.RUnlock()
+	if m, ok := membership.conns[c]; ok {
+		return sortedKeys(m.groups)
+	}
+	return nil
+}
+
+// Get the sorted tags of the connection, it's a copy
+func Tags(c Conn) []string {
+	membership.RLock()
+	defer membership.RUnlock()
+	if m, ok := membership.conns[c]; ok {
+		return sortedKeys(m.tags)
+	}
+	return nil
+}
+
+func addMembership(c Conn, name string, tag bool) bool {
+	membership.Lock()
+	defer membership.Unlock()
+	m, ok := membership.conns[c]
+	if !ok {
+		cs, ok := c.(interface{ state() *connState })
+		if !ok || !cs.state().onRelease(func() { releaseMembership(c) }) {
+			return false
+		}
+		if membership.conns == nil {
+			membership.conns = make(map[Conn]*connMembers)
+			membership.groups = make(map[string]map[Conn]struct{})
+			membership.tags = make(map[string]map[Conn]struct{})
+		}
+		m = &connMembers{
+			groups: make(map[string]struct{}),
+			tags:   make(map[string]struct{}),
+		}
+		membership.conns[c] = m
+	}
+	names, idx := m.groups, membership.groups
+	if tag {
+		names, idx = m.tags, membership.tags
+	}
+	names[name] = struct{}{}
+	index(idx, name, c)
+	return true
+}
+
+func delMembership(c Conn, name string, tag bool) bool {
+	membership.Lock()
+	defer membership.Unlock()
+	m, ok := membership.conns[c]
+	if !ok {
+		return false
+	}
+	names, index := m.groups, membership.groups
+	if tag {
+		names, index = m.tags, membership.tags
+	}
+	if _, ok = names[name]; ok {
+		delete(names, name)
+		unindex(index, name, c)
+	}
+	return ok
+}
+
+// Remove all of the memberships of the closed connection
+func releaseMembership(c Conn) {
+	membership.Lock()
+	defer membership.Unlock()
+	m, ok := membership.conns[c]
+	if !ok {
+		return
+	}
+	delete(membership.conns, c)
+	for name := range m.groups {
+		unindex(membership.groups, name, c)
+	}
+	for name := range m.tags {
+		unindex(membership.tags, name, c)
+	}
+}
+
+func index(index map[string]map[Conn]struct{}, name string, c Conn) {
+	set, ok := index[name]
+	if !ok {
+		set = make(map[Conn]struct{})
+		index[name] = set
+	}
+	set[c] = struct{}{}
+}
+
+func unindex(index map[string]map[Conn]struct{}, name string, c Conn) {
+	if set, ok := index[name]; ok {
+		delete(set, c)
+		if len(set) == 0 {
+			delete(index, name)
+		}
+	}
+}
+
+func connsOf(set map[Conn]struct{}) []Conn {
+	conns := make([]Conn, 0, len(set))
+	for c := range set {
+		conns = append(conns, c)
+	}
+	return conns
+}
+
+func sortedKeys(set map[string]struct{}) []string {
+	keys := make([]string, 0, len(set))
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,155 @@
+// Copyright 2018 Ryan Liu. All rights reserved.
+// Bounded inboxes of the sessions, which are drained to the connections
+
+package evio
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+)
+
+// ErrInboxFull is returned by PushInbox when the inbox of InboxReject is full
+var ErrInboxFull = errors.New("inbox full")
+
+// ErrNoInbox is returned by PushInbox when the session id has no inbox
+var ErrNoInbox = errors.New("no inbox")
+
+// What happens to a message which is pushed to a full inbox
+type OverflowPolicy int
+
+const (
+	// Discard the oldest queued message to make room for the new one
+	InboxDropOldest OverflowPolicy = iota
+	// Discard the new message
+	InboxDropNewest
+	// Refuse the new message with ErrInboxFull
+	InboxReject
+)
+
+type inbox struct {
+	id       string // session id, which is changed by RebindSessionId()
+	capacity int
+	policy   OverflowPolicy
+	msgs     [][]byte // queued messages
+	dropped  int      // messages discarded by the policy or a failed write
+	sending  bool     // a batch is being written to the connection
+}
+
+var inboxes struct {
+	sync.Mutex
+	boxes map[string]*inbox // inbox of every session id
+}
+
+// Create the inbox of the session id, which queues up to capacity messages
+// of PushInbox, or change the capacity and policy of an existing one. The
+// session may be bound later, the messages are kept until then, and the
+// inbox is removed by DestroySession() of the session
+func SessionInbox(id string, capacity int, policy OverflowPolicy) {
+	if capacity < 1 {
+		capacity = 1
+	}
+	inboxes.Lock()
+	if inboxes.boxes == nil {
+		inboxes.boxes = make(map[string]*inbox)
+	}
+	ib, ok := inboxes.boxes[id]
+	if !ok {
+		ib = &inbox{id: id}
+		inboxes.boxes[id] = ib
+	}
+	ib.capacity, ib.policy = capacity, policy
+	inboxes.Unlock()
+}
+
+// Queue the message to the inbox of the session id, which is written to the
+// connection as it is, so it must not be changed after. The loop writes the
+// queued messages once the former ones are flushed to the socket, so the
+// inbox fills up while the connection is stalled or not bound yet
+func PushInbox(id string, msg []byte) error {
+	inboxes.Lock()
+	ib, ok := inboxes.boxes[id]
+	if !ok {
+		inboxes.Unlock()
+		return ErrNoInbox
+	}
+	if len(ib.msgs) >= ib.capacity {
+		switch ib.policy {
+		case InboxReject:
+			inboxes.Unlock()
+			return ErrInboxFull
+		case InboxDropNewest:
+			ib.dropped++
+			inboxes.Unlock()
+			return nil
+		default:
+			ib.msgs[0] = nil
+			ib.msgs = ib.msgs[1:]
+			ib.dropped++
+		}
+	}
+	ib.msgs = append(ib.msgs, msg)
+	inboxes.Unlock()
+	inboxDrain(id)
+	return nil
+}
+
+// Get the number of the queued messages of the inbox, and the ones which
+// are discarded by the policy or a failed write
+func InboxStats(id string) (queued, dropped int, found bool) {
+	inboxes.Lock()
+	defer inboxes.Unlock()
+	if ib, ok := inboxes.boxes[id]; ok {
+		return len(ib.msgs), ib.dropped, true
+	}
+	return 0, 0, false
+}
+
+// Write the queued messages to the connection of the session id as a batch,
+// the next batch is written once this one is flushed
+func inboxDrain(id string) {
+	c := FindConnById(id)
+	if c == nil {
+		return
+	}
+	inboxes.Lock()
+	ib, ok := inboxes.boxes[id]
+	if !ok || ib.sending || len(ib.msgs) == 0 {
+		inboxes.Unlock()
+		return
+	}
+	batch := ib.msgs
+	ib.msgs = nil
+	ib.sending = true
+	inboxes.Unlock()
+	QueueWriteCB(c, bytes.Join(batch, nil), func(err error) {
+		inboxes.Lock()
+		ib.sending = false
+		if err != nil {
+			ib.dropped += len(batch)
+		}
+		id := ib.id
+		inboxes.Unlock()
+		if err == nil {
+			inboxDrain(id)
+		}
+	})
+}
+
+// Move the inbox to the new id, called after the id is changed
+func inboxRename(oldid, id string) {
+	inboxes.Lock()
+	if ib, ok := inboxes.boxes[oldid]; ok {
+		delete(inboxes.boxes, oldid)
+		ib.id = id
+		inboxes.boxes[id] = ib
+	}
+	inboxes.Unlock()
+}
+
+// Remove the inbox of the session id
+func inboxRemove(id string) {
+	inboxes.Lock()
+	delete(inboxes.boxes, id)
+	inboxes.Unlock()
+}
@@ -0,0 +1,99 @@
+// Copyright 2018 Ryan Liu. All rights reserved.
+// Secondary indexes of the sessions, such as by user id or device id
+
+package evio
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+type indexKey struct {
+	name string // index, such as "user"
+	key  string // key in the index, such as a user id
+}
+
+var indexes struct {
+	sync.RWMutex
+	conns map[Conn]map[indexKey]struct{} // index keys of every connection
+	keys  map[indexKey]map[Conn]struct{} // connections of every index key
+}
+
+// Add the connection to the named index under the key, such as the "user"
+// index by the user id, so all of the connections of a user are found by
+// FindConnsByIndex. A connection can have many keys, they are removed by
+// DestroySession() or when the connection is closed. It fails when the
+// connection is closed
+func IndexSession(c Conn, indexName, key string) (success bool) {
+	indexes.Lock()
+	defer indexes.Unlock()
+	keys, ok := indexes.conns[c]
+	if !ok {
+		cs, ok := c.(interface{ state() *connState })
+		if !ok || !cs.state().onRelease(func() { indexRemove(c) }) {
+			return false
+		}
+		if indexes.conns == nil {
+			indexes.conns = make(map[Conn]map[indexKey]struct{})
+			indexes.keys = make(map[indexKey]map[Conn]struct{})
+		}
+		keys = make(map[indexKey]struct{})
+		indexes.conns[c] = keys
+	}
+	k := indexKey{indexName, key}
+	keys[k] = struct{}{}
+	set, ok := indexes.keys[k]
+	if !ok {
+		set = make(map[Conn]struct{})
+		indexes.keys[k] = set
+	}
+	set[c] = struct{}{}
+	return true
+}
+
+// Get the connections under the key of the named index
+func FindConnsByIndex(indexName, key string) []Conn {
+	indexes.RLock()
+	defer indexes.RUnlock()
+	return connsOf(indexes.keys[indexKey{indexName, key}])
+}
+
+// Write the payload to the connections under the key of the named index,
+// the payload is shared and written as it is, so it must not be changed
+// after. The sent is the number of the connections
+func SendByIndex(indexName, key string, payload []byte) (sent int) {
+	for _, c := range FindConnsByIndex(indexName, key) {
+		lc, ok := c.(loopConn)
+		if !ok {
+			continue
+		}
+		cs := lc.state()
+		atomic.AddInt64(&cs.outbytes, int64(len(payload)))
+		lc.run(func() Action {
+			atomic.AddInt64(&cs.outbytes, -int64(len(payload)))
+			cs.push(payload)
+			return None
+		})
+		sent++
+	}
+	return
+}
+
+// Remove all of the index keys of the connection
+func indexRemove(c Conn) {
+	indexes.Lock()
+	defer indexes.Unlock()
+	keys, ok := indexes.conns[c]
+	if !ok {
+		return
+	}
+	delete(indexes.conns, c)
+	for k := range keys {
+		if set, ok := indexes.keys[k]; ok {
+			delete(set, c)
+			if len(set) == 0 {
+				delete(indexes.keys, k)
+			}
+		}
+	}
+}
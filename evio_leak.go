@@ -0,0 +1,80 @@
+// Copyright 2018 Ryan Liu. All rights reserved.
+// Checks of the leftover session state, such as for the leak tests
+
+package evio
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// List the entries of the registry, which are sorted, as the quoted id and
+// the liveness of its connection: open, closed, or stale when the session
+// of the connection has another id, see ReconcileRegistry()
+func DebugRegistryDump() []string {
+	var lines []string
+	RangeSessions(func(id string, c Conn) bool {
+		lines = append(lines, fmt.Sprintf("%q %s", id, connLiveness(id, c)))
+		return true
+	})
+	sort.Strings(lines)
+	return lines
+}
+
+// Get an error which lists the leftover entries of the registry, and the
+// connections which are still in the groups, tags, indexes or presence,
+// such as at the end of a test after all of the connections are closed and
+// their sessions destroyed. It's nil when nothing is left
+func AssertNoLeaks() error {
+	var leaks []string
+	if lines := DebugRegistryDump(); len(lines) > 0 {
+		leaks = append(leaks, fmt.Sprintf("%d sessions (%s)", len(lines), strings.Join(lines, ", ")))
+	}
+	membership.RLock()
+	members := len(membership.conns)
+	membership.RUnlock()
+	indexes.RLock()
+	indexed := len(indexes.conns)
+	indexes.RUnlock()
+	presence.Lock()
+	var present int
+	for _, sub := range presence.subs {
+		present += len(sub.keys)
+	}
+	presence.Unlock()
+	for _, n := range []struct {
+		count int
+		what  string
+	}{
+		{members, "connections in groups or tags"},
+		{indexed, "indexed connections"},
+		{present, "connections in presence"},
+	} {
+		if n.count > 0 {
+			leaks = append(leaks, fmt.Sprintf("%d %s", n.count, n.what))
+		}
+	}
+	if len(leaks) == 0 {
+		return nil
+	}
+	return fmt.Errorf("evio: leaked %s", strings.Join(leaks, ", "))
+}
+
+// The liveness of the connection of a registry entry
+func connLiveness(id string, c Conn) string {
+	if sess, ok := GetSession(c).(ISession); !ok || sess.GetId() != id {
+		return "stale"
+	}
+	sc, ok := c.(interface{ state() *connState })
+	if !ok {
+		return "open"
+	}
+	cs := sc.state()
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if cs.closed {
+		return "closed"
+	}
+	return "open"
+}
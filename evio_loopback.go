@@ -0,0 +1,232 @@
+// Copyright 2018 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package evio
+
+import (
+	"net"
+	"sync"
+)
+
+// TestConn is an in-memory connection which drives the events on the
+// calling goroutine, without sockets or event loops, see LoopbackServer.
+// The data of Feed is passed to the events, and the written data is staged
+// until it's taken by Output, so a protocol can be tested deterministically.
+type TestConn struct {
+	connState
+	events Events
+	ctx    interface{}
+	action Action
+	done   bool     // closed, detached or shutdown
+	peer   net.Conn // the other side of a detached connection
+
+	mu     sync.Mutex
+	wakes  int             // pending Wake calls
+	cmds   []func() Action // pending commands, such as of Broadcast
+	msgsup bool            // pending WokenMessage events
+	stats  *loopStats      // counters of its own loop, see onLoop
+}
+
+// LoopbackServer opens a TestConn with the events, which fires the Opened
+// event before it returns. The Serving and Tick events are not fired.
+func LoopbackServer(events Events) *TestConn {
+	c := &TestConn{events: DispatchEvents(events), stats: &loopStats{}}
+	c.setLoop(c.stats)
+	c.accepted()
+	c.opening()
+	c.receive = c.events.Receive
+	c.closingfn = c.events.Closing
+	if c.events.Opened != nil {
+		c.enter()
+		out, opts, action := c.events.Opened(c)
+		c.leave()
+		c.comp = newCompressor(opts.CompressWrites)
+		c.setMaxWakes(opts)
+		c.setWriteCap(opts, c, c.events.WriteOverflow)
+		c.meter.start(opts)
+		c.trace = opts.Trace
+		c.capture, c.logcapture = newCaptureRing(opts.CaptureRing), opts.LogCapture
+		c.setAutoPong(opts)
+		c.queue(append([]byte{}, out...))
+		c.apply(action)
+	}
+	return c
+}
+
+// Feed passes the data to the Data event, and then processes the pending
+// wakes. The returned action is the last action of the connection. An empty
+// non-nil data is delivered as an empty read, which does not close.
+func (c *TestConn) Feed(in []byte) Action {
+	if c.done || in == nil {
+		return c.action
+	}
+	c.received(len(in))
+	c.traceIn(c, in)
+	c.readMark(c, len(in))
+	if awaiting, action := c.awaitAck(in); awaiting {
+		c.apply(action)
+	} else if c.autoPong(in) {
+		// answered without the Data event
+	} else if c.held(in) {
+		// passed to the Data event by the retry of RetryData
+	} else if c.events.Receive != nil {
+		c.enter()
+		out, action := c.events.Receive(c, in)
+		c.leave()
+		c.queue(append([]byte{}, out...))
+		c.apply(action)
+	}
+	return c.Step()
+}
+
+// Step processes the pending Wake calls, the messages of WakeWithMessage and
+// the commands from other goroutines, until there is nothing pending.
+func (c *TestConn) Step() Action {
+	for !c.done {
+		c.mu.Lock()
+		wakes, cmds, msgsup := c.wakes, c.cmds, c.msgsup
+		c.wakes, c.cmds, c.msgsup = 0, nil, false
+		c.mu.Unlock()
+		if wakes == 0 && len(cmds) == 0 && !msgsup {
+			break
+		}
+		for ; wakes > 0 && !c.done; wakes-- {
+			if c.woke() && c.events.Send != nil {
+				c.enter()
+				out, action := c.events.Send(c)
+				c.leave()
+				c.queue(append([]byte{}, out...))
+				c.apply(action)
+			}
+		}
+		for _, fn := range cmds {
+			if c.done {
+				break
+			}
+			c.enter()
+			action := fn()
+			c.leave()
+			c.apply(action)
+		}
+		for _, msg := range c.takeMessages(nil) {
+			if c.done || c.events.WokenMessage == nil {
+				break
+			}
+			c.enter()
+			out, action := c.events.WokenMessage(c, msg)
+			c.leave()
+			c.queue(append([]byte{}, out...))
+			c.apply(action)
+		}
+	}
+	return c.action
+}
+
+// Output takes the staged data which is written to the connection, it's nil
+// while the connection is corked.
+func (c *TestConn) Output() []byte {
+	if c.corked {
+		return nil // held by Cork
+	}
+	var out []byte
+	bufs := c.takeOut()
+	for _, b := range bufs {
+		out = append(out, b...)
+	}
+	c.traceOut(c, bufs, -1)
+	c.settle(nil)
+	return out
+}
+
+// Close closes the connection from the peer side, which fires the Closed
+// event with the err, unless the connection is already closed. A nil err
+// is an EOF, so PeerClosed returns true.
+func (c *TestConn) Close(err error) {
+	if !c.done {
+		if err == nil {
+			c.peerClosed()
+		}
+		c.closedBy(Remote)
+		c.finish(err)
+	}
+}
+
+// Closed returns true when the connection is closed, detached or shutdown.
+func (c *TestConn) Closed() bool { return c.done }
+
+// DetachedPeer returns the other side of the pipe which is passed to the
+// Detached event, it's nil when the connection is not detached.
+func (c *TestConn) DetachedPeer() net.Conn { return c.peer }
+
+// apply applies the action of an event, the Shutdown action closes the
+// connection, because there is no server.
+func (c *TestConn) apply(action Action) {
+	if action == None || c.done {
+		return
+	}
+	c.action = action
+	switch action {
+	case Close, Shutdown:
+		c.finish(c.cerr)
+	case Detach:
+		c.done = true
+		c.release()
+		if c.events.Detached != nil {
+			var rwc net.Conn
+			rwc, c.peer = net.Pipe()
+			if out := c.Output(); len(out) > 0 {
+				go rwc.Write(out) // the pipe is synchronous
+			}
+			c.events.Detached(c, rwc)
+		}
+	}
+}
+
+func (c *TestConn) finish(err error) {
+	c.closedBy(Local)
+	c.done = true
+	c.release()
+	c.logCapture(c, err)
+	if c.events.Closed != nil {
+		c.events.Closed(c, err)
+	}
+}
+
+func (c *TestConn) run(fn func() Action) {
+	c.mu.Lock()
+	c.cmds = append(c.cmds, fn)
+	c.mu.Unlock()
+}
+
+func (c *TestConn) shut() bool { return c.done }
+
+func (c *TestConn) wakeMessages() {
+	c.mu.Lock()
+	c.msgsup = true
+	c.mu.Unlock()
+}
+
+func (c *TestConn) Context() interface{}       { return c.ctx }
+func (c *TestConn) SetContext(ctx interface{}) { c.ctx = ctx }
+func (c *TestConn) AddrIndex() int             { return 0 }
+func (c *TestConn) ListenerAddr() net.Addr     { return loopbackAddr{} }
+func (c *TestConn) LocalAddr() net.Addr        { return loopbackAddr{} }
+func (c *TestConn) RemoteAddr() net.Addr       { return loopbackAddr{} }
+func (c *TestConn) Wake() {
+	if c.wake() {
+		c.mu.Lock()
+		c.wakes++
+		c.mu.Unlock()
+	}
+}
+func (c *TestConn) SetSendBuffer(n int) error { return ErrNotSupported }
+func (c *TestConn) SetRecvBuffer(n int) error { return ErrNotSupported }
+func (c *TestConn) SetNoDelay(bool) error     { return ErrNotSupported }
+func (c *TestConn) SetLinger(int) error       { return ErrNotSupported }
+func (c *TestConn) SetReuseInputBuffer(bool)  {}
+
+type loopbackAddr struct{}
+
+func (loopbackAddr) Network() string { return "loopback" }
+func (loopbackAddr) String() string  { return "loopback" }
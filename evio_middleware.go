@@ -0,0 +1,86 @@
+// Copyright 2018 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package evio
+
+import (
+	"fmt"
+	"log"
+	"runtime/debug"
+)
+
+// DataHandler is the signature of the Events.Data event.
+type DataHandler func(c Conn, in []byte) (out []byte, action Action)
+
+// DataMiddleware wraps a DataHandler, such as for logging, metrics or
+// authentication. It may transform the input before passing it to the next
+// handler, or return without calling next, such as with a Close action.
+type DataMiddleware func(next DataHandler) DataHandler
+
+// Chain composes the middlewares into one, the first middleware is the
+// outermost, so it sees the input first and the output last.
+//
+//	events.Data = evio.Chain(evio.Recover(nil), evio.Log(nil))(handler)
+func Chain(mws ...DataMiddleware) DataMiddleware {
+	return func(next DataHandler) DataHandler {
+		for i := len(mws) - 1; i >= 0; i-- {
+			next = mws[i](next)
+		}
+		return next
+	}
+}
+
+// Recover returns a middleware which recovers from a panic of the next
+// handlers and closes the connection. The onPanic is called with the
+// recovered value, or the value and the stack are logged when it's nil.
+func Recover(onPanic func(c Conn, v interface{})) DataMiddleware {
+	return func(next DataHandler) DataHandler {
+		return func(c Conn, in []byte) (out []byte, action Action) {
+			defer func() {
+				if v := recover(); v != nil {
+					if onPanic != nil {
+						onPanic(c, v)
+					} else {
+						log.Printf("evio: panic in data of %v: %v\n%s", c.RemoteAddr(), v, debug.Stack())
+					}
+					out, action = nil, Close
+				}
+			}()
+			return next(c, in)
+		}
+	}
+}
+
+// Log returns a middleware which logs the size of the input and the output
+// of every Data event, and the action. The logf is log.Printf when it's nil.
+func Log(logf func(format string, args ...interface{})) DataMiddleware {
+	if logf == nil {
+		logf = log.Printf
+	}
+	return func(next DataHandler) DataHandler {
+		return func(c Conn, in []byte) (out []byte, action Action) {
+			out, action = next(c, in)
+			event := "data"
+			if in == nil {
+				event = "wake"
+			}
+			logf("evio: %s %v in %d out %d%s", event, c.RemoteAddr(), len(in), len(out), actionSuffix(action))
+			return
+		}
+	}
+}
+
+func actionSuffix(action Action) string {
+	switch action {
+	case None:
+		return ""
+	case Detach:
+		return " detach"
+	case Close:
+		return " close"
+	case Shutdown:
+		return " shutdown"
+	}
+	return fmt.Sprintf(" action %d", action)
+}
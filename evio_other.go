@@ -28,6 +28,10 @@ func (ln *listener) system() error {
 	return nil
 }
 
+func (ln *listener) inherit() error {
+	return errors.New("inherited listeners are not available")
+}
+
 func serve(events Events, listeners []*listener) error {
 	return stdserve(events, listeners)
 }
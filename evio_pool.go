@@ -0,0 +1,136 @@
+// Copyright 2018 Ryan Liu. All rights reserved.
+// Bounded pool of the goroutines for the blocking work of the handlers
+
+package evio
+
+import (
+	"sync"
+	"time"
+)
+
+// Default max number of the running goroutines of Submit
+const DefaultPoolWorkers = 256
+
+type poolJob struct {
+	cs *connState // nil when the work is not tied to a connection
+	fn func()
+}
+
+var pool = struct {
+	sync.Mutex
+	workers int       // max running goroutines
+	queue   int       // max waiting jobs
+	running int       // running goroutines
+	jobs    []poolJob // waiting jobs
+	done    time.Time // end of the last job
+}{workers: DefaultPoolWorkers}
+
+// Change the size of the pool of Submit, up to workers functions run at once
+// and up to queue ones wait for them. The running functions are not stopped
+// when the workers are reduced, their goroutines exit after them
+func SetPoolSize(workers, queue int) {
+	if workers < 1 {
+		workers = 1
+	}
+	if queue < 0 {
+		queue = 0
+	}
+	pool.Lock()
+	pool.workers, pool.queue = workers, queue
+	pool.Unlock()
+}
+
+// Run the fn on a goroutine of the pool, such as the blocking work of a Data
+// event, which must not run on the loop. It returns false when the pool is
+// full, so the caller can shed the load, such as by closing the connection.
+// The fn which is still waiting is dropped when the connection is closed or
+// detached, a running one is not interrupted. The c can be nil for the work
+// which is not tied to a connection
+func Submit(c Conn, fn func()) bool {
+	job := poolJob{fn: fn}
+	if c != nil {
+		if sc, ok := c.(interface{ state() *connState }); ok {
+			job.cs = sc.state()
+			if job.released() {
+				return false
+			}
+		}
+	}
+	pool.Lock()
+	if pool.running < pool.workers {
+		pool.running++
+		pool.Unlock()
+		goLabeled("pool", func() { poolRun(job) })
+		return true
+	}
+	if len(pool.jobs) < pool.queue {
+		pool.jobs = append(pool.jobs, job)
+		pool.Unlock()
+		return true
+	}
+	pool.Unlock()
+	return false
+}
+
+// Get the number of the running goroutines and the waiting jobs of the pool
+func PoolStats() (running, waiting int) {
+	pool.Lock()
+	defer pool.Unlock()
+	return pool.running, len(pool.jobs)
+}
+
+// The health of the background goroutines of evio, such as for a health
+// check which detects a wedged pool, of which the waiting jobs grow while
+// the last job ended long ago
+type BackgroundStats struct {
+	PoolRunning int       // running goroutines of Submit
+	PoolWaiting int       // waiting jobs of Submit
+	PoolLastRun time.Time // end of the last job of Submit, zero before any
+
+	// The changes of sessions which are buffered for the Replicator, and
+	// the ones which are dropped, see ReplicationDropped
+	ReplicationPending int
+	ReplicationDropped uint64
+}
+
+// Get the health of the background goroutines, it only takes the locks of
+// the counters, so it's cheap to poll
+func BackgroundStatus() (st BackgroundStats) {
+	pool.Lock()
+	st.PoolRunning, st.PoolWaiting, st.PoolLastRun = pool.running, len(pool.jobs), pool.done
+	pool.Unlock()
+	st.ReplicationPending = replicationPending()
+	st.ReplicationDropped = ReplicationDropped()
+	return
+}
+
+// Run the job and then the waiting ones, until there is none or the workers
+// are reduced below the running goroutines
+func poolRun(job poolJob) {
+	for {
+		if !job.released() {
+			job.fn()
+		}
+		pool.Lock()
+		pool.done = time.Now()
+		if len(pool.jobs) == 0 || pool.running > pool.workers {
+			pool.running--
+			pool.Unlock()
+			return
+		}
+		job = pool.jobs[0]
+		pool.jobs[0] = poolJob{}
+		pool.jobs = pool.jobs[1:]
+		pool.Unlock()
+	}
+}
+
+// The connection of the job is closed or detached
+func (job poolJob) released() bool {
+	if job.cs == nil {
+		return false
+	}
+	job.cs.mu.Lock()
+	defer job.cs.mu.Unlock()
+	return job.cs.closed
+}
@@ -0,0 +1,116 @@
+// Copyright 2018 Ryan Liu. All rights reserved.
+// Presence of users, derived from the bound sessions
+
+package evio
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+var presence struct {
+	sync.Mutex
+	count int32 // number of subscriptions
+	subs  []*presenceSub
+}
+
+type presenceSub struct {
+	userKey  func(sess ISession) string
+	onChange func(key string, online bool)
+	keys     map[Conn]string // the counted key of every connection
+	counts   map[string]int  // number of live sessions by key
+}
+
+type presenceChange struct {
+	sub    *presenceSub
+	key    string
+	online bool
+}
+
+// Subscribe the presence of users, onChange is called when the count of
+// live sessions of a key changes from 0 to 1 (online) or from 1 to 0 (offline).
+// The session is ignored when userKey returns an empty key.
+func SubscribePresence(userKey func(sess ISession) string,
+	onChange func(key string, online bool)) (unsubscribe func()) {
+	sub := &presenceSub{
+		userKey:  userKey,
+		onChange: onChange,
+		keys:     make(map[Conn]string),
+		counts:   make(map[string]int),
+	}
+	presence.Lock()
+	presence.subs = append(presence.subs, sub)
+	atomic.AddInt32(&presence.count, 1)
+	presence.Unlock()
+	return func() {
+		presence.Lock()
+		defer presence.Unlock()
+		for i, s := range presence.subs {
+			if s == sub {
+				presence.subs = append(presence.subs[:i], presence.subs[i+1:]...)
+				atomic.AddInt32(&presence.count, -1)
+				return
+			}
+		}
+	}
+}
+
+// Count the session of connection, called after the session is bound,
+// a rebind with the same key does not change the presence
+func presenceBind(c Conn, sess ISession) {
+	if atomic.LoadInt32(&presence.count) == 0 {
+		return
+	}
+	var changes []presenceChange
+	presence.Lock()
+	for _, sub := range presence.subs {
+		key := sub.userKey(sess)
+		old, ok := sub.keys[c]
+		if ok && old == key {
+			continue
+		}
+		if ok {
+			changes = sub.dec(c, old, changes)
+		}
+		if key != "" {
+			sub.keys[c] = key
+			if sub.counts[key]++; sub.counts[key] == 1 {
+				changes = append(changes, presenceChange{sub, key, true})
+			}
+		}
+	}
+	presence.Unlock()
+	firePresence(changes)
+}
+
+// Uncount the session of connection, called after the session is destroyed
+func presenceUnbind(c Conn) {
+	if atomic.LoadInt32(&presence.count) == 0 {
+		return
+	}
+	var changes []presenceChange
+	presence.Lock()
+	for _, sub := range presence.subs {
+		if key, ok := sub.keys[c]; ok {
+			changes = sub.dec(c, key, changes)
+		}
+	}
+	presence.Unlock()
+	firePresence(changes)
+}
+
+func (sub *presenceSub) dec(c Conn, key string, changes []presenceChange) []presenceChange {
+	delete(sub.keys, c)
+	if sub.counts[key]--; sub.counts[key] <= 0 {
+		delete(sub.counts, key)
+		changes = append(changes, presenceChange{sub, key, false})
+	}
+	return changes
+}
+
+// The callbacks are called outside of the lock, they may bind sessions
+func firePresence(changes []presenceChange) {
+	for _, ch := range changes {
+		ch.sub.onChange(ch.key, ch.online)
+	}
+}
@@ -0,0 +1,116 @@
+// Copyright 2018 Ryan Liu. All rights reserved.
+// Topics of pub/sub, which are subscribed by the session ids
+
+package evio
+
+import "sync"
+
+var pubsub struct {
+	sync.RWMutex
+	topics map[string]map[string]struct{} // session ids of every topic
+	subs   map[string]map[string]struct{} // topics of every session id
+}
+
+// A published message, which is passed to Events.WokenMessage()
+type TopicMessage struct {
+	Topic   string
+	Payload []byte
+}
+
+// Subscribe the topic for the session id, which must be bound already,
+// the subscriptions are removed by DestroySession() of the session
+func Subscribe(id string, topic string) (success bool) {
+	if id == "" {
+		return
+	}
+	pubsub.Lock()
+	defer pubsub.Unlock()
+	// checked under the lock, so a destroy which removes the id from the
+	// registry first removes this subscription too, see pubsubRemove
+	if FindConnById(id) == nil {
+		return
+	}
+	if pubsub.topics == nil {
+		pubsub.topics = make(map[string]map[string]struct{})
+		pubsub.subs = make(map[string]map[string]struct{})
+	}
+	addMember(pubsub.topics, topic, id)
+	addMember(pubsub.subs, id, topic)
+	return true
+}
+
+// Unsubscribe the topic for the session id
+func Unsubscribe(id string, topic string) (found bool) {
+	pubsub.Lock()
+	defer pubsub.Unlock()
+	if _, found = pubsub.topics[topic][id]; found {
+		delMember(pubsub.topics, topic, id)
+		delMember(pubsub.subs, id, topic)
+	}
+	return
+}
+
+// Publish the payload to every subscriber of the topic, every connection
+// is woken with a TopicMessage, the payload is shared and must not be
+// changed after publishing. The delivered is the number of woken connections
+func Publish(topic string, payload []byte) (delivered int) {
+	labeled("publish", func() {
+		pubsub.RLock()
+		ids := make([]string, 0, len(pubsub.topics[topic]))
+		for id := range pubsub.topics[topic] {
+			ids = append(ids, id)
+		}
+		pubsub.RUnlock()
+		msg := TopicMessage{Topic: topic, Payload: payload}
+		for _, id := range ids {
+			if WakeWithMessage(id, msg) == nil {
+				delivered++
+			}
+		}
+	})()
+	return
+}
+
+// Move the subscriptions to the new id, called after the id is changed
+func pubsubRename(oldid, id string) {
+	pubsub.Lock()
+	defer pubsub.Unlock()
+	topics, ok := pubsub.subs[oldid]
+	if !ok {
+		return
+	}
+	delete(pubsub.subs, oldid)
+	for topic := range topics {
+		delMember(pubsub.topics, topic, oldid)
+		addMember(pubsub.topics, topic, id)
+		addMember(pubsub.subs, id, topic)
+	}
+}
+
+// Remove all of the subscriptions of the session id
+func pubsubRemove(id string) {
+	pubsub.Lock()
+	defer pubsub.Unlock()
+	for topic := range pubsub.subs[id] {
+		delMember(pubsub.topics, topic, id)
+	}
+	delete(pubsub.subs, id)
+}
+
+func addMember(sets map[string]map[string]struct{}, key, member string) {
+	set, ok := sets[key]
+	if !ok {
+		set = make(map[string]struct{})
+		sets[key] = set
+	}
+	set[member] = struct{}{}
+}
+
+func delMember(sets map[string]map[string]struct{}, key, member string) {
+	if set, ok := sets[key]; ok {
+		delete(set, member)
+		if len(set) == 0 {
+			delete(sets, key)
+		}
+	}
+}
@@ -0,0 +1,181 @@
+// Copyright 2018 Ryan Liu. All rights reserved.
+// Registry of the sessions, which is pluggable
+
+package evio
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// A registry of the connections by session id, all of the session functions
+// use the active one, see SetRegistry(). The methods must be safe for the
+// concurrent use. The functions of evio iterate by RangeSessions(), which
+// never calls the other methods from the fn of Range, so an implementation
+// can hold its lock during Range
+type Registry interface {
+	Load(id string) (c Conn, ok bool)
+	Store(id string, c Conn)
+	Delete(id string)
+	// Delete the id only when it's still bound to the connection
+	CompareAndDelete(id string, c Conn) (deleted bool)
+	Range(fn func(id string, c Conn) bool)
+	Len() int
+}
+
+// The default registry, which is a sync.Map with a counter
+type MapRegistry struct {
+	n int64 // number of the ids, first for 64-bit alignment
+	m sync.Map
+}
+
+func (r *MapRegistry) Load(id string) (Conn, bool) {
+	if v, ok := r.m.Load(id); ok {
+		return v.(Conn), true
+	}
+	return nil, false
+}
+
+func (r *MapRegistry) Store(id string, c Conn) {
+	if _, loaded := r.m.Swap(id, c); !loaded {
+		atomic.AddInt64(&r.n, 1)
+	}
+}
+
+func (r *MapRegistry) Delete(id string) {
+	if _, loaded := r.m.LoadAndDelete(id); loaded {
+		atomic.AddInt64(&r.n, -1)
+	}
+}
+
+func (r *MapRegistry) CompareAndDelete(id string, c Conn) bool {
+	if r.m.CompareAndDelete(id, c) {
+		atomic.AddInt64(&r.n, -1)
+		return true
+	}
+	return false
+}
+
+func (r *MapRegistry) Range(fn func(id string, c Conn) bool) {
+	r.m.Range(func(key, value interface{}) bool {
+		return fn(key.(string), value.(Conn))
+	})
+}
+
+func (r *MapRegistry) Len() int { return int(atomic.LoadInt64(&r.n)) }
+
+type registryBox struct{ Registry }
+
+var activeRegistry atomic.Value
+
+func init() { activeRegistry.Store(registryBox{&MapRegistry{}}) }
+
+// Install the registry, nil restores a new default one. The entries of the
+// old registry are not moved, so it's called before serving usually
+func SetRegistry(r Registry) {
+	if r == nil {
+		r = &MapRegistry{}
+	}
+	activeRegistry.Store(registryBox{r})
+}
+
+// Get the active registry
+func GetRegistry() Registry {
+	return activeRegistry.Load().(registryBox).Registry
+}
+
+type registryItem struct {
+	id string
+	c  Conn
+}
+
+// Call fn for the entries of the registry, until it returns false. The
+// entries are taken before the first call, so fn can bind and destroy the
+// sessions, including its own, or iterate again, without a deadlock. The
+// changes take effect on a subsequent iteration: a session which is bound by
+// fn is not visited, and an entry which is deleted by fn is still visited
+func RangeSessions(fn func(id string, c Conn) bool) {
+	var items []registryItem
+	GetRegistry().Range(func(id string, c Conn) bool {
+		items = append(items, registryItem{id, c})
+		return true
+	})
+	for _, item := range items {
+		if !fn(item.id, item.c) {
+			return
+		}
+	}
+}
+
+var watermarks struct {
+	sync.Mutex
+	count int32 // number of the watermarks
+	marks []*watermark
+}
+
+type watermark struct {
+	high, low     int
+	onHigh, onLow func(count int)
+	above         bool // the count has reached high, and not fallen to low since
+}
+
+type watermarkCall struct {
+	fn    func(count int)
+	count int
+}
+
+// Watch the number of the sessions in the registry, onHigh is called when it
+// rises to high, and onLow when it falls to low after that, such as for the
+// signals of autoscaling. The low must be below high, so a count between them
+// never flaps between the callbacks. Either callback can be nil. A count which
+// is at high already when it's registered doesn't call onHigh until it has
+// fallen to low. The callbacks are called after a session is bound or
+// destroyed, on the goroutine of it
+func RegisterWatermark(high, low int, onHigh, onLow func(count int)) (unregister func()) {
+	if low >= high {
+		low = high - 1
+	}
+	mark := &watermark{high: high, low: low, onHigh: onHigh, onLow: onLow}
+	watermarks.Lock()
+	mark.above = GetRegistry().Len() >= high
+	watermarks.marks = append(watermarks.marks, mark)
+	atomic.AddInt32(&watermarks.count, 1)
+	watermarks.Unlock()
+	return func() {
+		watermarks.Lock()
+		defer watermarks.Unlock()
+		for i, m := range watermarks.marks {
+			if m == mark {
+				watermarks.marks = append(watermarks.marks[:i], watermarks.marks[i+1:]...)
+				atomic.AddInt32(&watermarks.count, -1)
+				return
+			}
+		}
+	}
+}
+
+// Check the watermarks against the count of registry, called after the
+// sessions are bound or destroyed
+func watermarkCheck() {
+	if atomic.LoadInt32(&watermarks.count) == 0 {
+		return
+	}
+	var calls []watermarkCall
+	watermarks.Lock()
+	n := GetRegistry().Len()
+	for _, m := range watermarks.marks {
+		if !m.above && n >= m.high {
+			m.above = true
+			calls = append(calls, watermarkCall{m.onHigh, n})
+		} else if m.above && n <= m.low {
+			m.above = false
+			calls = append(calls, watermarkCall{m.onLow, n})
+		}
+	}
+	watermarks.Unlock()
+	for _, call := range calls {
+		if call.fn != nil {
+			call.fn(call.count)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+// Copyright 2018 Ryan Liu. All rights reserved.
+// Replication of the sessions to a standby registry
+
+package evio
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Size of the buffer of the replication, the changes over it are dropped
+const replicaBuffer = 4096
+
+// A session which can be replicated, the data is passed to Replicator.OnBind
+type IMarshalSession interface {
+	ISession
+	Marshal() ([]byte, error)
+}
+
+// A mirror of the binds and destroys of sessions, such as to a standby node.
+// The methods are called on a separate goroutine in the order of changes
+type Replicator interface {
+	OnBind(id string, data []byte)
+	OnDestroy(id string)
+}
+
+// A replicator which does nothing, it's the default
+type NopReplicator struct{}
+
+func (NopReplicator) OnBind(id string, data []byte) {}
+func (NopReplicator) OnDestroy(id string)           {}
+
+// A change of session, which is sent by ChanReplicator
+type ReplicaEvent struct {
+	Id        string
+	Data      []byte
+	Destroyed bool
+}
+
+// A replicator which sends the changes to a channel, it's a reference for
+// the real replicators and useful for tests
+type ChanReplicator struct {
+	C chan ReplicaEvent
+}
+
+func NewChanReplicator(size int) *ChanReplicator {
+	return &ChanReplicator{C: make(chan ReplicaEvent, size)}
+}
+
+func (r *ChanReplicator) OnBind(id string, data []byte) {
+	r.C <- ReplicaEvent{Id: id, Data: data}
+}
+
+func (r *ChanReplicator) OnDestroy(id string) {
+	r.C <- ReplicaEvent{Id: id, Destroyed: true}
+}
+
+var replication struct {
+	dropped uint64 // changes dropped, first for 64-bit alignment
+	active  int32  // a replicator is set
+	sync.Mutex
+	ops chan replicaOp
+}
+
+type replicaOp struct {
+	id      string
+	data    []byte
+	destroy bool
+}
+
+// Set the replicator of the session changes, nil stops the replication.
+// The changes are buffered and flushed asynchronously, so the loops are
+// never blocked, it's best-effort that the changes are dropped when the
+// buffer is full. The buffered changes of the old replicator are flushed
+func SetReplicator(r Replicator) {
+	replication.Lock()
+	defer replication.Unlock()
+	if replication.ops != nil {
+		close(replication.ops)
+		replication.ops = nil
+	}
+	if _, ok := r.(NopReplicator); ok || r == nil {
+		atomic.StoreInt32(&replication.active, 0)
+		return
+	}
+	ops := make(chan replicaOp, replicaBuffer)
+	goLabeled("replication", func() {
+		for op := range ops {
+			if op.destroy {
+				r.OnDestroy(op.id)
+			} else {
+				r.OnBind(op.id, op.data)
+			}
+		}
+	})
+	replication.ops = ops
+	atomic.StoreInt32(&replication.active, 1)
+}
+
+// Get the number of changes which are dropped, because the buffer is full
+// or the session can not be marshaled
+func ReplicationDropped() uint64 {
+	return atomic.LoadUint64(&replication.dropped)
+}
+
+// Get the number of changes which are buffered for the replicator
+func replicationPending() int {
+	replication.Lock()
+	defer replication.Unlock()
+	return len(replication.ops)
+}
+
+// Replicate the bind of session, the session state is marshaled when it
+// implements IMarshalSession
+func replicateBind(sess ISession) {
+	if atomic.LoadInt32(&replication.active) == 0 {
+		return
+	}
+	op := replicaOp{id: sess.GetId()}
+	if ms, ok := sess.(IMarshalSession); ok {
+		data, err := ms.Marshal()
+		if err != nil {
+			atomic.AddUint64(&replication.dropped, 1)
+			return
+		}
+		op.data = data
+	}
+	replicate(op)
+}
+
+// Replicate the destroy of session
+func replicateDestroy(id string) {
+	if atomic.LoadInt32(&replication.active) == 0 {
+		return
+	}
+	replicate(replicaOp{id: id, destroy: true})
+}
+
+func replicate(op replicaOp) {
+	replication.Lock()
+	defer replication.Unlock()
+	if replication.ops == nil {
+		return
+	}
+	select {
+	case replication.ops <- op:
+	default:
+		atomic.AddUint64(&replication.dropped, 1)
+	}
+}
@@ -1,5 +1,6 @@
 // Copyright 2018 Ryan Liu. All rights reserved.
-// A session interface with id of a string
+// A session interface with id of a string, which is any non-empty string,
+// the bytes are compared as they are, so a binary id works as a text one
 
 /*
 Example:
@@ -64,8 +65,9 @@ func ReloadSession(c evio.Conn, newid string) (sess *Session, oldid string) {
 		sess = NewSession()
 	}
 	if oldid != newid {
-		sess.SetId(newid)
+		// Always change the id through evio, keep the registry in sync
 		evio.BindSession(c, sess)
+		evio.RebindSessionId(c, newid)
 	}
 	return
 }
@@ -112,25 +114,120 @@ func main() {
 
 package evio
 
-import "sync"
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrSessionTimeout is returned by WaitForSession when no session is bound
+var ErrSessionTimeout = errors.New("session wait timeout")
+
+// ErrEmptyID is returned by TryBindSession when the id of session is empty
+var ErrEmptyID = errors.New("empty session id")
 
-// Conn map, use session id as the key
-var registry sync.Map
+// ErrSessionExists is returned by SwapSession and CommitSession when the new
+// id is bound to another connection
+var ErrSessionExists = errors.New("session id in use")
 
-// A session interface
+// ErrSessionCommitted is returned by CommitSession when the connection has
+// a session already
+var ErrSessionCommitted = errors.New("session committed already")
+
+// Signal the waiters of WaitForSession, after a session is bound
+var bindings = sync.NewCond(&sync.Mutex{})
+
+// Serialize DisplaceByUser, so a user never has two live sessions
+var displaceMu sync.Mutex
+
+// Serialize SwapSession and the moves of ids, so two of them never take the
+// same id
+var swapMu sync.Mutex
+
+// A session interface, the id is the key of the registry, it may be binary,
+// such as the 16 bytes of an ULID, but not empty
 type ISession interface {
 	GetId() string
 	SetId(id string)
 }
 
+type debugLogf struct {
+	logf func(format string, args ...interface{})
+}
+
+var sessionDebug atomic.Value
+
+func init() { sessionDebug.Store(debugLogf{}) }
+
+// Log the sessions with an empty id, which are not found by the id, such as
+// a bug of the id generator. The logf is log.Printf usually, nil disables it
+func SetSessionDebug(logf func(format string, args ...interface{})) {
+	sessionDebug.Store(debugLogf{logf})
+}
+
+// Log the session with an empty id in the debug mode
+func debugEmptyId(where string, sess ISession) {
+	if logf := sessionDebug.Load().(debugLogf).logf; logf != nil {
+		logf("evio: empty session id in %s of %T", where, sess)
+	}
+}
+
 // Get connection
 func FindConnById(id string) Conn {
-	if c, ok := registry.Load(id); ok {
-		return c.(Conn)
+	if c, ok := GetRegistry().Load(id); ok {
+		return c
 	}
 	return nil
 }
 
+// Wait for the session of id to be bound, it returns immediately when the
+// session exists, or ErrSessionTimeout after the timeout elapses
+func WaitForSession(id string, timeout time.Duration) (Conn, error) {
+	if c := FindConnById(id); c != nil {
+		return c, nil
+	}
+	expired := timeout <= 0
+	if !expired {
+		timer := time.AfterFunc(timeout, labeled("timer", func() {
+			bindings.L.Lock()
+			expired = true
+			bindings.L.Unlock()
+			bindings.Broadcast()
+		}))
+		defer timer.Stop()
+	}
+	bindings.L.Lock()
+	defer bindings.L.Unlock()
+	for {
+		if c := FindConnById(id); c != nil {
+			return c, nil
+		}
+		if expired {
+			return nil, ErrSessionTimeout
+		}
+		bindings.Wait()
+	}
+}
+
+// Wake the waiters of WaitForSession, the lock orders it after their checks
+func notifyBound() {
+	bindings.L.Lock()
+	bindings.L.Unlock()
+	bindings.Broadcast()
+}
+
+// Deliver a typed message to the Events.WokenMessage() of the connection,
+// the messages are queued until the loop of connection takes them,
+// ErrWakeQueueFull is returned when Options.MaxPendingWakes is reached
+func WakeWithMessage(id string, msg interface{}) error {
+	c := FindConnById(id)
+	if c == nil {
+		return ErrConnClosed
+	}
+	return wakeMessage(c, msg)
+}
+
 // Get session of current connection
 func GetSession(c Conn) interface{} {
 	if c == nil {
@@ -139,13 +236,18 @@ func GetSession(c Conn) interface{} {
 	return c.Context()
 }
 
-// Get only the id of session
+// Get only the id of session, it is empty when the context is not a session,
+// such as the state of a handshake before CommitSession
 func GetSessionId(cxt interface{}) string {
 	if cxt == nil {
 		return ""
 	}
-	if sess := cxt.(ISession); sess != nil {
-		return sess.GetId()
+	if sess, ok := cxt.(ISession); ok && sess != nil {
+		id := sess.GetId()
+		if id == "" {
+			debugEmptyId("GetSessionId", sess)
+		}
+		return id
 	}
 	return ""
 }
@@ -162,20 +264,54 @@ func SaveSession(c Conn, sess ISession) string {
 	return id
 }
 
-// Create session with a connection, called by Events.Opened() usually
+// Create session with a connection, called by Events.Opened() usually,
+// binding the same id to the same connection again keeps the registry intact.
+// The success is false when the bind is refused, see TryBindSession
 func BindSession(c Conn, sess ISession) (success bool) {
+	return TryBindSession(c, sess) == nil
+}
+
+// Bind the session like BindSession, and tell the reason of a refused bind.
+// ErrEmptyID is returned when the id of session is empty, the connection is
+// kept as it is then, and ErrConnClosed when the connection is nil
+func TryBindSession(c Conn, sess ISession) error {
 	if c == nil {
-		return
+		return ErrConnClosed
+	}
+	if sess.GetId() == "" {
+		debugEmptyId("BindSession", sess)
+		return ErrEmptyID
 	}
 	cxt := GetSession(c)
-	if id := GetSessionId(cxt); id != "" {
-		registry.Delete(id)
+	if oldid := GetSessionId(cxt); oldid != "" && oldid != sess.GetId() {
+		// the old id may be bound to another connection since, keep it then
+		if v, ok := GetRegistry().Load(oldid); !ok || v == c {
+			GetRegistry().CompareAndDelete(oldid, c)
+			pubsubRemove(oldid)
+			inboxRemove(oldid)
+			replicateDestroy(oldid)
+		}
 	}
-	if id := SaveSession(c, sess); id != "" {
-		registry.Store(id, c)
-		success = true
+	id := SaveSession(c, sess)
+	if v, ok := GetRegistry().Load(id); !ok || v != c {
+		GetRegistry().Store(id, c)
+		notifyBound()
+		inboxDrain(id)
+		watermarkCheck()
 	}
-	return
+	presenceBind(c, sess)
+	replicateBind(sess)
+	return nil
+}
+
+// Create session with the remote address as id, it's useful for the virtual
+// connections of UDP, which have no other identity
+func BindSessionByAddr(c Conn, sess ISession) error {
+	if c == nil || c.RemoteAddr() == nil {
+		return ErrConnClosed
+	}
+	sess.SetId(c.RemoteAddr().String())
+	return TryBindSession(c, sess)
 }
 
 // Destroy session, called by Events.Closed() usually
@@ -185,9 +321,209 @@ func DestroySession(c Conn) (found bool) {
 		return
 	}
 	if id := GetSessionId(cxt); id != "" {
-		registry.Delete(id)
+		// the id may be bound to another connection since, keep it then
+		if v, ok := GetRegistry().Load(id); !ok || v == c {
+			GetRegistry().CompareAndDelete(id, c)
+			pubsubRemove(id)
+			inboxRemove(id)
+			replicateDestroy(id)
+			watermarkCheck()
+		}
 		found = true
 	}
 	c.SetContext(nil)
+	presenceUnbind(c)
+	indexRemove(c)
+	return
+}
+
+// Change the id of session, and move the connection to the new id in registry.
+// The success is false when the new id is bound to another connection, and
+// the session is kept as it is then
+func RebindSessionId(c Conn, id string) (success bool) {
+	sess, ok := GetSession(c).(ISession)
+	if !ok || id == "" {
+		return
+	}
+	swapMu.Lock()
+	defer swapMu.Unlock()
+	if v, ok := GetRegistry().Load(id); ok && v != c {
+		return
+	}
+	if oldid := sess.GetId(); oldid != "" && oldid != id {
+		GetRegistry().CompareAndDelete(oldid, c)
+		pubsubRename(oldid, id)
+		inboxRename(oldid, id)
+		replicateDestroy(oldid)
+	}
+	sess.SetId(id)
+	GetRegistry().Store(id, c)
+	notifyBound()
+	inboxDrain(id)
+	presenceBind(c, sess)
+	replicateBind(sess)
+	return true
+}
+
+// Replace the session of connection with another one, such as a guest
+// session which is upgraded after the authentication. The registry is kept
+// when the id is the same, otherwise the connection is moved to the new id
+// like RebindSessionId, the new id is bound before the old one is removed,
+// so the connection is always found. ErrSessionExists is returned when the
+// new id is bound to another connection. It binds the session when the
+// connection has none
+func SwapSession(c Conn, sess ISession) error {
+	if c == nil {
+		return ErrConnClosed
+	}
+	id := sess.GetId()
+	if id == "" {
+		debugEmptyId("SwapSession", sess)
+		return ErrEmptyID
+	}
+	swapMu.Lock()
+	defer swapMu.Unlock()
+	if v, ok := GetRegistry().Load(id); ok && v != c {
+		return ErrSessionExists
+	}
+	old, ok := GetSession(c).(ISession)
+	if !ok {
+		return TryBindSession(c, sess)
+	}
+	oldid := old.GetId()
+	c.SetContext(sess)
+	if oldid != id {
+		GetRegistry().Store(id, c)
+		if oldid != "" {
+			GetRegistry().CompareAndDelete(oldid, c)
+			pubsubRename(oldid, id)
+			inboxRename(oldid, id)
+			replicateDestroy(oldid)
+		}
+		notifyBound()
+		inboxDrain(id)
+	}
+	presenceBind(c, sess)
+	replicateBind(sess)
+	return nil
+}
+
+// Bind the session of a staged connection, which has been served without a
+// session until the identity is established, such as after a handshake of
+// several messages, so the registry never holds the throwaway ids. It's
+// called from an event of the connection, and cancels Options.DeferSession,
+// so Events.FirstData doesn't bind another session. ErrSessionCommitted is
+// returned when the connection has a session already, ErrSessionExists when
+// the id is bound to another connection, and ErrConnClosed when the
+// connection is closed, such as during a slow handshake
+func CommitSession(c Conn, sess ISession) error {
+	if c == nil {
+		return ErrConnClosed
+	}
+	id := sess.GetId()
+	if id == "" {
+		debugEmptyId("CommitSession", sess)
+		return ErrEmptyID
+	}
+	if _, ok := GetSession(c).(ISession); ok {
+		return ErrSessionCommitted
+	}
+	swapMu.Lock()
+	defer swapMu.Unlock()
+	if v, ok := GetRegistry().Load(id); ok && v != c {
+		return ErrSessionExists
+	}
+	if sc, ok := c.(interface{ state() *connState }); ok {
+		cs := sc.state()
+		cs.mu.Lock()
+		closed := cs.closed
+		cs.mu.Unlock()
+		if closed {
+			return ErrConnClosed
+		}
+		cs.deferred = false
+	}
+	return TryBindSession(c, sess)
+}
+
+// Repair the entries which key is different from the id of session,
+// it happens when ISession.SetId() is called without RebindSessionId().
+// The entries which id is bound to another connection are skipped, and kept
+// as they are
+func ReconcileRegistry() (repaired, skipped int) {
+	labeled("registry", func() {
+		swapMu.Lock()
+		defer swapMu.Unlock()
+		reg := GetRegistry()
+		RangeSessions(func(key string, c Conn) bool {
+			id := ""
+			if sess, ok := GetSession(c).(ISession); ok {
+				id = sess.GetId()
+			}
+			if id != key {
+				if v, ok := reg.Load(id); ok && v != c {
+					skipped++
+					return true
+				}
+				reg.CompareAndDelete(key, c)
+				if id != "" {
+					reg.Store(id, c)
+				}
+				repaired++
+			}
+			return true
+		})
+	})()
+	return
+}
+
+// Close the connections of matched sessions in a single pass of registry,
+// the reason is sent to the connection before closing, and the Closed event
+// will be fired on the loop of connection
+func DestroyMatching(match func(sess ISession) bool, reason []byte) (killed int) {
+	labeled("registry", func() {
+		reg := GetRegistry()
+		RangeSessions(func(key string, c Conn) bool {
+			if sess, ok := GetSession(c).(ISession); ok && match(sess) {
+				reg.Delete(key)
+				if closeAfter(c, reason) {
+					killed++
+				}
+			}
+			return true
+		})
+	})()
+	return
+}
+
+// Bind the session in the context of newConn, after closing the connections
+// of the other sessions of the same user, such as when a user logs in twice.
+// The notice is sent to the old connections before closing. The keyOf
+// extracts the user key of a session, the sessions of an empty key are
+// never displaced
+func DisplaceByUser(userKey string, newConn Conn, notice []byte,
+	keyOf func(sess ISession) string) (displaced int) {
+	sess, ok := GetSession(newConn).(ISession)
+	if !ok || userKey == "" {
+		return
+	}
+	displaceMu.Lock()
+	defer displaceMu.Unlock()
+	labeled("registry", func() {
+		reg := GetRegistry()
+		RangeSessions(func(key string, c Conn) bool {
+			if c == newConn {
+				return true
+			}
+			if old, ok := GetSession(c).(ISession); ok && keyOf(old) == userKey {
+				reg.CompareAndDelete(key, c)
+				if closeAfter(c, notice) {
+					displaced++
+				}
+			}
+			return true
+		})
+	})()
+	BindSession(newConn, sess)
 	return
 }
@@ -0,0 +1,1788 @@
+// Copyright 2018 Ryan Liu. All rights reserved.
+// A session interface with id of a string
+
+package evio
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type testSession struct {
+	id string
+}
+
+func (sess *testSession) GetId() string   { return sess.id }
+func (sess *testSession) SetId(id string) { sess.id = id }
+
+// A connection only has the context, other methods are not implemented
+type testConn struct {
+	Conn
+	ctx interface{}
+}
+
+func (c *testConn) Context() interface{}       { return c.ctx }
+func (c *testConn) SetContext(ctx interface{}) { c.ctx = ctx }
+
+func TestReconcileRegistry(t *testing.T) {
+	c := &testConn{}
+	sess := &testSession{id: "reconcile-1"}
+	if err := TryBindSession(c, sess); err != nil {
+		t.Fatal(err)
+	}
+	defer DestroySession(c)
+	sess.SetId("reconcile-2") // bypass the registry
+	if FindConnById("reconcile-2") != nil {
+		t.Fatal("expected divergent registry")
+	}
+	if n, _ := ReconcileRegistry(); n != 1 {
+		t.Fatalf("expected 1 repaired, got %d", n)
+	}
+	if FindConnById("reconcile-1") != nil {
+		t.Fatal("expected stale id removed")
+	}
+	if FindConnById("reconcile-2") != c {
+		t.Fatal("expected repaired id")
+	}
+	if n, _ := ReconcileRegistry(); n != 0 {
+		t.Fatalf("expected 0 repaired, got %d", n)
+	}
+
+	// the id of another connection is not taken over
+	other := &testConn{}
+	BindSession(other, &testSession{id: "reconcile-3"})
+	defer DestroySession(other)
+	sess.SetId("reconcile-3")
+	if n, skipped := ReconcileRegistry(); n != 0 || skipped != 1 {
+		t.Fatalf("expected 1 skipped, got %d repaired and %d skipped", n, skipped)
+	}
+	if FindConnById("reconcile-3") != other || FindConnById("reconcile-2") != c {
+		t.Fatal("expected the entries kept")
+	}
+	sess.SetId("reconcile-2")
+}
+
+func TestRebindSessionId(t *testing.T) {
+	c := &testConn{}
+	BindSession(c, &testSession{id: "rebind-1"})
+	defer DestroySession(c)
+	if !RebindSessionId(c, "rebind-2") {
+		t.Fatal("expected rebind success")
+	}
+	if FindConnById("rebind-1") != nil || FindConnById("rebind-2") != c {
+		t.Fatal("expected connection moved to the new id")
+	}
+	if GetSessionId(GetSession(c)) != "rebind-2" {
+		t.Fatal("expected session id changed")
+	}
+	other := &testConn{}
+	BindSession(other, &testSession{id: "rebind-3"})
+	defer DestroySession(other)
+	if RebindSessionId(c, "rebind-3") {
+		t.Fatal("expected the id of another connection refused")
+	}
+	if FindConnById("rebind-2") != c || FindConnById("rebind-3") != other {
+		t.Fatal("expected the registry kept")
+	}
+	if GetSessionId(GetSession(c)) != "rebind-2" {
+		t.Fatal("expected session id kept")
+	}
+}
+
+// fakeRegistry records the stored ids
+type fakeRegistry struct {
+	MapRegistry
+	stored []string
+}
+
+func (r *fakeRegistry) Store(id string, c Conn) {
+	r.stored = append(r.stored, id)
+	r.MapRegistry.Store(id, c)
+}
+
+func TestSetRegistry(t *testing.T) {
+	r := &fakeRegistry{}
+	SetRegistry(r)
+	defer SetRegistry(nil)
+	c := &testConn{}
+	BindSession(c, &testSession{id: "fake-1"})
+	if len(r.stored) != 1 || r.stored[0] != "fake-1" || r.Len() != 1 {
+		t.Fatalf("expected the bind routed to the registry, got %v", r.stored)
+	}
+	if FindConnById("fake-1") != c {
+		t.Fatal("expected the connection found in the registry")
+	}
+	DestroySession(c)
+	if r.Len() != 0 {
+		t.Fatal("expected the id deleted from the registry")
+	}
+}
+
+// lockedRegistry holds its lock during Range, like a registry of striped
+// locks, so a mutation from the fn of Range would deadlock
+type lockedRegistry struct {
+	mu sync.Mutex
+	m  map[string]Conn
+}
+
+func (r *lockedRegistry) Load(id string) (Conn, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	c, ok := r.m[id]
+	return c, ok
+}
+
+func (r *lockedRegistry) Store(id string, c Conn) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.m[id] = c
+}
+
+func (r *lockedRegistry) Delete(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.m, id)
+}
+
+func (r *lockedRegistry) CompareAndDelete(id string, c Conn) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.m[id] != c {
+		return false
+	}
+	delete(r.m, id)
+	return true
+}
+
+func (r *lockedRegistry) Range(fn func(id string, c Conn) bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for id, c := range r.m {
+		if !fn(id, c) {
+			return
+		}
+	}
+}
+
+func (r *lockedRegistry) Len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.m)
+}
+
+func TestRangeSessionsMutation(t *testing.T) {
+	SetRegistry(&lockedRegistry{m: make(map[string]Conn)})
+	defer SetRegistry(nil)
+	conns := make(map[string]*testConn)
+	for _, id := range []string{"range-a", "range-b", "range-c"} {
+		conns[id] = &testConn{}
+		BindSession(conns[id], &testSession{id: id})
+	}
+	added := &testConn{}
+	var visited []string
+	RangeSessions(func(id string, c Conn) bool {
+		visited = append(visited, id)
+		if id == "range-a" {
+			BindSession(added, &testSession{id: "range-d"}) // add
+			DestroySession(conns["range-b"])                // delete another
+			var n int
+			RangeSessions(func(id string, c Conn) bool { n++; return true })
+			if n != 3 {
+				t.Errorf("expected 3 entries in the nested range, got %d", n)
+			}
+			DestroySession(c) // delete self
+		}
+		return true
+	})
+	sort.Strings(visited)
+	if strings.Join(visited, ",") != "range-a,range-b,range-c" {
+		t.Fatalf("expected the entries before the range visited, got %v", visited)
+	}
+	if FindConnById("range-a") != nil || FindConnById("range-b") != nil || FindConnById("range-d") != added {
+		t.Fatal("expected the mutations applied after the range")
+	}
+	// the iterations of evio mutate the registry too
+	if n, _ := ReconcileRegistry(); n != 0 {
+		t.Fatalf("expected nothing to repair, got %d", n)
+	}
+	DestroyMatching(func(sess ISession) bool { return sess.GetId() == "range-c" }, nil)
+	if FindConnById("range-c") != nil || GetRegistry().Len() != 1 {
+		t.Fatal("expected the matched session destroyed")
+	}
+	DestroySession(added)
+	for _, c := range conns {
+		DestroySession(c)
+	}
+}
+
+func TestWaitForSession(t *testing.T) {
+	c := &testConn{}
+	go func() {
+		time.Sleep(time.Second / 20)
+		BindSession(c, &testSession{id: "wait-1"})
+	}()
+	defer DestroySession(c)
+	start := time.Now()
+	if found, err := WaitForSession("wait-1", time.Second); err != nil || found != c {
+		t.Fatalf("expected the bound connection, got %v, %v", found, err)
+	}
+	if time.Since(start) >= time.Second {
+		t.Fatal("expected woken by the bind, not the timeout")
+	}
+	// the existing session is returned immediately
+	if found, err := WaitForSession("wait-1", 0); err != nil || found != c {
+		t.Fatalf("expected the bound connection, got %v, %v", found, err)
+	}
+	if _, err := WaitForSession("wait-2", time.Second/20); err != ErrSessionTimeout {
+		t.Fatalf("expected %v, got %v", ErrSessionTimeout, err)
+	}
+}
+
+func TestSubscribePresence(t *testing.T) {
+	var changes []string
+	unsubscribe := SubscribePresence(func(sess ISession) string {
+		return strings.SplitN(sess.GetId(), "/", 2)[0]
+	}, func(key string, online bool) {
+		changes = append(changes, fmt.Sprintf("%s:%v", key, online))
+	})
+	defer unsubscribe()
+	c1, c2 := &testConn{}, &testConn{}
+	sess := &testSession{id: "alice/1"}
+	BindSession(c1, sess)
+	BindSession(c1, sess) // rebind does not flap
+	BindSession(c2, &testSession{id: "alice/2"})
+	DestroySession(c1)
+	RebindSessionId(c2, "bob/2")
+	DestroySession(c2)
+	expected := "alice:true alice:false bob:true bob:false"
+	if got := strings.Join(changes, " "); got != expected {
+		t.Fatalf("expected '%s', got '%s'", expected, got)
+	}
+}
+
+func TestDestroyMatching(t *testing.T) {
+	t.Run("poll", func(t *testing.T) {
+		testDestroyMatching("tcp", ":9991", false)
+	})
+	t.Run("stdlib", func(t *testing.T) {
+		testDestroyMatching("tcp", ":9992", true)
+	})
+}
+
+func testDestroyMatching(network, addr string, stdlib bool) {
+	var opened, kicked int32
+	var events Events
+	events.Opened = func(c Conn) (out []byte, opts Options, action Action) {
+		n := atomic.AddInt32(&opened, 1)
+		tenant := "a"
+		if n == 3 {
+			tenant = "b"
+		}
+		BindSession(c, &testSession{id: fmt.Sprintf("%s/%d", tenant, n)})
+		out = []byte(tenant + "\n")
+		return
+	}
+	events.Closed = func(c Conn, err error) (action Action) {
+		DestroySession(c)
+		return
+	}
+	events.Serving = func(srv Server) (action Action) {
+		for i := 0; i < 3; i++ {
+			go func() {
+				conn, err := net.Dial(network, addr)
+				must(err)
+				defer conn.Close()
+				rd := bufio.NewReader(conn)
+				tenant, err := rd.ReadString('\n')
+				must(err)
+				if tenant == "a\n" {
+					if line, _ := rd.ReadString('\n'); line != "bye\n" {
+						panic("expected the reason")
+					}
+					if _, err := rd.ReadByte(); err == nil {
+						panic("expected error")
+					}
+					atomic.AddInt32(&kicked, 1)
+				} else {
+					time.Sleep(time.Second / 2)
+				}
+			}()
+		}
+		return
+	}
+	var killed int
+	events.Tick = func() (delay time.Duration, action Action) {
+		delay = time.Second / 20
+		if killed == 0 && atomic.LoadInt32(&opened) == 3 {
+			killed = DestroyMatching(func(sess ISession) bool {
+				return strings.HasPrefix(sess.GetId(), "a/")
+			}, []byte("bye\n"))
+			if killed != 2 {
+				panic(fmt.Sprintf("expected 2 killed, got %d", killed))
+			}
+		}
+		if atomic.LoadInt32(&kicked) == 2 {
+			if FindConnById("b/3") == nil {
+				panic("expected b/3 alive")
+			}
+			action = Shutdown
+		}
+		return
+	}
+	if stdlib {
+		must(Serve(events, network+"-net://"+addr))
+	} else {
+		must(Serve(events, network+"://"+addr))
+	}
+}
+
+func TestWakeWithMessage(t *testing.T) {
+	t.Run("poll", func(t *testing.T) {
+		testWakeWithMessage("tcp", ":9991", false)
+	})
+	t.Run("stdlib", func(t *testing.T) {
+		testWakeWithMessage("tcp", ":9992", true)
+	})
+	if err := WakeWithMessage("nobody", 0); err != ErrConnClosed {
+		t.Fatalf("expected ErrConnClosed, got %v", err)
+	}
+}
+
+func testWakeWithMessage(network, addr string, stdlib bool) {
+	type message struct{ n int }
+	var opened, done int32
+	var events Events
+	events.Opened = func(c Conn) (out []byte, opts Options, action Action) {
+		BindSession(c, &testSession{id: "user"})
+		atomic.StoreInt32(&opened, 1)
+		return
+	}
+	events.WokenMessage = func(c Conn, msg interface{}) (out []byte, action Action) {
+		return []byte(fmt.Sprintf("%d\n", msg.(*message).n)), None
+	}
+	events.Closed = func(c Conn, err error) (action Action) {
+		DestroySession(c)
+		return
+	}
+	events.Serving = func(srv Server) (action Action) {
+		go func() {
+			conn, err := net.Dial(network, addr)
+			must(err)
+			defer conn.Close()
+			rd := bufio.NewReader(conn)
+			for i := 1; i <= 3; i++ {
+				line, err := rd.ReadString('\n')
+				must(err)
+				if line != fmt.Sprintf("%d\n", i) {
+					panic(fmt.Sprintf("expected %d, got %q", i, line))
+				}
+			}
+			atomic.StoreInt32(&done, 1)
+		}()
+		return
+	}
+	var woken bool
+	events.Tick = func() (delay time.Duration, action Action) {
+		if !woken && atomic.LoadInt32(&opened) == 1 {
+			// all of the messages must be queued, none is overwritten
+			for i := 1; i <= 3; i++ {
+				must(WakeWithMessage("user", &message{i}))
+			}
+			woken = true
+		}
+		if atomic.LoadInt32(&done) == 1 {
+			action = Shutdown
+		}
+		return time.Second / 20, action
+	}
+	if stdlib {
+		must(Serve(events, network+"-net://"+addr))
+	} else {
+		must(Serve(events, network+"://"+addr))
+	}
+}
+
+func TestMaxPendingWakes(t *testing.T) {
+	t.Run("poll", func(t *testing.T) {
+		testMaxPendingWakes("tcp", ":9991", false)
+	})
+	t.Run("stdlib", func(t *testing.T) {
+		testMaxPendingWakes("tcp", ":9992", true)
+	})
+	var cs connState
+	cs.setMaxWakes(Options{MaxPendingWakes: 2})
+	if !cs.wake() || !cs.wake() || cs.wake() {
+		t.Fatal("expected the third wake dropped")
+	}
+	cs.woke()
+	if n := cs.pendingWakes(); n != 1 {
+		t.Fatalf("expected 1 pending wake, got %d", n)
+	}
+}
+
+func testMaxPendingWakes(network, addr string, stdlib bool) {
+	var opened, done int32
+	var events Events
+	events.Opened = func(c Conn) (out []byte, opts Options, action Action) {
+		BindSession(c, &testSession{id: "user"})
+		opts.MaxPendingWakes = 2
+		atomic.StoreInt32(&opened, 1)
+		return
+	}
+	events.WokenMessage = func(c Conn, msg interface{}) (out []byte, action Action) {
+		return []byte(msg.(string)), None
+	}
+	events.Closed = func(c Conn, err error) (action Action) {
+		DestroySession(c)
+		return
+	}
+	events.Serving = func(srv Server) (action Action) {
+		go func() {
+			conn, err := net.Dial(network, addr)
+			must(err)
+			defer conn.Close()
+			rd := bufio.NewReader(conn)
+			line, err := rd.ReadString('\n')
+			must(err)
+			if line != "ab\n" {
+				panic(fmt.Sprintf("expected ab, got %q", line))
+			}
+			atomic.StoreInt32(&done, 1)
+		}()
+		return
+	}
+	var woken bool
+	events.Tick = func() (delay time.Duration, action Action) {
+		if !woken && atomic.LoadInt32(&opened) == 1 {
+			// the loop is busy in the tick, so the wakes are pending
+			must(WakeWithMessage("user", "a"))
+			must(WakeWithMessage("user", "b\n"))
+			if err := WakeWithMessage("user", "c\n"); err != ErrWakeQueueFull {
+				panic(fmt.Sprintf("expected ErrWakeQueueFull, got %v", err))
+			}
+			if n := PendingWakes(FindConnById("user")); n != 2 {
+				panic(fmt.Sprintf("expected 2 pending wakes, got %d", n))
+			}
+			woken = true
+		}
+		if atomic.LoadInt32(&done) == 1 {
+			action = Shutdown
+		}
+		return time.Second / 20, action
+	}
+	if stdlib {
+		must(Serve(events, network+"-net://"+addr))
+	} else {
+		must(Serve(events, network+"://"+addr))
+	}
+}
+
+func TestCancelPendingWakes(t *testing.T) {
+	t.Run("poll", func(t *testing.T) {
+		testCancelPendingWakes("tcp", ":9991", false)
+	})
+	t.Run("stdlib", func(t *testing.T) {
+		testCancelPendingWakes("tcp", ":9992", true)
+	})
+	var sent int
+	var events Events
+	events.Send = func(c Conn) (out []byte, action Action) {
+		sent++
+		return
+	}
+	events.WokenMessage = func(c Conn, msg interface{}) (out []byte, action Action) {
+		sent++
+		return
+	}
+	c := LoopbackServer(events)
+	c.Wake()
+	c.Wake()
+	must(wakeMessage(c, "stale"))
+	if n := CancelPendingWakes(c); n != 3 {
+		t.Fatalf("expected 3 cancelled wakes, got %d", n)
+	}
+	c.Step()
+	if sent != 0 || PendingWakes(c) != 0 {
+		t.Fatalf("expected no wakes, got %d sent and %d pending", sent, PendingWakes(c))
+	}
+	c.Wake()
+	c.Step()
+	if sent != 1 {
+		t.Fatalf("expected 1 wake after the cancel, got %d", sent)
+	}
+}
+
+func testCancelPendingWakes(network, addr string, stdlib bool) {
+	const numWakes = 2000
+	var taken, cancelled, done int32
+	var events Events
+	events.Send = func(c Conn) (out []byte, action Action) {
+		atomic.AddInt32(&taken, 1)
+		return
+	}
+	events.WokenMessage = func(c Conn, msg interface{}) (out []byte, action Action) {
+		atomic.AddInt32(&taken, 1)
+		return
+	}
+	events.Opened = func(c Conn) (out []byte, opts Options, action Action) {
+		go func() {
+			var wg sync.WaitGroup
+			wg.Add(2)
+			go func() {
+				defer wg.Done()
+				for i := 0; i < numWakes; i++ {
+					if i%2 == 0 {
+						c.Wake()
+					} else {
+						must(wakeMessage(c, i))
+					}
+				}
+			}()
+			go func() {
+				defer wg.Done()
+				for i := 0; i < numWakes/10; i++ {
+					atomic.AddInt32(&cancelled, int32(CancelPendingWakes(c)))
+					runtime.Gosched()
+				}
+			}()
+			wg.Wait()
+			atomic.AddInt32(&cancelled, int32(CancelPendingWakes(c)))
+			atomic.StoreInt32(&done, 1)
+		}()
+		return
+	}
+	events.Serving = func(srv Server) (action Action) {
+		go func() {
+			conn, err := net.Dial(network, addr)
+			must(err)
+			defer conn.Close()
+			time.Sleep(time.Second * 2)
+		}()
+		return
+	}
+	deadline := time.Now().Add(time.Second * 5)
+	events.Tick = func() (delay time.Duration, action Action) {
+		if atomic.LoadInt32(&done) == 1 {
+			if n := atomic.LoadInt32(&taken) + atomic.LoadInt32(&cancelled); n == numWakes {
+				return 0, Shutdown
+			}
+		}
+		if time.Now().After(deadline) {
+			panic(fmt.Sprintf("expected %d wakes taken or cancelled, got %d taken and %d cancelled",
+				numWakes, atomic.LoadInt32(&taken), atomic.LoadInt32(&cancelled)))
+		}
+		return time.Second / 20, None
+	}
+	if stdlib {
+		must(Serve(events, network+"-net://"+addr))
+	} else {
+		must(Serve(events, network+"://"+addr))
+	}
+}
+
+func TestBindSessionTwice(t *testing.T) {
+	c := &testConn{}
+	sess := &testSession{id: "twice"}
+	BindSession(c, sess)
+	defer DestroySession(c)
+	var stop, missed int32
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for atomic.LoadInt32(&stop) == 0 {
+				if FindConnById("twice") != c {
+					atomic.StoreInt32(&missed, 1)
+				}
+			}
+		}()
+	}
+	for i := 0; i < 100000; i++ {
+		if err := TryBindSession(c, sess); err != nil {
+			t.Fatal(err)
+		}
+	}
+	atomic.StoreInt32(&stop, 1)
+	wg.Wait()
+	if missed != 0 {
+		t.Fatal("expected the connection always found")
+	}
+	// a new id still moves the connection
+	BindSession(c, &testSession{id: "twice-2"})
+	if FindConnById("twice") != nil || FindConnById("twice-2") != c {
+		t.Fatal("expected connection moved to the new id")
+	}
+}
+
+func TestClusterRouter(t *testing.T) {
+	members := []string{"node1", "node2", "node3"}
+	r := NewClusterRouter("node1", members)
+	const total = 30000
+	owners := make(map[string]string, total)
+	counts := make(map[string]int)
+	for i := 0; i < total; i++ {
+		id := fmt.Sprintf("session-%d", i)
+		owner := r.OwnerOf(id)
+		owners[id] = owner
+		counts[owner]++
+		if r.Owns(id) != (owner == "node1") {
+			t.Fatal("expected Owns to match OwnerOf")
+		}
+	}
+	for _, m := range members {
+		if share := float64(counts[m]) / total; share < 0.25 || share > 0.42 {
+			t.Fatalf("unbalanced share of %s: %.3f", m, share)
+		}
+	}
+	// a new member only takes ids from the others
+	r.UpdateMembers(append(members, "node4"))
+	moved := 0
+	for id, owner := range owners {
+		if now := r.OwnerOf(id); now != owner {
+			if now != "node4" {
+				t.Fatalf("expected %s moved to node4, got %s", id, now)
+			}
+			moved++
+		}
+	}
+	if share := float64(moved) / total; share < 0.15 || share > 0.35 {
+		t.Fatalf("expected about a quarter remapped, got %.3f", share)
+	}
+	r.UpdateMembers(nil)
+	if r.OwnerOf("session-1") != "" || r.Owns("session-1") {
+		t.Fatal("expected no owner without members")
+	}
+}
+
+func TestNewLocalSessionId(t *testing.T) {
+	members := []string{"node1", "node2", "node3", "node4", "node5"}
+	r := NewClusterRouter("node3", members)
+	seen := make(map[string]bool)
+	for i := 0; i < 1000; i++ {
+		id := NewLocalSessionId(r)
+		if owner := r.OwnerOf(id); owner != "node3" {
+			t.Fatalf("expected %s owned by node3, got %s", id, owner)
+		}
+		if seen[id] {
+			t.Fatalf("expected unique ids, got %s again", id)
+		}
+		seen[id] = true
+	}
+	// not a member, an id is still returned
+	r = NewClusterRouter("node6", members)
+	if id := NewLocalSessionId(r); id == "" || r.Owns(id) {
+		t.Fatalf("expected an id owned by another node, got %q", id)
+	}
+}
+
+func TestPublish(t *testing.T) {
+	t.Run("poll", func(t *testing.T) {
+		testPublish("tcp", ":9991", false)
+	})
+	t.Run("stdlib", func(t *testing.T) {
+		testPublish("tcp", ":9992", true)
+	})
+	c := &testConn{}
+	if Subscribe("pub-nobody", "news") {
+		t.Fatal("expected no subscription without session")
+	}
+	BindSession(c, &testSession{id: "pub-1"})
+	Subscribe("pub-1", "news")
+	RebindSessionId(c, "pub-2")
+	if !Unsubscribe("pub-2", "news") || Unsubscribe("pub-2", "news") {
+		t.Fatal("expected the subscription moved to the new id")
+	}
+	Subscribe("pub-2", "news")
+	DestroySession(c)
+	if n := len(pubsub.subs["pub-2"]) + len(pubsub.topics["news"]); n != 0 {
+		t.Fatalf("expected subscriptions removed, got %d", n)
+	}
+	// a subscription which races with the destroy is removed by it, or refused
+	for i := 0; i < 100; i++ {
+		BindSession(c, &testSession{id: "pub-3"})
+		subscribed := make(chan struct{})
+		go func() {
+			Subscribe("pub-3", "news")
+			close(subscribed)
+		}()
+		DestroySession(c)
+		<-subscribed
+		if n := len(pubsub.subs["pub-3"]) + len(pubsub.topics["news"]); n != 0 {
+			t.Fatalf("expected subscriptions removed, got %d", n)
+		}
+	}
+}
+
+func testPublish(network, addr string, stdlib bool) {
+	var opened, done int32
+	var events Events
+	events.Opened = func(c Conn) (out []byte, opts Options, action Action) {
+		n := atomic.AddInt32(&opened, 1)
+		id := fmt.Sprintf("pub/%d", n)
+		BindSession(c, &testSession{id: id})
+		if n != 3 {
+			Subscribe(id, "news")
+		}
+		return
+	}
+	events.WokenMessage = func(c Conn, msg interface{}) (out []byte, action Action) {
+		m := msg.(TopicMessage)
+		return []byte(m.Topic + ":" + string(m.Payload)), None
+	}
+	events.Closed = func(c Conn, err error) (action Action) {
+		DestroySession(c)
+		return
+	}
+	events.Serving = func(srv Server) (action Action) {
+		for i := 0; i < 3; i++ {
+			go func() {
+				conn, err := net.Dial(network, addr)
+				must(err)
+				defer conn.Close()
+				conn.SetReadDeadline(time.Now().Add(time.Second / 2))
+				line, _ := bufio.NewReader(conn).ReadString('\n')
+				if line == "news:hello\n" {
+					atomic.AddInt32(&done, 1)
+				}
+			}()
+		}
+		return
+	}
+	var published bool
+	events.Tick = func() (delay time.Duration, action Action) {
+		if !published && atomic.LoadInt32(&opened) == 3 {
+			if n := Publish("news", []byte("hello\n")); n != 2 {
+				panic(fmt.Sprintf("expected 2 delivered, got %d", n))
+			}
+			published = true
+		}
+		if atomic.LoadInt32(&done) == 2 {
+			action = Shutdown
+		}
+		return time.Second / 20, action
+	}
+	if stdlib {
+		must(Serve(events, network+"-net://"+addr))
+	} else {
+		must(Serve(events, network+"://"+addr))
+	}
+}
+
+func TestBroadcast(t *testing.T) {
+	t.Run("poll", func(t *testing.T) {
+		testBroadcast("tcp", ":9991", false)
+	})
+	t.Run("stdlib", func(t *testing.T) {
+		testBroadcast("tcp", ":9992", true)
+	})
+}
+
+func testBroadcast(network, addr string, stdlib bool) {
+	var opened, slowClosed, fastRead int32
+	var events Events
+	// the write of the stalled client blocks a stdlib loop
+	events.NumLoops = 2
+	events.LoadBalance = RoundRobin
+	events.Opened = func(c Conn) (out []byte, opts Options, action Action) {
+		atomic.AddInt32(&opened, 1)
+		return
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		if string(in) == "slow" {
+			c.SetSendBuffer(4096) // let the write queue grow soon
+		}
+		BindSession(c, &testSession{id: "bc/" + string(in)})
+		return
+	}
+	events.Closed = func(c Conn, err error) (action Action) {
+		if GetSessionId(GetSession(c)) == "bc/slow" && !stdlib {
+			if err != ErrSlowConsumer {
+				panic(fmt.Sprintf("expected ErrSlowConsumer, got %v", err))
+			}
+			atomic.StoreInt32(&slowClosed, 1)
+		}
+		DestroySession(c)
+		return
+	}
+	events.Serving = func(srv Server) (action Action) {
+		for _, name := range []string{"slow", "fast"} {
+			go func(name string) {
+				conn, err := net.Dial(network, addr)
+				must(err)
+				defer conn.Close()
+				conn.Write([]byte(name))
+				if name == "slow" {
+					conn.(*net.TCPConn).SetReadBuffer(4096)
+					time.Sleep(time.Second * 2)
+					return
+				}
+				buf := make([]byte, 0xFFFF)
+				for {
+					n, err := conn.Read(buf)
+					if err != nil {
+						return
+					}
+					atomic.AddInt32(&fastRead, int32(n))
+				}
+			}(name)
+		}
+		return
+	}
+	payload := make([]byte, 64*1024)
+	var slowSkipped bool
+	events.Tick = func() (delay time.Duration, action Action) {
+		if FindConnById("bc/slow") != nil && FindConnById("bc/fast") != nil {
+			_, skipped := Broadcast(payload, 512*1024, true)
+			for _, id := range skipped {
+				if id == "bc/slow" {
+					slowSkipped = true
+				}
+			}
+		}
+		// the stdlib loop is blocked by the stalled write, it can't close
+		closed := stdlib || atomic.LoadInt32(&slowClosed) == 1
+		if slowSkipped && closed && atomic.LoadInt32(&fastRead) > 512*1024 {
+			action = Shutdown
+		}
+		return time.Second / 50, action
+	}
+	if stdlib {
+		must(Serve(events, network+"-net://"+addr))
+	} else {
+		must(Serve(events, network+"://"+addr))
+	}
+}
+
+func TestGroupsAndTags(t *testing.T) {
+	c := LoopbackServer(Events{})
+	if !Join(c, "room-b") || !Join(c, "room-a") || !Tag(c, "vip") {
+		t.Fatal("expected join success")
+	}
+	groups := Groups(c)
+	if strings.Join(groups, ",") != "room-a,room-b" {
+		t.Fatalf("expected sorted groups, got %v", groups)
+	}
+	groups[0] = "changed"
+	if Groups(c)[0] != "room-a" {
+		t.Fatal("expected a copy of groups")
+	}
+	if tags := Tags(c); len(tags) != 1 || tags[0] != "vip" {
+		t.Fatalf("expected vip tag, got %v", tags)
+	}
+	if !Leave(c, "room-b") || Leave(c, "room-b") {
+		t.Fatal("expected leave once")
+	}
+	if members := GroupMembers("room-a"); len(members) != 1 || members[0] != c {
+		t.Fatal("expected the member of room-a")
+	}
+	c.Close(nil)
+	if len(Groups(c)) != 0 || len(Tagged("vip")) != 0 || len(GroupMembers("room-a")) != 0 {
+		t.Fatal("expected memberships removed after close")
+	}
+	if Join(c, "room-a") {
+		t.Fatal("expected closed connection can't join")
+	}
+}
+
+func TestSendByIndex(t *testing.T) {
+	phone, laptop, other := LoopbackServer(Events{}), LoopbackServer(Events{}), LoopbackServer(Events{})
+	defer phone.Close(nil)
+	defer laptop.Close(nil)
+	defer other.Close(nil)
+	BindSession(phone, &testSession{id: "alice-phone"})
+	BindSession(laptop, &testSession{id: "alice-laptop"})
+	BindSession(other, &testSession{id: "bob-phone"})
+	IndexSession(phone, "user", "alice")
+	IndexSession(phone, "device", "phone")
+	IndexSession(laptop, "user", "alice")
+	IndexSession(other, "user", "bob")
+	if sent := SendByIndex("user", "alice", []byte("hi alice")); sent != 2 {
+		t.Fatalf("expected 2 connections of alice, got %d", sent)
+	}
+	for _, c := range []*TestConn{phone, laptop, other} {
+		c.Step()
+	}
+	if string(phone.Output()) != "hi alice" || string(laptop.Output()) != "hi alice" {
+		t.Fatal("expected the payload written to both of alice's connections")
+	}
+	if out := other.Output(); len(out) != 0 {
+		t.Fatalf("expected nothing for bob, got %q", out)
+	}
+	if conns := FindConnsByIndex("device", "phone"); len(conns) != 1 || conns[0] != phone {
+		t.Fatalf("expected the phone by the device index, got %v", conns)
+	}
+	DestroySession(phone)
+	if len(FindConnsByIndex("user", "alice")) != 1 || len(FindConnsByIndex("device", "phone")) != 0 {
+		t.Fatal("expected the keys of the destroyed session removed")
+	}
+	laptop.Close(nil)
+	if len(FindConnsByIndex("user", "alice")) != 0 {
+		t.Fatal("expected the keys removed after close")
+	}
+	if IndexSession(laptop, "user", "alice") {
+		t.Fatal("expected closed connection can't be indexed")
+	}
+	DestroySession(laptop)
+	DestroySession(other)
+}
+
+func TestMoveGroup(t *testing.T) {
+	c := LoopbackServer(Events{})
+	defer c.Close(nil)
+	BindSession(c, &testSession{id: "mover"})
+	defer DestroySession(c)
+	Join(c, "room-a")
+	Join(c, "lobby")
+	if err := MoveGroup("mover", "room-b", "room-a"); err != ErrNotInGroup {
+		t.Fatalf("expected %v, got %v", ErrNotInGroup, err)
+	}
+	if err := MoveGroup("nobody", "room-a", "room-b"); err != ErrConnClosed {
+		t.Fatalf("expected %v, got %v", ErrConnClosed, err)
+	}
+	if err := MoveGroup("mover", "room-a", "room-a"); err != nil {
+		t.Fatal(err)
+	}
+	// a broadcast sees the session in exactly one of the rooms
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		from, to := "room-a", "room-b"
+		for i := 0; i < 1000; i++ {
+			must(MoveGroup("mover", from, to))
+			from, to = to, from
+		}
+	}()
+	for moving := true; moving; {
+		select {
+		case <-done:
+			moving = false
+		default:
+		}
+		var rooms int
+		for _, group := range Groups(c) {
+			if strings.HasPrefix(group, "room-") {
+				rooms++
+			}
+		}
+		if rooms != 1 {
+			t.Fatalf("expected one room, got %v", Groups(c))
+		}
+	}
+	if groups := strings.Join(Groups(c), ","); groups != "lobby,room-a" {
+		t.Fatalf("expected back in room-a, got %s", groups)
+	}
+}
+
+type marshalSession struct {
+	testSession
+	name string
+}
+
+func (sess *marshalSession) Marshal() ([]byte, error) { return []byte(sess.name), nil }
+
+func (sess *marshalSession) Unmarshal(data []byte) error {
+	sess.name = string(data)
+	return nil
+}
+
+func TestReplicator(t *testing.T) {
+	r := NewChanReplicator(10)
+	SetReplicator(r)
+	defer SetReplicator(nil)
+	c := &testConn{}
+	BindSession(c, &marshalSession{testSession{id: "replica-1"}, "alice"})
+	RebindSessionId(c, "replica-2")
+	BindSession(c, &marshalSession{testSession{id: "replica-4"}, "bob"})
+	DestroySession(c)
+	expected := []ReplicaEvent{
+		{Id: "replica-1", Data: []byte("alice")},
+		{Id: "replica-1", Destroyed: true},
+		{Id: "replica-2", Data: []byte("alice")},
+		{Id: "replica-2", Destroyed: true},
+		{Id: "replica-4", Data: []byte("bob")},
+		{Id: "replica-4", Destroyed: true},
+	}
+	for _, e := range expected {
+		select {
+		case got := <-r.C:
+			if got.Id != e.Id || string(got.Data) != string(e.Data) || got.Destroyed != e.Destroyed {
+				t.Fatalf("expected %v, got %v", e, got)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expected %v replicated", e)
+		}
+	}
+	// a stalled replicator never blocks the binds
+	SetReplicator(NewChanReplicator(0))
+	for i := 0; i < replicaBuffer*2; i++ {
+		BindSession(c, &testSession{id: "replica-3"})
+	}
+	DestroySession(c)
+	if ReplicationDropped() == 0 {
+		t.Fatal("expected dropped changes")
+	}
+	if st := BackgroundStatus(); st.ReplicationPending == 0 || st.ReplicationDropped == 0 {
+		t.Fatalf("expected the stalled replication reported, got %+v", st)
+	}
+}
+
+func TestExportRegistry(t *testing.T) {
+	old1, old2 := &testConn{}, &testConn{}
+	BindSession(old1, &marshalSession{testSession{id: "export-1"}, "alice"})
+	BindSession(old2, &testSession{id: "export-2"})
+	data, err := ExportRegistry()
+	if err != nil {
+		t.Fatal(err)
+	}
+	DestroySession(old1)
+	DestroySession(old2)
+
+	// the adopted connections have the new sessions of Opened
+	new1, new2 := &testConn{}, &testConn{}
+	BindSession(new1, &marshalSession{testSession{id: "export-new"}, ""})
+	new2.SetContext(&testSession{})
+	defer DestroySession(new1)
+	defer DestroySession(new2)
+	adopted := map[string]Conn{"export-1": new1, "export-2": new2}
+	err = ImportRegistry(data, func(id string) Conn { return adopted[id] })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if FindConnById("export-1") != new1 || FindConnById("export-2") != new2 {
+		t.Fatal("expected the sessions imported")
+	}
+	if FindConnById("export-new") != nil {
+		t.Fatal("expected the id of Opened replaced")
+	}
+	if sess := GetSession(new1).(*marshalSession); sess.name != "alice" {
+		t.Fatalf("expected alice, got %q", sess.name)
+	}
+	if ImportRegistry([]byte("bad"), nil) == nil {
+		t.Fatal("expected error of bad data")
+	}
+}
+
+func TestBindSessionEmptyId(t *testing.T) {
+	var logged []string
+	SetSessionDebug(func(format string, args ...interface{}) {
+		logged = append(logged, fmt.Sprintf(format, args...))
+	})
+	defer SetSessionDebug(nil)
+	c := &testConn{}
+	if err := TryBindSession(c, &testSession{}); err != ErrEmptyID {
+		t.Fatalf("expected ErrEmptyID, got %v", err)
+	}
+	if c.Context() != nil || FindConnById("") != nil {
+		t.Fatal("expected nothing bound")
+	}
+	if len(logged) != 1 || !strings.Contains(logged[0], "BindSession") {
+		t.Fatalf("expected the empty id logged, got %q", logged)
+	}
+	if err := TryBindSession(nil, &testSession{id: "nil"}); err != ErrConnClosed {
+		t.Fatalf("expected ErrConnClosed, got %v", err)
+	}
+	if BindSession(c, &testSession{}) {
+		t.Fatal("expected the bind refused")
+	}
+
+	// a binary id is bound and exported as it is
+	id := string([]byte{0x01, 0xff, 0x00, 0xfe})
+	if !BindSession(c, &testSession{id: id}) {
+		t.Fatal("expected the binary id bound")
+	}
+	if FindConnById(id) != c {
+		t.Fatal("expected the binary id found")
+	}
+	data, err := ExportRegistry()
+	if err != nil {
+		t.Fatal(err)
+	}
+	DestroySession(c)
+	adopted := &testConn{ctx: &testSession{id: "adopted"}}
+	defer DestroySession(adopted)
+	err = ImportRegistry(data, func(v string) Conn {
+		if v == id {
+			return adopted
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if FindConnById(id) != adopted {
+		t.Fatal("expected the binary id imported")
+	}
+}
+
+func TestDisplaceByUser(t *testing.T) {
+	t.Run("poll", func(t *testing.T) {
+		testDisplaceByUser("tcp", ":9991", false)
+	})
+	t.Run("stdlib", func(t *testing.T) {
+		testDisplaceByUser("tcp", ":9992", true)
+	})
+	// the old connection of a re-bound id does not remove the new one
+	c1, c2 := &testConn{}, &testConn{}
+	BindSession(c1, &testSession{id: "displace"})
+	c2.SetContext(&testSession{id: "displace"})
+	DisplaceByUser("displace", c2, nil, func(sess ISession) string { return sess.GetId() })
+	DestroySession(c1)
+	if FindConnById("displace") != c2 {
+		t.Fatal("expected the new connection kept")
+	}
+	// nor does a bind of another id to the old connection
+	BindSession(c1, &testSession{id: "displace"})
+	BindSession(c2, &testSession{id: "displace"})
+	BindSession(c1, &testSession{id: "displace-2"})
+	if FindConnById("displace") != c2 {
+		t.Fatal("expected the new connection kept")
+	}
+	DestroySession(c1)
+	DestroySession(c2)
+}
+
+func testDisplaceByUser(network, addr string, stdlib bool) {
+	userKey := func(sess ISession) string {
+		return strings.SplitN(sess.GetId(), "/", 2)[0]
+	}
+	var noticed int32
+	var events Events
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		SaveSession(c, &testSession{id: string(in)})
+		DisplaceByUser(userKey(GetSession(c).(ISession)), c, []byte("elsewhere\n"), userKey)
+		return []byte("ok\n"), None
+	}
+	events.Closed = func(c Conn, err error) (action Action) {
+		DestroySession(c)
+		return
+	}
+	login := func(id string) (net.Conn, *bufio.Reader) {
+		conn, err := net.Dial(network, addr)
+		must(err)
+		conn.Write([]byte(id))
+		rd := bufio.NewReader(conn)
+		if line, _ := rd.ReadString('\n'); line != "ok\n" {
+			panic("expected login")
+		}
+		return conn, rd
+	}
+	events.Serving = func(srv Server) (action Action) {
+		go func() {
+			conn1, rd1 := login("alice/1")
+			defer conn1.Close()
+			conn2, _ := login("alice/2")
+			defer conn2.Close()
+			if line, _ := rd1.ReadString('\n'); line != "elsewhere\n" {
+				panic(fmt.Sprintf("expected the notice, got %q", line))
+			}
+			if _, err := rd1.ReadByte(); err == nil {
+				panic("expected the first login closed")
+			}
+			if FindConnById("alice/1") != nil || FindConnById("alice/2") == nil {
+				panic("expected only the second login")
+			}
+			atomic.StoreInt32(&noticed, 1)
+		}()
+		return
+	}
+	events.Tick = func() (delay time.Duration, action Action) {
+		if atomic.LoadInt32(&noticed) == 1 {
+			action = Shutdown
+		}
+		return time.Second / 20, action
+	}
+	if stdlib {
+		must(Serve(events, network+"-net://"+addr))
+	} else {
+		must(Serve(events, network+"://"+addr))
+	}
+}
+
+func TestDeferSession(t *testing.T) {
+	t.Run("poll", func(t *testing.T) {
+		testDeferSession("tcp", ":9991", false)
+	})
+	t.Run("stdlib", func(t *testing.T) {
+		testDeferSession("tcp", ":9992", true)
+	})
+}
+
+func testDeferSession(network, addr string, stdlib bool) {
+	var opened, firsts, echoed int32
+	var events Events
+	events.Opened = func(c Conn) (out []byte, opts Options, action Action) {
+		opts.DeferSession = true
+		atomic.AddInt32(&opened, 1)
+		return
+	}
+	events.FirstData = func(c Conn, in []byte) ISession {
+		atomic.AddInt32(&firsts, 1)
+		return &testSession{id: "defer-" + string(in)}
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		if FindConnById("defer-user") != c {
+			panic("expected the session bound before the data")
+		}
+		return in, None
+	}
+	events.Closed = func(c Conn, err error) (action Action) {
+		DestroySession(c)
+		return
+	}
+	events.Serving = func(srv Server) (action Action) {
+		go func() {
+			// a probe which closes without sending anything
+			conn, err := net.Dial(network, addr)
+			must(err)
+			conn.Close()
+			conn, err = net.Dial(network, addr)
+			must(err)
+			defer conn.Close()
+			conn.Write([]byte("user"))
+			_, err = conn.Read(make([]byte, 4))
+			must(err)
+			atomic.StoreInt32(&echoed, 1)
+			time.Sleep(time.Second / 2)
+		}()
+		return
+	}
+	events.Tick = func() (delay time.Duration, action Action) {
+		if atomic.LoadInt32(&echoed) == 1 && atomic.LoadInt32(&opened) == 2 {
+			var entries int
+			GetRegistry().Range(func(id string, c Conn) bool {
+				if strings.HasPrefix(id, "defer-") {
+					entries++
+				}
+				return true
+			})
+			if n := atomic.LoadInt32(&firsts); n != 1 || entries != 1 {
+				panic(fmt.Sprintf("expected one session, got %d of %d entries", n, entries))
+			}
+			action = Shutdown
+		}
+		return time.Second / 20, action
+	}
+	if stdlib {
+		must(Serve(events, network+"-net://"+addr))
+	} else {
+		must(Serve(events, network+"://"+addr))
+	}
+}
+
+func TestSessionInbox(t *testing.T) {
+	t.Run("poll", func(t *testing.T) {
+		testSessionInbox("tcp", ":9991", false)
+	})
+	t.Run("stdlib", func(t *testing.T) {
+		testSessionInbox("tcp", ":9992", true)
+	})
+	open := func(id string, policy OverflowPolicy) *TestConn {
+		SessionInbox(id, 2, policy)
+		var events Events
+		events.Opened = func(c Conn) (out []byte, opts Options, action Action) {
+			BindSession(c, &testSession{id: id})
+			return
+		}
+		return LoopbackServer(events)
+	}
+	// pushes four messages while the first one is written, so the inbox of
+	// two overflows once
+	push := func(id string) (errs []error) {
+		for _, msg := range []string{"1", "2", "3", "4"} {
+			errs = append(errs, PushInbox(id, []byte(msg)))
+		}
+		return
+	}
+	expect := func(c *TestConn, output ...string) {
+		for _, s := range output {
+			c.Step()
+			if out := c.Output(); string(out) != s {
+				t.Fatalf("expected %q, got %q", s, out)
+			}
+		}
+	}
+	t.Run("drop-oldest", func(t *testing.T) {
+		c := open("inbox-oldest", InboxDropOldest)
+		defer DestroySession(c)
+		if errs := push("inbox-oldest"); errs[3] != nil {
+			t.Fatalf("expected no error, got %v", errs[3])
+		}
+		expect(c, "1", "34")
+		if _, dropped, _ := InboxStats("inbox-oldest"); dropped != 1 {
+			t.Fatalf("expected 1 dropped, got %d", dropped)
+		}
+	})
+	t.Run("drop-newest", func(t *testing.T) {
+		c := open("inbox-newest", InboxDropNewest)
+		defer DestroySession(c)
+		if errs := push("inbox-newest"); errs[3] != nil {
+			t.Fatalf("expected no error, got %v", errs[3])
+		}
+		expect(c, "1", "23")
+		if _, dropped, _ := InboxStats("inbox-newest"); dropped != 1 {
+			t.Fatalf("expected 1 dropped, got %d", dropped)
+		}
+	})
+	t.Run("reject", func(t *testing.T) {
+		c := open("inbox-reject", InboxReject)
+		defer DestroySession(c)
+		if errs := push("inbox-reject"); errs[3] != ErrInboxFull {
+			t.Fatalf("expected ErrInboxFull, got %v", errs[3])
+		}
+		expect(c, "1", "23")
+		if _, dropped, _ := InboxStats("inbox-reject"); dropped != 0 {
+			t.Fatalf("expected no dropped, got %d", dropped)
+		}
+	})
+	t.Run("unbound", func(t *testing.T) {
+		SessionInbox("inbox-later", 4, InboxReject)
+		must(PushInbox("inbox-later", []byte("early")))
+		if queued, _, _ := InboxStats("inbox-later"); queued != 1 {
+			t.Fatalf("expected 1 queued before the bind, got %d", queued)
+		}
+		c := open("inbox-later", InboxReject)
+		expect(c, "early")
+		DestroySession(c)
+		if _, _, found := InboxStats("inbox-later"); found {
+			t.Fatal("expected the inbox removed by destroy")
+		}
+		if err := PushInbox("inbox-later", []byte("late")); err != ErrNoInbox {
+			t.Fatalf("expected ErrNoInbox, got %v", err)
+		}
+	})
+}
+
+func testSessionInbox(network, addr string, stdlib bool) {
+	const numMsgs = 50
+	var done int32
+	var events Events
+	events.Opened = func(c Conn) (out []byte, opts Options, action Action) {
+		SessionInbox("inbox", numMsgs, InboxReject)
+		BindSession(c, &testSession{id: "inbox"})
+		go func() {
+			for i := 0; i < numMsgs; i++ {
+				must(PushInbox("inbox", []byte(fmt.Sprintf("msg %d\n", i))))
+			}
+		}()
+		return
+	}
+	events.Closed = func(c Conn, err error) (action Action) {
+		DestroySession(c)
+		return
+	}
+	events.Serving = func(srv Server) (action Action) {
+		go func() {
+			conn, err := net.Dial(network, addr)
+			must(err)
+			defer conn.Close()
+			rd := bufio.NewReader(conn)
+			for i := 0; i < numMsgs; i++ {
+				line, err := rd.ReadString('\n')
+				must(err)
+				if line != fmt.Sprintf("msg %d\n", i) {
+					panic(fmt.Sprintf("unexpected %q", line))
+				}
+			}
+			atomic.StoreInt32(&done, 1)
+		}()
+		return
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	events.Tick = func() (delay time.Duration, action Action) {
+		if atomic.LoadInt32(&done) == 1 {
+			return 0, Shutdown
+		}
+		if time.Now().After(deadline) {
+			panic("expected the inbox drained")
+		}
+		return time.Second / 20, None
+	}
+	if stdlib {
+		must(Serve(events, network+"-net://"+addr))
+	} else {
+		must(Serve(events, network+"://"+addr))
+	}
+}
+
+func TestSwapSession(t *testing.T) {
+	c := &testConn{}
+	guest := &testSession{id: "swap-guest"}
+	BindSession(c, guest)
+	defer DestroySession(c)
+
+	// the same id keeps the registry
+	user := &marshalSession{testSession{id: "swap-guest"}, "alice"}
+	if err := SwapSession(c, user); err != nil {
+		t.Fatal(err)
+	}
+	if GetSession(c) != user || FindConnById("swap-guest") != c {
+		t.Fatal("expected the session replaced under the same id")
+	}
+
+	// a new id moves the connection
+	upgraded := &marshalSession{testSession{id: "swap-alice"}, "alice"}
+	if err := SwapSession(c, upgraded); err != nil {
+		t.Fatal(err)
+	}
+	if GetSession(c) != upgraded || FindConnById("swap-alice") != c {
+		t.Fatal("expected the connection moved to the new id")
+	}
+	if FindConnById("swap-guest") != nil {
+		t.Fatal("expected the old id removed")
+	}
+
+	// the id of another live session is refused
+	other := &testConn{}
+	BindSession(other, &testSession{id: "swap-bob"})
+	defer DestroySession(other)
+	if err := SwapSession(c, &testSession{id: "swap-bob"}); err != ErrSessionExists {
+		t.Fatalf("expected ErrSessionExists, got %v", err)
+	}
+	if GetSession(c) != upgraded || FindConnById("swap-bob") != other {
+		t.Fatal("expected both sessions kept")
+	}
+	if err := SwapSession(c, &testSession{}); err != ErrEmptyID {
+		t.Fatalf("expected ErrEmptyID, got %v", err)
+	}
+}
+
+func TestSubmit(t *testing.T) {
+	SetPoolSize(2, 1)
+	defer SetPoolSize(DefaultPoolWorkers, 0)
+	var running, peak, ran int32
+	block := make(chan struct{})
+	var wg sync.WaitGroup
+	work := func() {
+		defer wg.Done()
+		n := atomic.AddInt32(&running, 1)
+		for {
+			p := atomic.LoadInt32(&peak)
+			if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+				break
+			}
+		}
+		<-block
+		atomic.AddInt32(&running, -1)
+		atomic.AddInt32(&ran, 1)
+	}
+	wg.Add(3)
+	for i := 0; i < 3; i++ {
+		if !Submit(nil, work) {
+			t.Fatalf("expected job %d accepted", i)
+		}
+	}
+	if Submit(nil, work) {
+		t.Fatal("expected the full pool to reject")
+	}
+	if running, waiting := PoolStats(); running != 2 || waiting != 1 {
+		t.Fatalf("expected 2 running and 1 waiting, got %d and %d", running, waiting)
+	}
+	if st := BackgroundStatus(); st.PoolRunning != 2 || st.PoolWaiting != 1 {
+		t.Fatalf("expected 2 running and 1 waiting, got %+v", st)
+	}
+	start := time.Now()
+	for atomic.LoadInt32(&running) != 2 {
+		time.Sleep(time.Millisecond)
+	}
+	close(block)
+	wg.Wait()
+	if peak != 2 || ran != 3 {
+		t.Fatalf("expected 3 jobs with 2 at once, got %d with %d", ran, peak)
+	}
+	for BackgroundStatus().PoolRunning != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if st := BackgroundStatus(); st.PoolLastRun.Before(start) {
+		t.Fatalf("expected the end of the last job, got %v", st.PoolLastRun)
+	}
+
+	// the waiting job of a closed connection is dropped
+	c := LoopbackServer(Events{})
+	block = make(chan struct{})
+	wg.Add(2)
+	Submit(nil, work)
+	Submit(nil, work)
+	if !Submit(c, func() { t.Error("expected the job of the closed connection dropped") }) {
+		t.Fatal("expected the job of the connection waiting")
+	}
+	c.Close(nil)
+	if Submit(c, func() {}) {
+		t.Fatal("expected the closed connection rejected")
+	}
+	close(block)
+	wg.Wait()
+	for {
+		if running, _ := PoolStats(); running == 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestCommitSession(t *testing.T) {
+	var events Events
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		switch msg := string(in); {
+		case msg == "hello":
+			c.SetContext("challenged") // the state of the handshake
+			return []byte("challenge"), None
+		case strings.HasPrefix(msg, "auth ") && c.Context() == "challenged":
+			if err := CommitSession(c, &testSession{id: "staged-" + msg[5:]}); err != nil {
+				return []byte(err.Error()), Close
+			}
+			return []byte("welcome"), None
+		}
+		return in, None
+	}
+	events.Closed = func(c Conn, err error) (action Action) {
+		DestroySession(c)
+		return
+	}
+	c := LoopbackServer(events)
+	defer c.Close(nil)
+	c.Feed([]byte("hello"))
+	if GetRegistry().Len() != 0 || FindConnById("staged-alice") != nil {
+		t.Fatal("expected no session during the handshake")
+	}
+	c.Feed([]byte("auth alice"))
+	if out := string(c.Output()); out != "challengewelcome" {
+		t.Fatalf("expected the handshake done, got %q", out)
+	}
+	if FindConnById("staged-alice") != c || GetRegistry().Len() != 1 {
+		t.Fatal("expected the session committed after the handshake")
+	}
+	if err := CommitSession(c, &testSession{id: "staged-bob"}); err != ErrSessionCommitted {
+		t.Fatalf("expected %v, got %v", ErrSessionCommitted, err)
+	}
+
+	// the id of another connection is not taken
+	other := LoopbackServer(events)
+	other.Feed([]byte("hello"))
+	other.Feed([]byte("auth alice"))
+	if out := string(other.Output()); out != "challenge"+ErrSessionExists.Error() || !other.Closed() {
+		t.Fatalf("expected %v, got %q", ErrSessionExists, out)
+	}
+	if FindConnById("staged-alice") != c {
+		t.Fatal("expected the committed session kept")
+	}
+}
+
+func TestRegisterWatermark(t *testing.T) {
+	SetRegistry(nil)
+	defer SetRegistry(nil)
+	var events []string
+	unregister := RegisterWatermark(4, 2, func(count int) {
+		events = append(events, fmt.Sprintf("high %d", count))
+	}, func(count int) {
+		events = append(events, fmt.Sprintf("low %d", count))
+	})
+	var conns []*testConn
+	bind := func(n int) {
+		for i := 0; i < n; i++ {
+			c := &testConn{}
+			BindSession(c, &testSession{id: fmt.Sprintf("mark-%d", len(conns))})
+			conns = append(conns, c)
+		}
+	}
+	destroy := func(n int) {
+		for i := 0; i < n; i++ {
+			DestroySession(conns[len(conns)-1])
+			conns = conns[:len(conns)-1]
+		}
+	}
+	bind(5)    // crosses high once
+	destroy(2) // stays above low, no flapping
+	bind(1)
+	destroy(2) // falls to low
+	destroy(1)
+	bind(2) // below high again
+	bind(1)
+	want := "high 4,low 2,high 4"
+	if got := strings.Join(events, ","); got != want {
+		t.Fatalf("expected %q, got %q", want, got)
+	}
+	unregister()
+	destroy(len(conns))
+	if len(events) != 3 {
+		t.Fatalf("expected no callback after unregister, got %v", events)
+	}
+}
+
+func TestMigrateSession(t *testing.T) {
+	const network, addr = "tcp", ":9991"
+	var finished int32
+	var migrated int32
+	var events Events
+	events.NumLoops = 2
+	events.LoadBalance = RoundRobin
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		if GetSession(c) == nil {
+			id := strings.TrimSpace(string(in))
+			must(TryBindSession(c, &testSession{id: id}))
+			Join(c, "migrate")
+			Tag(c, "migrate-"+id)
+			IndexSession(c, "migrate", id)
+			return []byte("bound\n"), None
+		}
+		return in, None
+	}
+	events.WokenMessage = func(c Conn, msg interface{}) (out []byte, action Action) {
+		return []byte(msg.(string)), None
+	}
+	events.Migrated = func(c Conn, fromLoop, toLoop int) {
+		atomic.AddInt32(&migrated, 1)
+	}
+	events.Serving = func(srv Server) (action Action) {
+		go func() {
+			defer atomic.StoreInt32(&finished, 1)
+			var ids []string
+			rds := make(map[string]*bufio.Reader)
+			conns := make(map[string]net.Conn)
+			// the loops accept by the kernel, so dial until the retired one
+			// has some of the connections
+			for len(ids) < 4 || srv.LoopStats()[1].ActiveConns == 0 {
+				id := fmt.Sprintf("m%d", len(ids))
+				ids = append(ids, id)
+				conn, err := net.Dial(network, addr)
+				must(err)
+				defer conn.Close()
+				rd := bufio.NewReader(conn)
+				_, err = conn.Write([]byte(id + "\n"))
+				must(err)
+				if line, _ := rd.ReadString('\n'); line != "bound\n" {
+					panic(fmt.Sprintf("expected bound, got %q", line))
+				}
+				conns[id], rds[id] = conn, rd
+			}
+			echo := func(id, msg string) {
+				_, err := conns[id].Write([]byte(msg))
+				must(err)
+				if line, _ := rds[id].ReadString('\n'); line != msg {
+					panic(fmt.Sprintf("expected %q, got %q", msg, line))
+				}
+			}
+			before := make(map[string]Conn)
+			offsets := make(map[string]uint64)
+			for _, id := range ids {
+				before[id] = FindConnById(id)
+				offsets[id] = before[id].InOffset()
+			}
+			// the traffic goes on while the loop is retired
+			stop := make(chan struct{})
+			traffic := make(chan int)
+			go func() {
+				var n int
+				for ; ; n++ {
+					select {
+					case <-stop:
+						traffic <- n
+						return
+					default:
+					}
+					echo("m1", fmt.Sprintf("busy %d\n", n))
+				}
+			}()
+			for _, id := range ids {
+				if id != "m1" { // the busy one
+					must(WakeWithMessage(id, "woken "+id+"\n"))
+				}
+			}
+			moved := int32(srv.LoopStats()[1].ActiveConns)
+			must(srv.SetLoopCount(1))
+			close(stop)
+			n := <-traffic
+			for _, id := range ids {
+				if id != "m1" {
+					if line, _ := rds[id].ReadString('\n'); line != "woken "+id+"\n" {
+						panic(fmt.Sprintf("expected the woken message of %s, got %q", id, line))
+					}
+				}
+				c := FindConnById(id)
+				if c == nil || c != before[id] || GetSessionId(GetSession(c)) != id {
+					panic(fmt.Sprintf("expected the session %s bound to the same connection", id))
+				}
+				if fmt.Sprint(Groups(c)) != "[migrate]" || fmt.Sprint(Tags(c)) != "[migrate-"+id+"]" {
+					panic(fmt.Sprintf("expected the memberships of %s kept, got %v %v", id, Groups(c), Tags(c)))
+				}
+				if found := FindConnsByIndex("migrate", id); len(found) != 1 || found[0] != c {
+					panic(fmt.Sprintf("expected the index of %s kept, got %v", id, found))
+				}
+				echo(id, "after\n")
+				want := offsets[id] + uint64(len("after\n"))
+				if id == "m1" {
+					for i := 0; i < n; i++ {
+						want += uint64(len(fmt.Sprintf("busy %d\n", i)))
+					}
+				}
+				if got := c.InOffset(); got != want {
+					panic(fmt.Sprintf("expected %d bytes in for %s, got %d", want, id, got))
+				}
+			}
+			// fired before the echoes of the moved connections
+			if m := atomic.LoadInt32(&migrated); m != moved || m == 0 {
+				panic(fmt.Sprintf("expected %d migrated connections, got %d", moved, m))
+			}
+			if len(GroupMembers("migrate")) != len(ids) {
+				panic("expected all of the sessions in the group")
+			}
+		}()
+		return
+	}
+	start := time.Now()
+	events.Tick = func() (delay time.Duration, action Action) {
+		if atomic.LoadInt32(&finished) == 1 {
+			return 0, Shutdown
+		}
+		if time.Since(start) > 10*time.Second {
+			panic("timeout")
+		}
+		return time.Second / 20, None
+	}
+	must(Serve(events, network+"://"+addr))
+}
+
+func TestAssertNoLeaks(t *testing.T) {
+	defer SetRegistry(GetRegistry())
+	SetRegistry(nil)
+	if err := AssertNoLeaks(); err != nil {
+		t.Fatalf("expected no leaks before the test, got %v", err)
+	}
+	unsubscribe := SubscribePresence(func(sess ISession) string { return sess.GetId() },
+		func(key string, online bool) {})
+	defer unsubscribe()
+	var events Events
+	events.Opened = func(c Conn) (out []byte, opts Options, action Action) {
+		must(TryBindSession(c, &testSession{id: "leak"}))
+		Join(c, "leak")
+		return
+	}
+	c := LoopbackServer(events)
+	if lines := DebugRegistryDump(); len(lines) != 1 || lines[0] != `"leak" open` {
+		t.Fatalf("expected the open session, got %v", lines)
+	}
+	// closed without DestroySession, so the registry and presence keep it,
+	// and the group is left on the close
+	c.Close(nil)
+	if lines := DebugRegistryDump(); len(lines) != 1 || lines[0] != `"leak" closed` {
+		t.Fatalf("expected the closed session, got %v", lines)
+	}
+	err := AssertNoLeaks()
+	if err == nil || !strings.Contains(err.Error(), `1 sessions ("leak" closed)`) ||
+		!strings.Contains(err.Error(), "1 connections in presence") ||
+		strings.Contains(err.Error(), "groups") {
+		t.Fatalf("expected the leak of the session, got %v", err)
+	}
+	DestroySession(c)
+	if err := AssertNoLeaks(); err != nil {
+		t.Fatalf("expected no leaks after destroying, got %v", err)
+	}
+}
@@ -6,11 +6,15 @@ package evio
 
 import (
 	"errors"
+	"fmt"
 	"io"
+	"log"
 	"net"
 	"runtime"
+	"sort"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 )
 
@@ -18,17 +22,39 @@ var errClosing = errors.New("closing")
 var errCloseConns = errors.New("close conns")
 
 type stdserver struct {
-	events   Events         // user events
-	loops    []*stdloop     // all the loops
-	lns      []*listener    // all the listeners
-	loopwg   sync.WaitGroup // loop close waitgroup
-	lnwg     sync.WaitGroup // listener close waitgroup
-	cond     *sync.Cond     // shutdown signaler
-	serr     error          // signal error
-	accepted uintptr        // accept counter
+	events   Events           // user events
+	loops    []*stdloop       // all the loops
+	lns      []*listener      // all the listeners
+	loopwg   sync.WaitGroup   // loop close waitgroup
+	lnwg     sync.WaitGroup   // listener close waitgroup
+	cond     *sync.Cond       // shutdown signaler
+	serr     error            // signal error
+	accepted uintptr          // accept counter
+	udpconns sync.Map         // virtual udp connections stdudpkey -> stdconn
+	udpmu    sync.Mutex       // orders the creation of the udp connections with their datagrams
+	iplimit  *ipLimiter       // connection limit per remote ip
+	acclimit *acceptLimiter   // accept rate limit
+	outceil  *outboundCeiling // Events.MaxTotalOutbound
+	stats    []*loopStats     // counters of the loops
+	stopped  chan struct{}    // closed when the loops are stopped
+	shutdown int32            // set once the shutdown begins
+	lnerr    error            // genuine failure of a listener, guarded by cond
+}
+
+// stdudpkey is the key of a virtual udp connection.
+type stdudpkey struct {
+	lnidx int
+	addr  string
+}
+
+// stdudppeer is the remote peer of a virtual udp connection.
+type stdudppeer struct {
+	key   stdudpkey
+	pconn net.PacketConn
 }
 
 type stdudpconn struct {
+	connState
 	addrIndex  int
 	localAddr  net.Addr
 	remoteAddr net.Addr
@@ -38,17 +64,33 @@ type stdudpconn struct {
 func (c *stdudpconn) Context() interface{}       { return nil }
 func (c *stdudpconn) SetContext(ctx interface{}) {}
 func (c *stdudpconn) AddrIndex() int             { return c.addrIndex }
+func (c *stdudpconn) ListenerAddr() net.Addr     { return c.localAddr }
 func (c *stdudpconn) LocalAddr() net.Addr        { return c.localAddr }
 func (c *stdudpconn) RemoteAddr() net.Addr       { return c.remoteAddr }
 func (c *stdudpconn) Wake()                      {}
+func (c *stdudpconn) SetSendBuffer(n int) error  { return ErrNotSupported }
+func (c *stdudpconn) SetRecvBuffer(n int) error  { return ErrNotSupported }
+func (c *stdudpconn) SetReuseInputBuffer(bool)   {}
+func (c *stdudpconn) Cork() error                { return ErrNotSupported }
+func (c *stdudpconn) Uncork() error              { return ErrNotSupported }
+func (c *stdudpconn) SetNoDelay(bool) error      { return ErrNotSupported }
+func (c *stdudpconn) SetLinger(int) error        { return ErrNotSupported }
 
 type stdloop struct {
 	idx   int               // loop index
 	ch    chan interface{}  // command channel
 	conns map[*stdconn]bool // track all the conns bound to this loop
+	stats *loopStats        // counters of the loop
+	cmdch chan struct{}     // notifies the pending commands
+	cmdmu sync.Mutex        // guards the pending commands
+	cmds  []*stdcmd         // pending commands
+
+	backlog []interface{} // messages of the ranked batch which are left by an error
+	rates   int32         // the rates are due to be sampled, accessed atomically
 }
 
 type stdconn struct {
+	connState
 	addrIndex  int
 	localAddr  net.Addr
 	remoteAddr net.Addr
@@ -58,6 +100,45 @@ type stdconn struct {
 	lnidx      int         // index of listener
 	donein     []byte      // extra data for done connection
 	done       int32       // 0: attached, 1: closed, 2: detached
+	udp        *stdudppeer // remote peer of virtual udp connection
+}
+
+// exec schedules fn to run on the loop that owns the connection.
+// It never blocks, so that it's safe to call from the loop itself.
+func (c *stdconn) exec(fn func(s *stdserver, l *stdloop, c *stdconn) error) {
+	l := c.loop
+	l.cmdmu.Lock()
+	l.cmds = append(l.cmds, &stdcmd{c, fn})
+	l.cmdmu.Unlock()
+	select {
+	case l.cmdch <- struct{}{}:
+	default:
+	}
+}
+
+func (c *stdconn) run(fn func() Action) {
+	c.exec(func(s *stdserver, l *stdloop, c *stdconn) error {
+		c.enter()
+		action := fn()
+		c.leave()
+		return stdloopRead(s, l, c, nil, action)
+	})
+}
+
+func (c *stdconn) shut() bool { return atomic.LoadInt32(&c.done) == 1 }
+
+func (c *stdconn) wakeMessages() { c.exec(stdloopWokenMessages) }
+
+// stdcmd is a function which runs on the loop of the connection.
+type stdcmd struct {
+	c  *stdconn
+	fn func(s *stdserver, l *stdloop, c *stdconn) error
+}
+
+// stddrain is a step of Server.DrainLoop, which runs on the drained loop.
+type stddrain struct {
+	force bool // close the remaining connections at the timeout
+	done  chan DrainStats
 }
 
 type wakeReq struct {
@@ -67,13 +148,56 @@ type wakeReq struct {
 func (c *stdconn) Context() interface{}       { return c.ctx }
 func (c *stdconn) SetContext(ctx interface{}) { c.ctx = ctx }
 func (c *stdconn) AddrIndex() int             { return c.addrIndex }
+func (c *stdconn) ListenerAddr() net.Addr     { return c.localAddr }
 func (c *stdconn) LocalAddr() net.Addr        { return c.localAddr }
 func (c *stdconn) RemoteAddr() net.Addr       { return c.remoteAddr }
-func (c *stdconn) Wake()                      { c.loop.ch <- wakeReq{c} }
+func (c *stdconn) Wake() {
+	if c.wake() {
+		c.loop.ch <- wakeReq{c}
+	}
+}
+func (c *stdconn) SetSendBuffer(n int) error {
+	if c.udp != nil {
+		return ErrNotSupported
+	}
+	if conn, ok := c.conn.(interface{ SetWriteBuffer(int) error }); ok {
+		return conn.SetWriteBuffer(n)
+	}
+	return ErrNotSupported
+}
+func (c *stdconn) SetRecvBuffer(n int) error {
+	if c.udp != nil {
+		return ErrNotSupported
+	}
+	if conn, ok := c.conn.(interface{ SetReadBuffer(int) error }); ok {
+		return conn.SetReadBuffer(n)
+	}
+	return ErrNotSupported
+}
+func (c *stdconn) SetReuseInputBuffer(bool) {}
+func (c *stdconn) Cork() error {
+	if c.udp != nil {
+		return ErrNotSupported
+	}
+	return c.connState.Cork()
+}
+func (c *stdconn) SetNoDelay(noDelay bool) error {
+	if conn, ok := c.conn.(interface{ SetNoDelay(bool) error }); ok && c.udp == nil {
+		return conn.SetNoDelay(noDelay)
+	}
+	return ErrNotSupported
+}
+func (c *stdconn) SetLinger(sec int) error {
+	if conn, ok := c.conn.(interface{ SetLinger(int) error }); ok && c.udp == nil {
+		return conn.SetLinger(sec)
+	}
+	return ErrNotSupported
+}
 
 type stdin struct {
-	c  *stdconn
-	in []byte
+	c     *stdconn
+	in    []byte
+	first bool // first datagram of a virtual udp connection
 }
 
 type stderr struct {
@@ -98,7 +222,22 @@ func (s *stdserver) signalShutdown(err error) {
 	s.cond.L.Unlock()
 }
 
-func stdserve(events Events, listeners []*listener) error {
+// listenerError records the err of an accept or a read of the listener,
+// which is returned by Serve. A listener which is closed by the shutdown
+// is not a failure, so nil is returned for it.
+func (s *stdserver) listenerError(err error) error {
+	if atomic.LoadInt32(&s.shutdown) == 1 && listenerClosed(err) {
+		return nil
+	}
+	s.cond.L.Lock()
+	if s.lnerr == nil {
+		s.lnerr = err
+	}
+	s.cond.L.Unlock()
+	return err
+}
+
+func stdserve(events Events, listeners []*listener) (err error) {
 	numLoops := events.NumLoops
 	if numLoops <= 0 {
 		if numLoops == 0 {
@@ -112,32 +251,46 @@ func stdserve(events Events, listeners []*listener) error {
 	s.events = DispatchEvents(events)
 	s.lns = listeners
 	s.cond = sync.NewCond(&sync.Mutex{})
+	s.iplimit = newIPLimiter(events.MaxConnsPerIP)
+	s.acclimit = newAcceptLimiter(events.MaxAcceptsPerSec)
+	s.outceil = newOutboundCeiling(events.MaxTotalOutbound, events.OutboundCeiling, func() []*loopStats { return s.stats })
+	s.stopped = make(chan struct{})
+	// the loops are created before serving, so the functions of Server can
+	// use them, they are started after
+	for i := 0; i < numLoops; i++ {
+		s.stats = append(s.stats, &loopStats{})
+		s.loops = append(s.loops, &stdloop{
+			idx:   i,
+			ch:    make(chan interface{}),
+			conns: make(map[*stdconn]bool),
+			stats: s.stats[i],
+			cmdch: make(chan struct{}, 1),
+		})
+	}
 
 	//println("-- server starting")
 	if events.Serving != nil {
 		var svr Server
 		svr.NumLoops = numLoops
+		svr.LoopStats = summarizeLoops(func() []*loopStats { return s.stats }, false)
+		svr.LoopStatsAndReset = summarizeLoops(func() []*loopStats { return s.stats }, true)
+		svr.DrainLoop = s.drainLoop
+		svr.SetLoopCount = func(n int) error { return ErrNotSupported }
+		svr.AcceptsThrottled = s.acclimit.count
+		svr.TotalOutboundBuffered = totalOutbound(func() []*loopStats { return s.stats })
+		svr.FlushAll = func() {}
 		svr.Addrs = make([]net.Addr, len(listeners))
 		for i, ln := range listeners {
 			svr.Addrs[i] = ln.lnaddr
 		}
-		action := events.Serving(svr)
-		switch action {
-		case Shutdown:
-			return nil
+		if shutdown, err := serving(s.events, svr); shutdown {
+			return err
 		}
 	}
-	for i := 0; i < numLoops; i++ {
-		s.loops = append(s.loops, &stdloop{
-			idx:   i,
-			ch:    make(chan interface{}),
-			conns: make(map[*stdconn]bool),
-		})
-	}
-	var ferr error
 	defer func() {
 		// wait on a signal for shutdown
-		ferr = s.waitForShutdown()
+		s.waitForShutdown()
+		atomic.StoreInt32(&s.shutdown, 1)
 
 		// notify all loops to close by closing all listeners
 		for _, l := range s.loops {
@@ -161,17 +314,30 @@ func stdserve(events Events, listeners []*listener) error {
 			l.ch <- errCloseConns
 		}
 		s.loopwg.Wait()
+		close(s.stopped)
 
+		s.cond.L.Lock()
+		err = s.lnerr
+		s.cond.L.Unlock()
 	}()
 	s.loopwg.Add(numLoops)
 	for i := 0; i < numLoops; i++ {
-		go stdloopRun(s, s.loops[i])
+		l := s.loops[i]
+		goLabeled("loop", func() { stdloopRun(s, l) })
 	}
-	s.lnwg.Add(len(listeners))
 	for i := 0; i < len(listeners); i++ {
-		go stdlistenerRun(s, listeners[i], i)
+		ln, lnidx := listeners[i], i
+		// the datagrams are always read by one goroutine
+		n := 1
+		if ln.pconn == nil && events.AcceptLoops > 1 {
+			n = events.AcceptLoops
+		}
+		s.lnwg.Add(n)
+		for j := 0; j < n; j++ {
+			goLabeled("accept", func() { stdlistenerRun(s, ln, lnidx) })
+		}
 	}
-	return ferr
+	return nil
 }
 
 func stdlistenerRun(s *stdserver, ln *listener, lnidx int) {
@@ -186,10 +352,17 @@ func stdlistenerRun(s *stdserver, ln *listener, lnidx int) {
 			// udp
 			n, addr, err := ln.pconn.ReadFrom(packet[:])
 			if err != nil {
-				ferr = err
+				ferr = s.listenerError(err)
 				return
 			}
-			l := s.loops[int(atomic.AddUintptr(&s.accepted, 1))%len(s.loops)]
+			if s.events.UDPIdleTimeout > 0 {
+				stdlistenerUDPConn(s, ln, lnidx, addr, packet[:n])
+				continue
+			}
+			l := s.nextLoop()
+			if l == nil {
+				continue // all of the loops are drained
+			}
 			l.ch <- &stdudpconn{
 				addrIndex:  lnidx,
 				localAddr:  ln.lnaddr,
@@ -198,28 +371,179 @@ func stdlistenerRun(s *stdserver, ln *listener, lnidx int) {
 			}
 		} else {
 			// tcp
+			for wait := s.acclimit.wait(); wait > 0; wait = s.acclimit.wait() {
+				time.Sleep(wait) // the connections wait in the backlog
+			}
 			conn, err := ln.ln.Accept()
 			if err != nil {
-				ferr = err
+				ferr = s.listenerError(err)
 				return
 			}
-			l := s.loops[int(atomic.AddUintptr(&s.accepted, 1))%len(s.loops)]
+			l := s.selectLoop(conn.RemoteAddr())
+			if l == nil {
+				l = s.nextLoop()
+			}
+			if l == nil {
+				conn.Close() // all of the loops are drained
+				continue
+			}
 			c := &stdconn{conn: conn, loop: l, lnidx: lnidx}
+			c.accepted()
+			c.outsum, c.outceil = &l.stats.outbytes, s.outceil
+			c.setLoop(l.stats)
+			if !s.iplimit.acquire(&c.connState, conn.RemoteAddr()) {
+				conn.Close() // over the limit of the remote ip
+				continue
+			}
 			l.ch <- c
-			go func(c *stdconn) {
-				var packet [0xFFFF]byte
+			goLabeled("reader", func() {
+				var packet []byte
 				for {
-					n, err := c.conn.Read(packet[:])
+					// the size is adjusted by the loop
+					if size := c.readSize(); len(packet) != size {
+						packet = make([]byte, size)
+					}
+					n, err := c.conn.Read(packet)
 					if err != nil {
 						c.conn.SetReadDeadline(time.Time{})
 						l.ch <- &stderr{c, err}
 						return
 					}
-					l.ch <- &stdin{c, append([]byte{}, packet[:n]...)}
+					l.ch <- &stdin{c: c, in: append([]byte{}, packet[:n]...)}
+				}
+			})
+		}
+	}
+}
+
+// selectLoop picks the loop of an accepted connection by
+// Events.LoopSelector, it's nil when there is no selector, or the index is
+// out of range or of a drained loop.
+func (s *stdserver) selectLoop(remote net.Addr) *stdloop {
+	if s.events.LoopSelector == nil {
+		return nil
+	}
+	idx := s.events.LoopSelector(remote, len(s.loops))
+	if idx < 0 || idx >= len(s.loops) || s.loops[idx].stats.isDraining() {
+		return nil
+	}
+	return s.loops[idx]
+}
+
+// nextLoop picks the next loop in a round-robin fashion, the drained loops
+// are skipped, it's nil when all of the loops are drained.
+func (s *stdserver) nextLoop() *stdloop {
+	for i := 0; i < len(s.loops); i++ {
+		l := s.loops[int(atomic.AddUintptr(&s.accepted, 1))%len(s.loops)]
+		if !l.stats.isDraining() {
+			return l
+		}
+	}
+	return nil
+}
+
+// drainLoop is Server.DrainLoop, the connections are closed only.
+func (s *stdserver) drainLoop(index int, migrate bool, timeout time.Duration) (DrainStats, error) {
+	if index < 0 || index >= len(s.loops) {
+		return DrainStats{}, fmt.Errorf("evio: no loop %d", index)
+	}
+	if migrate {
+		return DrainStats{}, ErrNotSupported
+	}
+	l := s.loops[index]
+	if !atomic.CompareAndSwapInt32(&l.stats.draining, 0, 1) {
+		return DrainStats{}, ErrLoopDrained
+	}
+	step := func(force bool) (DrainStats, error) {
+		d := &stddrain{force: force, done: make(chan DrainStats, 1)}
+		select {
+		case l.ch <- d:
+		case <-s.stopped:
+			return DrainStats{}, ErrServerClosed
+		}
+		select {
+		case st := <-d.done:
+			return st, nil
+		case <-s.stopped:
+			return DrainStats{}, ErrServerClosed
+		}
+	}
+	st, err := step(false)
+	if err != nil {
+		return st, err
+	}
+	deadline := time.Now().Add(timeout)
+	for atomic.LoadInt32(&l.stats.conns) > 0 && time.Now().Before(deadline) {
+		select {
+		case <-time.After(time.Millisecond * 10):
+		case <-s.stopped:
+			return st, ErrServerClosed
+		}
+	}
+	_, err = step(true)
+	return st, err
+}
+
+// stdloopDrain runs a step of Server.DrainLoop on the drained loop. The
+// writes are synchronous, so the connections are closed at once, unless
+// they are notified by Events.DrainNotice, then they are closed by the
+// client, or by the forced step.
+func stdloopDrain(s *stdserver, l *stdloop, d *stddrain) error {
+	var st DrainStats
+	var err error
+	for c := range l.conns {
+		if atomic.LoadInt32(&c.done) != 0 {
+			if d.force && c.udp == nil {
+				c.conn.Close() // the reader is stuck
+			}
+			continue
+		}
+		if !d.force {
+			st.Closed++
+			if s.events.DrainNotice != nil {
+				c.enter()
+				notice := s.events.DrainNotice(c)
+				c.leave()
+				stdloopWrite(s, c, notice)
+				if c.udp == nil {
+					continue
 				}
-			}(c)
+			}
+		}
+		if e := stdloopClose(s, l, c); e != nil {
+			err = e
 		}
 	}
+	d.done <- st
+	return err
+}
+
+// stdlistenerUDPConn passes the datagram to the virtual connection of the
+// remote address, the connection is created on the first datagram. It's
+// called by the listener, and by a loop for a datagram of an expired
+// connection, so the connection is sent to its loop before its datagrams.
+func stdlistenerUDPConn(s *stdserver, ln *listener, lnidx int, addr net.Addr, packet []byte) {
+	key := stdudpkey{lnidx, addr.String()}
+	in := append([]byte{}, packet...)
+	s.udpmu.Lock()
+	defer s.udpmu.Unlock()
+	if v, ok := s.udpconns.Load(key); ok {
+		c := v.(*stdconn)
+		c.loop.ch <- &stdin{c: c, in: in}
+		return
+	}
+	l := s.nextLoop()
+	if l == nil {
+		return // all of the loops are drained
+	}
+	c := &stdconn{loop: l, lnidx: lnidx, remoteAddr: addr}
+	c.accepted()
+	c.outsum, c.outceil = &l.stats.outbytes, s.outceil
+	c.setLoop(l.stats)
+	c.udp = &stdudppeer{key: key, pconn: ln.pconn}
+	s.udpconns.Store(key, c)
+	l.ch <- c
+	l.ch <- &stdin{c: c, in: in, first: true}
 }
 
 func stdloopRun(s *stdserver, l *stdloop) {
@@ -241,7 +565,7 @@ func stdloopRun(s *stdserver, l *stdloop) {
 		s.loopwg.Done()
 	}()
 	if l.idx == 0 && s.events.Tick != nil {
-		go func() {
+		goLabeled("ticker", func() {
 			for {
 				tick <- true
 				delay, ok := <-tock
@@ -250,12 +574,20 @@ func stdloopRun(s *stdserver, l *stdloop) {
 				}
 				time.Sleep(delay)
 			}
-		}()
+		})
 	}
 	//fmt.Println("-- loop started --", l.idx)
 	for {
 		select {
 		case <-tick:
+			for _, lp := range s.loops[1:] {
+				atomic.StoreInt32(&lp.rates, 1)
+				select {
+				case lp.cmdch <- struct{}{}:
+				default:
+				}
+			}
+			stdloopSampleRates(l) // before the Tick event, which may read them
 			delay, action := s.events.Tick()
 			switch action {
 			case Shutdown:
@@ -263,22 +595,19 @@ func stdloopRun(s *stdserver, l *stdloop) {
 			}
 			tock <- delay
 		case v := <-l.ch:
-			switch v := v.(type) {
-			case error:
-				err = v
-			case *stdconn:
-				err = stdloopAccept(s, l, v)
-			case *stdin:
-				out, action := stdloopReadReceive(s, v.c, v.in)
-				err = stdloopRead(s, l, v.c, out, action)
-			case *stdudpconn:
-				err = stdloopReadUDP(s, l, v)
-			case *stderr:
-				err = stdloopError(s, l, v.c, v.err)
-			case wakeReq:
-				out, action := stdloopReadSend(s, v.c)
-				err = stdloopRead(s, l, v.c, out, action)
+			if !l.stats.prioritized() {
+				err = stdloopMessage(s, l, v)
+				break
+			}
+			batch := stdloopBatch(l, v)
+			for i, v := range batch {
+				if err = stdloopMessage(s, l, v); err != nil {
+					l.backlog = batch[i+1:]
+					break
+				}
 			}
+		case <-l.cmdch:
+			err = stdloopCommands(s, l)
 		}
 		if err != nil {
 			return
@@ -286,10 +615,117 @@ func stdloopRun(s *stdserver, l *stdloop) {
 	}
 }
 
+// stdloopSampleRates samples the rates of the connections of the loop, see
+// Conn.RateRxBps.
+func stdloopSampleRates(l *stdloop) {
+	now := time.Now()
+	for c := range l.conns {
+		c.sampleRates(now)
+	}
+}
+
+// stdloopCommands runs all of the pending commands, and samples the rates
+// for a tick of the first loop.
+func stdloopCommands(s *stdserver, l *stdloop) error {
+	if atomic.SwapInt32(&l.rates, 0) == 1 {
+		stdloopSampleRates(l)
+	}
+	l.cmdmu.Lock()
+	cmds := l.cmds
+	l.cmds = nil
+	l.cmdmu.Unlock()
+	for _, cmd := range cmds {
+		if l.conns[cmd.c] && atomic.LoadInt32(&cmd.c.done) == 0 {
+			if err := cmd.fn(s, l, cmd.c); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// stdloopMessage handles a message of the loop channel.
+func stdloopMessage(s *stdserver, l *stdloop, v interface{}) (err error) {
+	switch v := v.(type) {
+	case error:
+		err = v
+	case *stdconn:
+		err = stdloopAccept(s, l, v)
+		if err == nil && l.stats.isDraining() {
+			err = stdloopClose(s, l, v) // accepted before the drain
+		}
+	case *stddrain:
+		err = stdloopDrain(s, l, v)
+	case *stdin:
+		if v.c.udp != nil && !l.conns[v.c] {
+			if v.first {
+				break // closed by the Opened event
+			}
+			// the virtual udp connection is expired after the datagram is
+			// passed to it, so a new one gets it
+			c := v.c
+			goLabeled("udp", func() {
+				stdlistenerUDPConn(s, s.lns[c.lnidx], c.lnidx, c.remoteAddr, v.in)
+			})
+			break
+		}
+		l.stats.addRead(len(v.in))
+		v.c.readDone(len(v.in))
+		out, action := stdloopReadReceive(s, v.c, v.in)
+		err = stdloopRead(s, l, v.c, out, action)
+	case *stdudpconn:
+		err = stdloopReadUDP(s, l, v)
+	case *stderr:
+		err = stdloopError(s, l, v.c, v.err)
+	case wakeReq:
+		if !v.c.woke() || v.c.shut() {
+			break // cancelled or closing
+		}
+		out, action := stdloopReadSend(s, v.c)
+		err = stdloopRead(s, l, v.c, out, action)
+	}
+	return err
+}
+
+// stdloopBatch takes the messages which are ready along with v, and sorts
+// them by the priority of their connections, the equal ones keep the order.
+func stdloopBatch(l *stdloop, v interface{}) []interface{} {
+	batch := []interface{}{v}
+fill:
+	for len(batch) < stdBatchSize {
+		select {
+		case v := <-l.ch:
+			batch = append(batch, v)
+		default:
+			break fill
+		}
+	}
+	sort.SliceStable(batch, func(i, j int) bool {
+		return stdPriority(batch[i]) > stdPriority(batch[j])
+	})
+	return batch
+}
+
+// stdBatchSize is the most messages which are ranked at once, like the
+// events of a poll wait.
+const stdBatchSize = 64
+
+// stdPriority is the priority of the connection of a message.
+func stdPriority(v interface{}) int {
+	switch v := v.(type) {
+	case *stdin:
+		return v.c.priority()
+	case *stderr:
+		return v.c.priority()
+	case wakeReq:
+		return v.c.priority()
+	}
+	return 0
+}
+
 func stdloopEgress(s *stdserver, l *stdloop) {
 	var closed bool
-loop:
-	for v := range l.ch {
+	egress := func(v interface{}) bool {
 		switch v := v.(type) {
 		case error:
 			if v == errCloseConns {
@@ -301,24 +737,43 @@ loop:
 		case *stderr:
 			stdloopError(s, l, v.c, v.err)
 		}
-		if len(l.conns) == 0 && closed {
-			break loop
+		return len(l.conns) == 0 && closed
+	}
+	// the messages of the batch which are left by an error
+	backlog := l.backlog
+	l.backlog = nil
+	for _, v := range backlog {
+		if egress(v) {
+			return
+		}
+	}
+	for v := range l.ch {
+		if egress(v) {
+			return
 		}
 	}
 }
 
 func stdloopError(s *stdserver, l *stdloop, c *stdconn, err error) error {
 	delete(l.conns, c)
+	atomic.AddInt32(&l.stats.conns, -1)
+	c.release()
+	s.iplimit.release(&c.connState)
 	closeEvent := true
 	switch atomic.LoadInt32(&c.done) {
 	case 0: // read error
 		c.conn.Close()
 		if err == io.EOF {
+			c.peerClosed()
 			err = nil
+		} else if errors.Is(err, syscall.ECONNRESET) {
+			c.peerReset()
 		}
+		c.closedBy(Remote)
 	case 1: // closed
 		c.conn.Close()
-		err = nil
+		c.closedBy(Local)
+		err = c.cerr
 	case 2: // detached
 		err = nil
 		if s.events.Detached == nil {
@@ -332,6 +787,7 @@ func stdloopError(s *stdserver, l *stdloop, c *stdconn, err error) error {
 		}
 	}
 	if closeEvent {
+		c.logCapture(c, err)
 		if s.events.Closed != nil {
 			switch s.events.Closed(c, err) {
 			case Shutdown:
@@ -373,14 +829,41 @@ func (c *stddetachedConn) Close() error {
 
 func (c *stddetachedConn) Wake() {}
 
-func stdloopRead(s *stdserver, l *stdloop, c *stdconn, out []byte, action Action) error {
-	var err error
-	if len(out) > 0 {
-		if s.events.PreWrite != nil {
-			s.events.PreWrite()
+// stdloopWrite writes the pending buffers and the out data to the connection.
+func stdloopWrite(s *stdserver, c *stdconn, out []byte) error {
+	c.queue(out)
+	if len(c.out) == 0 || c.corked {
+		return nil
+	}
+	if s.events.PreWrite != nil {
+		s.events.PreWrite()
+	}
+	if c.udp != nil {
+		for _, b := range c.takeOut() {
+			n, _ := c.udp.pconn.WriteTo(b, c.remoteAddr)
+			c.loop.stats.addWritten(n)
+			c.sent(n)
+			c.traceOut(c, [][]byte{b}, n)
 		}
-		_, err = c.conn.Write(out)
+		c.settle(nil)
+		return nil
 	}
+	bufs := net.Buffers(c.takeOut())
+	c.traceOut(c, bufs, -1) // before WriteTo, which consumes the buffers
+	c.congest(true)
+	n, err := bufs.WriteTo(c.conn)
+	c.congest(false)
+	c.loop.stats.addWritten(int(n))
+	c.sent(int(n))
+	c.settle(err)
+	return err
+}
+
+func stdloopRead(s *stdserver, l *stdloop, c *stdconn, out []byte, action Action) error {
+	if action != None {
+		c.corked = false // flush the held writes before the action
+	}
+	err := stdloopWrite(s, c, out)
 	switch action {
 	case Shutdown:
 		return errClosing
@@ -392,8 +875,26 @@ func stdloopRead(s *stdserver, l *stdloop, c *stdconn, out []byte, action Action
 	return err
 }
 
+// stdloopWokenMessages fires the WokenMessage events for the pending messages.
+func stdloopWokenMessages(s *stdserver, l *stdloop, c *stdconn) error {
+	var out []byte
+	var action Action
+	for _, msg := range c.takeMessages(l.stats) {
+		if s.events.WokenMessage == nil || action != None {
+			break
+		}
+		c.enter()
+		out, action = s.events.WokenMessage(c, msg)
+		c.leave()
+		c.queue(out)
+	}
+	return stdloopRead(s, l, c, nil, action)
+}
+
 func stdloopReadSend(s *stdserver, c *stdconn) ([]byte, Action) {
 	if s.events.Send != nil {
+		c.enter()
+		defer c.leave()
 		return s.events.Send(c)
 	}
 	return nil, None
@@ -405,20 +906,45 @@ func stdloopReadReceive(s *stdserver, c *stdconn, in []byte) ([]byte, Action) {
 		c.donein = append(c.donein, in...)
 		return nil, None
 	}
+	if c.shut() {
+		return nil, None // read before the reader is stopped by the close
+	}
+	c.received(len(in))
+	c.traceIn(c, in)
+	c.readMark(c, len(in))
+	if c.udp != nil {
+		c.touch()
+	}
+	if awaiting, action := c.awaitAck(in); awaiting {
+		return nil, action
+	}
+	if c.autoPong(in) {
+		return nil, None
+	}
+	if c.held(in) {
+		return nil, None
+	}
 	if s.events.Receive != nil {
+		c.enter()
+		defer c.leave()
 		return s.events.Receive(c, in)
 	}
 	return nil, None
 }
 
 func stdloopReadUDP(s *stdserver, l *stdloop, c *stdudpconn) error {
+	l.stats.addRead(len(c.in))
 	if s.events.Receive != nil {
 		out, action := s.events.Receive(c, c.in)
-		if len(out) > 0 {
+		c.queue(out)
+		if len(c.out) > 0 {
 			if s.events.PreWrite != nil {
 				s.events.PreWrite()
 			}
-			s.lns[c.addrIndex].pconn.WriteTo(out, c.remoteAddr)
+			for _, b := range c.out {
+				n, _ := s.lns[c.addrIndex].pconn.WriteTo(b, c.remoteAddr)
+				l.stats.addWritten(n)
+			}
 		}
 		switch action {
 		case Shutdown:
@@ -429,6 +955,9 @@ func stdloopReadUDP(s *stdserver, l *stdloop, c *stdudpconn) error {
 }
 
 func stdloopDetach(s *stdserver, l *stdloop, c *stdconn) error {
+	if c.udp != nil {
+		return nil // not available for udp connections
+	}
 	atomic.StoreInt32(&c.done, 2)
 	c.conn.SetReadDeadline(time.Now())
 	return nil
@@ -436,30 +965,114 @@ func stdloopDetach(s *stdserver, l *stdloop, c *stdconn) error {
 
 func stdloopClose(s *stdserver, l *stdloop, c *stdconn) error {
 	atomic.StoreInt32(&c.done, 1)
+	if c.udp != nil {
+		return stdloopCloseUDP(s, l, c)
+	}
 	c.conn.SetReadDeadline(time.Now())
 	return nil
 }
 
+// stdloopCloseUDP closes a virtual udp connection, which has no reader to
+// report the closing.
+func stdloopCloseUDP(s *stdserver, l *stdloop, c *stdconn) error {
+	c.closedBy(Local)
+	delete(l.conns, c)
+	atomic.AddInt32(&l.stats.conns, -1)
+	s.udpconns.Delete(c.udp.key)
+	c.release()
+	c.logCapture(c, c.cerr)
+	if s.events.Closed != nil {
+		switch s.events.Closed(c, c.cerr) {
+		case Shutdown:
+			return errClosing
+		}
+	}
+	return nil
+}
+
+func stdloopUDPIdle(s *stdserver, l *stdloop, c *stdconn) error {
+	if !c.idleExpired(s.events.UDPIdleTimeout) {
+		return nil
+	}
+	return stdloopClose(s, l, c)
+}
+
+func stdloopHandshakeTimeout(s *stdserver, l *stdloop, c *stdconn) error {
+	if !c.handshakeExpired() {
+		return nil
+	}
+	c.cerr = ErrHandshakeTimeout
+	return stdloopClose(s, l, c)
+}
+
+// keepAliveConfig is the keepalive of the options, the unset values are
+// left unchanged.
+func keepAliveConfig(opts Options) net.KeepAliveConfig {
+	cfg := net.KeepAliveConfig{Enable: true, Idle: opts.TCPKeepAlive, Interval: -1, Count: -1}
+	if opts.KeepAliveInterval > 0 {
+		cfg.Interval = opts.KeepAliveInterval
+	}
+	if opts.KeepAliveProbes > 0 {
+		cfg.Count = opts.KeepAliveProbes
+	}
+	return cfg
+}
+
 func stdloopAccept(s *stdserver, l *stdloop, c *stdconn) error {
 	l.conns[c] = true
+	atomic.AddInt32(&l.stats.conns, 1)
+	c.opening()
 	c.addrIndex = c.lnidx
 	c.localAddr = s.lns[c.lnidx].lnaddr
-	c.remoteAddr = c.conn.RemoteAddr()
+	if c.udp != nil {
+		c.watchIdle(s.events.UDPIdleTimeout, func() {
+			c.exec(stdloopUDPIdle)
+		})
+	} else {
+		c.remoteAddr = c.conn.RemoteAddr()
+	}
 
+	c.receive = s.events.Receive
+	c.closingfn = s.events.Closing
 	if s.events.Opened != nil {
+		c.enter()
 		out, opts, action := s.events.Opened(c)
-		if len(out) > 0 {
-			if s.events.PreWrite != nil {
-				s.events.PreWrite()
-			}
-			c.conn.Write(out)
-		}
+		c.leave()
+		c.setReadBuffer(opts)
+		c.setMaxWakes(opts)
+		c.setWriteCap(opts, c, s.events.WriteOverflow)
+		c.meter.start(opts)
+		c.trace = opts.Trace
+		c.capture, c.logcapture = newCaptureRing(opts.CaptureRing), opts.LogCapture
+		c.setAutoPong(opts)
+		c.comp = newCompressor(opts.CompressWrites)
+		stdloopWrite(s, c, out)
 		if opts.TCPKeepAlive > 0 {
-			if c, ok := c.conn.(*net.TCPConn); ok {
-				c.SetKeepAlive(true)
-				c.SetKeepAlivePeriod(opts.TCPKeepAlive)
+			if tc, ok := c.conn.(*net.TCPConn); ok {
+				tc.SetKeepAlive(true)
+				tc.SetKeepAlivePeriod(opts.TCPKeepAlive)
+				if opts.KeepAliveInterval > 0 || opts.KeepAliveProbes > 0 {
+					if err := tc.SetKeepAliveConfig(keepAliveConfig(opts)); err != nil {
+						c.noteError(err)
+						log.Printf("evio: keepalive probes are unsupported: %v", err)
+					}
+				}
 			}
 		}
+		if opts.RecvBuf > 0 {
+			c.SetRecvBuffer(opts.RecvBuf)
+		}
+		if opts.SendBuf > 0 {
+			c.SetSendBuffer(opts.SendBuf)
+		}
+		if opts.Linger != nil {
+			c.SetLinger(*opts.Linger)
+		}
+		if opts.HandshakeTimeout > 0 && c.handshakeExpired() {
+			c.hstimer = time.AfterFunc(opts.HandshakeTimeout, labeled("timer", func() {
+				c.exec(stdloopHandshakeTimeout)
+			}))
+		}
 		switch action {
 		case Shutdown:
 			return errClosing
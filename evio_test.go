@@ -6,11 +6,18 @@ package evio
 
 import (
 	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"hash/fnv"
 	"io"
+	"log"
 	"math/rand"
 	"net"
 	"os"
+	"runtime/pprof"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -401,6 +408,38 @@ func TestBadAddresses(t *testing.T) {
 	}
 }
 
+func TestServeAddrs(t *testing.T) {
+	var serving int32
+	var events Events
+	events.Serving = func(srv Server) (action Action) {
+		atomic.StoreInt32(&serving, 1)
+		return Shutdown
+	}
+	// the second tcp address is in use, so the bound ones are rolled back
+	err := ServeAddrs(events, "tcp://:9991, unix://socket9 ,tcp://:9991")
+	if err == nil || !strings.Contains(err.Error(), "cannot bind tcp://:9991") {
+		t.Fatalf("expected the failed address in the error, got %v", err)
+	}
+	if atomic.LoadInt32(&serving) != 0 {
+		t.Fatal("expected no serving")
+	}
+	ln, err := net.Listen("tcp", ":9991")
+	if err != nil {
+		t.Fatalf("expected the listener closed, got %v", err)
+	}
+	ln.Close()
+	if _, err := os.Stat("socket9"); !os.IsNotExist(err) {
+		t.Fatalf("expected the unix socket removed, got %v", err)
+	}
+	if err := ServeAddrs(events, "tcp://:9991,"); err == nil || !strings.Contains(err.Error(), "empty address") {
+		t.Fatalf("expected an empty address error, got %v", err)
+	}
+	must(ServeAddrs(events, "tcp://:9991,unix://socket9"))
+	if atomic.LoadInt32(&serving) != 1 {
+		t.Fatal("expected serving")
+	}
+}
+
 func TestInputStream(t *testing.T) {
 	var s InputStream
 	in := []byte("HELLO")
@@ -457,6 +496,62 @@ func TestReuseInputBuffer(t *testing.T) {
 
 }
 
+func TestSetReuseInputBuffer(t *testing.T) {
+	const rounds = 50
+	var done int32
+	var kept [][]byte
+	var events Events
+	events.Opened = func(c Conn) (out []byte, opts Options, action Action) {
+		opts.ReuseInputBuffer = true
+		return
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		if c.Context() == nil && strings.HasPrefix(string(in), "keep") {
+			c.SetContext("keeper")
+			c.SetReuseInputBuffer(false) // the bytes are kept from now on
+			in = append([]byte{}, in...)
+		}
+		if c.Context() == "keeper" {
+			kept = append(kept, in)
+		}
+		return in, None
+	}
+	events.Serving = func(srv Server) (action Action) {
+		go func() {
+			defer atomic.StoreInt32(&done, 1)
+			keeper, err := net.Dial("tcp", ":9991")
+			must(err)
+			defer keeper.Close()
+			shared, err := net.Dial("tcp", ":9991")
+			must(err)
+			defer shared.Close()
+			echo := func(conn net.Conn, msg string) {
+				_, err := conn.Write([]byte(msg))
+				must(err)
+				_, err = io.ReadFull(conn, make([]byte, len(msg)))
+				must(err)
+			}
+			for i := 0; i < rounds; i++ {
+				echo(keeper, fmt.Sprintf("keep %02d", i))
+				echo(shared, fmt.Sprintf("temp %02d", i)) // reuses the packet
+			}
+			for i, in := range kept {
+				if want := fmt.Sprintf("keep %02d", i); string(in) != want {
+					panic(fmt.Sprintf("expected %q kept intact, got %q", want, in))
+				}
+			}
+		}()
+		return
+	}
+	events.Tick = func() (delay time.Duration, action Action) {
+		if atomic.LoadInt32(&done) == 1 {
+			return 0, Shutdown
+		}
+		return time.Second / 20, None
+	}
+	must(Serve(events, "tcp://:9991"))
+}
+
 func TestReuseport(t *testing.T) {
 	var events Events
 	events.Serving = func(s Server) (action Action) {
@@ -476,3 +571,4055 @@ func TestReuseport(t *testing.T) {
 	}
 	wg.Wait()
 }
+
+func TestHandshakeTimeout(t *testing.T) {
+	t.Run("poll", func(t *testing.T) {
+		testHandshakeTimeout("tcp", ":9991", false)
+	})
+	t.Run("stdlib", func(t *testing.T) {
+		testHandshakeTimeout("tcp", ":9992", true)
+	})
+}
+
+func testHandshakeTimeout(network, addr string, stdlib bool) {
+	var timeouts int32
+	var events Events
+	events.Opened = func(c Conn) (out []byte, opts Options, action Action) {
+		opts.HandshakeTimeout = time.Second / 10
+		return
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		CompleteHandshake(c)
+		c.SetContext("established")
+		return
+	}
+	events.Closed = func(c Conn, err error) (action Action) {
+		if err == ErrHandshakeTimeout {
+			if c.Context() != nil {
+				panic("established connection timed out")
+			}
+			atomic.AddInt32(&timeouts, 1)
+		}
+		return
+	}
+	events.Serving = func(srv Server) (action Action) {
+		go func() {
+			// finishes the handshake
+			conn, err := net.Dial(network, addr)
+			must(err)
+			defer conn.Close()
+			conn.Write([]byte("hello"))
+			time.Sleep(time.Second / 2)
+		}()
+		go func() {
+			// never finishes the handshake
+			conn, err := net.Dial(network, addr)
+			must(err)
+			defer conn.Close()
+			if _, err := conn.Read([]byte{0}); err == nil {
+				panic("expected error")
+			}
+		}()
+		return
+	}
+	start := time.Now()
+	events.Tick = func() (delay time.Duration, action Action) {
+		if time.Since(start) > time.Second/3 {
+			if atomic.LoadInt32(&timeouts) != 1 {
+				panic("expected one handshake timeout")
+			}
+			action = Shutdown
+		}
+		delay = time.Second / 20
+		return
+	}
+	if stdlib {
+		must(Serve(events, network+"-net://"+addr))
+	} else {
+		must(Serve(events, network+"://"+addr))
+	}
+}
+
+func TestWriteAll(t *testing.T) {
+	t.Run("poll", func(t *testing.T) {
+		testWriteAll("tcp", ":9991", false)
+	})
+	t.Run("stdlib", func(t *testing.T) {
+		testWriteAll("tcp", ":9992", true)
+	})
+}
+
+func testWriteAll(network, addr string, stdlib bool) {
+	var done int32
+	var events Events
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		WriteAll(c, [][]byte{[]byte("frame1\r\n"), nil, []byte("frame2\r\n")})
+		out = []byte("frame3\r\n")
+		return
+	}
+	events.Serving = func(srv Server) (action Action) {
+		go func() {
+			conn, err := net.Dial(network, addr)
+			must(err)
+			defer conn.Close()
+			conn.Write([]byte("hello"))
+			expected := "frame1\r\nframe2\r\nframe3\r\n"
+			p := make([]byte, len(expected))
+			_, err = io.ReadFull(conn, p)
+			must(err)
+			if string(p) != expected {
+				panic("mismatch")
+			}
+			atomic.StoreInt32(&done, 1)
+		}()
+		return
+	}
+	events.Tick = func() (delay time.Duration, action Action) {
+		if atomic.LoadInt32(&done) == 1 {
+			action = Shutdown
+		}
+		delay = time.Second / 20
+		return
+	}
+	if stdlib {
+		must(Serve(events, network+"-net://"+addr))
+	} else {
+		must(Serve(events, network+"://"+addr))
+	}
+}
+
+func TestExpectWithin(t *testing.T) {
+	t.Run("poll", func(t *testing.T) {
+		testExpectWithin("tcp", ":9991", false)
+	})
+	t.Run("stdlib", func(t *testing.T) {
+		testExpectWithin("tcp", ":9992", true)
+	})
+}
+
+func testExpectWithin(network, addr string, stdlib bool) {
+	var timeouts, done int32
+	var events Events
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		if string(in) == "late" {
+			panic("expected timeout before late response")
+		}
+		ExpectWithin(c, time.Second/10, func(c Conn) (action Action) {
+			atomic.AddInt32(&timeouts, 1)
+			return Close
+		})
+		out = in
+		return
+	}
+	events.Serving = func(srv Server) (action Action) {
+		go func() {
+			conn, err := net.Dial(network, addr)
+			must(err)
+			defer conn.Close()
+			p := make([]byte, 5)
+			// responds in time
+			conn.Write([]byte("early"))
+			_, err = io.ReadFull(conn, p)
+			must(err)
+			time.Sleep(time.Second / 50)
+			conn.Write([]byte("quick"))
+			_, err = io.ReadFull(conn, p)
+			must(err)
+			// responds too late
+			time.Sleep(time.Second / 4)
+			conn.Write([]byte("late"))
+			if _, err := conn.Read(p); err == nil {
+				panic("expected error")
+			}
+			atomic.StoreInt32(&done, 1)
+		}()
+		return
+	}
+	events.Tick = func() (delay time.Duration, action Action) {
+		if atomic.LoadInt32(&done) == 1 {
+			if atomic.LoadInt32(&timeouts) != 1 {
+				panic("expected one timeout")
+			}
+			action = Shutdown
+		}
+		delay = time.Second / 20
+		return
+	}
+	if stdlib {
+		must(Serve(events, network+"-net://"+addr))
+	} else {
+		must(Serve(events, network+"://"+addr))
+	}
+}
+
+func TestFlush(t *testing.T) {
+	t.Run("poll", func(t *testing.T) {
+		testFlush("tcp", ":9991", false)
+	})
+	t.Run("stdlib", func(t *testing.T) {
+		testFlush("tcp", ":9992", true)
+	})
+}
+
+func testFlush(network, addr string, stdlib bool) {
+	var flushed, done int32
+	var pushed Conn
+	payload := make([]byte, 4*1024*1024)
+	var events Events
+	events.NumLoops = 1 // the probe shares the loop of the push
+	events.Opened = func(c Conn) (out []byte, opts Options, action Action) {
+		opts.SendBuf = 64 << 10
+		return
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		if in == nil {
+			// woken
+			return payload, None
+		}
+		if string(in) == "probe" {
+			// the loop cannot wait for the payload of another connection
+			if err := Flush(pushed); err != ErrOnLoop {
+				panic(fmt.Sprintf("expected ErrOnLoop, got %v", err))
+			}
+			// nor for the queueing, which happens after the event
+			if buffered, err := QueueWrite(pushed, nil); !buffered || err != nil {
+				panic(fmt.Sprintf("expected a queued write, got %v", err))
+			}
+			return []byte("ok"), None
+		}
+		if err := Flush(c); err != ErrOnLoop {
+			panic(fmt.Sprintf("expected ErrOnLoop, got %v", err))
+		}
+		pushed = c
+		go func() {
+			c.Wake()
+			err := Flush(c)
+			for err == ErrOnLoop {
+				time.Sleep(time.Millisecond)
+				err = Flush(c)
+			}
+			if err != nil {
+				panic(err)
+			}
+			atomic.StoreInt32(&flushed, 1)
+		}()
+		return
+	}
+	events.Serving = func(srv Server) (action Action) {
+		go func() {
+			conn, err := net.Dial(network, addr)
+			must(err)
+			defer conn.Close()
+			must(conn.(*net.TCPConn).SetReadBuffer(64 << 10))
+			conn.Write([]byte("push"))
+			// the payload is pending while it's not read
+			time.Sleep(time.Second / 5)
+			if atomic.LoadInt32(&flushed) != 0 {
+				panic("expected the Flush to wait for the payload")
+			}
+			p := make([]byte, len(payload))
+			_, err = io.ReadFull(conn, p)
+			must(err)
+			// closing before the Flush returns fails it with ErrConnClosed
+			for atomic.LoadInt32(&flushed) == 0 {
+				time.Sleep(time.Millisecond)
+			}
+			probe, err := net.Dial(network, addr)
+			must(err)
+			defer probe.Close()
+			probe.Write([]byte("probe"))
+			ok := make([]byte, 2)
+			_, err = io.ReadFull(probe, ok)
+			must(err)
+			if string(ok) != "ok" {
+				panic("expected the probe to be answered")
+			}
+			atomic.StoreInt32(&done, 1)
+		}()
+		return
+	}
+	events.Tick = func() (delay time.Duration, action Action) {
+		if atomic.LoadInt32(&done) == 1 && atomic.LoadInt32(&flushed) == 1 {
+			action = Shutdown
+		}
+		delay = time.Second / 20
+		return
+	}
+	if stdlib {
+		must(Serve(events, network+"-net://"+addr))
+	} else {
+		must(Serve(events, network+"://"+addr))
+	}
+}
+
+func TestHangup(t *testing.T) {
+	t.Run("poll", func(t *testing.T) {
+		testHangup("unix", "socket1", false)
+	})
+	t.Run("stdlib", func(t *testing.T) {
+		testHangup("unix", "socket2", true)
+	})
+}
+
+func testHangup(network, addr string, stdlib bool) {
+	data := make([]byte, 256*1024)
+	rand.Read(data)
+	var received []byte
+	var events Events
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		received = append(received, in...)
+		return
+	}
+	events.Closed = func(c Conn, err error) (action Action) {
+		if string(received) != string(data) {
+			panic("final bytes were not delivered before close")
+		}
+		return Shutdown
+	}
+	events.Serving = func(srv Server) (action Action) {
+		go func() {
+			conn, err := net.Dial(network, addr)
+			must(err)
+			conn.Write(data)
+			conn.Close()
+		}()
+		return
+	}
+	if stdlib {
+		must(Serve(events, network+"-net://"+addr))
+	} else {
+		must(Serve(events, network+"://"+addr))
+	}
+}
+
+func TestReadBufferPolicy(t *testing.T) {
+	var cs connState
+	cs.setReadBuffer(Options{ReadBufferSize: 1024})
+	cs.readDone(1024)
+	if cs.readSize() != 1024 {
+		t.Fatalf("expected fixed size, got %d", cs.readSize())
+	}
+	cs.setReadBuffer(Options{
+		ReadBufferSize:    1024,
+		ReadBufferPolicy:  DoublingReadBuffer,
+		MaxReadBufferSize: 3000,
+	})
+	for _, expected := range []int{2048, 3000, 3000} {
+		cs.readDone(cs.readSize())
+		if cs.readSize() != expected {
+			t.Fatalf("expected %d, got %d", expected, cs.readSize())
+		}
+	}
+	for _, expected := range []int{1500, 1024, 1024} {
+		cs.readDone(10)
+		if cs.readSize() != expected {
+			t.Fatalf("expected %d, got %d", expected, cs.readSize())
+		}
+	}
+}
+
+// BenchmarkReadBufferPolicy streams a megabyte per op, the reads/op are the
+// read syscalls of the loop, which are the Data events, and rbuf is the
+// largest read buffer of the connection.
+func BenchmarkReadBufferPolicy(b *testing.B) {
+	const size = 1024 * 1024
+	for _, bench := range []struct {
+		name string
+		opts Options
+	}{
+		{"fixed-4k", Options{ReadBufferSize: 4096}},
+		{"fixed-64k", Options{ReadBufferSize: 65536}},
+		{"doubling-4k-1m", Options{ReadBufferSize: 4096,
+			ReadBufferPolicy: DoublingReadBuffer, MaxReadBufferSize: size}},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			var done, reads, rbuf int32
+			var total int
+			var events Events
+			events.Opened = func(c Conn) (out []byte, opts Options, action Action) {
+				return nil, bench.opts, None
+			}
+			events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+				atomic.AddInt32(&reads, 1)
+				if n := int32(c.(interface{ state() *connState }).state().readSize()); n > atomic.LoadInt32(&rbuf) {
+					atomic.StoreInt32(&rbuf, n)
+				}
+				if total += len(in); total >= size {
+					total -= size
+					return []byte("k"), None
+				}
+				return
+			}
+			events.Serving = func(srv Server) (action Action) {
+				go func() {
+					defer atomic.StoreInt32(&done, 1)
+					c, err := net.Dial("tcp", srv.Addrs[0].String())
+					must(err)
+					defer c.Close()
+					data := make([]byte, size)
+					b.SetBytes(size)
+					b.ReportAllocs()
+					b.ResetTimer()
+					for i := 0; i < b.N; i++ {
+						_, err := c.Write(data)
+						must(err)
+						_, err = io.ReadFull(c, make([]byte, 1))
+						must(err)
+					}
+					b.StopTimer()
+					b.ReportMetric(float64(atomic.LoadInt32(&reads))/float64(b.N), "reads/op")
+					b.ReportMetric(float64(atomic.LoadInt32(&rbuf)), "rbuf")
+				}()
+				return
+			}
+			events.Tick = func() (delay time.Duration, action Action) {
+				if atomic.LoadInt32(&done) == 1 {
+					action = Shutdown
+				}
+				return time.Second / 20, action
+			}
+			must(Serve(events, "tcp://127.0.0.1:0"))
+		})
+	}
+}
+
+func TestEphemeralPort(t *testing.T) {
+	for _, stdlib := range []bool{false, true} {
+		var done int32
+		var events Events
+		events.Serving = func(srv Server) (action Action) {
+			if len(srv.Addrs) != 2 {
+				t.Fatalf("expected 2 addrs, got %d", len(srv.Addrs))
+			}
+			for _, addr := range srv.Addrs {
+				if strings.HasSuffix(addr.String(), ":0") {
+					t.Fatalf("expected resolved port, got %s", addr)
+				}
+			}
+			go func() {
+				conn, err := net.Dial("tcp", srv.Addrs[0].String())
+				must(err)
+				conn.Close()
+				atomic.StoreInt32(&done, 1)
+			}()
+			return
+		}
+		events.Tick = func() (delay time.Duration, action Action) {
+			if atomic.LoadInt32(&done) == 1 {
+				action = Shutdown
+			}
+			delay = time.Second / 20
+			return
+		}
+		if stdlib {
+			must(Serve(events, "tcp-net://127.0.0.1:0", "udp-net://127.0.0.1:0"))
+		} else {
+			must(Serve(events, "tcp://127.0.0.1:0", "udp://127.0.0.1:0"))
+		}
+	}
+}
+
+func TestUDPConns(t *testing.T) {
+	t.Run("poll", func(t *testing.T) {
+		testUDPConns("udp", ":9991", false)
+	})
+	t.Run("stdlib", func(t *testing.T) {
+		testUDPConns("udp", ":9992", true)
+	})
+}
+
+func testUDPConns(network, addr string, stdlib bool) {
+	type counter struct {
+		testSession
+		n int
+	}
+	var opened, closed int32
+	var events Events
+	events.UDPIdleTimeout = time.Second / 5
+	events.Opened = func(c Conn) (out []byte, opts Options, action Action) {
+		atomic.AddInt32(&opened, 1)
+		BindSessionByAddr(c, &counter{})
+		return
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		sess := GetSession(c).(*counter)
+		if in == nil {
+			return []byte("woke"), None
+		}
+		if string(in) == "wake" {
+			go FindConnById(sess.GetId()).Wake()
+			return
+		}
+		sess.n++
+		return []byte(fmt.Sprint(sess.n)), None
+	}
+	events.Closed = func(c Conn, err error) (action Action) {
+		if FindConnById(c.RemoteAddr().String()) != c {
+			panic("expected session bound by addr")
+		}
+		DestroySession(c)
+		atomic.AddInt32(&closed, 1)
+		return
+	}
+	var done int32
+	events.Serving = func(srv Server) (action Action) {
+		go func() {
+			conn, err := net.Dial(network, addr)
+			must(err)
+			defer conn.Close()
+			packet := make([]byte, 64)
+			expect := func(data string) {
+				conn.SetReadDeadline(time.Now().Add(time.Second))
+				n, err := conn.Read(packet)
+				must(err)
+				if string(packet[:n]) != data {
+					panic(fmt.Sprintf("expected %q, got %q", data, packet[:n]))
+				}
+			}
+			for _, data := range []string{"1", "2", "3"} {
+				conn.Write([]byte("ping"))
+				expect(data)
+			}
+			conn.Write([]byte("wake"))
+			expect("woke")
+			time.Sleep(time.Second / 2)
+			if atomic.LoadInt32(&closed) != 1 {
+				panic("expected idle connection closed")
+			}
+			// a new datagram opens a new connection
+			conn.Write([]byte("ping"))
+			expect("1")
+			if atomic.LoadInt32(&opened) != 2 {
+				panic("expected a new connection")
+			}
+			atomic.StoreInt32(&done, 1)
+		}()
+		return
+	}
+	events.Tick = func() (delay time.Duration, action Action) {
+		delay = time.Second / 20
+		if atomic.LoadInt32(&done) == 1 {
+			action = Shutdown
+		}
+		return
+	}
+	if stdlib {
+		must(Serve(events, network+"-net://"+addr))
+	} else {
+		must(Serve(events, network+"://"+addr))
+	}
+	if atomic.LoadInt32(&closed) != 2 {
+		panic("expected closed on shutdown")
+	}
+}
+
+func TestUDPConnsRace(t *testing.T) {
+	t.Run("poll", func(t *testing.T) {
+		testUDPConnsRace("udp", ":9991", false)
+	})
+	t.Run("stdlib", func(t *testing.T) {
+		testUDPConnsRace("udp", ":9992", true)
+	})
+}
+
+func testUDPConnsRace(network, addr string, stdlib bool) {
+	const numPeers, numPings = 16, 8
+	var mu sync.Mutex
+	open := make(map[string]bool)
+	var opened, done int32
+	var events Events
+	events.NumLoops = 4 // the loops read the same socket
+	events.UDPIdleTimeout = time.Minute
+	events.Opened = func(c Conn) (out []byte, opts Options, action Action) {
+		mu.Lock()
+		defer mu.Unlock()
+		if open[c.RemoteAddr().String()] {
+			panic("expected one connection of the peer")
+		}
+		open[c.RemoteAddr().String()] = true
+		atomic.AddInt32(&opened, 1)
+		return
+	}
+	events.Closed = func(c Conn, err error) (action Action) {
+		mu.Lock()
+		delete(open, c.RemoteAddr().String())
+		mu.Unlock()
+		return
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		if string(in) == "bye" {
+			// the next datagram is passed to the connection meanwhile
+			time.Sleep(time.Second / 10)
+			return nil, Close
+		}
+		return in, None
+	}
+	events.Serving = func(srv Server) (action Action) {
+		go func() {
+			defer atomic.StoreInt32(&done, 1)
+			var wg sync.WaitGroup
+			for i := 0; i < numPeers; i++ {
+				conn, err := net.Dial(network, addr)
+				must(err)
+				defer conn.Close()
+				wg.Add(1)
+				go func(conn net.Conn) {
+					defer wg.Done()
+					// a burst of the first datagrams, which the loops race for
+					for j := 0; j < numPings; j++ {
+						conn.Write([]byte("ping"))
+					}
+					packet := make([]byte, 64)
+					for j := 0; j < numPings; j++ {
+						conn.SetReadDeadline(time.Now().Add(time.Second))
+						_, err := conn.Read(packet)
+						must(err)
+					}
+				}(conn)
+			}
+			wg.Wait()
+			if n := atomic.LoadInt32(&opened); n != numPeers {
+				panic(fmt.Sprintf("expected %d connections, got %d", numPeers, n))
+			}
+			// a datagram which reaches a closed connection is not lost
+			conn, err := net.Dial(network, addr)
+			must(err)
+			defer conn.Close()
+			conn.Write([]byte("bye"))
+			conn.Write([]byte("after"))
+			packet := make([]byte, 64)
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			n, err := conn.Read(packet)
+			must(err)
+			if string(packet[:n]) != "after" {
+				panic(fmt.Sprintf("expected %q, got %q", "after", packet[:n]))
+			}
+			if n := atomic.LoadInt32(&opened); n != numPeers+2 {
+				panic(fmt.Sprintf("expected a new connection, got %d", n-numPeers))
+			}
+		}()
+		return
+	}
+	events.Tick = func() (delay time.Duration, action Action) {
+		delay = time.Second / 20
+		if atomic.LoadInt32(&done) == 1 {
+			action = Shutdown
+		}
+		return
+	}
+	if stdlib {
+		must(Serve(events, network+"-net://"+addr))
+	} else {
+		must(Serve(events, network+"://"+addr))
+	}
+}
+
+func TestMaxConnsPerIP(t *testing.T) {
+	t.Run("poll", func(t *testing.T) {
+		testMaxConnsPerIP("tcp", ":9991", false)
+	})
+	t.Run("stdlib", func(t *testing.T) {
+		testMaxConnsPerIP("tcp", ":9992", true)
+	})
+	lim := newIPLimiter(1)
+	var cs1, cs2 connState
+	addr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	if !lim.acquire(&cs1, addr) || lim.acquire(&cs2, addr) {
+		t.Fatal("expected only one connection acquired")
+	}
+	lim.release(&cs1)
+	lim.release(&cs2)
+	if len(lim.counts) != 0 {
+		t.Fatalf("expected no entries, got %v", lim.counts)
+	}
+}
+
+func testMaxConnsPerIP(network, addr string, stdlib bool) {
+	var events Events
+	events.MaxConnsPerIP = 2
+	events.Opened = func(c Conn) (out []byte, opts Options, action Action) {
+		return []byte("hi\n"), opts, None
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		return nil, Close
+	}
+	var done int32
+	events.Serving = func(srv Server) (action Action) {
+		go func() {
+			defer atomic.StoreInt32(&done, 1)
+			dial := func() (net.Conn, bool) {
+				conn, err := net.Dial(network, addr)
+				must(err)
+				conn.SetReadDeadline(time.Now().Add(time.Second))
+				line, err := bufio.NewReader(conn).ReadString('\n')
+				return conn, err == nil && line == "hi\n"
+			}
+			c1, ok1 := dial()
+			c2, ok2 := dial()
+			c3, ok3 := dial()
+			defer c1.Close()
+			defer c2.Close()
+			defer c3.Close()
+			if !ok1 || !ok2 || ok3 {
+				panic(fmt.Sprintf("expected the third rejected: %v %v %v", ok1, ok2, ok3))
+			}
+			// closed by the server, the slot is released
+			c1.Write([]byte("bye"))
+			c1.Read(make([]byte, 1))
+			c4, ok4 := dial()
+			defer c4.Close()
+			if !ok4 {
+				panic("expected a connection after releasing")
+			}
+		}()
+		return
+	}
+	events.Tick = func() (delay time.Duration, action Action) {
+		if atomic.LoadInt32(&done) == 1 {
+			action = Shutdown
+		}
+		return time.Second / 20, action
+	}
+	if stdlib {
+		must(Serve(events, network+"-net://"+addr))
+	} else {
+		must(Serve(events, network+"://"+addr))
+	}
+}
+
+func TestMaxAcceptsPerSec(t *testing.T) {
+	t.Run("poll", func(t *testing.T) {
+		testMaxAcceptsPerSec("tcp", ":9991", false, 0)
+	})
+	t.Run("poll-accept-loops", func(t *testing.T) {
+		testMaxAcceptsPerSec("tcp", ":9991", false, 2)
+	})
+	t.Run("stdlib", func(t *testing.T) {
+		testMaxAcceptsPerSec("tcp", ":9992", true, 0)
+	})
+}
+
+func testMaxAcceptsPerSec(network, addr string, stdlib bool, acceptLoops int) {
+	const conns = 40
+	var events Events
+	events.NumLoops = 2
+	events.AcceptLoops = acceptLoops
+	events.MaxAcceptsPerSec = 100 // a burst of 10, then 10ms for each
+	events.Opened = func(c Conn) (out []byte, opts Options, action Action) {
+		return []byte("hi\n"), opts, None
+	}
+	var done int32
+	events.Serving = func(srv Server) (action Action) {
+		go func() {
+			defer atomic.StoreInt32(&done, 1)
+			start := time.Now()
+			var wg sync.WaitGroup
+			for i := 0; i < conns; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					conn, err := net.Dial(network, addr)
+					must(err)
+					defer conn.Close()
+					conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+					line, err := bufio.NewReader(conn).ReadString('\n')
+					if err != nil || line != "hi\n" {
+						panic(fmt.Sprintf("expected an opened connection, got %q %v", line, err))
+					}
+				}()
+			}
+			wg.Wait()
+			if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+				panic(fmt.Sprintf("expected the accepts throttled, all opened in %v", elapsed))
+			}
+			if n := srv.AcceptsThrottled(); n == 0 {
+				panic("expected the throttled accepts counted")
+			}
+		}()
+		return
+	}
+	events.Tick = func() (delay time.Duration, action Action) {
+		if atomic.LoadInt32(&done) == 1 {
+			action = Shutdown
+		}
+		return time.Second / 20, action
+	}
+	if stdlib {
+		must(Serve(events, network+"-net://"+addr))
+	} else {
+		must(Serve(events, network+"://"+addr))
+	}
+}
+
+// A connection only has the state, other methods are not implemented
+type stateConn struct {
+	Conn
+	cs connState
+}
+
+func (c *stateConn) state() *connState { return &c.cs }
+
+func TestCorrelationTracker(t *testing.T) {
+	var tr CorrelationTracker
+	c := &stateConn{}
+	must(tr.Expect(c, 1))
+	// delivered before awaiting
+	if !tr.Deliver(c, 1, []byte("one")) {
+		t.Fatal("expected a waiter")
+	}
+	resp, err := tr.Await(c, 1, time.Second)
+	if err != nil || string(resp) != "one" {
+		t.Fatalf("expected one, got %q %v", resp, err)
+	}
+	go func() {
+		time.Sleep(time.Second / 20)
+		tr.Deliver(c, 2, []byte("two"))
+	}()
+	resp, err = tr.Await(c, 2, time.Second)
+	if err != nil || string(resp) != "two" {
+		t.Fatalf("expected two, got %q %v", resp, err)
+	}
+	if _, err := tr.Await(c, 3, time.Second/20); err != ErrResponseTimeout {
+		t.Fatalf("expected ErrResponseTimeout, got %v", err)
+	}
+	if tr.Deliver(c, 3, nil) {
+		t.Fatal("expected no waiter after the timeout")
+	}
+	go func() {
+		time.Sleep(time.Second / 20)
+		c.cs.release()
+	}()
+	if _, err := tr.Await(c, 4, time.Second); err != ErrConnClosed {
+		t.Fatalf("expected ErrConnClosed, got %v", err)
+	}
+	if _, err := tr.Await(c, 5, time.Second); err != ErrConnClosed {
+		t.Fatalf("expected ErrConnClosed for a closed conn, got %v", err)
+	}
+	if len(tr.conns) != 0 {
+		t.Fatal("expected the closed conn removed")
+	}
+}
+
+func TestLoopStats(t *testing.T) {
+	t.Run("poll", func(t *testing.T) {
+		testLoopStats("tcp", ":9991", false)
+	})
+	t.Run("stdlib", func(t *testing.T) {
+		testLoopStats("tcp", ":9992", true)
+	})
+}
+
+func testLoopStats(network, addr string, stdlib bool) {
+	var events Events
+	events.NumLoops = 2
+	events.LoadBalance = RoundRobin
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		return in, None
+	}
+	var stats func() []LoopStat
+	var done int32
+	events.Serving = func(srv Server) (action Action) {
+		stats = srv.LoopStats
+		go func() {
+			defer atomic.StoreInt32(&done, 1)
+			var conns []net.Conn
+			for i := 0; i < 4; i++ {
+				conn, err := net.Dial(network, addr)
+				must(err)
+				defer conn.Close()
+				conn.Write([]byte("hello"))
+				_, err = io.ReadFull(conn, make([]byte, 5))
+				must(err)
+				conns = append(conns, conn)
+			}
+			var total LoopStat
+			for i, st := range stats() {
+				if st.Index != i {
+					panic("unexpected loop index")
+				}
+				total.ActiveConns += st.ActiveConns
+				total.BytesRead += st.BytesRead
+				total.BytesWritten += st.BytesWritten
+			}
+			if total.ActiveConns != 4 || total.BytesRead != 20 || total.BytesWritten != 20 {
+				panic(fmt.Sprintf("unexpected stats: %+v", total))
+			}
+		}()
+		return
+	}
+	events.Tick = func() (delay time.Duration, action Action) {
+		if atomic.LoadInt32(&done) == 1 {
+			action = Shutdown
+		}
+		return time.Second / 20, action
+	}
+	if stdlib {
+		must(Serve(events, network+"-net://"+addr))
+	} else {
+		must(Serve(events, network+"://"+addr))
+	}
+	var active int
+	for _, st := range stats() {
+		active += st.ActiveConns
+	}
+	if active != 0 {
+		panic(fmt.Sprintf("expected no active conns, got %d", active))
+	}
+}
+
+func TestSendThenAwaitClose(t *testing.T) {
+	t.Run("poll", func(t *testing.T) {
+		testSendThenAwaitClose("tcp", ":9991", false)
+	})
+	t.Run("stdlib", func(t *testing.T) {
+		testSendThenAwaitClose("tcp", ":9992", true)
+	})
+}
+
+func testSendThenAwaitClose(network, addr string, stdlib bool) {
+	var events Events
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		if string(in) != "quit" {
+			panic(fmt.Sprintf("unexpected data %q", in))
+		}
+		SendThenAwaitClose(c, []byte("bye\n"), func(in []byte) bool {
+			return string(in) == "ack"
+		}, time.Second/5)
+		return
+	}
+	var mu sync.Mutex
+	errs := make(map[string]error)
+	events.Closed = func(c Conn, err error) (action Action) {
+		mu.Lock()
+		errs[c.RemoteAddr().String()] = err
+		mu.Unlock()
+		return
+	}
+	var done int32
+	events.Serving = func(srv Server) (action Action) {
+		go func() {
+			defer atomic.StoreInt32(&done, 1)
+			var wg sync.WaitGroup
+			for _, reply := range []string{"ack", "nope"} {
+				wg.Add(1)
+				go func(reply string) {
+					defer wg.Done()
+					conn, err := net.Dial(network, addr)
+					must(err)
+					defer conn.Close()
+					conn.Write([]byte("quit"))
+					rd := bufio.NewReader(conn)
+					line, err := rd.ReadString('\n')
+					must(err)
+					if line != "bye\n" {
+						panic("expected bye")
+					}
+					conn.Write([]byte(reply))
+					conn.SetReadDeadline(time.Now().Add(time.Second))
+					if _, err := rd.ReadByte(); err != io.EOF {
+						panic(fmt.Sprintf("expected EOF, got %v", err))
+					}
+					// the socket is closed before the Closed event
+					var ok bool
+					for i := 0; i < 100 && !ok; i++ {
+						time.Sleep(time.Millisecond * 10)
+						mu.Lock()
+						err, ok = errs[conn.LocalAddr().String()]
+						mu.Unlock()
+					}
+					if !ok {
+						panic("expected closed")
+					}
+					if reply == "ack" && err != nil {
+						panic(fmt.Sprintf("expected no error, got %v", err))
+					}
+					if reply == "nope" && err != ErrResponseTimeout {
+						panic(fmt.Sprintf("expected ErrResponseTimeout, got %v", err))
+					}
+				}(reply)
+			}
+			wg.Wait()
+		}()
+		return
+	}
+	events.Tick = func() (delay time.Duration, action Action) {
+		if atomic.LoadInt32(&done) == 1 {
+			action = Shutdown
+		}
+		return time.Second / 20, action
+	}
+	if stdlib {
+		must(Serve(events, network+"-net://"+addr))
+	} else {
+		must(Serve(events, network+"://"+addr))
+	}
+}
+
+func TestCompressWrites(t *testing.T) {
+	t.Run("poll", func(t *testing.T) {
+		testCompressWrites("tcp", ":9991", false)
+	})
+	t.Run("stdlib", func(t *testing.T) {
+		testCompressWrites("tcp", ":9992", true)
+	})
+}
+
+func testCompressWrites(network, addr string, stdlib bool) {
+	big := bytes.Repeat([]byte("compress"), 128)
+	var events Events
+	events.Opened = func(c Conn) (out []byte, opts Options, action Action) {
+		opts.CompressWrites = CompressWrites{MinSize: 64, Codec: "gzip"}
+		return
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		switch string(in) {
+		case "small":
+			return []byte("small\n"), None
+		case "big":
+			return big, None
+		case "force":
+			WriteCompressed(c, []byte("forced\n"), true)
+		case "skip":
+			WriteCompressed(c, big, false)
+		}
+		return
+	}
+	var done int32
+	events.Serving = func(srv Server) (action Action) {
+		go func() {
+			defer atomic.StoreInt32(&done, 1)
+			conn, err := net.Dial(network, addr)
+			must(err)
+			defer conn.Close()
+			rd := bufio.NewReader(conn)
+			expect := func(req string, compressed bool, data []byte) {
+				conn.Write([]byte(req))
+				var r io.Reader = rd
+				if compressed {
+					zr, err := gzip.NewReader(rd)
+					must(err)
+					zr.Multistream(false)
+					r = zr
+				}
+				p := make([]byte, len(data))
+				_, err := io.ReadFull(r, p)
+				must(err)
+				if !bytes.Equal(p, data) {
+					panic(fmt.Sprintf("%s: expected %q, got %q", req, data, p))
+				}
+				if compressed {
+					// the end of gzip member
+					if _, err := r.Read(p); err != io.EOF {
+						panic(fmt.Sprintf("%s: expected EOF, got %v", req, err))
+					}
+				}
+			}
+			expect("small", false, []byte("small\n"))
+			expect("big", true, big)
+			expect("force", true, []byte("forced\n"))
+			expect("skip", false, big)
+		}()
+		return
+	}
+	events.Tick = func() (delay time.Duration, action Action) {
+		if atomic.LoadInt32(&done) == 1 {
+			action = Shutdown
+		}
+		return time.Second / 20, action
+	}
+	if stdlib {
+		must(Serve(events, network+"-net://"+addr))
+	} else {
+		must(Serve(events, network+"://"+addr))
+	}
+}
+
+func BenchmarkCompressWrites(b *testing.B) {
+	// a json-like payload that compresses like typical responses
+	var buf bytes.Buffer
+	for i := 0; buf.Len() < 64*1024; i++ {
+		fmt.Fprintf(&buf, `{"id":%d,"name":"user%d","online":%v},`, i, i%97, i%3 == 0)
+	}
+	for _, codec := range []string{"gzip", "deflate"} {
+		for _, size := range []int{256, 4096, 65536} {
+			b.Run(fmt.Sprintf("%s/%d", codec, size), func(b *testing.B) {
+				cp := newCompressor(CompressWrites{Codec: codec})
+				data := buf.Bytes()[:size]
+				var n int
+				b.SetBytes(int64(size))
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					n = len(cp.compress(data))
+				}
+				b.ReportMetric(100*(1-float64(n)/float64(size)), "%saved")
+			})
+		}
+	}
+}
+
+func TestReadWatermark(t *testing.T) {
+	t.Run("poll", func(t *testing.T) {
+		testReadWatermark("tcp", ":9991", false)
+	})
+	t.Run("stdlib", func(t *testing.T) {
+		testReadWatermark("tcp", ":9992", true)
+	})
+}
+
+func testReadWatermark(network, addr string, stdlib bool) {
+	var events Events
+	var fired int
+	events.Opened = func(c Conn) (out []byte, opts Options, action Action) {
+		SetReadWatermark(c, 10, func(c Conn, soFar int) {
+			if fired != 0 {
+				panic("expected fired once")
+			}
+			fired = soFar
+		})
+		return
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		return []byte(fmt.Sprintf("%d\n", fired)), None
+	}
+	var done int32
+	events.Serving = func(srv Server) (action Action) {
+		go func() {
+			defer atomic.StoreInt32(&done, 1)
+			conn, err := net.Dial(network, addr)
+			must(err)
+			defer conn.Close()
+			rd := bufio.NewReader(conn)
+			for _, v := range [][2]string{
+				{"12345", "0\n"}, {"678901234", "14\n"}, {"5", "14\n"},
+			} {
+				conn.Write([]byte(v[0]))
+				line, err := rd.ReadString('\n')
+				must(err)
+				if line != v[1] {
+					panic(fmt.Sprintf("expected %q, got %q", v[1], line))
+				}
+			}
+		}()
+		return
+	}
+	events.Tick = func() (delay time.Duration, action Action) {
+		if atomic.LoadInt32(&done) == 1 {
+			action = Shutdown
+		}
+		return time.Second / 20, action
+	}
+	if stdlib {
+		must(Serve(events, network+"-net://"+addr))
+	} else {
+		must(Serve(events, network+"://"+addr))
+	}
+}
+
+func TestLatency(t *testing.T) {
+	t.Run("poll", func(t *testing.T) {
+		testLatency("tcp", ":9991", false)
+	})
+	t.Run("stdlib", func(t *testing.T) {
+		testLatency("tcp", ":9992", true)
+	})
+}
+
+func testLatency(network, addr string, stdlib bool) {
+	var events Events
+	events.Opened = func(c Conn) (out []byte, opts Options, action Action) {
+		if c.AcceptToOpenLatency() <= 0 {
+			panic("expected accept to open latency")
+		}
+		if c.FirstByteLatency() != 0 {
+			panic("expected no first byte latency")
+		}
+		return
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		if c.FirstByteLatency() < time.Second/10 {
+			panic(fmt.Sprintf("expected first byte latency, got %v", c.FirstByteLatency()))
+		}
+		return nil, Shutdown
+	}
+	events.Serving = func(srv Server) (action Action) {
+		go func() {
+			conn, err := net.Dial(network, addr)
+			must(err)
+			defer conn.Close()
+			time.Sleep(time.Second / 10)
+			conn.Write([]byte("hello"))
+			conn.Read([]byte{0})
+		}()
+		return
+	}
+	if stdlib {
+		must(Serve(events, network+"-net://"+addr))
+	} else {
+		must(Serve(events, network+"://"+addr))
+	}
+}
+
+func TestServingVeto(t *testing.T) {
+	t.Run("poll", func(t *testing.T) {
+		testServingVeto(t, "tcp", ":9991", false)
+	})
+	t.Run("stdlib", func(t *testing.T) {
+		testServingVeto(t, "tcp", ":9992", true)
+	})
+}
+
+func testServingVeto(t *testing.T, network, addr string, stdlib bool) {
+	reason := errors.New("dependency not ready")
+	var events Events
+	events.Serving = func(srv Server) (action Action) {
+		srv.Veto(reason)
+		return
+	}
+	events.Opened = func(c Conn) (out []byte, opts Options, action Action) {
+		panic("expected no connection")
+	}
+	if stdlib {
+		addr = network + "-net://" + addr
+	} else {
+		addr = network + "://" + addr
+	}
+	if err := Serve(events, addr); err != reason {
+		t.Fatalf("expected '%v', got '%v'", reason, err)
+	}
+	// the listener is closed, so the address can be bound again
+	events.Serving = func(srv Server) (action Action) {
+		return Shutdown
+	}
+	if err := Serve(events, addr); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoopbackServer(t *testing.T) {
+	var closed error = io.EOF
+	var events Events
+	events.Opened = func(c Conn) (out []byte, opts Options, action Action) {
+		return []byte("hello\n"), opts, None
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		switch {
+		case in == nil:
+			return []byte("woke\n"), None
+		case string(in) == "wake":
+			c.Wake()
+			c.Wake()
+			return
+		case string(in) == "quit":
+			return []byte("bye\n"), Close
+		}
+		c.SetContext(string(in))
+		return in, None
+	}
+	events.Closed = func(c Conn, err error) (action Action) {
+		closed = err
+		return
+	}
+	c := LoopbackServer(events)
+	if out := string(c.Output()); out != "hello\n" {
+		t.Fatalf("expected hello, got %q", out)
+	}
+	if c.Feed([]byte("ping")) != None || string(c.Output()) != "ping" {
+		t.Fatal("expected echo")
+	}
+	if c.Context() != "ping" {
+		t.Fatal("expected context")
+	}
+	c.Feed([]byte("wake"))
+	if out := string(c.Output()); out != "woke\nwoke\n" {
+		t.Fatalf("expected two wakes, got %q", out)
+	}
+	// a wake from other goroutine is processed by the next step
+	done := make(chan bool)
+	go func() { c.Wake(); done <- true }()
+	<-done
+	if c.Step() != None || string(c.Output()) != "woke\n" {
+		t.Fatal("expected the pending wake")
+	}
+	if c.Feed([]byte("quit")) != Close || !c.Closed() || closed != nil {
+		t.Fatal("expected closed")
+	}
+	if out := string(c.Output()); out != "bye\n" {
+		t.Fatalf("expected bye, got %q", out)
+	}
+	if c.Feed([]byte("ping")) != Close || len(c.Output()) != 0 {
+		t.Fatal("expected no more events")
+	}
+}
+
+func TestMaxWriteBuffer(t *testing.T) {
+	t.Run("poll", func(t *testing.T) {
+		testMaxWriteBuffer("tcp", ":9991", false)
+	})
+	t.Run("stdlib", func(t *testing.T) {
+		testMaxWriteBuffer("tcp", ":9992", true)
+	})
+	for _, policy := range []WriteOverflowPolicy{DropOldest, DropNewest, CloseOnOverflow} {
+		var dropped int
+		var closed error
+		var events Events
+		events.Opened = func(c Conn) (out []byte, opts Options, action Action) {
+			opts.MaxWriteBuffer = 8
+			opts.WriteOverflowPolicy = policy
+			return
+		}
+		events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+			return in, None
+		}
+		events.WriteOverflow = func(c Conn, n int) { dropped += n }
+		events.Closed = func(c Conn, err error) (action Action) {
+			closed = err
+			return
+		}
+		c := LoopbackServer(events)
+		c.Feed([]byte("aaaa"))
+		c.Feed([]byte("bbbb"))
+		c.Feed([]byte("cccc"))
+		// closing discards all of the pending data
+		expected, expectedDropped := map[WriteOverflowPolicy]string{
+			DropOldest: "bbbbcccc", DropNewest: "aaaabbbb", CloseOnOverflow: "",
+		}[policy], 4
+		if policy == CloseOnOverflow {
+			expectedDropped = 12
+		}
+		if out := string(c.Output()); out != expected || dropped != expectedDropped {
+			t.Fatalf("policy %d: expected %q and %d dropped, got %q and %d",
+				policy, expected, expectedDropped, out, dropped)
+		}
+		if (closed == ErrWriteBufferOverflow) != (policy == CloseOnOverflow) {
+			t.Fatalf("policy %d: unexpected closed %v", policy, closed)
+		}
+	}
+}
+
+func TestDropOldestPartial(t *testing.T) {
+	var dropped int
+	var events Events
+	events.Opened = func(c Conn) (out []byte, opts Options, action Action) {
+		opts.MaxWriteBuffer = 8
+		opts.WriteOverflowPolicy = DropOldest
+		return
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		return in, None
+	}
+	events.WriteOverflow = func(c Conn, n int) { dropped += n }
+	c := LoopbackServer(events)
+	done := make(map[string]error)
+	for _, b := range []string{"aaaa", "bbbb"} {
+		b := b
+		QueueWriteCB(c, []byte(b), func(err error) { done[b] = err })
+		c.Step()
+	}
+	c.consume(2) // the socket took a part of the first buffer
+	c.Feed([]byte("cccc"))
+	if out := string(c.Output()); out != "aacccc" || dropped != 4 {
+		t.Fatalf("expected %q and 4 dropped, got %q and %d", "aacccc", out, dropped)
+	}
+	if err, ok := done["aaaa"]; !ok || err != nil {
+		t.Fatalf("expected the partial buffer written, got %v", err)
+	}
+	if err := done["bbbb"]; err != ErrWriteBufferOverflow {
+		t.Fatalf("expected the next buffer dropped, got %v", err)
+	}
+	if n := c.OutboundMessages(); n != 0 {
+		t.Fatalf("expected no outbound messages, got %d", n)
+	}
+}
+
+func testMaxWriteBuffer(network, addr string, stdlib bool) {
+	var dropped int32
+	var events Events
+	events.Opened = func(c Conn) (out []byte, opts Options, action Action) {
+		opts.MaxWriteBuffer = 1024 * 1024
+		return
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		return make([]byte, 2*1024*1024), None
+	}
+	events.WriteOverflow = func(c Conn, n int) {
+		atomic.StoreInt32(&dropped, int32(n))
+	}
+	events.Closed = func(c Conn, err error) (action Action) {
+		if err != ErrWriteBufferOverflow {
+			panic(fmt.Sprintf("expected ErrWriteBufferOverflow, got %v", err))
+		}
+		if atomic.LoadInt32(&dropped) != 2*1024*1024 {
+			panic("expected the dropped output reported")
+		}
+		return Shutdown
+	}
+	events.Serving = func(srv Server) (action Action) {
+		go func() {
+			conn, err := net.Dial(network, addr)
+			must(err)
+			defer conn.Close()
+			conn.Write([]byte("hello"))
+			if n, _ := io.Copy(io.Discard, conn); n != 0 {
+				panic(fmt.Sprintf("expected no data, got %d bytes", n))
+			}
+		}()
+		return
+	}
+	if stdlib {
+		must(Serve(events, network+"-net://"+addr))
+	} else {
+		must(Serve(events, network+"://"+addr))
+	}
+}
+
+func TestConnRates(t *testing.T) {
+	t.Run("poll", func(t *testing.T) {
+		testConnRates("tcp", ":9991", false)
+	})
+	t.Run("stdlib", func(t *testing.T) {
+		testConnRates("tcp", ":9992", true)
+	})
+}
+
+func testConnRates(network, addr string, stdlib bool) {
+	const chunk, interval = 16 * 1024, time.Second / 50
+	const expected = float64(chunk) * float64(time.Second/interval)
+	var client atomic.Value
+	var events Events
+	events.Opened = func(c Conn) (out []byte, opts Options, action Action) {
+		opts.RateWindow = time.Second / 4
+		client.Store(c)
+		return
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		return in, None
+	}
+	events.Serving = func(srv Server) (action Action) {
+		go func() {
+			conn, err := net.Dial(network, addr)
+			must(err)
+			defer conn.Close()
+			go io.Copy(io.Discard, conn)
+			data := make([]byte, chunk)
+			for range time.Tick(interval) {
+				if _, err := conn.Write(data); err != nil {
+					return
+				}
+			}
+		}()
+		return
+	}
+	start := time.Now()
+	events.Tick = func() (delay time.Duration, action Action) {
+		c, _ := client.Load().(Conn)
+		if c == nil {
+			return time.Second / 10, None
+		}
+		rx, tx := c.RateRxBps(), c.RateTxBps()
+		if c.RateRxBps() != rx || c.RateTxBps() != tx {
+			panic("expected the same rates until the next tick")
+		}
+		if time.Since(start) > time.Second*3/2 {
+			if rx < expected/2 || rx > expected*3/2 || tx < expected/2 || tx > expected*3/2 {
+				panic(fmt.Sprintf("expected about %.0f B/s, got rx %.0f, tx %.0f", expected, rx, tx))
+			}
+			action = Shutdown
+		}
+		return time.Second / 10, action
+	}
+	if stdlib {
+		must(Serve(events, network+"-net://"+addr))
+	} else {
+		must(Serve(events, network+"://"+addr))
+	}
+}
+
+func TestSequenceCounters(t *testing.T) {
+	var events Events
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		if string(in) == "quiet" {
+			return nil, None
+		}
+		return in, None
+	}
+	c := LoopbackServer(events)
+	c.Feed([]byte("one"))
+	c.Feed([]byte("quiet"))
+	c.Feed([]byte("three"))
+	if c.OutSeq() != 2 {
+		t.Fatalf("expected 2 writes, got %d", c.OutSeq())
+	}
+	if c.InOffset() != 13 {
+		t.Fatalf("expected 13 bytes, got %d", c.InOffset())
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	var events Events
+	events.Negotiate = func(c Conn, hello []byte) (handlerKey string, out []byte, action Action) {
+		return string(hello), []byte("ok " + string(hello) + "\n"), None
+	}
+	events.Handlers = map[string]DataHandler{
+		"v1": func(c Conn, in []byte) (out []byte, action Action) {
+			return append([]byte("v1:"), in...), None
+		},
+		"v2": func(c Conn, in []byte) (out []byte, action Action) {
+			return bytes.ToUpper(in), None
+		},
+	}
+	for _, v := range []struct{ hello, frame, want string }{
+		{"v1", "hello", "ok v1\nv1:hello"},
+		{"v2", "hello", "ok v2\nHELLO"},
+	} {
+		c := LoopbackServer(events)
+		c.Feed([]byte(v.hello))
+		if action := c.Feed([]byte(v.frame)); action != None {
+			t.Fatalf("expected %s open, got %v", v.hello, action)
+		}
+		if out := string(c.Output()); out != v.want {
+			t.Fatalf("expected %q, got %q", v.want, out)
+		}
+	}
+	c := LoopbackServer(events)
+	if c.Feed([]byte("v3")); !c.Closed() {
+		t.Fatal("expected the unsupported version closed")
+	}
+	if out := string(c.Output()); out != "ok v3\n" {
+		t.Fatalf("expected the reply written before the close, got %q", out)
+	}
+}
+
+func TestOutboundCounters(t *testing.T) {
+	var events Events
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		return in, None
+	}
+	c := LoopbackServer(events)
+	for _, frame := range []string{"one", "two", "three"} {
+		c.Feed([]byte(frame))
+	}
+	if c.OutboundBytes() != 11 || c.OutboundMessages() != 3 {
+		t.Fatalf("expected 3 frames of 11 bytes, got %d of %d", c.OutboundMessages(), c.OutboundBytes())
+	}
+	c.Output()
+	c.Feed([]byte("four"))
+	if c.OutboundBytes() != 4 || c.OutboundMessages() != 1 {
+		t.Fatalf("expected 1 frame of 4 bytes, got %d of %d", c.OutboundMessages(), c.OutboundBytes())
+	}
+}
+
+func TestCork(t *testing.T) {
+	t.Run("loopback", func(t *testing.T) {
+		c := LoopbackServer(corkEvents())
+		for _, msg := range []string{"cork", "x", "y", "z"} {
+			c.Feed([]byte(msg))
+		}
+		if out := c.Output(); out != nil || c.OutboundMessages() != 3 {
+			t.Fatalf("expected 3 writes held, got %q and %d", out, c.OutboundMessages())
+		}
+		c.Feed([]byte("uncork"))
+		if out := string(c.Output()); out != "xyz!" {
+			t.Fatalf("expected the held writes, got %q", out)
+		}
+	})
+	t.Run("poll", func(t *testing.T) {
+		testCork("tcp", ":9991", false)
+	})
+	t.Run("stdlib", func(t *testing.T) {
+		testCork("tcp", ":9992", true)
+	})
+}
+
+func corkEvents() Events {
+	var events Events
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		switch string(in) {
+		case "cork":
+			must(c.Cork())
+			return nil, None
+		case "uncork":
+			must(c.Uncork())
+			return []byte("!"), None
+		}
+		return in, None
+	}
+	return events
+}
+
+func testCork(network, addr string, stdlib bool) {
+	var done int32
+	events := corkEvents()
+	events.Opened = func(c Conn) (out []byte, opts Options, action Action) {
+		must(c.SetNoDelay(true))
+		return
+	}
+	events.Serving = func(srv Server) (action Action) {
+		go func() {
+			defer atomic.StoreInt32(&done, 1)
+			conn, err := net.Dial(network, addr)
+			must(err)
+			defer conn.Close()
+			send := func(msgs ...string) {
+				for _, msg := range msgs {
+					_, err := conn.Write([]byte(msg))
+					must(err)
+					time.Sleep(time.Second / 100) // a Data event of every write
+				}
+			}
+			send("cork", "x", "y", "z")
+			buf := make([]byte, 16)
+			conn.SetReadDeadline(time.Now().Add(time.Second / 30))
+			if n, err := conn.Read(buf); err == nil {
+				panic(fmt.Sprintf("expected the writes held, got %q", buf[:n]))
+			}
+			// the corked writes arrive at once
+			send("uncork")
+			conn.SetReadDeadline(time.Time{})
+			n, err := conn.Read(buf)
+			must(err)
+			if string(buf[:n]) != "xyz!" {
+				panic(fmt.Sprintf("expected the coalesced writes, got %q", buf[:n]))
+			}
+		}()
+		return
+	}
+	start := time.Now()
+	events.Tick = func() (delay time.Duration, action Action) {
+		if atomic.LoadInt32(&done) == 1 {
+			return 0, Shutdown
+		}
+		if time.Since(start) > 2*time.Second {
+			panic("timeout")
+		}
+		return time.Second / 20, None
+	}
+	if stdlib {
+		must(Serve(events, network+"-net://"+addr))
+	} else {
+		must(Serve(events, network+"://"+addr))
+	}
+}
+
+func TestChain(t *testing.T) {
+	var order []string
+	trace := func(name string) DataMiddleware {
+		return func(next DataHandler) DataHandler {
+			return func(c Conn, in []byte) (out []byte, action Action) {
+				order = append(order, name+">")
+				out, action = next(c, in)
+				order = append(order, "<"+name)
+				return
+			}
+		}
+	}
+	auth := func(next DataHandler) DataHandler {
+		return func(c Conn, in []byte) (out []byte, action Action) {
+			if string(in) == "deny" {
+				return []byte("denied"), Close
+			}
+			return next(c, bytes.ToUpper(in))
+		}
+	}
+	var logged []string
+	logf := func(format string, args ...interface{}) {
+		logged = append(logged, fmt.Sprintf(format, args...))
+	}
+	var panicked interface{}
+	handler := func(c Conn, in []byte) (out []byte, action Action) {
+		if string(in) == "PANIC" {
+			panic("boom")
+		}
+		order = append(order, "handler")
+		return in, None
+	}
+	var events Events
+	events.Data = Chain(Recover(func(c Conn, v interface{}) { panicked = v }),
+		Log(logf), trace("a"), trace("b"), auth)(handler)
+
+	c := LoopbackServer(events)
+	if c.Feed([]byte("ping")) != None || string(c.Output()) != "PING" {
+		t.Fatal("expected the transformed echo")
+	}
+	if strings.Join(order, " ") != "a> b> handler <b <a" {
+		t.Fatalf("unexpected order %q", order)
+	}
+	if len(logged) != 1 || logged[0] != "evio: data loopback in 4 out 4" {
+		t.Fatalf("unexpected log %q", logged)
+	}
+	if c.Feed([]byte("panic")) != Close || panicked != "boom" || len(c.Output()) != 0 {
+		t.Fatal("expected the panic recovered and the connection closed")
+	}
+	c = LoopbackServer(events)
+	order = nil
+	if c.Feed([]byte("deny")) != Close || string(c.Output()) != "denied" {
+		t.Fatal("expected the short-circuit")
+	}
+	if strings.Join(order, " ") != "a> b> <b <a" {
+		t.Fatalf("unexpected order %q", order)
+	}
+}
+
+func TestEmptyRead(t *testing.T) {
+	t.Run("poll", func(t *testing.T) {
+		testEmptyRead(":9991", false)
+	})
+	t.Run("stdlib", func(t *testing.T) {
+		testEmptyRead(":9992", true)
+	})
+	t.Run("loopback", func(t *testing.T) {
+		var empty bool
+		var events Events
+		events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+			empty = in != nil && len(in) == 0
+			return
+		}
+		c := LoopbackServer(events)
+		if c.Feed([]byte{}) != None || !empty || c.Closed() || c.PeerClosed() {
+			t.Fatal("expected the empty read delivered and the connection open")
+		}
+		c.Close(nil)
+		if !c.PeerClosed() {
+			t.Fatal("expected closed by the peer")
+		}
+	})
+}
+
+func testEmptyRead(addr string, stdlib bool) {
+	var empties, closes, peerClosed int32
+	var events Events
+	events.UDPIdleTimeout = time.Minute
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		switch {
+		case in == nil:
+		case len(in) == 0:
+			atomic.AddInt32(&empties, 1)
+		case c.PeerClosed():
+			panic("expected the connection open")
+		default:
+			out = in
+		}
+		return
+	}
+	events.Closed = func(c Conn, err error) (action Action) {
+		atomic.AddInt32(&closes, 1)
+		if c.PeerClosed() && err == nil {
+			atomic.AddInt32(&peerClosed, 1)
+		}
+		return
+	}
+	events.Serving = func(srv Server) (action Action) {
+		go func() {
+			// an empty datagram keeps the virtual connection open
+			uc, err := net.Dial("udp", addr)
+			must(err)
+			defer uc.Close()
+			_, err = uc.Write([]byte{})
+			must(err)
+			_, err = uc.Write([]byte("hello"))
+			must(err)
+			buf := make([]byte, 5)
+			uc.SetReadDeadline(time.Now().Add(time.Second))
+			_, err = uc.Read(buf)
+			must(err)
+			// the EOF of a stream closes it
+			tc, err := net.Dial("tcp", addr)
+			must(err)
+			tc.Write([]byte("hello"))
+			_, err = io.ReadFull(tc, buf)
+			must(err)
+			tc.Close()
+		}()
+		return
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	events.Tick = func() (delay time.Duration, action Action) {
+		if atomic.LoadInt32(&peerClosed) == 1 {
+			if atomic.LoadInt32(&empties) != 1 || atomic.LoadInt32(&closes) != 1 {
+				panic(fmt.Sprintf("expected one empty read and one close, got %d and %d",
+					atomic.LoadInt32(&empties), atomic.LoadInt32(&closes)))
+			}
+			return 0, Shutdown
+		}
+		if time.Now().After(deadline) {
+			panic("expected the stream closed by the peer")
+		}
+		return time.Second / 20, None
+	}
+	if stdlib {
+		must(Serve(events, "tcp-net://"+addr, "udp-net://"+addr))
+	} else {
+		must(Serve(events, "tcp://"+addr, "udp://"+addr))
+	}
+}
+
+func TestProfileLabels(t *testing.T) {
+	t.Run("poll", func(t *testing.T) {
+		testProfileLabels("tcp", ":9991", false)
+	})
+	t.Run("stdlib", func(t *testing.T) {
+		testProfileLabels("tcp", ":9992", true)
+	})
+}
+
+func testProfileLabels(network, addr string, stdlib bool) {
+	var events Events
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		var buf bytes.Buffer
+		pprof.Lookup("goroutine").WriteTo(&buf, 1)
+		if !strings.Contains(buf.String(), `"evio":"loop"`) {
+			panic("expected the label of the loop")
+		}
+		return nil, Shutdown
+	}
+	events.Serving = func(srv Server) (action Action) {
+		go func() {
+			conn, err := net.Dial(network, addr)
+			must(err)
+			defer conn.Close()
+			conn.Write([]byte("hello"))
+			conn.Read([]byte{0})
+		}()
+		return
+	}
+	if stdlib {
+		must(Serve(events, network+"-net://"+addr))
+	} else {
+		must(Serve(events, network+"://"+addr))
+	}
+}
+
+func TestAcceptLoops(t *testing.T) {
+	t.Run("poll", func(t *testing.T) {
+		testAcceptLoops("tcp", ":9991", false)
+	})
+	t.Run("stdlib", func(t *testing.T) {
+		testAcceptLoops("tcp", ":9992", true)
+	})
+}
+
+func testAcceptLoops(network, addr string, stdlib bool) {
+	const numConns = 16
+	var opened, echoed int32
+	var events Events
+	events.NumLoops = 2
+	events.AcceptLoops = 2
+	events.LoadBalance = RoundRobin
+	events.Opened = func(c Conn) (out []byte, opts Options, action Action) {
+		atomic.AddInt32(&opened, 1)
+		return
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		return in, None
+	}
+	events.Serving = func(srv Server) (action Action) {
+		for i := 0; i < numConns; i++ {
+			go func(i int) {
+				conn, err := net.Dial(network, addr)
+				must(err)
+				defer conn.Close()
+				msg := fmt.Sprintf("hello %d", i)
+				_, err = conn.Write([]byte(msg))
+				must(err)
+				buf := make([]byte, len(msg))
+				_, err = io.ReadFull(conn, buf)
+				must(err)
+				if string(buf) != msg {
+					panic(fmt.Sprintf("expected %q, got %q", msg, buf))
+				}
+				atomic.AddInt32(&echoed, 1)
+			}(i)
+		}
+		return
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	events.Tick = func() (delay time.Duration, action Action) {
+		if atomic.LoadInt32(&echoed) == numConns {
+			if n := atomic.LoadInt32(&opened); n != numConns {
+				panic(fmt.Sprintf("expected %d opened, got %d", numConns, n))
+			}
+			return 0, Shutdown
+		}
+		if time.Now().After(deadline) {
+			panic(fmt.Sprintf("expected %d echoes, got %d", numConns, atomic.LoadInt32(&echoed)))
+		}
+		return time.Second / 20, None
+	}
+	if stdlib {
+		must(Serve(events, network+"-net://"+addr))
+	} else {
+		must(Serve(events, network+"://"+addr))
+	}
+}
+
+func TestDrainLoop(t *testing.T) {
+	t.Run("poll", func(t *testing.T) {
+		testDrainLoop("tcp", ":9991", false)
+	})
+	t.Run("stdlib", func(t *testing.T) {
+		testDrainLoop("tcp", ":9992", true)
+	})
+}
+
+func testDrainLoop(network, addr string, stdlib bool) {
+	const numConns = 4
+	var finished int32
+	var events Events
+	events.NumLoops = 2
+	events.LoadBalance = RoundRobin
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		return in, None
+	}
+	echo := func(conn net.Conn, msg string) {
+		_, err := conn.Write([]byte(msg))
+		must(err)
+		buf := make([]byte, len(msg))
+		_, err = io.ReadFull(conn, buf)
+		must(err)
+		if string(buf) != msg {
+			panic(fmt.Sprintf("expected %q, got %q", msg, buf))
+		}
+	}
+	// closed counts the connections which are closed by the server
+	closed := func(conns []net.Conn) (n int) {
+		for _, conn := range conns {
+			conn.SetReadDeadline(time.Now().Add(time.Second / 5))
+			if _, err := conn.Read(make([]byte, 1)); err == io.EOF {
+				n++
+			}
+		}
+		return n
+	}
+	events.Serving = func(srv Server) (action Action) {
+		go func() {
+			defer atomic.StoreInt32(&finished, 1)
+			var conns []net.Conn
+			for i := 0; i < numConns; i++ {
+				conn, err := net.Dial(network, addr)
+				must(err)
+				defer conn.Close()
+				echo(conn, "hello")
+				conns = append(conns, conn)
+			}
+			n0 := srv.LoopStats()[0].ActiveConns
+			if n0 == 0 {
+				panic("expected connections on loop 0")
+			}
+			if stdlib {
+				if _, err := srv.DrainLoop(0, true, time.Second); err != ErrNotSupported {
+					panic(fmt.Sprintf("expected %v, got %v", ErrNotSupported, err))
+				}
+				st, err := srv.DrainLoop(0, false, time.Second)
+				must(err)
+				if st.Closed != n0 {
+					panic(fmt.Sprintf("expected %d closed, got %d", n0, st.Closed))
+				}
+				if n := closed(conns); n != n0 {
+					panic(fmt.Sprintf("expected %d connections closed, got %d", n0, n))
+				}
+			} else {
+				st, err := srv.DrainLoop(0, true, time.Second)
+				must(err)
+				if st.Migrated != n0 {
+					panic(fmt.Sprintf("expected %d migrated, got %d", n0, st.Migrated))
+				}
+				for i, conn := range conns {
+					echo(conn, fmt.Sprintf("migrated %d", i))
+				}
+				if _, err := srv.DrainLoop(1, true, time.Second); err != ErrLoopDrained {
+					panic(fmt.Sprintf("expected %v, got %v", ErrLoopDrained, err))
+				}
+			}
+			if _, err := srv.DrainLoop(0, false, time.Second); err != ErrLoopDrained {
+				panic(fmt.Sprintf("expected %v, got %v", ErrLoopDrained, err))
+			}
+			stat := srv.LoopStats()[0]
+			if !stat.Draining || stat.ActiveConns != 0 {
+				panic(fmt.Sprintf("expected an empty draining loop, got %+v", stat))
+			}
+			// new connections land on the other loop
+			conn, err := net.Dial(network, addr)
+			must(err)
+			defer conn.Close()
+			echo(conn, "hello")
+			if n := srv.LoopStats()[0].ActiveConns; n != 0 {
+				panic(fmt.Sprintf("expected no connections on loop 0, got %d", n))
+			}
+			if !stdlib {
+				conns = append(conns, conn)
+				st, err := srv.DrainLoop(1, false, time.Second)
+				must(err)
+				if st.Closed != len(conns) {
+					panic(fmt.Sprintf("expected %d closed, got %d", len(conns), st.Closed))
+				}
+				if n := closed(conns); n != len(conns) {
+					panic(fmt.Sprintf("expected %d connections closed, got %d", len(conns), n))
+				}
+			}
+		}()
+		return
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	events.Tick = func() (delay time.Duration, action Action) {
+		if atomic.LoadInt32(&finished) == 1 {
+			return 0, Shutdown
+		}
+		if time.Now().After(deadline) {
+			panic("drain test timed out")
+		}
+		return time.Second / 20, None
+	}
+	if stdlib {
+		must(Serve(events, network+"-net://"+addr))
+	} else {
+		must(Serve(events, network+"://"+addr))
+	}
+}
+
+func TestQueueWriteCB(t *testing.T) {
+	t.Run("poll", func(t *testing.T) {
+		testQueueWriteCB("tcp", ":9991", false)
+	})
+	t.Run("stdlib", func(t *testing.T) {
+		testQueueWriteCB("tcp", ":9992", true)
+	})
+	var events Events
+	events.Opened = func(c Conn) (out []byte, opts Options, action Action) {
+		opts.MaxWriteBuffer = 4
+		opts.WriteOverflowPolicy = DropNewest
+		return
+	}
+	var errs []error
+	done := func(err error) { errs = append(errs, err) }
+	c := LoopbackServer(events)
+	QueueWriteCB(c, []byte("ok"), done)
+	QueueWriteCB(c, []byte("too long"), done)
+	if len(errs) != 0 {
+		t.Fatalf("expected no receipts before the loop runs, got %v", errs)
+	}
+	c.Step()
+	if len(errs) != 1 || errs[0] != ErrWriteBufferOverflow {
+		t.Fatalf("expected an overflow, got %v", errs)
+	}
+	if out := c.Output(); string(out) != "ok" {
+		t.Fatalf("expected %q, got %q", "ok", out)
+	}
+	if len(errs) != 2 || errs[1] != nil {
+		t.Fatalf("expected a written receipt, got %v", errs)
+	}
+	// closed before the flush
+	errs = nil
+	QueueWriteCB(c, []byte("bye"), done)
+	c.Step()
+	c.Close(nil)
+	QueueWriteCB(c, []byte("late"), done)
+	if len(errs) != 2 || errs[0] != ErrConnClosed || errs[1] != ErrConnClosed {
+		t.Fatalf("expected two closed receipts, got %v", errs)
+	}
+}
+
+func testQueueWriteCB(network, addr string, stdlib bool) {
+	const numWrites = 8
+	var receipts, failed int32
+	var events Events
+	events.Opened = func(c Conn) (out []byte, opts Options, action Action) {
+		go func() {
+			for i := 0; i < numWrites; i++ {
+				QueueWriteCB(c, []byte(fmt.Sprintf("msg %d\n", i)), func(err error) {
+					if err != nil {
+						atomic.AddInt32(&failed, 1)
+					}
+					atomic.AddInt32(&receipts, 1)
+				})
+			}
+		}()
+		return
+	}
+	events.Serving = func(srv Server) (action Action) {
+		go func() {
+			conn, err := net.Dial(network, addr)
+			must(err)
+			defer conn.Close()
+			rd := bufio.NewReader(conn)
+			for i := 0; i < numWrites; i++ {
+				line, err := rd.ReadString('\n')
+				must(err)
+				if line != fmt.Sprintf("msg %d\n", i) {
+					panic(fmt.Sprintf("unexpected %q", line))
+				}
+			}
+		}()
+		return
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	events.Tick = func() (delay time.Duration, action Action) {
+		if atomic.LoadInt32(&receipts) == numWrites {
+			if n := atomic.LoadInt32(&failed); n != 0 {
+				panic(fmt.Sprintf("expected no failed receipts, got %d", n))
+			}
+			return 0, Shutdown
+		}
+		if time.Now().After(deadline) {
+			panic(fmt.Sprintf("expected %d receipts, got %d", numWrites, atomic.LoadInt32(&receipts)))
+		}
+		return time.Second / 20, None
+	}
+	if stdlib {
+		must(Serve(events, network+"-net://"+addr))
+	} else {
+		must(Serve(events, network+"://"+addr))
+	}
+}
+
+func TestPriority(t *testing.T) {
+	t.Run("poll", func(t *testing.T) {
+		testPriority("tcp", ":9991", false)
+	})
+	t.Run("stdlib", func(t *testing.T) {
+		testPriority("tcp", ":9992", true)
+	})
+}
+
+func testPriority(network, addr string, stdlib bool) {
+	const numLow = 8
+	var mu sync.Mutex
+	var order []string
+	var events Events
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		switch string(in) {
+		case "x":
+			mu.Lock()
+			order = append(order, c.Context().(string))
+			mu.Unlock()
+			return nil, None
+		case "block":
+			// the loop is saturated while the backlog arrives
+			time.Sleep(time.Second / 4)
+			return nil, None
+		case "high":
+			c.SetPriority(1)
+		}
+		c.SetContext(string(in))
+		return in, None
+	}
+	events.Serving = func(srv Server) (action Action) {
+		go func() {
+			dial := func(role string) net.Conn {
+				conn, err := net.Dial(network, addr)
+				must(err)
+				_, err = conn.Write([]byte(role))
+				must(err)
+				buf := make([]byte, len(role))
+				_, err = io.ReadFull(conn, buf)
+				must(err)
+				return conn
+			}
+			gate := dial("gate")
+			defer gate.Close()
+			var lows []net.Conn
+			for i := 0; i < numLow; i++ {
+				conn := dial("low")
+				defer conn.Close()
+				lows = append(lows, conn)
+			}
+			high := dial("high")
+			defer high.Close()
+			_, err := gate.Write([]byte("block"))
+			must(err)
+			time.Sleep(time.Second / 20)
+			for _, conn := range lows {
+				_, err := conn.Write([]byte("x"))
+				must(err)
+			}
+			_, err = high.Write([]byte("x"))
+			must(err)
+			time.Sleep(time.Second) // keep the connections until the shutdown
+		}()
+		return
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	events.Tick = func() (delay time.Duration, action Action) {
+		mu.Lock()
+		defer mu.Unlock()
+		if len(order) == numLow+1 {
+			if order[0] != "high" {
+				panic(fmt.Sprintf("expected the high priority first, got %v", order))
+			}
+			return 0, Shutdown
+		}
+		if time.Now().After(deadline) {
+			panic(fmt.Sprintf("expected %d data events, got %v", numLow+1, order))
+		}
+		return time.Second / 20, None
+	}
+	if stdlib {
+		must(Serve(events, network+"-net://"+addr))
+	} else {
+		must(Serve(events, network+"://"+addr))
+	}
+}
+
+func TestMigrated(t *testing.T) {
+	const numConns = 4
+	var mu sync.Mutex
+	var moves []string
+	var finished int32
+	var events Events
+	events.NumLoops = 2
+	events.LoadBalance = RoundRobin
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		return in, None
+	}
+	events.Migrated = func(c Conn, fromLoop, toLoop int) {
+		mu.Lock()
+		moves = append(moves, fmt.Sprintf("%d>%d", fromLoop, toLoop))
+		mu.Unlock()
+	}
+	events.Serving = func(srv Server) (action Action) {
+		go func() {
+			defer atomic.StoreInt32(&finished, 1)
+			for i := 0; i < numConns; i++ {
+				conn, err := net.Dial("tcp", ":9991")
+				must(err)
+				defer conn.Close()
+				_, err = conn.Write([]byte("hello"))
+				must(err)
+				_, err = io.ReadFull(conn, make([]byte, 5))
+				must(err)
+			}
+			st, err := srv.DrainLoop(0, true, time.Second)
+			must(err)
+			if st.Migrated == 0 {
+				panic("expected migrated connections")
+			}
+			deadline := time.Now().Add(time.Second)
+			for {
+				mu.Lock()
+				n := len(moves)
+				mu.Unlock()
+				if n == st.Migrated {
+					break
+				}
+				if time.Now().After(deadline) {
+					panic(fmt.Sprintf("expected %d migrated events, got %d", st.Migrated, n))
+				}
+				time.Sleep(time.Millisecond * 10)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			for _, move := range moves {
+				if move != "0>1" {
+					panic(fmt.Sprintf("expected 0>1, got %s", move))
+				}
+			}
+		}()
+		return
+	}
+	events.Tick = func() (delay time.Duration, action Action) {
+		if atomic.LoadInt32(&finished) == 1 {
+			return 0, Shutdown
+		}
+		return time.Second / 20, None
+	}
+	must(Serve(events, "tcp://:9991"))
+}
+
+func TestCloseConn(t *testing.T) {
+	t.Run("poll", func(t *testing.T) {
+		testCloseConn("tcp", ":9991", false)
+	})
+	t.Run("stdlib", func(t *testing.T) {
+		testCloseConn("tcp", ":9992", true)
+	})
+}
+
+func testCloseConn(network, addr string, stdlib bool) {
+	payload := make([]byte, 4*1024*1024)
+	var stalled, done int32
+	var events Events
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		linger := time.Duration(0)
+		if string(in) == "stall" {
+			linger = time.Second / 10
+			c.SetContext("stall")
+		}
+		go func() {
+			must(CloseConn(c, linger))
+			must(CloseConn(c, linger)) // closing already
+		}()
+		return payload, None
+	}
+	events.Closed = func(c Conn, err error) (action Action) {
+		if err := CloseConn(c, 0); err != ErrConnClosed {
+			panic(fmt.Sprintf("expected ErrConnClosed, got %v", err))
+		}
+		if c.Context() == "stall" {
+			atomic.StoreInt32(&stalled, 1)
+		}
+		return
+	}
+	events.Serving = func(srv Server) (action Action) {
+		go func() {
+			defer atomic.StoreInt32(&done, 1)
+			conn, err := net.Dial(network, addr)
+			must(err)
+			defer conn.Close()
+			_, err = conn.Write([]byte("go"))
+			must(err)
+			_, err = io.ReadFull(conn, make([]byte, len(payload)))
+			must(err)
+			if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+				panic(fmt.Sprintf("expected EOF after the flush, got %v", err))
+			}
+			if stdlib {
+				return // the writes are synchronous, they never linger
+			}
+			// a peer which never reads is closed after the linger
+			conn, err = net.Dial(network, addr)
+			must(err)
+			defer conn.Close()
+			_, err = conn.Write([]byte("stall"))
+			must(err)
+			deadline := time.Now().Add(2 * time.Second)
+			for atomic.LoadInt32(&stalled) == 0 {
+				if time.Now().After(deadline) {
+					panic("expected the stalled connection closed")
+				}
+				time.Sleep(time.Millisecond * 10)
+			}
+		}()
+		return
+	}
+	events.Tick = func() (delay time.Duration, action Action) {
+		if atomic.LoadInt32(&done) == 1 {
+			return 0, Shutdown
+		}
+		return time.Second / 20, None
+	}
+	if stdlib {
+		must(Serve(events, network+"-net://"+addr))
+	} else {
+		must(Serve(events, network+"://"+addr))
+	}
+}
+
+func TestCloseInitiator(t *testing.T) {
+	t.Run("poll", func(t *testing.T) {
+		testCloseInitiator("tcp", ":9991", false)
+	})
+	t.Run("stdlib", func(t *testing.T) {
+		testCloseInitiator("tcp", ":9992", true)
+	})
+}
+
+func testCloseInitiator(network, addr string, stdlib bool) {
+	var closed int32
+	var initiators sync.Map
+	var events Events
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		if c.CloseInitiator() != Unknown {
+			panic("expected Unknown before the close")
+		}
+		c.SetContext(string(in))
+		if string(in) == "local" {
+			return nil, Close
+		}
+		return in, None
+	}
+	events.Closed = func(c Conn, err error) (action Action) {
+		if c.Context() != nil {
+			initiators.Store(c.Context(), c.CloseInitiator())
+			atomic.AddInt32(&closed, 1)
+		}
+		return
+	}
+	events.Serving = func(srv Server) (action Action) {
+		go func() {
+			// closed by the server
+			conn, err := net.Dial(network, addr)
+			must(err)
+			defer conn.Close()
+			_, err = conn.Write([]byte("local"))
+			must(err)
+			if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+				panic(fmt.Sprintf("expected EOF, got %v", err))
+			}
+			// closed by the client
+			conn, err = net.Dial(network, addr)
+			must(err)
+			_, err = conn.Write([]byte("remote"))
+			must(err)
+			_, err = io.ReadFull(conn, make([]byte, 6))
+			must(err)
+			conn.Close()
+		}()
+		return
+	}
+	start := time.Now()
+	events.Tick = func() (delay time.Duration, action Action) {
+		if atomic.LoadInt32(&closed) == 2 {
+			return 0, Shutdown
+		}
+		if time.Since(start) > 2*time.Second {
+			panic("timeout")
+		}
+		return time.Second / 20, None
+	}
+	if stdlib {
+		must(Serve(events, network+"-net://"+addr))
+	} else {
+		must(Serve(events, network+"://"+addr))
+	}
+	for side, want := range map[string]Initiator{"local": Local, "remote": Remote} {
+		if v, _ := initiators.Load(side); v != want {
+			panic(fmt.Sprintf("expected %v for the %s close, got %v", want, side, v))
+		}
+	}
+}
+
+func TestBackgroundClose(t *testing.T) {
+	t.Run("poll", func(t *testing.T) {
+		testBackgroundClose("tcp", ":9991", false)
+	})
+	t.Run("stdlib", func(t *testing.T) {
+		testBackgroundClose("tcp", ":9992", true)
+	})
+}
+
+func testBackgroundClose(network, addr string, stdlib bool) {
+	const conns = 4
+	var closed int32
+	var events Events
+	// the flags are set by the close commands, and read on the loops
+	after := func(c Conn, event string) {
+		if c.Context() == "closing" {
+			panic(event + " fired after the close was processed")
+		}
+	}
+	events.Opened = func(c Conn) (out []byte, opts Options, action Action) {
+		lc := c.(loopConn)
+		go func() {
+			// a reaper which closes the connection under the traffic
+			for i := 0; i < 100; i++ {
+				c.Wake()
+			}
+			lc.run(func() Action {
+				c.SetContext("closing")
+				return Close
+			})
+			for i := 0; i < 100; i++ {
+				c.Wake()
+			}
+		}()
+		return
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		if in == nil {
+			after(c, "wake")
+			return []byte("w"), None
+		}
+		after(c, "data")
+		return in, None
+	}
+	events.Closed = func(c Conn, err error) (action Action) {
+		atomic.AddInt32(&closed, 1)
+		return
+	}
+	events.Serving = func(srv Server) (action Action) {
+		for i := 0; i < conns; i++ {
+			go func() {
+				conn, err := net.Dial(network, addr)
+				must(err)
+				defer conn.Close()
+				go io.Copy(io.Discard, conn)
+				for {
+					if _, err := conn.Write([]byte("traffic")); err != nil {
+						return // closed by the server
+					}
+				}
+			}()
+		}
+		return
+	}
+	start := time.Now()
+	events.Tick = func() (delay time.Duration, action Action) {
+		if atomic.LoadInt32(&closed) == conns {
+			return 0, Shutdown
+		}
+		if time.Since(start) > 5*time.Second {
+			panic("timeout")
+		}
+		return time.Second / 20, None
+	}
+	if stdlib {
+		must(Serve(events, network+"-net://"+addr))
+	} else {
+		must(Serve(events, network+"://"+addr))
+	}
+}
+
+func TestListenerAddr(t *testing.T) {
+	t.Run("poll", func(t *testing.T) {
+		testListenerAddr("tcp", ":9991", ":9993", false)
+	})
+	t.Run("stdlib", func(t *testing.T) {
+		testListenerAddr("tcp", ":9992", ":9994", true)
+	})
+}
+
+func testListenerAddr(network, addr1, addr2 string, stdlib bool) {
+	var opened int32
+	var addrs []net.Addr
+	var events Events
+	events.Serving = func(srv Server) (action Action) {
+		addrs = srv.Addrs
+		go func() {
+			for _, addr := range []string{addr1, addr2} {
+				conn, err := net.Dial(network, addr)
+				must(err)
+				defer conn.Close()
+			}
+		}()
+		return
+	}
+	events.Opened = func(c Conn) (out []byte, opts Options, action Action) {
+		if c.ListenerAddr().String() != addrs[c.AddrIndex()].String() {
+			panic(fmt.Sprintf("expected %v, got %v", addrs[c.AddrIndex()], c.ListenerAddr()))
+		}
+		_, port, _ := net.SplitHostPort(c.ListenerAddr().String())
+		if want := []string{addr1, addr2}[c.AddrIndex()]; ":"+port != want {
+			panic(fmt.Sprintf("expected listener %s, got %v", want, c.ListenerAddr()))
+		}
+		atomic.AddInt32(&opened, 1)
+		return
+	}
+	start := time.Now()
+	events.Tick = func() (delay time.Duration, action Action) {
+		if atomic.LoadInt32(&opened) == 2 {
+			return 0, Shutdown
+		}
+		if time.Since(start) > 2*time.Second {
+			panic("timeout")
+		}
+		return time.Second / 20, None
+	}
+	scheme := network + "://"
+	if stdlib {
+		scheme = network + "-net://"
+	}
+	must(Serve(events, scheme+addr1, scheme+addr2))
+}
+
+func TestSetLoopCount(t *testing.T) {
+	t.Run("poll", func(t *testing.T) {
+		testSetLoopCount("tcp", ":9991", false)
+	})
+	t.Run("stdlib", func(t *testing.T) {
+		testSetLoopCount("tcp", ":9992", true)
+	})
+}
+
+func testSetLoopCount(network, addr string, stdlib bool) {
+	var finished int32
+	var events Events
+	events.NumLoops = 2
+	events.LoadBalance = RoundRobin
+	events.AcceptLoops = 1 // the accepts are not raced by the loops
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		return in, None
+	}
+	expect := func(stats []LoopStat, conns ...int) {
+		for i, n := range conns {
+			if stats[i].ActiveConns != n {
+				panic(fmt.Sprintf("expected %v connections on the loops, got %+v", conns, stats))
+			}
+		}
+	}
+	echo := func(conn net.Conn, msg string) {
+		_, err := conn.Write([]byte(msg))
+		must(err)
+		buf := make([]byte, len(msg))
+		_, err = io.ReadFull(conn, buf)
+		must(err)
+		if string(buf) != msg {
+			panic(fmt.Sprintf("expected %q, got %q", msg, buf))
+		}
+	}
+	events.Serving = func(srv Server) (action Action) {
+		go func() {
+			defer atomic.StoreInt32(&finished, 1)
+			if stdlib {
+				if err := srv.SetLoopCount(4); err != ErrNotSupported {
+					panic(fmt.Sprintf("expected %v, got %v", ErrNotSupported, err))
+				}
+				return
+			}
+			var conns []net.Conn
+			dial := func(n int) {
+				for i := 0; i < n; i++ {
+					conn, err := net.Dial(network, addr)
+					must(err)
+					echo(conn, "hello")
+					conns = append(conns, conn)
+				}
+			}
+			echoAll := func(step string) {
+				for i, conn := range conns {
+					echo(conn, fmt.Sprintf("%s %d", step, i))
+				}
+			}
+			defer func() {
+				for _, conn := range conns {
+					conn.Close()
+				}
+			}()
+			dial(4)
+			if err := srv.SetLoopCount(0); err == nil {
+				panic("expected an error of the invalid count")
+			}
+			// scale up, the new loops take their share
+			must(srv.SetLoopCount(4))
+			dial(8)
+			stats := srv.LoopStats()
+			if len(stats) != 4 {
+				panic(fmt.Sprintf("expected 4 loops, got %+v", stats))
+			}
+			expect(stats, 4, 4, 2, 2)
+			echoAll("up")
+			// scale down, the connections are migrated to the first loop
+			must(srv.SetLoopCount(1))
+			echoAll("down") // the handoffs are done once they echo
+			stats = srv.LoopStats()
+			if stats[0].ActiveConns != len(conns) || stats[0].Retired {
+				panic(fmt.Sprintf("expected all connections on loop 0, got %+v", stats))
+			}
+			for _, st := range stats[1:] {
+				if !st.Retired || st.ActiveConns != 0 {
+					panic(fmt.Sprintf("expected loop %d retired, got %+v", st.Index, st))
+				}
+			}
+			// the retired loops are revived before adding
+			must(srv.SetLoopCount(3))
+			stats = srv.LoopStats()
+			if len(stats) != 4 || stats[1].Retired || stats[2].Retired || !stats[3].Retired {
+				panic(fmt.Sprintf("expected loops 1 and 2 revived, got %+v", stats))
+			}
+			// the retired loop 3 is not counted by the round robin
+			dial(3)
+			echoAll("revived")
+			expect(srv.LoopStats(), len(conns)-2, 1, 1, 0)
+		}()
+		return
+	}
+	start := time.Now()
+	events.Tick = func() (delay time.Duration, action Action) {
+		if atomic.LoadInt32(&finished) == 1 {
+			return 0, Shutdown
+		}
+		if time.Since(start) > 5*time.Second {
+			panic("timeout")
+		}
+		return time.Second / 20, None
+	}
+	if stdlib {
+		must(Serve(events, network+"-net://"+addr))
+	} else {
+		must(Serve(events, network+"://"+addr))
+	}
+}
+
+func TestLastError(t *testing.T) {
+	var closedErr error
+	var events Events
+	events.Opened = func(c Conn) (out []byte, opts Options, action Action) {
+		opts.MaxWriteBuffer = 8
+		opts.WriteOverflowPolicy = DropNewest
+		return
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		if string(in) == "bad" {
+			RecordError(c, io.ErrUnexpectedEOF) // the protocol recovers
+			return nil, None
+		}
+		return in, None
+	}
+	events.Closed = func(c Conn, err error) (action Action) {
+		closedErr = c.LastError()
+		return
+	}
+	c := LoopbackServer(events)
+	c.Feed([]byte("aaaa"))
+	c.Feed([]byte("bbbb"))
+	if err := c.LastError(); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	c.Feed([]byte("cccc")) // dropped, the connection goes on
+	if err := c.LastError(); err != ErrWriteBufferOverflow {
+		t.Fatalf("expected %v, got %v", ErrWriteBufferOverflow, err)
+	}
+	if out := string(c.Output()); out != "aaaabbbb" || c.Closed() {
+		t.Fatalf("expected the connection open with the output, got %q", out)
+	}
+	c.Feed([]byte("dddd"))
+	if err := c.LastError(); err != nil {
+		t.Fatalf("expected the error cleared by a write, got %v", err)
+	}
+	c.Feed([]byte("bad"))
+	c.Close(nil)
+	if closedErr != io.ErrUnexpectedEOF {
+		t.Fatalf("expected %v in Closed, got %v", io.ErrUnexpectedEOF, closedErr)
+	}
+}
+
+func TestDrainNotice(t *testing.T) {
+	t.Run("poll", func(t *testing.T) {
+		testDrainNotice("tcp", ":9991", false)
+	})
+	t.Run("stdlib", func(t *testing.T) {
+		testDrainNotice("tcp", ":9992", true)
+	})
+}
+
+func testDrainNotice(network, addr string, stdlib bool) {
+	const numConns = 6
+	const notice = "reconnect"
+	var finished int32
+	var events Events
+	events.NumLoops = 2
+	events.LoadBalance = RoundRobin
+	events.AcceptLoops = 1 // half of the connections are on loop 0
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		return in, None
+	}
+	events.DrainNotice = func(c Conn) []byte {
+		return []byte(notice)
+	}
+	events.Serving = func(srv Server) (action Action) {
+		go func() {
+			defer atomic.StoreInt32(&finished, 1)
+			var conns []net.Conn
+			for i := 0; i < numConns; i++ {
+				conn, err := net.Dial(network, addr)
+				must(err)
+				defer conn.Close()
+				_, err = conn.Write([]byte("hello"))
+				must(err)
+				_, err = io.ReadFull(conn, make([]byte, 5))
+				must(err)
+				conns = append(conns, conn)
+			}
+			var notified, closedAfter int32
+			var wg sync.WaitGroup
+			for _, conn := range conns {
+				wg.Add(1)
+				go func(conn net.Conn) {
+					defer wg.Done()
+					conn.SetReadDeadline(time.Now().Add(time.Second))
+					buf := make([]byte, len(notice))
+					if _, err := io.ReadFull(conn, buf); err != nil {
+						return // on the other loop
+					}
+					if string(buf) != notice {
+						panic(fmt.Sprintf("expected the notice, got %q", buf))
+					}
+					if atomic.AddInt32(&notified, 1)%2 == 1 {
+						conn.Close() // the client acts on the notice
+						return
+					}
+					// ignored, so closed at the timeout
+					if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+						panic(fmt.Sprintf("expected EOF after the notice, got %v", err))
+					}
+					atomic.AddInt32(&closedAfter, 1)
+				}(conn)
+			}
+			st, err := srv.DrainLoop(0, false, time.Second/4)
+			must(err)
+			wg.Wait()
+			if st.Closed == 0 || int(notified) != st.Closed {
+				panic(fmt.Sprintf("expected %d notified, got %d", st.Closed, notified))
+			}
+			if closedAfter == 0 {
+				panic("expected a connection closed at the timeout")
+			}
+		}()
+		return
+	}
+	start := time.Now()
+	events.Tick = func() (delay time.Duration, action Action) {
+		if atomic.LoadInt32(&finished) == 1 {
+			return 0, Shutdown
+		}
+		if time.Since(start) > 5*time.Second {
+			panic("timeout")
+		}
+		return time.Second / 20, None
+	}
+	if stdlib {
+		must(Serve(events, network+"-net://"+addr))
+	} else {
+		must(Serve(events, network+"://"+addr))
+	}
+}
+
+func TestCaptureRing(t *testing.T) {
+	var events Events
+	events.Opened = func(c Conn) (out []byte, opts Options, action Action) {
+		opts.CaptureRing = 16
+		opts.LogCapture = true
+		return
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		return bytes.ToUpper(in), None
+	}
+	c := LoopbackServer(events)
+	for _, msg := range []string{"hello", "wide world"} {
+		c.Feed([]byte(msg))
+		c.Output()
+	}
+	// the last 16 bytes are kept, the oldest ones are overwritten
+	var got []string
+	for _, rec := range c.DumpCapture() {
+		dir := "in"
+		if rec.Dir == Outbound {
+			dir = "out"
+		}
+		got = append(got, dir+" "+string(rec.Data))
+		if rec.Time.IsZero() {
+			t.Fatal("expected the time of the record")
+		}
+	}
+	if want := "in  world,out WIDE WORLD"; strings.Join(got, ",") != want {
+		t.Fatalf("expected %q, got %q", want, strings.Join(got, ","))
+	}
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+	c.Close(errors.New("boom"))
+	if out := logs.String(); !strings.Contains(out, "boom") || !strings.Contains(out, `"WIDE WORLD"`) {
+		t.Fatalf("expected the capture logged on the error, got %q", out)
+	}
+}
+
+func TestTrace(t *testing.T) {
+	t.Run("poll", func(t *testing.T) {
+		testTrace("tcp", ":9991", false)
+	})
+	t.Run("stdlib", func(t *testing.T) {
+		testTrace("tcp", ":9992", true)
+	})
+}
+
+func testTrace(network, addr string, stdlib bool) {
+	var closed int32
+	var mu sync.Mutex
+	traced := map[Direction][]byte{}
+	var events Events
+	events.Opened = func(c Conn) (out []byte, opts Options, action Action) {
+		opts.Trace = func(c Conn, dir Direction, b []byte) {
+			mu.Lock()
+			traced[dir] = append(traced[dir], b...)
+			mu.Unlock()
+		}
+		return []byte("hi "), opts, None
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		return []byte("pong"), None
+	}
+	events.Closed = func(c Conn, err error) (action Action) {
+		atomic.StoreInt32(&closed, 1)
+		return
+	}
+	events.Serving = func(srv Server) (action Action) {
+		go func() {
+			conn, err := net.Dial(network, addr)
+			must(err)
+			defer conn.Close()
+			_, err = io.ReadFull(conn, make([]byte, 3))
+			must(err)
+			_, err = conn.Write([]byte("ping"))
+			must(err)
+			_, err = io.ReadFull(conn, make([]byte, 4))
+			must(err)
+		}()
+		return
+	}
+	start := time.Now()
+	events.Tick = func() (delay time.Duration, action Action) {
+		if atomic.LoadInt32(&closed) == 1 {
+			return 0, Shutdown
+		}
+		if time.Since(start) > 2*time.Second {
+			panic("timeout")
+		}
+		return time.Second / 20, None
+	}
+	if stdlib {
+		must(Serve(events, network+"-net://"+addr))
+	} else {
+		must(Serve(events, network+"://"+addr))
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if in, out := string(traced[Inbound]), string(traced[Outbound]); in != "ping" || out != "hi pong" {
+		panic(fmt.Sprintf("expected ping and \"hi pong\" traced, got %q and %q", in, out))
+	}
+}
+
+func TestShutdownAccepting(t *testing.T) {
+	t.Run("poll", func(t *testing.T) {
+		testShutdownAccepting("tcp", ":9991", false)
+	})
+	t.Run("stdlib", func(t *testing.T) {
+		testShutdownAccepting("tcp", ":9992", true)
+	})
+}
+
+func testShutdownAccepting(network, addr string, stdlib bool) {
+	var opened int32
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	var events Events
+	events.AcceptLoops = 4
+	events.NumLoops = 2
+	events.Opened = func(c Conn) (out []byte, opts Options, action Action) {
+		atomic.AddInt32(&opened, 1)
+		return
+	}
+	events.Serving = func(srv Server) (action Action) {
+		// keep dialing, so the listeners are closed while accepting
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for {
+					select {
+					case <-stop:
+						return
+					default:
+					}
+					if conn, err := net.Dial(network, addr); err == nil {
+						conn.Close()
+					}
+				}
+			}()
+		}
+		return
+	}
+	start := time.Now()
+	events.Tick = func() (delay time.Duration, action Action) {
+		if atomic.LoadInt32(&opened) >= 50 {
+			return 0, Shutdown
+		}
+		if time.Since(start) > 2*time.Second {
+			panic("timeout")
+		}
+		return time.Millisecond, None
+	}
+	var err error
+	if stdlib {
+		err = Serve(events, network+"-net://"+addr)
+	} else {
+		err = Serve(events, network+"://"+addr)
+	}
+	close(stop)
+	wg.Wait()
+	if err != nil {
+		panic(fmt.Sprintf("expected a clean shutdown, got %v", err))
+	}
+}
+
+func TestLoopSelector(t *testing.T) {
+	t.Run("poll", func(t *testing.T) {
+		testLoopSelector("tcp", ":9991", false, 0)
+	})
+	t.Run("poll-accept-loops", func(t *testing.T) {
+		testLoopSelector("tcp", ":9991", false, 2)
+	})
+	t.Run("stdlib", func(t *testing.T) {
+		testLoopSelector("tcp", ":9992", true, 0)
+	})
+}
+
+func testLoopSelector(network, addr string, stdlib bool, acceptLoops int) {
+	const conns = 8
+	var done int32
+	var events Events
+	events.NumLoops = 4
+	events.AcceptLoops = acceptLoops
+	// the same loop for a remote ip
+	selected := int32(-1)
+	events.LoopSelector = func(remote net.Addr, numLoops int) int {
+		if numLoops != 4 {
+			panic(fmt.Sprintf("expected 4 loops, got %d", numLoops))
+		}
+		host, _, _ := net.SplitHostPort(remote.String())
+		h := fnv.New32a()
+		h.Write([]byte(host))
+		idx := int(h.Sum32() % uint32(numLoops))
+		atomic.StoreInt32(&selected, int32(idx))
+		return idx
+	}
+	events.Opened = func(c Conn) (out []byte, opts Options, action Action) {
+		return []byte("hi"), opts, None
+	}
+	events.Serving = func(srv Server) (action Action) {
+		go func() {
+			defer atomic.StoreInt32(&done, 1)
+			for i := 0; i < conns; i++ {
+				conn, err := net.Dial(network, addr)
+				must(err)
+				defer conn.Close()
+				_, err = io.ReadFull(conn, make([]byte, 2))
+				must(err)
+			}
+			for _, st := range srv.LoopStats() {
+				want := 0
+				if st.Index == int(atomic.LoadInt32(&selected)) {
+					want = conns
+				}
+				if st.ActiveConns != want {
+					panic(fmt.Sprintf("expected %d connections on loop %d, got %d", want, st.Index, st.ActiveConns))
+				}
+			}
+		}()
+		return
+	}
+	start := time.Now()
+	events.Tick = func() (delay time.Duration, action Action) {
+		if atomic.LoadInt32(&done) == 1 {
+			return 0, Shutdown
+		}
+		if time.Since(start) > 2*time.Second {
+			panic("timeout")
+		}
+		return time.Second / 20, None
+	}
+	if stdlib {
+		must(Serve(events, network+"-net://"+addr))
+	} else {
+		must(Serve(events, network+"://"+addr))
+	}
+}
+
+func TestWakeLatency(t *testing.T) {
+	t.Run("poll", func(t *testing.T) {
+		testWakeLatency("tcp", ":9991", false)
+	})
+	t.Run("stdlib", func(t *testing.T) {
+		testWakeLatency("tcp", ":9992", true)
+	})
+}
+
+func testWakeLatency(network, addr string, stdlib bool) {
+	const busy = time.Second / 10
+	var done int32
+	var events Events
+	events.Opened = func(c Conn) (out []byte, opts Options, action Action) {
+		must(TryBindSession(c, &testSession{id: "latency"}))
+		return []byte("hi"), opts, None
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		// the message waits for the busy loop
+		must(WakeWithMessage("latency", "busy"))
+		time.Sleep(busy)
+		return
+	}
+	events.Closed = func(c Conn, err error) (action Action) {
+		DestroySession(c)
+		return
+	}
+	events.WokenMessage = func(c Conn, msg interface{}) (out []byte, action Action) {
+		return []byte(msg.(string)[:1]), None
+	}
+	events.Serving = func(srv Server) (action Action) {
+		go func() {
+			defer atomic.StoreInt32(&done, 1)
+			conn, err := net.Dial(network, addr)
+			must(err)
+			defer conn.Close()
+			_, err = io.ReadFull(conn, make([]byte, 2))
+			must(err)
+			must(WakeWithMessage("latency", "idle"))
+			_, err = io.ReadFull(conn, make([]byte, 1))
+			must(err)
+			idle := srv.LoopStats()[0]
+			if idle.Wakes != 1 || idle.MaxWakeLatency >= busy/2 {
+				panic(fmt.Sprintf("expected a quick wake, got %d wakes at most %v", idle.Wakes, idle.MaxWakeLatency))
+			}
+			_, err = conn.Write([]byte("work"))
+			must(err)
+			_, err = io.ReadFull(conn, make([]byte, 1))
+			must(err)
+			st := srv.LoopStats()[0]
+			if st.Wakes != 2 || st.MaxWakeLatency < busy || st.WakeLatency < busy+idle.WakeLatency {
+				panic(fmt.Sprintf("expected a wake delayed by the busy loop, got %d wakes at most %v", st.Wakes, st.MaxWakeLatency))
+			}
+		}()
+		return
+	}
+	start := time.Now()
+	events.Tick = func() (delay time.Duration, action Action) {
+		if atomic.LoadInt32(&done) == 1 {
+			return 0, Shutdown
+		}
+		if time.Since(start) > 2*time.Second {
+			panic("timeout")
+		}
+		return time.Second / 20, None
+	}
+	if stdlib {
+		must(Serve(events, network+"-net://"+addr))
+	} else {
+		must(Serve(events, network+"://"+addr))
+	}
+}
+
+func TestMixedTransports(t *testing.T) {
+	t.Run("poll", func(t *testing.T) {
+		testMixedTransports(":9991", false)
+	})
+	t.Run("stdlib", func(t *testing.T) {
+		testMixedTransports(":9992", true)
+	})
+}
+
+func testMixedTransports(addr string, stdlib bool) {
+	var done, closed int32
+	var events Events
+	events.UDPIdleTimeout = time.Second
+	events.Opened = func(c Conn) (out []byte, opts Options, action Action) {
+		if _, ok := c.RemoteAddr().(*net.UDPAddr); ok {
+			must(BindSessionByAddr(c, &testSession{}))
+		} else {
+			must(TryBindSession(c, &testSession{id: "mixed-tcp"}))
+		}
+		return
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		id := GetSessionId(GetSession(c))
+		if in == nil {
+			return []byte(id + " woke\n"), None
+		}
+		go FindConnById(id).Wake()
+		return []byte(id + " " + string(in)), None
+	}
+	events.Closed = func(c Conn, err error) (action Action) {
+		DestroySession(c)
+		atomic.AddInt32(&closed, 1)
+		return
+	}
+	events.Serving = func(srv Server) (action Action) {
+		go func() {
+			defer atomic.StoreInt32(&done, 1)
+			// a stream may merge the writes, the datagrams are kept apart
+			tconn, err := net.Dial("tcp", addr)
+			must(err)
+			defer tconn.Close()
+			tconn.Write([]byte("ping\n"))
+			rd := bufio.NewReader(tconn)
+			for _, expect := range []string{"mixed-tcp ping\n", "mixed-tcp woke\n"} {
+				line, err := rd.ReadString('\n')
+				must(err)
+				if line != expect {
+					panic(fmt.Sprintf("expected %q, got %q", expect, line))
+				}
+			}
+			uconn, err := net.Dial("udp", addr)
+			must(err)
+			defer uconn.Close()
+			uconn.Write([]byte("ping\n"))
+			id := uconn.LocalAddr().String()
+			packet := make([]byte, 64)
+			for _, expect := range []string{id + " ping\n", id + " woke\n"} {
+				uconn.SetReadDeadline(time.Now().Add(time.Second))
+				n, err := uconn.Read(packet)
+				must(err)
+				if string(packet[:n]) != expect {
+					panic(fmt.Sprintf("expected %q, got %q", expect, packet[:n]))
+				}
+			}
+		}()
+		return
+	}
+	start := time.Now()
+	events.Tick = func() (delay time.Duration, action Action) {
+		if atomic.LoadInt32(&done) == 1 {
+			return 0, Shutdown
+		}
+		if time.Since(start) > 2*time.Second {
+			panic("timeout")
+		}
+		return time.Second / 20, None
+	}
+	if stdlib {
+		must(Serve(events, "tcp-net://"+addr, "udp-net://"+addr))
+	} else {
+		must(Serve(events, "tcp://"+addr, "udp://"+addr))
+	}
+	if n := atomic.LoadInt32(&closed); n != 2 {
+		panic(fmt.Sprintf("expected both connections closed, got %d", n))
+	}
+}
+
+func TestLoopStatsAndReset(t *testing.T) {
+	t.Run("poll", func(t *testing.T) {
+		testLoopStatsAndReset("tcp", ":9991", false)
+	})
+	t.Run("stdlib", func(t *testing.T) {
+		testLoopStatsAndReset("tcp", ":9992", true)
+	})
+}
+
+func testLoopStatsAndReset(network, addr string, stdlib bool) {
+	var done int32
+	var events Events
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		return in, None
+	}
+	events.Serving = func(srv Server) (action Action) {
+		go func() {
+			defer atomic.StoreInt32(&done, 1)
+			conn, err := net.Dial(network, addr)
+			must(err)
+			defer conn.Close()
+			for _, data := range []string{"hello", "abc"} {
+				_, err = conn.Write([]byte(data))
+				must(err)
+				_, err = io.ReadFull(conn, make([]byte, len(data)))
+				must(err)
+				// the written bytes are counted after the write returns
+				for srv.LoopStats()[0].BytesWritten != uint64(len(data)) {
+					time.Sleep(time.Millisecond)
+				}
+				st := srv.LoopStatsAndReset()[0]
+				if st.BytesRead != uint64(len(data)) || st.BytesWritten != uint64(len(data)) || st.ActiveConns != 1 {
+					panic(fmt.Sprintf("expected %d bytes of one connection, got %+v", len(data), st))
+				}
+			}
+			if st := srv.LoopStats()[0]; st.BytesRead != 0 || st.BytesWritten != 0 || st.ActiveConns != 1 {
+				panic(fmt.Sprintf("expected the counters reset, got %+v", st))
+			}
+		}()
+		return
+	}
+	start := time.Now()
+	events.Tick = func() (delay time.Duration, action Action) {
+		if atomic.LoadInt32(&done) == 1 {
+			return 0, Shutdown
+		}
+		if time.Since(start) > 2*time.Second {
+			panic("timeout")
+		}
+		return time.Second / 20, None
+	}
+	if stdlib {
+		must(Serve(events, network+"-net://"+addr))
+	} else {
+		must(Serve(events, network+"://"+addr))
+	}
+}
+
+func TestRetryData(t *testing.T) {
+	t.Run("poll", func(t *testing.T) {
+		testRetryData("tcp", ":9991", false)
+	})
+	t.Run("stdlib", func(t *testing.T) {
+		testRetryData("tcp", ":9992", true)
+	})
+}
+
+func testRetryData(network, addr string, stdlib bool) {
+	const backoff = time.Second / 20
+	var done int32
+	var attempts []string
+	var events Events
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		attempts = append(attempts, string(in))
+		if len(attempts) < 3 {
+			RetryData(c, in, backoff) // unavailable for a moment
+			return
+		}
+		return append([]byte("ok "), in...), None
+	}
+	events.Serving = func(srv Server) (action Action) {
+		go func() {
+			defer atomic.StoreInt32(&done, 1)
+			conn, err := net.Dial(network, addr)
+			must(err)
+			defer conn.Close()
+			start := time.Now()
+			_, err = conn.Write([]byte("req"))
+			must(err)
+			// held along with the retried data
+			time.Sleep(backoff / 5)
+			_, err = conn.Write([]byte("more"))
+			must(err)
+			expect := "ok reqmore"
+			packet := make([]byte, len(expect))
+			_, err = io.ReadFull(conn, packet)
+			must(err)
+			if string(packet) != expect {
+				panic(fmt.Sprintf("expected %q, got %q", expect, packet))
+			}
+			if elapsed := time.Since(start); elapsed < 2*backoff {
+				panic(fmt.Sprintf("expected two retries after %v, got the data after %v", 2*backoff, elapsed))
+			}
+		}()
+		return
+	}
+	start := time.Now()
+	events.Tick = func() (delay time.Duration, action Action) {
+		if atomic.LoadInt32(&done) == 1 {
+			return 0, Shutdown
+		}
+		if time.Since(start) > 2*time.Second {
+			panic("timeout")
+		}
+		return time.Second / 20, None
+	}
+	if stdlib {
+		must(Serve(events, network+"-net://"+addr))
+	} else {
+		must(Serve(events, network+"://"+addr))
+	}
+	if fmt.Sprint(attempts) != "[req reqmore reqmore]" {
+		panic(fmt.Sprintf("expected the data retried twice, got %q", attempts))
+	}
+}
+
+func TestCongested(t *testing.T) {
+	t.Run("poll", func(t *testing.T) {
+		testCongested("tcp", ":9991", false)
+	})
+	t.Run("stdlib", func(t *testing.T) {
+		testCongested("tcp", ":9992", true)
+	})
+}
+
+func testCongested(network, addr string, stdlib bool) {
+	const size = 32 << 20 // over the socket buffers
+	var done int32
+	conns := make(chan Conn, 1)
+	var events Events
+	events.Opened = func(c Conn) (out []byte, opts Options, action Action) {
+		conns <- c
+		return
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		return make([]byte, size), None
+	}
+	events.Serving = func(srv Server) (action Action) {
+		go func() {
+			defer atomic.StoreInt32(&done, 1)
+			conn, err := net.Dial(network, addr)
+			must(err)
+			defer conn.Close()
+			c := <-conns
+			waitFor := func(congested bool) {
+				for start := time.Now(); c.Congested() != congested; time.Sleep(time.Millisecond) {
+					if time.Since(start) > time.Second {
+						panic(fmt.Sprintf("expected congested %v", congested))
+					}
+				}
+			}
+			if c.Congested() {
+				panic("expected not congested before writing")
+			}
+			_, err = conn.Write([]byte("go"))
+			must(err)
+			waitFor(true) // the peer does not read
+			_, err = io.ReadFull(conn, make([]byte, size))
+			must(err)
+			waitFor(false)
+		}()
+		return
+	}
+	start := time.Now()
+	events.Tick = func() (delay time.Duration, action Action) {
+		if atomic.LoadInt32(&done) == 1 {
+			return 0, Shutdown
+		}
+		if time.Since(start) > 5*time.Second {
+			panic("timeout")
+		}
+		return time.Second / 20, None
+	}
+	if stdlib {
+		must(Serve(events, network+"-net://"+addr))
+	} else {
+		must(Serve(events, network+"://"+addr))
+	}
+}
+
+func TestPeerReset(t *testing.T) {
+	t.Run("poll", func(t *testing.T) {
+		testPeerReset("tcp", ":9991", false)
+	})
+	t.Run("stdlib", func(t *testing.T) {
+		testPeerReset("tcp", ":9992", true)
+	})
+}
+
+func testPeerReset(network, addr string, stdlib bool) {
+	type closed struct {
+		err        error
+		reset, fin bool
+	}
+	var done int32
+	closes := make(chan closed, 1)
+	var events Events
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		return in, None
+	}
+	events.Closed = func(c Conn, err error) (action Action) {
+		closes <- closed{err, c.PeerReset(), c.PeerClosed()}
+		return
+	}
+	events.Serving = func(srv Server) (action Action) {
+		go func() {
+			defer atomic.StoreInt32(&done, 1)
+			dial := func() *net.TCPConn {
+				conn, err := net.Dial(network, addr)
+				must(err)
+				_, err = conn.Write([]byte("hi"))
+				must(err)
+				_, err = io.ReadFull(conn, make([]byte, 2))
+				must(err)
+				return conn.(*net.TCPConn)
+			}
+			conn := dial()
+			must(conn.SetLinger(0)) // RST
+			conn.Close()
+			if c := <-closes; !c.reset || c.fin || c.err == nil {
+				panic(fmt.Sprintf("expected a reset with an error, got %+v", c))
+			}
+			conn = dial()
+			conn.Close() // FIN
+			if c := <-closes; c.reset || !c.fin || c.err != nil {
+				panic(fmt.Sprintf("expected a graceful close, got %+v", c))
+			}
+		}()
+		return
+	}
+	start := time.Now()
+	events.Tick = func() (delay time.Duration, action Action) {
+		if atomic.LoadInt32(&done) == 1 {
+			return 0, Shutdown
+		}
+		if time.Since(start) > 5*time.Second {
+			panic("timeout")
+		}
+		return time.Second / 20, None
+	}
+	if stdlib {
+		must(Serve(events, network+"-net://"+addr))
+	} else {
+		must(Serve(events, network+"://"+addr))
+	}
+}
+
+func TestQueueWrite(t *testing.T) {
+	testQueueWrite("tcp", ":9991")
+}
+
+func testQueueWrite(network, addr string) {
+	const chunk, max = 256 << 10, 32 << 20 // up to over the socket buffers
+	var done int32
+	conns := make(chan Conn, 1)
+	var events Events
+	events.Opened = func(c Conn) (out []byte, opts Options, action Action) {
+		conns <- c
+		return
+	}
+	events.Serving = func(srv Server) (action Action) {
+		go func() {
+			defer atomic.StoreInt32(&done, 1)
+			conn, err := net.Dial(network, addr)
+			must(err)
+			defer conn.Close()
+			c := <-conns
+			if buffered, err := QueueWrite(c, []byte("hello")); err != nil || buffered {
+				panic(fmt.Sprintf("expected the first write not buffered, got %v %v", buffered, err))
+			}
+			buf := make([]byte, 5)
+			_, err = io.ReadFull(conn, buf)
+			must(err)
+			// the peer stops reading, so the socket fills up
+			for n := 0; ; n += chunk {
+				if n > max {
+					panic("expected a buffered write")
+				}
+				buffered, err := QueueWrite(c, make([]byte, chunk))
+				must(err)
+				if buffered {
+					break
+				}
+				time.Sleep(time.Millisecond) // let the loop write it
+			}
+		}()
+		return
+	}
+	start := time.Now()
+	events.Tick = func() (delay time.Duration, action Action) {
+		if atomic.LoadInt32(&done) == 1 {
+			return 0, Shutdown
+		}
+		if time.Since(start) > 5*time.Second {
+			panic("timeout")
+		}
+		return time.Second / 20, None
+	}
+	must(Serve(events, network+"://"+addr))
+}
+
+func TestTotalOutboundBuffered(t *testing.T) {
+	testTotalOutboundBuffered("tcp", ":9991")
+}
+
+func testTotalOutboundBuffered(network, addr string) {
+	const numConns, size = 8, 4 << 20 // over the socket buffers
+	var done, fired int32
+	var ceiling uint64
+	conns := make(chan Conn, numConns)
+	var events Events
+	events.NumLoops = 2
+	events.MaxTotalOutbound = numConns * size / 4
+	events.OutboundCeiling = func(total uint64) {
+		atomic.AddInt32(&fired, 1)
+		atomic.StoreUint64(&ceiling, total)
+	}
+	events.Opened = func(c Conn) (out []byte, opts Options, action Action) {
+		opts.SendBuf = 64 << 10
+		conns <- c
+		return
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		return make([]byte, size), None
+	}
+	events.Serving = func(srv Server) (action Action) {
+		go func() {
+			defer atomic.StoreInt32(&done, 1)
+			var clients []net.Conn
+			var cs []Conn
+			for i := 0; i < numConns; i++ {
+				conn, err := net.Dial(network, addr)
+				must(err)
+				defer conn.Close()
+				must(conn.(*net.TCPConn).SetReadBuffer(64 << 10))
+				clients = append(clients, conn)
+				cs = append(cs, <-conns)
+			}
+			if n := srv.TotalOutboundBuffered(); n != 0 {
+				panic(fmt.Sprintf("expected nothing buffered, got %d", n))
+			}
+			for _, conn := range clients {
+				_, err := conn.Write([]byte("go"))
+				must(err)
+			}
+			// the peers do not read, so the loops keep the buffers
+			waitFor := func(ok func(total uint64) bool) uint64 {
+				for start := time.Now(); ; time.Sleep(time.Millisecond) {
+					var sum uint64
+					for _, c := range cs {
+						sum += uint64(WriteQueueLen(c))
+					}
+					if total := srv.TotalOutboundBuffered(); total == sum && ok(total) {
+						return total
+					}
+					if time.Since(start) > 2*time.Second {
+						panic("expected the total of the connections")
+					}
+				}
+			}
+			waitFor(func(total uint64) bool { return total > numConns*size/2 })
+			if atomic.LoadInt32(&fired) != 1 || atomic.LoadUint64(&ceiling) <= numConns*size/4 {
+				panic(fmt.Sprintf("expected the ceiling fired once, got %d at %d", fired, ceiling))
+			}
+			for _, conn := range clients {
+				_, err := io.ReadFull(conn, make([]byte, size))
+				must(err)
+			}
+			waitFor(func(total uint64) bool { return total == 0 })
+		}()
+		return
+	}
+	start := time.Now()
+	events.Tick = func() (delay time.Duration, action Action) {
+		if atomic.LoadInt32(&done) == 1 {
+			return 0, Shutdown
+		}
+		if time.Since(start) > 10*time.Second {
+			panic("timeout")
+		}
+		return time.Second / 20, None
+	}
+	must(Serve(events, network+"://"+addr))
+}
+
+func TestConnWriter(t *testing.T) {
+	t.Run("poll", func(t *testing.T) {
+		testConnWriter("tcp", ":9991", false)
+	})
+	t.Run("stdlib", func(t *testing.T) {
+		testConnWriter("tcp", ":9992", true)
+	})
+}
+
+func testConnWriter(network, addr string, stdlib bool) {
+	const numRecords = 20000 // about a megabyte of json
+	type record struct {
+		Seq  int    `json:"seq"`
+		Name string `json:"name"`
+	}
+	stream := func(c Conn, started chan struct{}) {
+		enc := json.NewEncoder(ConnWriter(c))
+		for i := 0; i < numRecords; i++ {
+			must(enc.Encode(record{i, fmt.Sprintf("record %d", i)}))
+			if i == 0 && started != nil {
+				close(started)
+			}
+		}
+	}
+	var done int32
+	var events Events
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		switch string(in) {
+		case "loop":
+			stream(c, nil) // queued once the event returns
+		case "goroutine":
+			started := make(chan struct{})
+			go stream(c, started) // waits for the peer
+			<-started             // the writes start while the event runs
+		}
+		return
+	}
+	events.Serving = func(srv Server) (action Action) {
+		go func() {
+			defer atomic.StoreInt32(&done, 1)
+			for _, from := range []string{"loop", "goroutine"} {
+				conn, err := net.Dial(network, addr)
+				must(err)
+				_, err = conn.Write([]byte(from))
+				must(err)
+				dec := json.NewDecoder(conn)
+				for i := 0; i < numRecords; i++ {
+					var rec record
+					must(dec.Decode(&rec))
+					if rec.Seq != i || rec.Name != fmt.Sprintf("record %d", i) {
+						panic(fmt.Sprintf("expected record %d from the %s, got %+v", i, from, rec))
+					}
+				}
+				conn.Close()
+			}
+		}()
+		return
+	}
+	start := time.Now()
+	events.Tick = func() (delay time.Duration, action Action) {
+		if atomic.LoadInt32(&done) == 1 {
+			return 0, Shutdown
+		}
+		if time.Since(start) > 10*time.Second {
+			panic("timeout")
+		}
+		return time.Second / 20, None
+	}
+	if stdlib {
+		must(Serve(events, network+"-net://"+addr))
+	} else {
+		must(Serve(events, network+"://"+addr))
+	}
+}
+
+func TestAckWindow(t *testing.T) {
+	t.Run("poll", func(t *testing.T) {
+		testAckWindow("tcp", ":9991", false)
+	})
+	t.Run("stdlib", func(t *testing.T) {
+		testAckWindow("tcp", ":9992", true)
+	})
+}
+
+func testAckWindow(network, addr string, stdlib bool) {
+	var queued, done int32
+	var events Events
+	events.Opened = func(c Conn) (out []byte, opts Options, action Action) {
+		AckWindow(c, 2)
+		go func() {
+			for i := 1; i <= 4; i++ {
+				if _, err := QueueWrite(c, []byte(fmt.Sprintf("m%d", i))); err != nil {
+					panic(err)
+				}
+				atomic.AddInt32(&queued, 1)
+			}
+		}()
+		return
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		if string(in) == "ack 2" {
+			// the event cannot wait for the window
+			if _, err := QueueWrite(c, []byte("mx")); err != ErrAckWindowFull {
+				panic(fmt.Sprintf("expected ErrAckWindowFull, got %v", err))
+			}
+			// the writer is woken while the event runs, it waits again
+			AckWindow(c, 2)
+			time.Sleep(time.Second / 20)
+			AckReceived(c, 2)
+		}
+		return
+	}
+	events.Serving = func(srv Server) (action Action) {
+		go func() {
+			defer atomic.StoreInt32(&done, 1)
+			conn, err := net.Dial(network, addr)
+			must(err)
+			defer conn.Close()
+			buf := make([]byte, 4)
+			_, err = io.ReadFull(conn, buf)
+			must(err)
+			if string(buf) != "m1m2" {
+				panic(fmt.Sprintf("expected m1m2, got %q", buf))
+			}
+			conn.SetReadDeadline(time.Now().Add(time.Second / 5))
+			if n, err := conn.Read(buf); err == nil {
+				panic(fmt.Sprintf("expected the writes to stall, got %q", buf[:n]))
+			}
+			if n := atomic.LoadInt32(&queued); n != 2 {
+				panic(fmt.Sprintf("expected 2 queued writes, got %d", n))
+			}
+			conn.SetReadDeadline(time.Time{})
+			_, err = conn.Write([]byte("ack 2"))
+			must(err)
+			_, err = io.ReadFull(conn, buf)
+			must(err)
+			if string(buf) != "m3m4" {
+				panic(fmt.Sprintf("expected m3m4, got %q", buf))
+			}
+		}()
+		return
+	}
+	start := time.Now()
+	events.Tick = func() (delay time.Duration, action Action) {
+		if atomic.LoadInt32(&done) == 1 {
+			return 0, Shutdown
+		}
+		if time.Since(start) > 10*time.Second {
+			panic("timeout")
+		}
+		return time.Second / 20, None
+	}
+	if stdlib {
+		must(Serve(events, network+"-net://"+addr))
+	} else {
+		must(Serve(events, network+"://"+addr))
+	}
+}
+
+func TestAutoPong(t *testing.T) {
+	t.Run("loopback", func(t *testing.T) {
+		var data int
+		var events Events
+		events.Opened = func(c Conn) (out []byte, opts Options, action Action) {
+			opts.AutoPong = AutoPong{
+				PingMatch: func(in []byte) bool { return string(in) == "ping" },
+				Pong:      []byte("pong"),
+			}
+			return
+		}
+		events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+			data++
+			return in, None
+		}
+		c := LoopbackServer(events)
+		c.Feed([]byte("ping"))
+		if out := string(c.Output()); out != "pong" || data != 0 {
+			t.Fatalf("expected the pong without Data, got %q of %d", out, data)
+		}
+		c.Feed([]byte("hello"))
+		if out := string(c.Output()); out != "hello" || data != 1 {
+			t.Fatalf("expected the other data passed to Data, got %q of %d", out, data)
+		}
+	})
+	t.Run("poll", func(t *testing.T) {
+		testAutoPong("tcp", ":9991", false)
+	})
+	t.Run("stdlib", func(t *testing.T) {
+		testAutoPong("tcp", ":9992", true)
+	})
+}
+
+func testAutoPong(network, addr string, stdlib bool) {
+	var done, data int32
+	var events Events
+	events.Opened = func(c Conn) (out []byte, opts Options, action Action) {
+		opts.AutoPong = AutoPong{
+			PingMatch: func(in []byte) bool { return bytes.Equal(in, []byte("ping\n")) },
+			Pong:      []byte("pong\n"),
+		}
+		return
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		atomic.AddInt32(&data, 1)
+		return in, None
+	}
+	events.Serving = func(srv Server) (action Action) {
+		go func() {
+			defer atomic.StoreInt32(&done, 1)
+			conn, err := net.Dial(network, addr)
+			must(err)
+			defer conn.Close()
+			rd := bufio.NewReader(conn)
+			for _, v := range []struct{ in, want string }{
+				{"ping\n", "pong\n"},
+				{"echo\n", "echo\n"},
+				{"ping\n", "pong\n"},
+			} {
+				_, err = conn.Write([]byte(v.in))
+				must(err)
+				line, err := rd.ReadString('\n')
+				must(err)
+				if line != v.want {
+					panic(fmt.Sprintf("expected %q for %q, got %q", v.want, v.in, line))
+				}
+			}
+			if n := atomic.LoadInt32(&data); n != 1 {
+				panic(fmt.Sprintf("expected only the echo passed to Data, got %d", n))
+			}
+		}()
+		return
+	}
+	start := time.Now()
+	events.Tick = func() (delay time.Duration, action Action) {
+		if atomic.LoadInt32(&done) == 1 {
+			return 0, Shutdown
+		}
+		if time.Since(start) > 5*time.Second {
+			panic("timeout")
+		}
+		return time.Second / 20, None
+	}
+	if stdlib {
+		must(Serve(events, network+"-net://"+addr))
+	} else {
+		must(Serve(events, network+"://"+addr))
+	}
+}
+
+func TestSaturatedCycles(t *testing.T) {
+	testSaturatedCycles("tcp", ":9991")
+}
+
+func testSaturatedCycles(network, addr string) {
+	const nconns = 100
+	var done, opened, blocked int32
+	var events Events
+	events.Opened = func(c Conn) (out []byte, opts Options, action Action) {
+		atomic.AddInt32(&opened, 1)
+		return
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		if atomic.CompareAndSwapInt32(&blocked, 0, 1) {
+			// the others become ready meanwhile, like after a broadcast
+			time.Sleep(time.Second / 5)
+		}
+		return in, None
+	}
+	events.Serving = func(srv Server) (action Action) {
+		go func() {
+			defer atomic.StoreInt32(&done, 1)
+			var conns []net.Conn
+			for i := 0; i < nconns; i++ {
+				conn, err := net.Dial(network, addr)
+				must(err)
+				defer conn.Close()
+				conns = append(conns, conn)
+			}
+			for atomic.LoadInt32(&opened) != nconns {
+				time.Sleep(time.Millisecond)
+			}
+			srv.LoopStatsAndReset()
+			_, err := conns[0].Write([]byte("x"))
+			must(err)
+			for atomic.LoadInt32(&blocked) == 0 {
+				time.Sleep(time.Millisecond)
+			}
+			for _, conn := range conns[1:] {
+				_, err := conn.Write([]byte("x"))
+				must(err)
+			}
+			for _, conn := range conns {
+				_, err := io.ReadFull(conn, make([]byte, 1))
+				must(err)
+			}
+			st := srv.LoopStats()[0]
+			if st.SaturatedCycles == 0 || st.MaxEventsPerCycle < 64 || st.Events < nconns {
+				panic(fmt.Sprintf("expected a saturated cycle, got %+v", st))
+			}
+		}()
+		return
+	}
+	start := time.Now()
+	events.Tick = func() (delay time.Duration, action Action) {
+		if atomic.LoadInt32(&done) == 1 {
+			return 0, Shutdown
+		}
+		if time.Since(start) > 5*time.Second {
+			panic("timeout")
+		}
+		return time.Second / 20, None
+	}
+	must(Serve(events, network+"://"+addr))
+}
+
+func TestClosing(t *testing.T) {
+	t.Run("poll", func(t *testing.T) {
+		testClosing("tcp", ":9991", false)
+	})
+	t.Run("stdlib", func(t *testing.T) {
+		testClosing("tcp", ":9992", true)
+	})
+}
+
+func testClosing(network, addr string, stdlib bool) {
+	var done int32
+	var mu sync.Mutex
+	var order []string
+	record := func(event string) {
+		mu.Lock()
+		order = append(order, event)
+		mu.Unlock()
+	}
+	var events Events
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		go func() { must(CloseConn(c, 0)) }()
+		return
+	}
+	events.Closing = func(c Conn) (out []byte, ok bool) {
+		record("closing")
+		mu.Lock()
+		defer mu.Unlock()
+		if len(order) == 1 {
+			return nil, false // the cleanup is not finished yet
+		}
+		return []byte("goodbye"), true
+	}
+	events.Closed = func(c Conn, err error) (action Action) {
+		record("closed")
+		return
+	}
+	events.Serving = func(srv Server) (action Action) {
+		go func() {
+			defer atomic.StoreInt32(&done, 1)
+			conn, err := net.Dial(network, addr)
+			must(err)
+			defer conn.Close()
+			_, err = conn.Write([]byte("bye"))
+			must(err)
+			data, err := io.ReadAll(conn)
+			must(err)
+			if string(data) != "goodbye" {
+				panic(fmt.Sprintf("expected the closing frame, got %q", data))
+			}
+			for {
+				mu.Lock()
+				n := len(order)
+				mu.Unlock()
+				if n == 3 {
+					break
+				}
+				time.Sleep(time.Millisecond)
+			}
+			if got := strings.Join(order, " "); got != "closing closing closed" {
+				panic(fmt.Sprintf("expected Closing before Closed, got %q", got))
+			}
+		}()
+		return
+	}
+	start := time.Now()
+	events.Tick = func() (delay time.Duration, action Action) {
+		if atomic.LoadInt32(&done) == 1 {
+			return 0, Shutdown
+		}
+		if time.Since(start) > 2*time.Second {
+			panic("timeout")
+		}
+		return time.Second / 20, None
+	}
+	if stdlib {
+		must(Serve(events, network+"-net://"+addr))
+	} else {
+		must(Serve(events, network+"://"+addr))
+	}
+}
+
+func TestFirstLine(t *testing.T) {
+	t.Run("poll", func(t *testing.T) {
+		testFirstLine("tcp", ":9991", false)
+	})
+	t.Run("stdlib", func(t *testing.T) {
+		testFirstLine("tcp", ":9992", true)
+	})
+}
+
+func testFirstLine(network, addr string, stdlib bool) {
+	var done, received int32
+	var events Events
+	events.FirstLine = func(c Conn, line []byte) (action Action) {
+		if !bytes.HasPrefix(line, []byte("GET ")) {
+			return Close
+		}
+		return None
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		atomic.AddInt32(&received, 1)
+		return in, None
+	}
+	events.Serving = func(srv Server) (action Action) {
+		go func() {
+			defer atomic.StoreInt32(&done, 1)
+			conn, err := net.Dial(network, addr)
+			must(err)
+			defer conn.Close()
+			_, err = conn.Write([]byte("BAD / HTTP/1.0\r\nbody"))
+			must(err)
+			if data, err := io.ReadAll(conn); err != nil || len(data) != 0 {
+				panic(fmt.Sprintf("expected the bad line closed, got %q %v", data, err))
+			}
+			if n := atomic.LoadInt32(&received); n != 0 {
+				panic(fmt.Sprintf("expected no data of the bad line, got %d", n))
+			}
+			// the data is held until the line is complete
+			conn, err = net.Dial(network, addr)
+			must(err)
+			defer conn.Close()
+			_, err = conn.Write([]byte("GET / HTTP/1.0\r"))
+			must(err)
+			time.Sleep(time.Second / 20)
+			_, err = conn.Write([]byte("\nhello"))
+			must(err)
+			msg := "GET / HTTP/1.0\r\nhello"
+			buf := make([]byte, len(msg))
+			_, err = io.ReadFull(conn, buf)
+			must(err)
+			if string(buf) != msg {
+				panic(fmt.Sprintf("expected %q, got %q", msg, buf))
+			}
+		}()
+		return
+	}
+	start := time.Now()
+	events.Tick = func() (delay time.Duration, action Action) {
+		if atomic.LoadInt32(&done) == 1 {
+			return 0, Shutdown
+		}
+		if time.Since(start) > 2*time.Second {
+			panic("timeout")
+		}
+		return time.Second / 20, None
+	}
+	if stdlib {
+		must(Serve(events, network+"-net://"+addr))
+	} else {
+		must(Serve(events, network+"://"+addr))
+	}
+}
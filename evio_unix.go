@@ -2,15 +2,21 @@
 // Use of this source code is governed by an MIT-style
 // license that can be found in the LICENSE file.
 
+//go:build darwin || netbsd || freebsd || openbsd || dragonfly || linux
 // +build darwin netbsd freebsd openbsd dragonfly linux
 
 package evio
 
 import (
+	"errors"
+	"fmt"
 	"io"
+	"log"
+	"math/rand"
 	"net"
 	"os"
 	"runtime"
+	"strconv"
 	"sync"
 	"sync/atomic"
 	"syscall"
@@ -21,50 +27,324 @@ import (
 )
 
 type conn struct {
-	fd         int              // file descriptor
-	lnidx      int              // listener index in the server lns list
-	out        []byte           // write buffer
-	sa         syscall.Sockaddr // remote socket address
-	reuse      bool             // should reuse input buffer
-	opened     bool             // connection opened event fired
-	action     Action           // next user action
-	ctx        interface{}      // user-defined context
-	addrIndex  int              // index of listening address
-	localAddr  net.Addr         // local addre
-	remoteAddr net.Addr         // remote addr
-	loop       *loop            // connected loop
+	connState
+	fd         int                  // file descriptor
+	lnidx      int                  // listener index in the server lns list
+	sa         syscall.Sockaddr     // remote socket address
+	reuse      bool                 // should reuse input buffer
+	edge       bool                 // edge-triggered
+	eager      bool                 // read while the output is pending
+	opened     bool                 // connection opened event fired
+	action     Action               // next user action
+	ctx        interface{}          // user-defined context
+	addrIndex  int                  // index of listening address
+	localAddr  net.Addr             // local addre
+	remoteAddr net.Addr             // remote addr
+	owner      atomic.Pointer[loop] // connected loop, changed by Server.DrainLoop
+	ukey       *udpKey              // key of virtual udp connection
+	writable   bool                 // the poll waits for the connection to be writable
+	flushing   bool                 // queued to the flush of the loop
+}
+
+// udpKey is the key of a virtual udp connection, which is the index of the
+// listener and the remote address in IPv6 form.
+type udpKey struct {
+	lnidx int
+	addr  [16]byte
+	port  int
+	zone  uint32
 }
 
 func (c *conn) Context() interface{}       { return c.ctx }
 func (c *conn) SetContext(ctx interface{}) { c.ctx = ctx }
 func (c *conn) AddrIndex() int             { return c.addrIndex }
+func (c *conn) ListenerAddr() net.Addr     { return c.localAddr }
 func (c *conn) LocalAddr() net.Addr        { return c.localAddr }
 func (c *conn) RemoteAddr() net.Addr       { return c.remoteAddr }
 func (c *conn) Wake() {
-	if c.loop != nil {
-		c.loop.poll.Trigger(c)
+	if l := c.owner.Load(); l != nil && c.wake() {
+		l.poll.Trigger(c)
 	}
 }
 
+func (c *conn) SetSendBuffer(n int) error {
+	if c.owner.Load() == nil || c.ukey != nil {
+		return ErrNotSupported
+	}
+	return syscall.SetsockoptInt(c.fd, syscall.SOL_SOCKET, syscall.SO_SNDBUF, n)
+}
+func (c *conn) SetRecvBuffer(n int) error {
+	if c.owner.Load() == nil || c.ukey != nil {
+		return ErrNotSupported
+	}
+	return syscall.SetsockoptInt(c.fd, syscall.SOL_SOCKET, syscall.SO_RCVBUF, n)
+}
+func (c *conn) SetReuseInputBuffer(reuse bool) { c.reuse = reuse }
+func (c *conn) Cork() error {
+	if c.owner.Load() == nil || c.ukey != nil {
+		return ErrNotSupported
+	}
+	if err := internal.SetCork(c.fd, true); err != syscall.ENOPROTOOPT {
+		return err
+	}
+	return c.connState.Cork()
+}
+func (c *conn) Uncork() error {
+	if c.owner.Load() == nil || c.ukey != nil {
+		return ErrNotSupported
+	}
+	if c.corked {
+		return c.connState.Uncork()
+	}
+	return internal.SetCork(c.fd, false)
+}
+func (c *conn) SetNoDelay(noDelay bool) error {
+	if c.owner.Load() == nil || c.ukey != nil {
+		return ErrNotSupported
+	}
+	var v int
+	if noDelay {
+		v = 1
+	}
+	return syscall.SetsockoptInt(c.fd, syscall.IPPROTO_TCP, syscall.TCP_NODELAY, v)
+}
+func (c *conn) SetLinger(sec int) error {
+	if c.owner.Load() == nil || c.ukey != nil {
+		return ErrNotSupported
+	}
+	var l syscall.Linger
+	if sec >= 0 {
+		l.Onoff, l.Linger = 1, int32(sec)
+	}
+	return syscall.SetsockoptLinger(c.fd, syscall.SOL_SOCKET, syscall.SO_LINGER, &l)
+}
+
+// exec schedules fn to run on the loop that owns the connection.
+func (c *conn) exec(fn func(s *server, l *loop, c *conn) error) {
+	if l := c.owner.Load(); l != nil {
+		l.poll.Trigger(&connCmd{c, fn})
+	}
+}
+
+func (c *conn) run(fn func() Action) {
+	c.exec(func(s *server, l *loop, c *conn) error {
+		c.enter()
+		action := fn()
+		c.leave()
+		if action != None {
+			c.action = action
+		}
+		if c.ukey != nil {
+			return loopUDPFlush(s, l, c)
+		}
+		if len(c.out) == 0 && c.action != None {
+			// nothing to write, the socket may never be writable
+			return loopAction(s, l, c)
+		}
+		l.writeLater(c)
+		return nil
+	})
+}
+
+func (c *conn) shut() bool { return c.action == Close }
+
+func (c *conn) wakeMessages() { c.exec(loopWokenMessages) }
+
+// own moves the connection to the loop, which runs its events since.
+func (c *conn) own(l *loop) {
+	c.owner.Store(l)
+	c.setLoop(l.stats)
+}
+
+// connAttach hands a connection which is accepted by an acceptor, or
+// migrated from another loop, to the loop of the connection.
+type connAttach struct {
+	c    *conn
+	from int // index of the former loop, -1 for an accepted connection
+}
+
+// loopDrain is a step of Server.DrainLoop, which runs on the drained loop.
+type loopDrain struct {
+	migrate bool // migrate the connections, otherwise close them
+	force   bool // close the remaining connections at the timeout
+	done    chan DrainStats
+}
+
+// loopRevive is a step of Server.SetLoopCount, which runs on a retired loop.
+type loopRevive struct {
+	done chan struct{}
+}
+
+// loopFlushAll is the note of Server.FlushAll.
+type loopFlushAll struct{}
+
+// acceptResume polls the listener again, once the accepting is no longer
+// throttled by Events.MaxAcceptsPerSec.
+type acceptResume struct {
+	fd int
+}
+
+// pauseAccept detaches the listener from the poll until the wait is over,
+// the pending connections are kept in the backlog meanwhile.
+func pauseAccept(p *internal.Poll, fd int, wait time.Duration) {
+	p.ModDetach(fd)
+	time.AfterFunc(wait, labeled("timer", func() {
+		p.Trigger(&acceptResume{fd}) // fails once the server is stopped
+	}))
+}
+
+// connCmd is a function which runs on the loop of the connection.
+type connCmd struct {
+	c  *conn
+	fn func(s *server, l *loop, c *conn) error
+}
+
+// rateSample is the note of a tick to the loops, which sample the rates of
+// their connections, see Conn.RateRxBps.
+type rateSample struct{}
+
+// loopSampleRates samples the rates of the connections of the loop.
+func loopSampleRates(l *loop) {
+	now := time.Now()
+	for _, c := range l.fdconns {
+		c.sampleRates(now)
+	}
+	for c := range l.udpconns {
+		c.sampleRates(now)
+	}
+}
+
+// udpPacket is a datagram of a virtual udp connection which is read by
+// another loop than the one that owns the connection.
+type udpPacket struct {
+	c     *conn
+	lnidx int
+	fd    int
+	sa    syscall.Sockaddr
+	sa6   *syscall.SockaddrInet6
+	in    []byte
+}
+
 type server struct {
-	events   Events             // user events
-	loops    []*loop            // all the loops
-	lns      []*listener        // all the listeners
-	wg       sync.WaitGroup     // loop close waitgroup
-	cond     *sync.Cond         // shutdown signaler
-	balance  LoadBalance        // load balancing method
-	accepted uintptr            // accept counter
-	tch      chan time.Duration // ticker channel
+	events   Events                  // user events
+	set      atomic.Pointer[loopSet] // all the loops, replaced when a loop is added
+	lns      []*listener             // all the listeners
+	wg       sync.WaitGroup          // loop close waitgroup
+	cond     *sync.Cond              // shutdown signaler
+	balance  LoadBalance             // load balancing method
+	accepted uintptr                 // accept counter
+	tch      chan time.Duration      // ticker channel
+	udpconns sync.Map                // virtual udp connections udpKey -> conn
+	iplimit  *ipLimiter              // connection limit per remote ip
+	acclimit *acceptLimiter          // accept rate limit
+	outceil  *outboundCeiling        // Events.MaxTotalOutbound
+	stopped  chan struct{}           // closed when the loops are stopped
+	accepts  []*internal.Poll        // polls of the accept loops
+	acceptwg sync.WaitGroup          // accept loop close waitgroup
+	loopmu   sync.Mutex              // orders adding a loop and the shutdown
+	closing  bool                    // the loops are being stopped, guarded by loopmu
+	scalemu  sync.Mutex              // serializes Server.SetLoopCount
+	shutdown int32                   // set once the shutdown begins
+	lnerr    error                   // genuine failure of a listener, guarded by cond
 
 	//ticktm   time.Time      // next tick time
 }
 
+// loopSet is a snapshot of the loops and their counters, the counters exist
+// before the loops are created.
+type loopSet struct {
+	loops []*loop
+	stats []*loopStats
+}
+
+// loops returns the current loops, a loop is never removed.
+func (s *server) loops() []*loop { return s.set.Load().loops }
+
+func (s *server) loopStats() []*loopStats { return s.set.Load().stats }
+
 type loop struct {
 	idx     int            // loop index in the server loops list
 	poll    *internal.Poll // epoll or kqueue
 	packet  []byte         // read packet buffer
 	fdconns map[int]*conn  // loop connections fd -> conn
-	count   int32          // connection count
+	stats   *loopStats     // counters of the loop
+
+	udpconns map[*conn]bool // virtual udp connections of the loop
+	paused   map[int]bool   // listeners detached by Events.MaxAcceptsPerSec
+	flushq   []*conn        // connections with the output of the commands
+}
+
+// pollAdd adds the fd of a connection to the poll, a test replaces it to
+// inject a failure.
+var pollAdd = (*internal.Poll).AddReadWrite
+
+// register adds the connection to the loop and its poll. A failure, such as
+// the limit of the watched fds, is logged and counted by
+// LoopStat.RegisterFailures, and the connection is not added, so the caller
+// closes it.
+func (l *loop) register(c *conn) error {
+	if err := pollAdd(l.poll, c.fd); err != nil {
+		atomic.AddUint64(&l.stats.regfails, 1)
+		log.Printf("evio: cannot poll connection %v: %v", internal.SockaddrToAddr(c.sa), err)
+		return err
+	}
+	c.writable = true
+	l.fdconns[c.fd] = c
+	atomic.AddInt32(&l.stats.conns, 1)
+	return nil
+}
+
+// modRead waits for the connection to be readable. Edge-triggered
+// connections always wait for both reading and writing.
+func (l *loop) modRead(c *conn) {
+	if !c.edge {
+		l.poll.ModRead(c.fd)
+		c.writable = false
+	}
+}
+
+// modReadWrite waits for the connection to be readable or writable.
+// Edge-triggered connections are rearmed, so the readiness is reported again.
+func (l *loop) modReadWrite(c *conn) {
+	if c.edge {
+		l.poll.ModEdge(c.fd)
+	} else {
+		l.poll.ModReadWrite(c.fd)
+		c.writable = true
+	}
+}
+
+// writeLater gets the output of the connection written. It's queued to the
+// flush of the loop, which writes the output of the commands and the wakes
+// after the notes of a wait, such as of a Broadcast, without waiting for the
+// socket to be writable, see loopFlush. Otherwise the connection waits for
+// the socket to be writable as usual.
+func (l *loop) writeLater(c *conn) {
+	switch {
+	case len(c.out) == 0 || c.flushing:
+	case c.edge || c.corked || c.action != None:
+		l.modReadWrite(c)
+	case c.writable: // waits for the socket already
+	default:
+		c.flushing = true
+		l.flushq = append(l.flushq, c)
+	}
+}
+
+// owns returns true when the connection is still managed by the loop.
+func (l *loop) owns(c *conn) bool {
+	if c.ukey != nil {
+		return l.udpconns[c]
+	}
+	return l.fdconns[c.fd] == c
+}
+
+// buffer returns the read packet buffer with the size, growing it if needed.
+func (l *loop) buffer(size int) []byte {
+	if len(l.packet) < size {
+		l.packet = make([]byte, size)
+	}
+	return l.packet[:size]
 }
 
 // waitForShutdown waits for a signal to shutdown
@@ -81,7 +361,22 @@ func (s *server) signalShutdown() {
 	s.cond.L.Unlock()
 }
 
-func serve(events Events, listeners []*listener) error {
+// acceptError records the err of an accept on the listener, which stops
+// the loop and is returned by Serve. A listener which is closed by the
+// shutdown is not a failure, so errClosing is returned for it.
+func (s *server) acceptError(err error) error {
+	if atomic.LoadInt32(&s.shutdown) == 1 && listenerClosed(err) {
+		return errClosing
+	}
+	s.cond.L.Lock()
+	if s.lnerr == nil {
+		s.lnerr = err
+	}
+	s.cond.L.Unlock()
+	return err
+}
+
+func serve(events Events, listeners []*listener) (err error) {
 	// figure out the correct number of loops/goroutines to use.
 	numLoops := events.NumLoops
 	if numLoops <= 0 {
@@ -98,70 +393,157 @@ func serve(events Events, listeners []*listener) error {
 	s.cond = sync.NewCond(&sync.Mutex{})
 	s.balance = events.LoadBalance
 	s.tch = make(chan time.Duration)
+	s.iplimit = newIPLimiter(events.MaxConnsPerIP)
+	s.acclimit = newAcceptLimiter(events.MaxAcceptsPerSec)
+	s.outceil = newOutboundCeiling(events.MaxTotalOutbound, events.OutboundCeiling, s.loopStats)
+	s.stopped = make(chan struct{})
+	stats := make([]*loopStats, numLoops)
+	for i := range stats {
+		stats[i] = &loopStats{}
+	}
+	s.set.Store(&loopSet{stats: stats})
 
 	//println("-- server starting")
 	if s.events.Serving != nil {
 		var svr Server
 		svr.NumLoops = numLoops
+		svr.LoopStats = summarizeLoops(s.loopStats, false)
+		svr.LoopStatsAndReset = summarizeLoops(s.loopStats, true)
+		svr.DrainLoop = s.drainLoop
+		svr.SetLoopCount = s.setLoopCount
+		svr.AcceptsThrottled = s.acclimit.count
+		svr.TotalOutboundBuffered = totalOutbound(s.loopStats)
+		svr.FlushAll = func() {
+			for _, l := range s.loops() {
+				l.poll.Trigger(loopFlushAll{})
+			}
+		}
 		svr.Addrs = make([]net.Addr, len(listeners))
 		for i, ln := range listeners {
 			svr.Addrs[i] = ln.lnaddr
 		}
-		action := s.events.Serving(svr)
-		switch action {
-		case None:
-		case Shutdown:
-			return nil
+		if shutdown, err := serving(s.events, svr); shutdown {
+			return err
 		}
 	}
 
 	defer func() {
 		// wait on a signal for shutdown
 		s.waitForShutdown()
+		atomic.StoreInt32(&s.shutdown, 1)
+
+		// stop accepting before the loops are closed
+		for _, p := range s.accepts {
+			p.Trigger(errClosing)
+		}
+		s.acceptwg.Wait()
+		for _, p := range s.accepts {
+			p.Close()
+		}
+
+		// no loop is added since
+		s.loopmu.Lock()
+		s.closing = true
+		s.loopmu.Unlock()
 
 		// notify all loops to close by closing all listeners
-		for _, l := range s.loops {
+		for _, l := range s.loops() {
 			l.poll.Trigger(errClosing)
 		}
 
 		// wait on all loops to complete reading events
 		s.wg.Wait()
+		close(s.stopped)
 
 		// close loops and all outstanding connections
-		for _, l := range s.loops {
+		for _, l := range s.loops() {
 			for _, c := range l.fdconns {
 				loopCloseConn(s, l, c, nil)
 			}
+			for c := range l.udpconns {
+				loopUDPClose(s, l, c, nil)
+			}
 			l.poll.Close()
 		}
 		//println("-- server stopped")
+
+		s.cond.L.Lock()
+		err = s.lnerr
+		s.cond.L.Unlock()
 	}()
 
 	// create loops locally and bind the listeners.
-	for i := 0; i < numLoops; i++ {
-		l := &loop{
-			idx:     i,
-			poll:    internal.OpenPoll(),
-			packet:  make([]byte, 0xFFFF),
-			fdconns: make(map[int]*conn),
-		}
+	loops := make([]*loop, numLoops)
+	for i := range loops {
+		loops[i] = s.newLoop(i, stats[i])
+	}
+	s.set.Store(&loopSet{loops, stats})
+	// start loops in background
+	s.wg.Add(len(loops))
+	for i := range loops {
+		l := loops[i]
+		goLabeled("loop", func() { loopRun(s, l) })
+	}
+	// start accept loops in background
+	for i := 0; i < events.AcceptLoops && hasStream(listeners); i++ {
+		p := internal.OpenPoll()
 		for _, ln := range listeners {
+			if ln.pconn == nil {
+				p.AddRead(ln.fd)
+			}
+		}
+		s.accepts = append(s.accepts, p)
+		s.acceptwg.Add(1)
+		goLabeled("accept", func() { acceptRun(s, p) })
+	}
+	return nil
+}
+
+// newLoop creates the loop of the index, which polls the listeners unless
+// they are polled by the accept loops.
+func (s *server) newLoop(idx int, stats *loopStats) *loop {
+	l := &loop{
+		idx:     idx,
+		poll:    internal.OpenPoll(),
+		packet:  make([]byte, 0xFFFF),
+		fdconns: make(map[int]*conn),
+		stats:   stats,
+
+		udpconns: make(map[*conn]bool),
+		paused:   make(map[int]bool),
+	}
+	l.poll.Urgent = s.events.Control != nil
+	for _, ln := range s.lns {
+		if ln.pconn != nil || s.events.AcceptLoops <= 0 {
 			l.poll.AddRead(ln.fd)
 		}
-		s.loops = append(s.loops, l)
 	}
-	// start loops in background
-	s.wg.Add(len(s.loops))
-	for _, l := range s.loops {
-		go loopRun(s, l)
+	return l
+}
+
+func hasStream(listeners []*listener) bool {
+	for _, ln := range listeners {
+		if ln.pconn == nil {
+			return true
+		}
 	}
-	return nil
+	return false
 }
 
 func loopCloseConn(s *server, l *loop, c *conn, err error) error {
-	atomic.AddInt32(&l.count, -1)
+	if _, ok := err.(syscall.Errno); ok {
+		c.closedBy(Remote) // the socket is reset or broken by the peer
+		if err == syscall.ECONNRESET {
+			c.peerReset()
+		}
+	}
+	c.closedBy(Local)
+	atomic.AddInt32(&l.stats.conns, -1)
 	delete(l.fdconns, c.fd)
+	c.release()
+	s.iplimit.release(&c.connState)
 	syscall.Close(c.fd)
+	c.logCapture(c, err)
 	if s.events.Closed != nil {
 		switch s.events.Closed(c, err) {
 		case None:
@@ -178,8 +560,10 @@ func loopDetachConn(s *server, l *loop, c *conn, err error) error {
 	}
 	l.poll.ModDetach(c.fd)
 
-	atomic.AddInt32(&l.count, -1)
+	atomic.AddInt32(&l.stats.conns, -1)
 	delete(l.fdconns, c.fd)
+	c.release()
+	s.iplimit.release(&c.connState)
 	if err := syscall.SetNonblock(c.fd, false); err != nil {
 		return err
 	}
@@ -195,6 +579,12 @@ func loopNote(s *server, l *loop, note interface{}) error {
 	var err error
 	switch v := note.(type) {
 	case time.Duration:
+		for _, lp := range s.loops() {
+			if lp != l {
+				lp.poll.Trigger(rateSample{})
+			}
+		}
+		loopSampleRates(l) // before the Tick event, which may read them
 		delay, action := s.events.Tick()
 		switch action {
 		case None:
@@ -205,11 +595,47 @@ func loopNote(s *server, l *loop, note interface{}) error {
 	case error: // shutdown
 		err = v
 	case *conn:
+		if lp := v.owner.Load(); lp != l && lp != nil {
+			lp.poll.Trigger(v) // the connection is migrated
+			return nil
+		}
 		// Wake called for connection
-		if l.fdconns[v.fd] != v {
-			return nil // ignore stale wakes
+		if !v.woke() || !l.owns(v) {
+			return nil // ignore cancelled and stale wakes
 		}
 		return loopWake(s, l, v)
+	case *connAttach:
+		err = loopAttach(s, l, v)
+	case rateSample:
+		loopSampleRates(l)
+	case *udpPacket:
+		if !l.owns(v.c) {
+			// expired meanwhile, so a new connection gets the datagram
+			return loopUDPConnRead(s, l, v.lnidx, v.fd, v.sa, v.sa6, v.in)
+		}
+		return loopUDPReceive(s, l, v.c, v.in)
+	case *connCmd:
+		if lp := v.c.owner.Load(); lp != l && lp != nil {
+			lp.poll.Trigger(v) // the connection is migrated
+			return nil
+		}
+		if !l.owns(v.c) {
+			return nil // ignore stale commands
+		}
+		return v.fn(s, l, v.c)
+	case *loopDrain:
+		return loopDrainRun(s, l, v)
+	case *loopRevive:
+		loopReviveRun(s, l, v)
+	case loopFlushAll:
+		for _, c := range l.fdconns {
+			l.writeLater(c) // written after the notes
+		}
+	case *acceptResume:
+		delete(l.paused, v.fd)
+		if !l.stats.isDraining() {
+			l.poll.AddRead(v.fd) // otherwise it's added when revived
+		}
 	}
 	return err
 }
@@ -221,10 +647,29 @@ func loopRun(s *server, l *loop) {
 		s.wg.Done()
 	}()
 
+	if s.events.PinLoops {
+		runtime.LockOSThread()
+		defer runtime.UnlockOSThread()
+		if err := internal.SetAffinity(l.idx % runtime.NumCPU()); err != nil {
+			log.Printf("evio: cannot pin loop %d: %v", l.idx, err)
+		}
+	}
 	if l.idx == 0 && s.events.Tick != nil {
-		go loopTicker(s, l)
+		goLabeled("ticker", func() { loopTicker(s, l) })
 	}
 
+	// rank the ready connections by Conn.SetPriority, once any is set
+	l.poll.Rank = func(fd int) int {
+		if !l.stats.prioritized() {
+			return 0
+		}
+		if c := l.fdconns[fd]; c != nil {
+			return c.priority()
+		}
+		return 0
+	}
+	l.poll.Waited = l.stats.addCycle
+	l.poll.Flush = func() error { return loopFlush(s, l) }
 	//fmt.Println("-- loop started --", l.idx)
 	l.poll.Wait(func(fd int, note interface{}) error {
 		if fd == 0 {
@@ -236,6 +681,15 @@ func loopRun(s *server, l *loop) {
 			return loopAccept(s, l, fd)
 		case !c.opened:
 			return loopOpened(s, l, c)
+		case note == internal.Hangup:
+			return loopHangup(s, l, c)
+		case note == internal.Urgent:
+			if err := loopUrgent(s, l, c); err != nil || !c.edge || !l.owns(c) {
+				return err // the level-triggered readiness is reported again
+			}
+			return loopEdge(s, l, c)
+		case c.edge:
+			return loopEdge(s, l, c)
 		case len(c.out) > 0:
 			return loopWrite(s, l, c)
 		case c.action != None:
@@ -256,55 +710,476 @@ func loopTicker(s *server, l *loop) {
 }
 
 func loopAccept(s *server, l *loop, fd int) error {
+	if l.stats.isDraining() {
+		return nil // the listeners are being removed from the loop
+	}
 	for i, ln := range s.lns {
 		if ln.fd == fd {
-			if len(s.loops) > 1 {
+			stream := ln.pconn == nil
+			if loops := s.loops(); len(loops) > 1 && !(stream && s.events.LoopSelector != nil) {
 				switch s.balance {
 				case LeastConnections:
-					n := atomic.LoadInt32(&l.count)
-					for _, lp := range s.loops {
-						if lp.idx != l.idx {
-							if atomic.LoadInt32(&lp.count) < n {
+					n := atomic.LoadInt32(&l.stats.conns)
+					for _, lp := range loops {
+						if lp.idx != l.idx && !lp.stats.isDraining() {
+							if atomic.LoadInt32(&lp.stats.conns) < n {
 								return nil // do not accept
 							}
 						}
 					}
 				case RoundRobin:
-					idx := int(atomic.LoadUintptr(&s.accepted)) % len(s.loops)
-					if idx != l.idx {
+					lp := roundRobin(loops, atomic.LoadUintptr(&s.accepted))
+					if lp != l && !lp.stats.isDraining() {
 						return nil // do not accept
 					}
 					atomic.AddUintptr(&s.accepted, 1)
 				}
 			}
-			if ln.pconn != nil {
+			if !stream {
 				return loopUDPRead(s, l, i, fd)
 			}
+			if wait := s.acclimit.wait(); wait > 0 {
+				l.paused[fd] = true
+				pauseAccept(l.poll, fd, wait)
+				return nil
+			}
 			nfd, sa, err := syscall.Accept(fd)
 			if err != nil {
-				if err == syscall.EAGAIN {
+				if err == syscall.EAGAIN || err == syscall.ECONNABORTED {
 					return nil
 				}
-				return err
+				return s.acceptError(err)
 			}
 			if err := syscall.SetNonblock(nfd, true); err != nil {
 				return err
 			}
-			c := &conn{fd: nfd, sa: sa, lnidx: i, loop: l}
-			l.fdconns[c.fd] = c
-			l.poll.AddReadWrite(c.fd)
-			atomic.AddInt32(&l.count, 1)
+			c := &conn{fd: nfd, sa: sa, lnidx: i}
+			c.own(l)
+			c.accepted()
+			c.outsum, c.outceil = &l.stats.outbytes, s.outceil
+			addr := internal.SockaddrToAddr(sa)
+			if !s.iplimit.acquire(&c.connState, addr) {
+				syscall.Close(nfd) // over the limit of the remote ip
+				return nil
+			}
+			if lp := s.selectLoop(addr); lp != nil && lp != l {
+				c.own(lp)
+				if err := lp.poll.Trigger(&connAttach{c, -1}); err != nil {
+					s.iplimit.release(&c.connState)
+					syscall.Close(nfd)
+				}
+				return nil
+			}
+			if err := l.register(c); err != nil {
+				s.iplimit.release(&c.connState)
+				syscall.Close(nfd) // never opened
+			}
 			break
 		}
 	}
 	return nil
 }
 
+// acceptRun accepts the stream connections on a separate poll, and hands
+// them to the loops, see Events.AcceptLoops.
+func acceptRun(s *server, p *internal.Poll) {
+	defer func() {
+		s.signalShutdown()
+		s.acceptwg.Done()
+	}()
+	p.Wait(func(fd int, note interface{}) error {
+		if fd == 0 {
+			switch v := note.(type) {
+			case error:
+				return v // shutdown
+			case *acceptResume:
+				p.AddRead(v.fd)
+			}
+			return nil
+		}
+		return acceptConns(s, p, fd)
+	})
+}
+
+func acceptConns(s *server, p *internal.Poll, fd int) error {
+	lnidx := -1
+	for i, ln := range s.lns {
+		if ln.fd == fd {
+			lnidx = i
+			break
+		}
+	}
+	if lnidx < 0 {
+		return nil
+	}
+	for {
+		if wait := s.acclimit.wait(); wait > 0 {
+			pauseAccept(p, fd, wait)
+			return nil
+		}
+		nfd, sa, err := syscall.Accept(fd)
+		if err != nil {
+			if err == syscall.EAGAIN || err == syscall.ECONNABORTED {
+				return nil // taken by another accept loop
+			}
+			return s.acceptError(err)
+		}
+		if err := syscall.SetNonblock(nfd, true); err != nil {
+			syscall.Close(nfd)
+			return err
+		}
+		addr := internal.SockaddrToAddr(sa)
+		l := s.selectLoop(addr)
+		if l == nil {
+			l = s.nextLoop()
+		}
+		if l == nil {
+			syscall.Close(nfd) // all of the loops are drained
+			continue
+		}
+		c := &conn{fd: nfd, sa: sa, lnidx: lnidx}
+		c.own(l)
+		c.accepted()
+		c.outsum, c.outceil = &l.stats.outbytes, s.outceil
+		if !s.iplimit.acquire(&c.connState, addr) {
+			syscall.Close(nfd) // over the limit of the remote ip
+			continue
+		}
+		if err := l.poll.Trigger(&connAttach{c, -1}); err != nil {
+			s.iplimit.release(&c.connState)
+			syscall.Close(nfd)
+			return err
+		}
+	}
+}
+
+// selectLoop picks the loop of an accepted connection by
+// Events.LoopSelector, it's nil when there is no selector, or the index is
+// out of range or of a drained loop.
+func (s *server) selectLoop(remote net.Addr) *loop {
+	if s.events.LoopSelector == nil {
+		return nil
+	}
+	loops := s.loops()
+	n := len(loops)
+	for n > 0 && loops[n-1].stats.isRetired() {
+		n-- // removed by Server.SetLoopCount
+	}
+	idx := s.events.LoopSelector(remote, n)
+	if idx < 0 || idx >= n || loops[idx].stats.isDraining() {
+		return nil
+	}
+	return loops[idx]
+}
+
+// roundRobin returns the loop of the nth accepted connection of RoundRobin.
+// The loops which are retired by Server.SetLoopCount are not counted, so the
+// rest keep their shares, the first loop is never retired.
+func roundRobin(loops []*loop, nth uintptr) *loop {
+	var n uintptr
+	for _, l := range loops {
+		if !l.stats.isRetired() {
+			n++
+		}
+	}
+	k := nth % n
+	for _, l := range loops {
+		if !l.stats.isRetired() {
+			if k == 0 {
+				return l
+			}
+			k--
+		}
+	}
+	return loops[0]
+}
+
+// nextLoop picks the loop of an accepted connection by the load balancing,
+// the drained loops are skipped, it's nil when all of the loops are drained.
+func (s *server) nextLoop() *loop {
+	var l *loop
+	loops := s.loops()
+	switch s.balance {
+	case LeastConnections:
+		for _, lp := range loops {
+			if !lp.stats.isDraining() && (l == nil ||
+				atomic.LoadInt32(&lp.stats.conns) < atomic.LoadInt32(&l.stats.conns)) {
+				l = lp
+			}
+		}
+		return l
+	case RoundRobin:
+		l = roundRobin(loops, atomic.AddUintptr(&s.accepted, 1)-1)
+	default:
+		l = loops[rand.Intn(len(loops))]
+	}
+	for i := 0; l.stats.isDraining() && i < len(loops); i++ {
+		l = loops[(l.idx+1)%len(loops)]
+	}
+	if l.stats.isDraining() {
+		return nil
+	}
+	return l
+}
+
+// loopAttach adds the connection which is accepted by an accept loop or
+// migrated from a drained loop.
+func loopAttach(s *server, l *loop, v *connAttach) error {
+	c := v.c
+	if l.stats.isDraining() {
+		// accepted or migrated before the loop is drained
+		if lp := s.nextLoop(); lp != nil {
+			lp.poll.Trigger(v)
+			c.own(lp)
+		} else {
+			s.iplimit.release(&c.connState)
+			syscall.Close(c.fd)
+		}
+		return nil
+	}
+	if err := l.register(c); err != nil {
+		if c.opened {
+			// migrated, the connection is closed like a broken one
+			l.fdconns[c.fd] = c
+			atomic.AddInt32(&l.stats.conns, 1)
+			return loopCloseConn(s, l, c, err)
+		}
+		s.iplimit.release(&c.connState)
+		syscall.Close(c.fd) // never opened
+		return nil
+	}
+	if c.opened {
+		if c.edge {
+			l.poll.ModEdge(c.fd)
+		} else if len(c.out) == 0 && c.action == None {
+			l.modRead(c)
+		}
+		if v.from >= 0 && v.from != l.idx && s.events.Migrated != nil {
+			c.enter()
+			s.events.Migrated(c, v.from, l.idx)
+			c.leave()
+		}
+	}
+	return nil
+}
+
+// drainLoop is Server.DrainLoop.
+func (s *server) drainLoop(index int, migrate bool, timeout time.Duration) (DrainStats, error) {
+	loops := s.loops()
+	if index < 0 || index >= len(loops) {
+		return DrainStats{}, fmt.Errorf("evio: no loop %d", index)
+	}
+	l := loops[index]
+	if !atomic.CompareAndSwapInt32(&l.stats.draining, 0, 1) {
+		return DrainStats{}, ErrLoopDrained
+	}
+	if migrate && s.nextLoop() == nil {
+		atomic.StoreInt32(&l.stats.draining, 0)
+		return DrainStats{}, ErrLoopDrained
+	}
+	step := func(d *loopDrain) (DrainStats, error) {
+		d.done = make(chan DrainStats, 1)
+		if err := l.poll.Trigger(d); err != nil {
+			return DrainStats{}, err
+		}
+		select {
+		case st := <-d.done:
+			return st, nil
+		case <-s.stopped:
+			return DrainStats{}, ErrServerClosed
+		}
+	}
+	st, err := step(&loopDrain{migrate: migrate})
+	if err != nil || migrate {
+		return st, err
+	}
+	deadline := time.Now().Add(timeout)
+	for atomic.LoadInt32(&l.stats.conns) > 0 && time.Now().Before(deadline) {
+		select {
+		case <-time.After(time.Millisecond * 10):
+		case <-s.stopped:
+			return st, ErrServerClosed
+		}
+	}
+	_, err = step(&loopDrain{force: true})
+	return st, err
+}
+
+// setLoopCount is Server.SetLoopCount.
+func (s *server) setLoopCount(n int) error {
+	if n < 1 {
+		return fmt.Errorf("evio: invalid loop count %d", n)
+	}
+	s.scalemu.Lock()
+	defer s.scalemu.Unlock()
+	loops := s.loops()
+	var active int
+	for _, l := range loops {
+		if !l.stats.isDraining() {
+			active++
+		}
+	}
+	// revive the retired loops first, then add the new ones
+	for _, l := range loops {
+		if active < n && l.stats.isRetired() {
+			if err := s.reviveLoop(l); err != nil {
+				return err
+			}
+			active++
+		}
+	}
+	for ; active < n; active++ {
+		if err := s.addLoop(); err != nil {
+			return err
+		}
+	}
+	// retire the last loops, their connections are migrated
+	for i := len(loops) - 1; i >= 0 && active > n; i-- {
+		l := loops[i]
+		if l.stats.isDraining() {
+			continue
+		}
+		if _, err := s.drainLoop(i, true, 0); err != nil {
+			return err
+		}
+		atomic.StoreInt32(&l.stats.retired, 1)
+		active--
+	}
+	return nil
+}
+
+// addLoop starts a new loop, which takes its share of the connections.
+func (s *server) addLoop() error {
+	s.loopmu.Lock()
+	defer s.loopmu.Unlock()
+	if s.closing {
+		return ErrServerClosed
+	}
+	set := s.set.Load()
+	l := s.newLoop(len(set.loops), &loopStats{})
+	loops := append(append([]*loop{}, set.loops...), l)
+	stats := append(append([]*loopStats{}, set.stats...), l.stats)
+	s.set.Store(&loopSet{loops, stats})
+	s.wg.Add(1)
+	goLabeled("loop", func() { loopRun(s, l) })
+	return nil
+}
+
+// reviveLoop makes a retired loop accept the connections again.
+func (s *server) reviveLoop(l *loop) error {
+	v := &loopRevive{done: make(chan struct{})}
+	if err := l.poll.Trigger(v); err != nil {
+		return err
+	}
+	select {
+	case <-v.done:
+		return nil
+	case <-s.stopped:
+		return ErrServerClosed
+	}
+}
+
+// loopReviveRun runs on a retired loop, which polls the listeners again.
+func loopReviveRun(s *server, l *loop, v *loopRevive) {
+	for _, ln := range s.lns {
+		if (ln.pconn != nil || s.events.AcceptLoops <= 0) && !l.paused[ln.fd] {
+			l.poll.AddRead(ln.fd)
+		}
+	}
+	atomic.StoreInt32(&l.stats.retired, 0)
+	atomic.StoreInt32(&l.stats.draining, 0)
+	close(v.done)
+}
+
+// loopDrainRun runs a step of Server.DrainLoop on the drained loop.
+func loopDrainRun(s *server, l *loop, d *loopDrain) error {
+	var st DrainStats
+	var err error
+	defer func() { d.done <- st }()
+	if !d.force {
+		for _, ln := range s.lns {
+			if (ln.pconn != nil || s.events.AcceptLoops <= 0) && !l.paused[ln.fd] {
+				l.poll.ModDetach(ln.fd)
+			}
+		}
+		for c := range l.udpconns {
+			st.Closed++
+			if s.events.DrainNotice != nil {
+				loopDrainNotice(s, l, c)
+				if e := loopUDPFlush(s, l, c); e != nil {
+					err = e
+				}
+			}
+			if e := loopUDPClose(s, l, c, nil); e != nil {
+				err = e
+			}
+		}
+	}
+	for _, c := range l.fdconns {
+		var lp *loop
+		if d.migrate {
+			lp = s.nextLoop()
+		}
+		switch {
+		case lp != nil:
+			l.poll.ModDetach(c.fd)
+			delete(l.fdconns, c.fd)
+			atomic.AddInt32(&l.stats.conns, -1)
+			st.Migrated++
+			// the pending output is written by the other loop, which
+			// waits for the socket to be writable after attaching it
+			c.flushing = false
+			// attached before the owner is changed, so the notes which are
+			// forwarded by this loop are after it
+			lp.poll.Trigger(&connAttach{c, l.idx})
+			c.own(lp)
+		case !c.opened:
+			// not opened yet, so no event is fired
+			l.poll.ModDetach(c.fd)
+			delete(l.fdconns, c.fd)
+			atomic.AddInt32(&l.stats.conns, -1)
+			st.Closed++
+			s.iplimit.release(&c.connState)
+			syscall.Close(c.fd)
+		case d.force:
+			if e := loopCloseConn(s, l, c, nil); e != nil {
+				err = e
+			}
+		case s.events.DrainNotice != nil:
+			// closed by the client, or at the timeout
+			st.Closed++
+			loopDrainNotice(s, l, c)
+			l.modReadWrite(c)
+		default:
+			// closed after the pending output is written
+			st.Closed++
+			if c.action == None {
+				c.action = Close
+			}
+			l.modReadWrite(c)
+		}
+	}
+	return err
+}
+
+// loopDrainNotice queues the Events.DrainNotice of a drained connection.
+func loopDrainNotice(s *server, l *loop, c *conn) {
+	c.enter()
+	notice := s.events.DrainNotice(c)
+	c.leave()
+	c.queue(append([]byte{}, notice...))
+}
+
 func loopUDPRead(s *server, l *loop, lnidx, fd int) error {
 	n, sa, err := syscall.Recvfrom(fd, l.packet, 0)
-	if err != nil || n == 0 {
+	if err != nil {
+		if err != syscall.EAGAIN && err != syscall.EINTR {
+			atomic.AddUint64(&l.stats.udpfails, 1)
+		}
 		return nil
 	}
+	// an empty datagram is delivered as an empty read, n is zero then
+	l.stats.addRead(n)
 	if s.events.Receive != nil {
 		var sa6 syscall.SockaddrInet6
 		switch sa := sa.(type) {
@@ -321,17 +1196,26 @@ func loopUDPRead(s *server, l *loop, lnidx, fd int) error {
 		case *syscall.SockaddrInet6:
 			sa6 = *sa
 		}
+		if s.events.UDPIdleTimeout > 0 {
+			return loopUDPConnRead(s, l, lnidx, fd, sa, &sa6, l.packet[:n])
+		}
 		c := &conn{}
 		c.addrIndex = lnidx
 		c.localAddr = s.lns[lnidx].lnaddr
-		c.remoteAddr = internal.SockaddrToAddr(&sa6)
+		c.remoteAddr = internal.SockaddrToUDPAddr(&sa6)
+		c.release() // udp connections are not managed by the loop
 		in := append([]byte{}, l.packet[:n]...)
 		out, action := s.events.Receive(c, in)
-		if len(out) > 0 {
+		c.queue(out)
+		if len(c.out) > 0 {
 			if s.events.PreWrite != nil {
 				s.events.PreWrite()
 			}
-			syscall.Sendto(fd, out, 0, sa)
+			for _, b := range c.out {
+				if syscall.Sendto(fd, b, 0, sa) == nil {
+					l.stats.addWritten(len(b))
+				}
+			}
 		}
 		switch action {
 		case Shutdown:
@@ -341,48 +1225,282 @@ func loopUDPRead(s *server, l *loop, lnidx, fd int) error {
 	return nil
 }
 
+// loopUDPConnRead delivers the datagram to the virtual connection of the
+// remote address, the connection is opened on the first datagram.
+func loopUDPConnRead(s *server, l *loop, lnidx, fd int, sa syscall.Sockaddr,
+	sa6 *syscall.SockaddrInet6, packet []byte) error {
+	key := udpKey{lnidx: lnidx, addr: sa6.Addr, port: sa6.Port, zone: sa6.ZoneId}
+	in := append([]byte{}, packet...)
+	c := &conn{fd: fd, sa: sa, lnidx: lnidx, ukey: &key}
+	c.own(l)
+	// the loops read the same fd, so only one of them creates the connection
+	if v, loaded := s.udpconns.LoadOrStore(key, c); loaded {
+		c := v.(*conn)
+		if lp := c.owner.Load(); lp != l {
+			// the connection is owned by another loop
+			lp.poll.Trigger(&udpPacket{c, lnidx, fd, sa, sa6, in})
+			return nil
+		}
+		return loopUDPReceive(s, l, c, in)
+	}
+	c.accepted()
+	c.outsum, c.outceil = &l.stats.outbytes, s.outceil
+	c.opening()
+	c.opened = true
+	c.addrIndex = lnidx
+	c.localAddr = s.lns[lnidx].lnaddr
+	c.remoteAddr = internal.SockaddrToUDPAddr(sa6)
+	l.udpconns[c] = true
+	atomic.AddInt32(&l.stats.conns, 1)
+	c.watchIdle(s.events.UDPIdleTimeout, func() {
+		c.exec(loopUDPIdle)
+	})
+	c.receive = s.events.Receive
+	c.closingfn = s.events.Closing
+	if s.events.Opened != nil {
+		c.enter()
+		out, opts, action := s.events.Opened(c)
+		c.leave()
+		c.comp = newCompressor(opts.CompressWrites)
+		c.queue(append([]byte{}, out...))
+		c.action = action
+		c.setMaxWakes(opts)
+		c.setWriteCap(opts, c, s.events.WriteOverflow)
+		c.meter.start(opts)
+		c.trace = opts.Trace
+		c.capture, c.logcapture = newCaptureRing(opts.CaptureRing), opts.LogCapture
+		c.setAutoPong(opts)
+		if opts.HandshakeTimeout > 0 && c.handshakeExpired() {
+			c.hstimer = time.AfterFunc(opts.HandshakeTimeout, labeled("timer", func() {
+				c.exec(loopHandshakeTimeout)
+			}))
+		}
+		if err := loopUDPFlush(s, l, c); err != nil || !l.owns(c) {
+			return err
+		}
+	}
+	return loopUDPReceive(s, l, c, in)
+}
+
+// loopUDPReceive fires the Receive event of a virtual udp connection.
+func loopUDPReceive(s *server, l *loop, c *conn, in []byte) error {
+	c.touch()
+	c.received(len(in))
+	c.traceIn(c, in)
+	c.readMark(c, len(in))
+	if awaiting, action := c.awaitAck(in); awaiting {
+		c.action = action
+		return loopUDPFlush(s, l, c)
+	}
+	if c.autoPong(in) {
+		return loopUDPFlush(s, l, c)
+	}
+	if c.held(in) {
+		return nil
+	}
+	if s.events.Receive != nil {
+		c.enter()
+		out, action := s.events.Receive(c, in)
+		c.leave()
+		c.queue(append([]byte{}, out...))
+		c.action = action
+	}
+	return loopUDPFlush(s, l, c)
+}
+
+// loopUDPFlush sends the write buffers of a virtual udp connection as
+// datagrams, and then applies the action.
+func loopUDPFlush(s *server, l *loop, c *conn) error {
+	if len(c.out) > 0 {
+		if s.events.PreWrite != nil {
+			s.events.PreWrite()
+		}
+		for _, b := range c.takeOut() {
+			if syscall.Sendto(c.fd, b, 0, c.sa) == nil {
+				l.stats.addWritten(len(b))
+				c.sent(len(b))
+				c.traceOut(c, [][]byte{b}, len(b))
+			}
+		}
+	}
+	c.flushed()
+	action := c.action
+	c.action = None
+	switch action {
+	case Close:
+		return loopUDPClose(s, l, c, c.cerr)
+	case Shutdown:
+		return errClosing
+	}
+	return nil
+}
+
+func loopUDPIdle(s *server, l *loop, c *conn) error {
+	if !c.idleExpired(s.events.UDPIdleTimeout) {
+		return nil
+	}
+	return loopUDPClose(s, l, c, nil)
+}
+
+func loopUDPClose(s *server, l *loop, c *conn, err error) error {
+	c.closedBy(Local) // a datagram peer never closes
+	delete(l.udpconns, c)
+	atomic.AddInt32(&l.stats.conns, -1)
+	s.udpconns.Delete(*c.ukey)
+	c.release()
+	c.logCapture(c, err)
+	if s.events.Closed != nil {
+		switch s.events.Closed(c, err) {
+		case None:
+		case Shutdown:
+			return errClosing
+		}
+	}
+	return nil
+}
+
 func loopOpened(s *server, l *loop, c *conn) error {
 	c.opened = true
+	c.opening()
 	c.addrIndex = c.lnidx
 	c.localAddr = s.lns[c.lnidx].lnaddr
 	c.remoteAddr = internal.SockaddrToAddr(c.sa)
+	c.receive = s.events.Receive
+	c.closingfn = s.events.Closing
 	if s.events.Opened != nil {
+		c.enter()
 		out, opts, action := s.events.Opened(c)
+		c.leave()
+		c.comp = newCompressor(opts.CompressWrites)
 		if len(out) > 0 {
-			c.out = append([]byte{}, out...)
+			c.queue(append([]byte{}, out...))
 		}
 		c.action = action
 		c.reuse = opts.ReuseInputBuffer
+		c.setMaxWakes(opts)
+		c.setWriteCap(opts, c, s.events.WriteOverflow)
+		c.meter.start(opts)
+		c.trace = opts.Trace
+		c.capture, c.logcapture = newCaptureRing(opts.CaptureRing), opts.LogCapture
+		c.setAutoPong(opts)
+		c.edge = opts.EdgeTriggered
+		c.eager = opts.EagerDelivery
+		c.setReadBuffer(opts)
 		if opts.TCPKeepAlive > 0 {
 			if _, ok := s.lns[c.lnidx].ln.(*net.TCPListener); ok {
 				internal.SetKeepAlive(c.fd, int(opts.TCPKeepAlive/time.Second))
+				if err := internal.SetKeepAliveProbes(c.fd, int(opts.KeepAliveInterval/time.Second),
+					opts.KeepAliveProbes); err != nil {
+					c.noteError(err)
+					log.Printf("evio: keepalive probes are unsupported: %v", err)
+				}
 			}
 		}
+		if opts.RecvBuf > 0 {
+			c.SetRecvBuffer(opts.RecvBuf)
+		}
+		if opts.SendBuf > 0 {
+			c.SetSendBuffer(opts.SendBuf)
+		}
+		if opts.Linger != nil {
+			c.SetLinger(*opts.Linger)
+		}
+		if opts.HandshakeTimeout > 0 && c.handshakeExpired() {
+			c.hstimer = time.AfterFunc(opts.HandshakeTimeout, labeled("timer", func() {
+				c.exec(loopHandshakeTimeout)
+			}))
+		}
 	}
-	if len(c.out) == 0 && c.action == None {
-		l.poll.ModRead(c.fd)
+	if c.edge {
+		l.poll.ModEdge(c.fd)
+	} else if len(c.out) == 0 && c.action == None {
+		l.modRead(c)
+	}
+	return nil
+}
+
+func loopHandshakeTimeout(s *server, l *loop, c *conn) error {
+	if !c.handshakeExpired() {
+		return nil
+	}
+	if c.ukey != nil {
+		return loopUDPClose(s, l, c, ErrHandshakeTimeout)
+	}
+	return loopCloseConn(s, l, c, ErrHandshakeTimeout)
+}
+
+// loopFlush writes the output which is queued by writeLater, in one pass
+// after the notes of a wait. The connections which cannot be written at once
+// wait for the socket to be writable as usual.
+func loopFlush(s *server, l *loop) error {
+	q := l.flushq
+	l.flushq = q[:0]
+	for i, c := range q {
+		q[i] = nil
+		if !l.owns(c) {
+			continue // migrated, the flag is reset by loopDrain
+		}
+		c.flushing = false
+		if c.writable || len(c.out) == 0 {
+			continue
+		}
+		if c.corked || c.action != None {
+			l.modReadWrite(c)
+			continue
+		}
+		if s.events.PreWrite != nil {
+			s.events.PreWrite()
+		}
+		n, err := internal.Writev(c.fd, c.out)
+		if err != nil && err != syscall.EAGAIN {
+			if err := loopCloseConn(s, l, c, err); err != nil {
+				return err
+			}
+			continue
+		}
+		if err == nil {
+			l.stats.addWritten(n)
+			c.sent(n)
+			c.traceOut(c, c.out, n)
+			c.consume(n)
+		}
+		c.congest(len(c.out) > 0)
+		if len(c.out) > 0 {
+			l.modReadWrite(c)
+		} else {
+			c.flushed()
+		}
 	}
 	return nil
 }
 
 func loopWrite(s *server, l *loop, c *conn) error {
+	if c.corked && c.action == None {
+		l.modRead(c) // held until Uncork
+		return nil
+	}
 	if s.events.PreWrite != nil {
 		s.events.PreWrite()
 	}
-	n, err := syscall.Write(c.fd, c.out)
-	if err != nil {
-		if err == syscall.EAGAIN {
-			return nil
-		}
+	n, err := internal.Writev(c.fd, c.out)
+	if err != nil && err != syscall.EAGAIN {
 		return loopCloseConn(s, l, c, err)
 	}
-	if n == len(c.out) {
-		c.out = nil
-	} else {
-		c.out = c.out[n:]
+	if err == nil {
+		l.stats.addWritten(n)
+		c.sent(n)
+		c.traceOut(c, c.out, n)
+		c.consume(n)
+	}
+	c.congest(len(c.out) > 0)
+	if len(c.out) == 0 {
+		c.flushed()
 	}
 	if len(c.out) == 0 && c.action == None {
-		l.poll.ModRead(c.fd)
+		l.modRead(c)
+	} else if c.eager && c.action == None {
+		// do not wait for the output to drain
+		return loopRead(s, l, c)
 	}
 	return nil
 }
@@ -392,62 +1510,204 @@ func loopAction(s *server, l *loop, c *conn) error {
 	default:
 		c.action = None
 	case Close:
-		return loopCloseConn(s, l, c, nil)
+		return loopCloseConn(s, l, c, c.cerr)
 	case Shutdown:
 		return errClosing
 	case Detach:
 		return loopDetachConn(s, l, c, nil)
 	}
 	if len(c.out) == 0 && c.action == None {
-		l.poll.ModRead(c.fd)
+		l.modRead(c)
+	}
+	return nil
+}
+
+// loopWokenMessages fires the WokenMessage events for the pending messages.
+func loopWokenMessages(s *server, l *loop, c *conn) error {
+	for _, msg := range c.takeMessages(l.stats) {
+		if s.events.WokenMessage == nil || c.action != None {
+			break
+		}
+		c.enter()
+		out, action := s.events.WokenMessage(c, msg)
+		c.leave()
+		c.action = action
+		if len(out) > 0 {
+			c.queue(append([]byte{}, out...))
+		}
+	}
+	if c.ukey != nil {
+		return loopUDPFlush(s, l, c)
+	}
+	if len(c.out) != 0 || c.action != None {
+		l.modReadWrite(c)
 	}
 	return nil
 }
 
 func loopWake(s *server, l *loop, c *conn) error {
-	if s.events.Send == nil {
+	if s.events.Send == nil || c.shut() {
 		return nil
 	}
+	c.enter()
 	out, action := s.events.Send(c)
+	c.leave()
 	c.action = action
 	if len(out) > 0 {
-		c.out = append([]byte{}, out...)
+		c.queue(append([]byte{}, out...))
 	}
-	if len(c.out) != 0 || c.action != None {
-		l.poll.ModReadWrite(c.fd)
+	if c.ukey != nil {
+		return loopUDPFlush(s, l, c)
+	}
+	if c.action != None {
+		l.modReadWrite(c)
+	} else {
+		l.writeLater(c)
 	}
 	return nil
 }
 
 func loopRead(s *server, l *loop, c *conn) error {
-	var in []byte
-	n, err := syscall.Read(c.fd, l.packet)
+	packet := l.buffer(c.readSize())
+	n, err := syscall.Read(c.fd, packet)
 	if err != nil {
 		if err == syscall.EAGAIN {
 			return nil
 		}
 		return loopCloseConn(s, l, c, err)
 	}
-	// if n is empty, return nil for next incoming data
 	if n == 0 {
-		return nil
+		// a stream read is empty only at EOF, unlike an empty datagram
+		c.peerClosed()
+		return loopCloseConn(s, l, c, nil)
 	}
+	l.stats.addRead(n)
+	c.readDone(n)
+	loopReceive(s, l, c, packet[:n])
+	if len(c.out) != 0 || c.action != None {
+		l.modReadWrite(c)
+	}
+	return nil
+}
 
-	in = l.packet[:n]
+// loopEdge handles the readiness of an edge-triggered connection. The
+// readiness is reported only once, so the connection is written and read
+// until EAGAIN, otherwise the remaining data would not be reported again.
+func loopEdge(s *server, l *loop, c *conn) error {
+	for {
+		if len(c.out) > 0 && !(c.corked && c.action == None) {
+			if s.events.PreWrite != nil {
+				s.events.PreWrite()
+			}
+			n, err := internal.Writev(c.fd, c.out)
+			if err == syscall.EAGAIN {
+				c.congest(true)
+				if !c.eager || c.action != None {
+					return nil // wait for writable
+				}
+				// read while the output is blocked
+			} else if err != nil {
+				return loopCloseConn(s, l, c, err)
+			} else {
+				l.stats.addWritten(n)
+				c.sent(n)
+				c.traceOut(c, c.out, n)
+				c.consume(n)
+				if len(c.out) > 0 {
+					continue
+				}
+				c.congest(false)
+				c.flushed()
+			}
+		}
+		if c.action != None {
+			if err := loopAction(s, l, c); err != nil || !l.owns(c) {
+				return err
+			}
+		}
+		packet := l.buffer(c.readSize())
+		n, err := syscall.Read(c.fd, packet)
+		if err != nil {
+			if err == syscall.EAGAIN {
+				return nil
+			}
+			return loopCloseConn(s, l, c, err)
+		}
+		if n == 0 {
+			c.peerClosed()
+			return loopCloseConn(s, l, c, nil)
+		}
+		l.stats.addRead(n)
+		c.readDone(n)
+		loopReceive(s, l, c, packet[:n])
+	}
+}
+
+// loopUrgent delivers the TCP urgent byte of a connection to Events.Control.
+func loopUrgent(s *server, l *loop, c *conn) error {
+	var b [1]byte
+	n, _, err := syscall.Recvfrom(c.fd, b[:], syscall.MSG_OOB)
+	if err != nil || n <= 0 {
+		return nil // EINVAL when the byte is taken or not arrived yet
+	}
+	c.enter()
+	s.events.Control(c, b[:n])
+	c.leave()
+	return nil
+}
+
+// loopHangup delivers all of the remaining data of a connection which is
+// hang up or has an error, and then closes the connection.
+func loopHangup(s *server, l *loop, c *conn) error {
+	for {
+		packet := l.buffer(c.readSize())
+		n, err := syscall.Read(c.fd, packet)
+		if n <= 0 || err != nil {
+			if err == syscall.EAGAIN {
+				err = nil
+			} else if n == 0 && err == nil {
+				c.peerClosed()
+			}
+			return loopCloseConn(s, l, c, err)
+		}
+		l.stats.addRead(n)
+		loopReceive(s, l, c, packet[:n])
+		if c.action != None {
+			return loopAction(s, l, c)
+		}
+	}
+}
+
+// loopReceive fires the Receive event for the incoming data.
+func loopReceive(s *server, l *loop, c *conn, in []byte) {
+	if c.shut() {
+		return // discarded while the output is written before the close
+	}
 	if !c.reuse {
 		in = append([]byte{}, in...)
 	}
+	c.received(len(in))
+	c.traceIn(c, in)
+	c.readMark(c, len(in))
+	if awaiting, action := c.awaitAck(in); awaiting {
+		c.action = action
+		return
+	}
+	if c.autoPong(in) {
+		return
+	}
+	if c.held(in) {
+		return
+	}
 	if s.events.Receive != nil {
+		c.enter()
 		out, action := s.events.Receive(c, in)
+		c.leave()
 		c.action = action
 		if len(out) > 0 {
-			c.out = append([]byte{}, out...)
+			c.queue(append([]byte{}, out...))
 		}
 	}
-	if len(c.out) != 0 || c.action != None {
-		l.poll.ModReadWrite(c.fd)
-	}
-	return nil
 }
 
 type detachedConn struct {
@@ -530,6 +1790,57 @@ func (ln *listener) system() error {
 	return syscall.SetNonblock(ln.fd, true)
 }
 
+// inherit adopts the inherited fd of the address as the listener, instead
+// of listening.
+func (ln *listener) inherit() error {
+	fd, err := strconv.Atoi(ln.addr)
+	if err != nil || fd < 0 {
+		return fmt.Errorf("bad fd address %q", ln.addr)
+	}
+	stream, err := listeningSocket(fd)
+	if err != nil {
+		return fmt.Errorf("fd %d is not a listening socket: %v", fd, err)
+	}
+	f := os.NewFile(uintptr(fd), "fd://"+ln.addr)
+	defer f.Close() // the net listeners have their own fds
+	if stream {
+		ln.ln, err = net.FileListener(f)
+		return err
+	}
+	if ln.pconn, err = net.FilePacketConn(f); err != nil {
+		return err
+	}
+	if _, ok := ln.pconn.(*net.UDPConn); !ok {
+		ln.pconn.Close()
+		ln.pconn = nil
+		return fmt.Errorf("fd %d is not a udp socket", fd)
+	}
+	return nil
+}
+
+// listeningSocket checks the type of the inherited fd, which is a listening
+// stream socket or a datagram socket.
+func listeningSocket(fd int) (stream bool, err error) {
+	typ, err := syscall.GetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_TYPE)
+	if err != nil {
+		return false, err
+	}
+	switch typ {
+	case syscall.SOCK_STREAM:
+		accepting, err := syscall.GetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_ACCEPTCONN)
+		if err != nil {
+			return false, err
+		}
+		if accepting == 0 {
+			return false, errors.New("not listening")
+		}
+		return true, nil
+	case syscall.SOCK_DGRAM:
+		return false, nil
+	}
+	return false, fmt.Errorf("socket type %d", typ)
+}
+
 func reuseportListenPacket(proto, addr string) (l net.PacketConn, err error) {
 	return reuseport.ListenPacket(proto, addr)
 }
@@ -0,0 +1,757 @@
+// Copyright 2018 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+//go:build linux
+// +build linux
+
+package evio
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/azhai/evio/internal"
+)
+
+func TestSocketBuffers(t *testing.T) {
+	const size = 32 * 1024
+	var events Events
+	events.Opened = func(c Conn) (out []byte, opts Options, action Action) {
+		opts.SendBuf = size
+		return
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		fd := c.(*conn).fd
+		// linux doubles the value for bookkeeping overhead
+		n, err := syscall.GetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_SNDBUF)
+		if err != nil || n < size {
+			t.Fatalf("expected send buffer >= %d, got %d (%v)", size, n, err)
+		}
+		must(c.SetRecvBuffer(size))
+		n, err = syscall.GetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_RCVBUF)
+		if err != nil || n < size {
+			t.Fatalf("expected recv buffer >= %d, got %d (%v)", size, n, err)
+		}
+		return nil, Shutdown
+	}
+	events.Serving = func(srv Server) (action Action) {
+		go func() {
+			c, err := net.Dial("tcp", ":9991")
+			must(err)
+			defer c.Close()
+			c.Write([]byte("hello"))
+			c.Read([]byte{0})
+		}()
+		return
+	}
+	must(Serve(events, "tcp://:9991"))
+}
+
+// getLinger reads the SO_LINGER socket option, which syscall has no getter
+// for.
+func getLinger(fd int) (syscall.Linger, error) {
+	var l syscall.Linger
+	n := uint32(unsafe.Sizeof(l))
+	_, _, errno := syscall.Syscall6(syscall.SYS_GETSOCKOPT, uintptr(fd), syscall.SOL_SOCKET,
+		syscall.SO_LINGER, uintptr(unsafe.Pointer(&l)), uintptr(unsafe.Pointer(&n)), 0)
+	if errno != 0 {
+		return l, errno
+	}
+	return l, nil
+}
+
+func TestLinger(t *testing.T) {
+	var events Events
+	events.Opened = func(c Conn) (out []byte, opts Options, action Action) {
+		secs := 7
+		opts.Linger = &secs
+		return
+	}
+	expect := func(c Conn, onoff, secs int32) {
+		l, err := getLinger(c.(*conn).fd)
+		if err != nil || l.Onoff != onoff || (onoff == 1 && l.Linger != secs) {
+			t.Fatalf("expected linger %d %d, got %+v (%v)", onoff, secs, l, err)
+		}
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		expect(c, 1, 7)
+		must(c.SetLinger(-1))
+		expect(c, 0, 0) // off, the kernel keeps the seconds
+		must(c.SetLinger(0))
+		expect(c, 1, 0)
+		return nil, Close // reset
+	}
+	done := make(chan error, 1)
+	events.Serving = func(srv Server) (action Action) {
+		go func() {
+			c, err := net.Dial("tcp", ":9991")
+			must(err)
+			defer c.Close()
+			c.Write([]byte("hello"))
+			_, err = c.Read([]byte{0})
+			done <- err
+		}()
+		return
+	}
+	events.Tick = func() (delay time.Duration, action Action) {
+		select {
+		case err := <-done:
+			if !errors.Is(err, syscall.ECONNRESET) {
+				t.Fatalf("expected %v, got %v", syscall.ECONNRESET, err)
+			}
+			return 0, Shutdown
+		default:
+		}
+		return time.Second / 20, None
+	}
+	must(Serve(events, "tcp://:9991"))
+}
+
+func TestControl(t *testing.T) {
+	var data, control []byte
+	var mu sync.Mutex
+	var events Events
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		mu.Lock()
+		data = append(data, in...)
+		mu.Unlock()
+		return
+	}
+	events.Control = func(c Conn, b []byte) {
+		mu.Lock()
+		control = append(control, b...)
+		mu.Unlock()
+	}
+	events.Closed = func(c Conn, err error) (action Action) {
+		return Shutdown
+	}
+	events.Serving = func(srv Server) (action Action) {
+		go func() {
+			conn, err := net.Dial("tcp", ":9991")
+			must(err)
+			defer conn.Close()
+			sc, err := conn.(*net.TCPConn).SyscallConn()
+			must(err)
+			_, err = conn.Write([]byte("abc"))
+			must(err)
+			must(sc.Control(func(fd uintptr) {
+				must(syscall.Sendto(int(fd), []byte("!"), syscall.MSG_OOB, nil))
+			}))
+			_, err = conn.Write([]byte("def"))
+			must(err)
+			for start := time.Now(); ; time.Sleep(time.Millisecond) {
+				mu.Lock()
+				n := len(data) + len(control)
+				mu.Unlock()
+				if n == 7 || time.Since(start) > time.Second {
+					return
+				}
+			}
+		}()
+		return
+	}
+	must(Serve(events, "tcp://:9991"))
+	if string(data) != "abcdef" || string(control) != "!" {
+		t.Fatalf("expected %q and %q, got %q and %q", "abcdef", "!", data, control)
+	}
+}
+
+func benchmarkWrite(b *testing.B, writev bool) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	must(err)
+	defer syscall.Close(fds[0])
+	defer syscall.Close(fds[1])
+	go func() {
+		p := make([]byte, 0xFFFF)
+		for {
+			if n, err := syscall.Read(fds[1], p); n <= 0 || err != nil {
+				return
+			}
+		}
+	}()
+	bufs := make([][]byte, 8)
+	for i := range bufs {
+		bufs[i] = make([]byte, 512)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if writev {
+			_, err = internal.Writev(fds[0], bufs)
+		} else {
+			var out []byte
+			for _, buf := range bufs {
+				out = append(out, buf...)
+			}
+			_, err = syscall.Write(fds[0], out)
+		}
+		must(err)
+	}
+}
+
+func BenchmarkWritev(b *testing.B)      { benchmarkWrite(b, true) }
+func BenchmarkConcatWrite(b *testing.B) { benchmarkWrite(b, false) }
+
+func TestPinLoops(t *testing.T) {
+	var events Events
+	events.NumLoops = 2
+	events.PinLoops = true
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		return nil, Shutdown
+	}
+	events.Serving = func(srv Server) (action Action) {
+		go func() {
+			c, err := net.Dial("tcp", ":9991")
+			must(err)
+			defer c.Close()
+			c.Write([]byte("hello"))
+			c.Read([]byte{0})
+		}()
+		return
+	}
+	must(Serve(events, "tcp://:9991"))
+}
+
+// benchmarkPinLoops measures the echo throughput of the parallel clients,
+// the pinned loops keep their caches warm but cannot move off a busy cpu.
+func benchmarkPinLoops(b *testing.B, pin bool) {
+	const size = 4096
+	var done int32
+	var events Events
+	events.NumLoops = 2
+	events.PinLoops = pin
+	events.LoadBalance = RoundRobin
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		return in, None
+	}
+	events.Serving = func(srv Server) (action Action) {
+		go func() {
+			defer atomic.StoreInt32(&done, 1)
+			addr := srv.Addrs[0].String()
+			b.SetBytes(size)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				c, err := net.Dial("tcp", addr)
+				must(err)
+				defer c.Close()
+				buf := make([]byte, size)
+				for pb.Next() {
+					_, err := c.Write(buf)
+					must(err)
+					_, err = io.ReadFull(c, buf)
+					must(err)
+				}
+			})
+			b.StopTimer()
+		}()
+		return
+	}
+	events.Tick = func() (delay time.Duration, action Action) {
+		if atomic.LoadInt32(&done) == 1 {
+			action = Shutdown
+		}
+		return time.Second / 20, action
+	}
+	must(Serve(events, "tcp://127.0.0.1:0"))
+}
+
+func BenchmarkPinnedLoops(b *testing.B)   { benchmarkPinLoops(b, true) }
+func BenchmarkUnpinnedLoops(b *testing.B) { benchmarkPinLoops(b, false) }
+
+func TestKeepAliveProbes(t *testing.T) {
+	var events Events
+	events.Opened = func(c Conn) (out []byte, opts Options, action Action) {
+		opts.TCPKeepAlive = time.Minute
+		opts.KeepAliveInterval = 5 * time.Second
+		opts.KeepAliveProbes = 3
+		return
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		fd := c.(*conn).fd
+		for opt, expected := range map[int]int{
+			syscall.TCP_KEEPIDLE:  60,
+			syscall.TCP_KEEPINTVL: 5,
+			syscall.TCP_KEEPCNT:   3,
+		} {
+			if v, err := syscall.GetsockoptInt(fd, syscall.IPPROTO_TCP, opt); err != nil || v != expected {
+				panic(fmt.Sprintf("expected %d of option %d, got %d, %v", expected, opt, v, err))
+			}
+		}
+		return nil, Shutdown
+	}
+	events.Serving = func(srv Server) (action Action) {
+		go func() {
+			c, err := net.Dial("tcp", ":9991")
+			must(err)
+			defer c.Close()
+			c.Write([]byte("hello"))
+			c.Read([]byte{0})
+		}()
+		return
+	}
+	must(Serve(events, "tcp://:9991"))
+}
+
+// serveEcho runs an echo server until the client function returns.
+func serveEcho(edge bool, client func(addr string)) {
+	var done int32
+	var events Events
+	events.Opened = func(c Conn) (out []byte, opts Options, action Action) {
+		opts.EdgeTriggered = edge
+		// do not wait for the acks of the small messages
+		syscall.SetsockoptInt(c.(*conn).fd, syscall.IPPROTO_TCP, syscall.TCP_NODELAY, 1)
+		return
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		if in == nil {
+			return []byte("woke"), None
+		}
+		if string(in) == "wake" {
+			go c.Wake()
+			return
+		}
+		return in, None
+	}
+	events.Serving = func(srv Server) (action Action) {
+		go func() {
+			client(srv.Addrs[0].String())
+			atomic.StoreInt32(&done, 1)
+		}()
+		return
+	}
+	events.Tick = func() (delay time.Duration, action Action) {
+		if atomic.LoadInt32(&done) == 1 {
+			action = Shutdown
+		}
+		return time.Second / 20, action
+	}
+	must(Serve(events, "tcp://127.0.0.1:0"))
+}
+
+func TestEdgeTriggered(t *testing.T) {
+	serveEcho(true, func(addr string) {
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				c, err := net.Dial("tcp", addr)
+				must(err)
+				defer c.Close()
+				msg := []byte("message\n")
+				go func() {
+					for i := 0; i < 1000; i++ {
+						c.Write(msg)
+					}
+				}()
+				data := make([]byte, len(msg)*1000)
+				_, err = io.ReadFull(c, data)
+				must(err)
+				if !bytes.Equal(data, bytes.Repeat(msg, 1000)) {
+					panic("mismatch")
+				}
+				c.Write([]byte("wake"))
+				_, err = io.ReadFull(c, data[:4])
+				must(err)
+				if string(data[:4]) != "woke" {
+					panic("expected woke")
+				}
+			}()
+		}
+		wg.Wait()
+	})
+}
+
+func benchmarkTrigger(b *testing.B, edge bool) {
+	serveEcho(edge, func(addr string) {
+		c, err := net.Dial("tcp", addr)
+		must(err)
+		defer c.Close()
+		msg := make([]byte, 16)
+		data := make([]byte, len(msg)*64)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			for j := 0; j < 64; j++ {
+				c.Write(msg)
+			}
+			_, err = io.ReadFull(c, data)
+			must(err)
+		}
+		b.StopTimer()
+	})
+}
+
+func BenchmarkLevelTriggered(b *testing.B) { benchmarkTrigger(b, false) }
+func BenchmarkEdgeTriggered(b *testing.B)  { benchmarkTrigger(b, true) }
+
+// serveBulk runs a server which replies a bulk of 4MB to "bulk", and sends
+// the time of every "ping" to the pinged channel, until client returns.
+func serveBulk(eager bool, client func(addr string, pinged chan time.Time)) {
+	var done int32
+	pinged := make(chan time.Time, 1)
+	bulk := make([]byte, 4*1024*1024)
+	var events Events
+	events.Opened = func(c Conn) (out []byte, opts Options, action Action) {
+		opts.EagerDelivery = eager
+		return
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		switch string(in) {
+		case "bulk":
+			return bulk, None
+		case "ping":
+			pinged <- time.Now()
+		}
+		return
+	}
+	events.Serving = func(srv Server) (action Action) {
+		go func() {
+			client(srv.Addrs[0].String(), pinged)
+			atomic.StoreInt32(&done, 1)
+		}()
+		return
+	}
+	events.Tick = func() (delay time.Duration, action Action) {
+		if atomic.LoadInt32(&done) == 1 {
+			action = Shutdown
+		}
+		return time.Second / 20, action
+	}
+	must(Serve(events, "tcp://127.0.0.1:0"))
+}
+
+func TestEagerDelivery(t *testing.T) {
+	serveBulk(true, func(addr string, pinged chan time.Time) {
+		c, err := net.Dial("tcp", addr)
+		must(err)
+		defer c.Close()
+		c.Write([]byte("bulk"))
+		time.Sleep(time.Second / 20)
+		c.Write([]byte("ping"))
+		// the bulk is not read, so the output of the server is pending
+		select {
+		case <-pinged:
+		case <-time.After(time.Second):
+			t.Fatal("expected the ping delivered while the output is pending")
+		}
+		_, err = io.CopyN(io.Discard, c, 4*1024*1024)
+		must(err)
+	})
+}
+
+func benchmarkDelivery(b *testing.B, eager bool) {
+	serveBulk(eager, func(addr string, pinged chan time.Time) {
+		c, err := net.Dial("tcp", addr)
+		must(err)
+		defer c.Close()
+		var latency time.Duration
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			c.Write([]byte("bulk"))
+			time.Sleep(time.Millisecond) // let the output be pending
+			start := time.Now()
+			c.Write([]byte("ping"))
+			time.Sleep(time.Millisecond * 5) // a slow reader
+			_, err = io.CopyN(io.Discard, c, 4*1024*1024)
+			must(err)
+			latency += (<-pinged).Sub(start)
+		}
+		b.StopTimer()
+		b.ReportMetric(float64(latency.Microseconds())/float64(b.N), "ping-us/op")
+	})
+}
+
+// The ping latency of the eager delivery does not wait for the bulk output.
+func BenchmarkEagerDelivery(b *testing.B)    { benchmarkDelivery(b, true) }
+func BenchmarkDeferredDelivery(b *testing.B) { benchmarkDelivery(b, false) }
+
+// benchmarkAccept measures connecting and one echo per connection, which
+// is dominated by accepting the connections.
+func benchmarkAccept(b *testing.B, acceptLoops int) {
+	var done int32
+	var events Events
+	events.NumLoops = 2
+	events.AcceptLoops = acceptLoops
+	events.LoadBalance = RoundRobin
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		return in, None
+	}
+	events.Serving = func(srv Server) (action Action) {
+		go func() {
+			defer atomic.StoreInt32(&done, 1)
+			addr := srv.Addrs[0].String()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				buf := []byte{0}
+				for pb.Next() {
+					c, err := net.Dial("tcp", addr)
+					must(err)
+					c.Write(buf)
+					c.Read(buf)
+					c.Close()
+				}
+			})
+			b.StopTimer()
+		}()
+		return
+	}
+	events.Tick = func() (delay time.Duration, action Action) {
+		if atomic.LoadInt32(&done) == 1 {
+			action = Shutdown
+		}
+		return time.Second / 20, action
+	}
+	must(Serve(events, "tcp://127.0.0.1:0"))
+}
+
+func BenchmarkAcceptOnLoops(b *testing.B) { benchmarkAccept(b, 0) }
+func BenchmarkAcceptLoops1(b *testing.B)  { benchmarkAccept(b, 1) }
+func BenchmarkAcceptLoops2(b *testing.B)  { benchmarkAccept(b, 2) }
+
+func TestInheritedListener(t *testing.T) {
+	t.Run("poll", func(t *testing.T) {
+		testInheritedListener(":9991", false)
+	})
+	t.Run("stdlib", func(t *testing.T) {
+		testInheritedListener(":9992", true)
+	})
+	if err := Serve(Events{}, "fd://x"); err == nil || !strings.Contains(err.Error(), "bad fd address") {
+		t.Fatalf("expected a bad fd address, got %v", err)
+	}
+	f, err := os.Open("evio.go")
+	must(err)
+	defer f.Close()
+	if err := Serve(Events{}, fmt.Sprintf("fd://%d", f.Fd())); err == nil || !strings.Contains(err.Error(), "not a listening socket") {
+		t.Fatalf("expected not a listening socket, got %v", err)
+	}
+	// a bound but not listening stream socket
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_STREAM, 0)
+	must(err)
+	defer syscall.Close(fd)
+	if err := Serve(Events{}, fmt.Sprintf("fd://%d", fd)); err == nil || !strings.Contains(err.Error(), "not listening") {
+		t.Fatalf("expected not listening, got %v", err)
+	}
+}
+
+// inheritedFd returns a dup of the fd of a new listener, like the one which
+// is passed by the socket activation.
+func inheritedFd(addr string) int {
+	ln, err := net.Listen("tcp", addr)
+	must(err)
+	defer ln.Close()
+	f, err := ln.(*net.TCPListener).File()
+	must(err)
+	defer f.Close()
+	fd, err := syscall.Dup(int(f.Fd()))
+	must(err)
+	return fd
+}
+
+func testInheritedListener(addr string, stdlib bool) {
+	var echoed int32
+	var events Events
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		return in, None
+	}
+	events.Serving = func(srv Server) (action Action) {
+		go func() {
+			conn, err := net.Dial("tcp", addr)
+			must(err)
+			defer conn.Close()
+			_, err = conn.Write([]byte("hello"))
+			must(err)
+			buf := make([]byte, 5)
+			_, err = io.ReadFull(conn, buf)
+			must(err)
+			atomic.StoreInt32(&echoed, 1)
+		}()
+		return
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	events.Tick = func() (delay time.Duration, action Action) {
+		if atomic.LoadInt32(&echoed) == 1 {
+			return 0, Shutdown
+		}
+		if time.Now().After(deadline) {
+			panic("expected an echo from the inherited listener")
+		}
+		return time.Second / 20, None
+	}
+	scheme := "fd://"
+	if stdlib {
+		scheme = "fd-net://"
+	}
+	must(Serve(events, fmt.Sprintf("%s%d", scheme, inheritedFd(addr))))
+}
+
+func TestRegisterFailure(t *testing.T) {
+	t.Run("loops", func(t *testing.T) { testRegisterFailure(t, 0) })
+	t.Run("accept-loops", func(t *testing.T) { testRegisterFailure(t, 1) })
+}
+
+func testRegisterFailure(t *testing.T, acceptLoops int) {
+	var failed int32
+	pollAdd = func(p *internal.Poll, fd int) error {
+		if atomic.CompareAndSwapInt32(&failed, 0, 1) {
+			return syscall.ENOSPC // the first connection
+		}
+		return p.AddReadWrite(fd)
+	}
+	defer func() { pollAdd = (*internal.Poll).AddReadWrite }()
+	var done, opened int32
+	var failures uint64
+	var events Events
+	events.AcceptLoops = acceptLoops
+	events.Opened = func(c Conn) (out []byte, opts Options, action Action) {
+		atomic.AddInt32(&opened, 1)
+		return []byte("hi"), opts, None
+	}
+	events.Serving = func(srv Server) (action Action) {
+		go func() {
+			defer atomic.StoreInt32(&done, 1)
+			addr := srv.Addrs[0].String()
+			c1, err := net.Dial("tcp", addr)
+			must(err)
+			defer c1.Close()
+			c1.SetReadDeadline(time.Now().Add(time.Second))
+			if data, err := io.ReadAll(c1); err != nil || len(data) != 0 {
+				panic(fmt.Sprintf("expected the failed connection closed, got %q %v", data, err))
+			}
+			c2, err := net.Dial("tcp", addr)
+			must(err)
+			defer c2.Close()
+			buf := make([]byte, 2)
+			c2.SetReadDeadline(time.Now().Add(time.Second))
+			_, err = io.ReadFull(c2, buf)
+			must(err)
+			for _, st := range srv.LoopStats() {
+				failures += st.RegisterFailures
+			}
+		}()
+		return
+	}
+	events.Tick = func() (delay time.Duration, action Action) {
+		if atomic.LoadInt32(&done) == 1 {
+			action = Shutdown
+		}
+		return time.Second / 20, action
+	}
+	must(Serve(events, "tcp://127.0.0.1:0"))
+	if n := atomic.LoadInt32(&opened); n != 1 {
+		t.Fatalf("expected only the second connection opened, got %d", n)
+	}
+	if failures != 1 {
+		t.Fatalf("expected 1 register failure, got %d", failures)
+	}
+}
+
+// procWrites returns the write syscalls of the process, which are the wakes
+// of the loops and the writes of the connections for a broadcast.
+func procWrites() uint64 {
+	data, err := os.ReadFile("/proc/self/io")
+	must(err)
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(line, "syscw: ") {
+			var n uint64
+			fmt.Sscan(line[len("syscw: "):], &n)
+			return n
+		}
+	}
+	return 0
+}
+
+// BenchmarkBroadcast measures a broadcast to 10k connections, with the write
+// syscalls and the poll cycles of every broadcast.
+func BenchmarkBroadcast(b *testing.B) {
+	conns := 10000
+	var rlim syscall.Rlimit
+	must(syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rlim))
+	if rlim.Cur < rlim.Max {
+		rlim.Cur = rlim.Max
+		syscall.Setrlimit(syscall.RLIMIT_NOFILE, &rlim)
+	}
+	if max := int(rlim.Cur-64) / 2; conns > max {
+		b.Logf("%d connections by the fd limit of %d", max, rlim.Cur)
+		conns = max
+	}
+	payload := []byte("broadcast\n")
+	var done, opened int32
+	var events Events
+	events.NumLoops = 2
+	events.Opened = func(c Conn) (out []byte, opts Options, action Action) {
+		BindSession(c, &testSession{id: fmt.Sprintf("bcast-%d", atomic.AddInt32(&opened, 1))})
+		return
+	}
+	events.Closed = func(c Conn, err error) (action Action) {
+		DestroySession(c)
+		return
+	}
+	events.Serving = func(srv Server) (action Action) {
+		go func() {
+			defer atomic.StoreInt32(&done, 1)
+			addr := srv.Addrs[0].String()
+			var received sync.WaitGroup
+			rounds := make(chan struct{})
+			clients := make([]net.Conn, conns)
+			for i := range clients {
+				c, err := net.Dial("tcp", addr)
+				must(err)
+				clients[i] = c
+				defer c.Close()
+			}
+			for atomic.LoadInt32(&opened) < int32(conns) {
+				time.Sleep(time.Millisecond)
+			}
+			for _, c := range clients {
+				go func(c net.Conn) {
+					buf := make([]byte, len(payload))
+					for range rounds {
+						if _, err := io.ReadFull(c, buf); err != nil {
+							panic(err)
+						}
+						received.Done()
+					}
+				}(c)
+			}
+			cycles := func() (n uint64) {
+				for _, st := range srv.LoopStats() {
+					n += st.Cycles
+				}
+				return
+			}
+			writes, polls := procWrites(), cycles()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				received.Add(conns)
+				for range clients {
+					rounds <- struct{}{}
+				}
+				Broadcast(payload, 0, false)
+				received.Wait()
+			}
+			b.StopTimer()
+			close(rounds)
+			b.ReportMetric(float64(procWrites()-writes)/float64(b.N), "writes/op")
+			b.ReportMetric(float64(cycles()-polls)/float64(b.N), "cycles/op")
+		}()
+		return
+	}
+	events.Tick = func() (delay time.Duration, action Action) {
+		if atomic.LoadInt32(&done) == 1 {
+			action = Shutdown
+		}
+		return time.Second / 20, action
+	}
+	must(Serve(events, "tcp://127.0.0.1:0"))
+}
@@ -0,0 +1,125 @@
+// Copyright 2018 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package evio
+
+// ackWindow is the window of AckWindow, which is guarded by the mu of the
+// connection. The messages of QueueWrite are numbered from 1 in the order
+// that the loop queues them.
+type ackWindow struct {
+	size     int
+	sent     uint64        // number of the queued messages
+	acked    uint64        // the highest acknowledged message
+	reserved int           // QueueWrite calls which are not queued yet
+	wait     chan struct{} // closed once a message may be sent
+}
+
+func (w *ackWindow) full() bool { return int(w.sent-w.acked)+w.reserved >= w.size }
+
+// wake releases the QueueWrite calls which wait for the window.
+func (w *ackWindow) wake() {
+	if w.wait != nil {
+		close(w.wait)
+		w.wait = nil
+	}
+}
+
+// AckWindow limits the messages of QueueWrite which are not acknowledged by
+// AckReceived to size, such as for the reliable messaging of a protocol,
+// which follows the acks of the peer rather than the socket. Over the
+// window, QueueWrite blocks until an ack, or returns ErrAckWindowFull while
+// the loop of the connection runs an event, which it cannot wait for. The messages are numbered from
+// 1 in the order that they are queued, the other writes are not counted. A
+// size of zero removes the window. It's safe to call from any goroutine.
+func AckWindow(c Conn, size int) {
+	lc, ok := c.(loopConn)
+	if !ok {
+		return
+	}
+	cs := lc.state()
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if w := cs.ackwin; w != nil {
+		w.wake()
+	}
+	if size <= 0 {
+		cs.ackwin = nil
+		return
+	}
+	if cs.ackwin == nil {
+		cs.ackwin = &ackWindow{}
+	}
+	cs.ackwin.size = size
+}
+
+// AckReceived acknowledges the messages of QueueWrite up to the number upTo,
+// which frees their slots of the AckWindow. It's called by the handler which
+// reads the acks of the peer, such as in the Data event. An ack beyond the
+// queued messages acknowledges all of them, and an older one is ignored.
+func AckReceived(c Conn, upTo uint64) {
+	lc, ok := c.(loopConn)
+	if !ok {
+		return
+	}
+	cs := lc.state()
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	w := cs.ackwin
+	if w == nil {
+		return
+	}
+	if upTo > w.sent {
+		upTo = w.sent
+	}
+	if upTo > w.acked {
+		w.acked = upTo
+		w.wake()
+	}
+}
+
+// reserveWindow takes a slot of the AckWindow for a QueueWrite, waiting for
+// it when the window is full and the caller may wait. The reserved is false
+// when there is no window.
+func (cs *connState) reserveWindow(wait bool) (reserved bool, err error) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	for {
+		w := cs.ackwin
+		switch {
+		case cs.closed:
+			return false, ErrConnClosed
+		case w == nil:
+			return false, nil
+		case !w.full():
+			w.reserved++
+			return true, nil
+		case !wait:
+			return false, ErrAckWindowFull // cannot wait for the acks
+		}
+		if w.wait == nil {
+			w.wait = make(chan struct{})
+		}
+		wait := w.wait
+		cs.mu.Unlock()
+		<-wait
+		cs.mu.Lock()
+	}
+}
+
+// settleWindow counts the message of a reserved slot once it's queued, or
+// frees the slot when it's not.
+func (cs *connState) settleWindow(queued bool) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	w := cs.ackwin
+	if w == nil || w.reserved == 0 {
+		return // the window is changed meanwhile
+	}
+	w.reserved--
+	if queued {
+		w.sent++
+	} else {
+		w.wake()
+	}
+}
@@ -0,0 +1,58 @@
+// Copyright 2018 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// +build darwin netbsd freebsd openbsd dragonfly linux
+
+package internal
+
+import (
+	"sync"
+	"syscall"
+)
+
+// closeGuard keeps the fd of the triggers open until the last trigger which
+// writes to it returns, so a trigger never writes to a closed fd which may be
+// reused by another file, such as an accepted socket. The lock is not held
+// while writing, which may block, so Close never waits for a trigger.
+type closeGuard struct {
+	mu      sync.Mutex
+	fd      int
+	closed  bool
+	writers int // triggers which are writing to the fd
+}
+
+// enter returns false once the fd is closed, otherwise the caller writes to
+// the fd and then calls leave.
+func (g *closeGuard) enter() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.closed {
+		return false
+	}
+	g.writers++
+	return true
+}
+
+// leave closes the fd when the guard is closed by the last writer.
+func (g *closeGuard) leave() {
+	g.mu.Lock()
+	g.writers--
+	last := g.closed && g.writers == 0
+	g.mu.Unlock()
+	if last {
+		syscall.Close(g.fd)
+	}
+}
+
+// close closes the fd, or leaves it to the last writer.
+func (g *closeGuard) close() error {
+	g.mu.Lock()
+	g.closed = true
+	idle := g.writers == 0
+	g.mu.Unlock()
+	if idle {
+		return syscall.Close(g.fd)
+	}
+	return nil
+}
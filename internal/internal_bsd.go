@@ -6,17 +6,29 @@
 
 package internal
 
-import (
-	"syscall"
-)
+import "syscall"
 
 // Poll ...
 type Poll struct {
+	ranker
 	fd      int
 	changes []syscall.Kevent_t
 	notes   noteQueue
+	wake    closeGuard // of the fd, for the triggers
+	// Waited is called with the number of the events of every wait, full
+	// is true when they fill the batch of MaxEvents.
+	Waited func(n int, full bool)
+	// Flush is called after the notes of every wait, such as to write the
+	// output of their commands at once.
+	Flush func() error
+	// Urgent is not supported by kqueue, the urgent data is never
+	// reported.
+	Urgent bool
 }
 
+// MaxEvents is the batch size of a wait.
+const MaxEvents = 128
+
 // OpenPoll ...
 func OpenPoll() *Poll {
 	l := new(Poll)
@@ -25,6 +37,7 @@ func OpenPoll() *Poll {
 		panic(err)
 	}
 	l.fd = p
+	l.wake.fd = p
 	_, err = syscall.Kevent(l.fd, []syscall.Kevent_t{{
 		Ident:  0,
 		Filter: syscall.EVFILT_USER,
@@ -39,12 +52,18 @@ func OpenPoll() *Poll {
 
 // Close ...
 func (p *Poll) Close() error {
-	return syscall.Close(p.fd)
+	return p.wake.close()
 }
 
 // Trigger ...
 func (p *Poll) Trigger(note interface{}) error {
-	p.notes.Add(note)
+	if !p.wake.enter() {
+		return syscall.EBADF // closed
+	}
+	defer p.wake.leave()
+	if !p.notes.Add(note) {
+		return nil // the trigger of the former note is pending
+	}
 	_, err := syscall.Kevent(p.fd, []syscall.Kevent_t{{
 		Ident:  0,
 		Filter: syscall.EVFILT_USER,
@@ -55,21 +74,34 @@ func (p *Poll) Trigger(note interface{}) error {
 
 // Wait ...
 func (p *Poll) Wait(iter func(fd int, note interface{}) error) error {
-	events := make([]syscall.Kevent_t, 128)
+	events := make([]syscall.Kevent_t, MaxEvents)
+	fdOf := func(i int) int { return int(events[i].Ident) }
 	for {
 		n, err := syscall.Kevent(p.fd, p.changes, events, nil)
 		if err != nil && err != syscall.EINTR {
 			return err
 		}
 		p.changes = p.changes[:0]
+		if n > 0 && p.Waited != nil {
+			p.Waited(n, n == len(events))
+		}
 		if err := p.notes.ForEach(func(note interface{}) error {
 			return iter(0, note)
 		}); err != nil {
 			return err
 		}
-		for i := 0; i < n; i++ {
+		if p.Flush != nil {
+			if err := p.Flush(); err != nil {
+				return err
+			}
+		}
+		for _, i := range p.sort(n, fdOf) {
 			if fd := int(events[i].Ident); fd != 0 {
-				if err := iter(fd, nil); err != nil {
+				var note interface{}
+				if events[i].Flags&(syscall.EV_EOF|syscall.EV_ERROR) != 0 {
+					note = Hangup
+				}
+				if err := iter(fd, note); err != nil {
 					return err
 				}
 			}
@@ -86,8 +118,9 @@ func (p *Poll) AddRead(fd int) {
 	)
 }
 
-// AddReadWrite ...
-func (p *Poll) AddReadWrite(fd int) {
+// AddReadWrite adds the fd of a connection. The change is applied by the
+// next kevent, so the error is always nil.
+func (p *Poll) AddReadWrite(fd int) error {
 	p.changes = append(p.changes,
 		syscall.Kevent_t{
 			Ident: uint64(fd), Flags: syscall.EV_ADD, Filter: syscall.EVFILT_READ,
@@ -96,6 +129,7 @@ func (p *Poll) AddReadWrite(fd int) {
 			Ident: uint64(fd), Flags: syscall.EV_ADD, Filter: syscall.EVFILT_WRITE,
 		},
 	)
+	return nil
 }
 
 // ModRead ...
@@ -112,6 +146,19 @@ func (p *Poll) ModReadWrite(fd int) {
 	})
 }
 
+// ModEdge sets the fd to edge-triggered reading and writing. The current
+// readiness of the fd is reported again, even when it's already reported.
+func (p *Poll) ModEdge(fd int) {
+	p.changes = append(p.changes,
+		syscall.Kevent_t{
+			Ident: uint64(fd), Flags: syscall.EV_ADD | syscall.EV_CLEAR, Filter: syscall.EVFILT_READ,
+		},
+		syscall.Kevent_t{
+			Ident: uint64(fd), Flags: syscall.EV_ADD | syscall.EV_CLEAR, Filter: syscall.EVFILT_WRITE,
+		},
+	)
+}
+
 // ModDetach ...
 func (p *Poll) ModDetach(fd int) {
 	p.changes = append(p.changes,
@@ -123,3 +170,13 @@ func (p *Poll) ModDetach(fd int) {
 		},
 	)
 }
+
+// SetCork returns ENOPROTOOPT, there is no TCP_CORK.
+func SetCork(fd int, on bool) error {
+	return syscall.ENOPROTOOPT
+}
+
+// SetAffinity pins the current thread to the cpu.
+func SetAffinity(cpu int) error {
+	return syscall.ENOTSUP
+}
@@ -18,3 +18,19 @@ func SetKeepAlive(fd, secs int) error {
 	}
 	return syscall.SetsockoptInt(fd, syscall.IPPROTO_TCP, syscall.TCP_KEEPALIVE, secs)
 }
+
+// SetKeepAliveProbes sets the interval and the count of the keepalive
+// probes, the zero values are left unchanged
+func SetKeepAliveProbes(fd, intvl, cnt int) error {
+	if intvl > 0 {
+		// TCP_KEEPINTVL
+		if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_TCP, 0x101, intvl); err != nil {
+			return err
+		}
+	}
+	if cnt > 0 {
+		// TCP_KEEPCNT
+		return syscall.SetsockoptInt(fd, syscall.IPPROTO_TCP, 0x102, cnt)
+	}
+	return nil
+}
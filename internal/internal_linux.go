@@ -6,15 +6,38 @@ package internal
 
 import (
 	"syscall"
+	"unsafe"
 )
 
 // Poll ...
 type Poll struct {
+	ranker
 	fd    int // epoll fd
 	wfd   int // wake fd
 	notes noteQueue
+	wake  closeGuard // of the wake fd
+	// Waited is called with the number of the events of every wait, full
+	// is true when they fill the batch of MaxEvents.
+	Waited func(n int, full bool)
+	// Flush is called after the notes of every wait, such as to write the
+	// output of their commands at once.
+	Flush func() error
+	// Urgent watches the connections for TCP urgent data (EPOLLPRI), which
+	// are reported with the Urgent note. It's set before adding any.
+	Urgent bool
 }
 
+// events adds EPOLLPRI to the events of a connection by Urgent.
+func (p *Poll) events(ev uint32) uint32 {
+	if p.Urgent {
+		ev |= syscall.EPOLLPRI
+	}
+	return ev
+}
+
+// MaxEvents is the batch size of a wait.
+const MaxEvents = 64
+
 // OpenPoll ...
 func OpenPoll() *Poll {
 	l := new(Poll)
@@ -29,13 +52,14 @@ func OpenPoll() *Poll {
 		panic(err)
 	}
 	l.wfd = int(r0)
+	l.wake.fd = l.wfd
 	l.AddRead(l.wfd)
 	return l
 }
 
 // Close ...
 func (p *Poll) Close() error {
-	if err := syscall.Close(p.wfd); err != nil {
+	if err := p.wake.close(); err != nil {
 		return err
 	}
 	return syscall.Close(p.fd)
@@ -43,45 +67,80 @@ func (p *Poll) Close() error {
 
 // Trigger ...
 func (p *Poll) Trigger(note interface{}) error {
-	p.notes.Add(note)
-	_, err := syscall.Write(p.wfd, []byte{0, 0, 0, 0, 0, 0, 0, 1})
+	if !p.wake.enter() {
+		return syscall.EBADF // closed
+	}
+	defer p.wake.leave()
+	if !p.notes.Add(note) {
+		return nil // the wake of the former note is pending
+	}
+	_, err := syscall.Write(p.wfd, wakeOne)
 	return err
 }
 
+// wakeOne is 1 in the host byte order, which is added to the eventfd
+// counter. A wrong order adds 1<<56, and the write blocks once a few
+// hundred triggers are not read yet.
+var wakeOne = func() []byte {
+	one := uint64(1)
+	return (*[8]byte)(unsafe.Pointer(&one))[:]
+}()
+
 // Wait ...
 func (p *Poll) Wait(iter func(fd int, note interface{}) error) error {
-	events := make([]syscall.EpollEvent, 64)
+	events := make([]syscall.EpollEvent, MaxEvents)
+	fdOf := func(i int) int { return int(events[i].Fd) }
+	wbuf := make([]byte, 8)
 	for {
 		n, err := syscall.EpollWait(p.fd, events, -1)
 		if err != nil && err != syscall.EINTR {
 			return err
 		}
+		if n > 0 && p.Waited != nil {
+			p.Waited(n, n == len(events))
+		}
+		for i := 0; i < n; i++ {
+			if int(events[i].Fd) == p.wfd {
+				// reset the counter before taking the notes, so the
+				// triggers after it wake the next wait
+				syscall.Read(p.wfd, wbuf)
+				break
+			}
+		}
 		if err := p.notes.ForEach(func(note interface{}) error {
 			return iter(0, note)
 		}); err != nil {
 			return err
 		}
-		for i := 0; i < n; i++ {
+		if p.Flush != nil {
+			if err := p.Flush(); err != nil {
+				return err
+			}
+		}
+		for _, i := range p.sort(n, fdOf) {
 			if fd := int(events[i].Fd); fd != p.wfd {
-				if err := iter(fd, nil); err != nil {
+				var note interface{}
+				if events[i].Events&(syscall.EPOLLHUP|syscall.EPOLLERR) != 0 {
+					note = Hangup
+				} else if events[i].Events&syscall.EPOLLPRI != 0 {
+					note = Urgent
+				}
+				if err := iter(fd, note); err != nil {
 					return err
 				}
-			} else {
-
 			}
 		}
 	}
 }
 
-// AddReadWrite ...
-func (p *Poll) AddReadWrite(fd int) {
-	if err := syscall.EpollCtl(p.fd, syscall.EPOLL_CTL_ADD, fd,
+// AddReadWrite adds the fd of a connection, unlike the other methods it
+// returns the error, such as ENOSPC at the limit of the watched fds.
+func (p *Poll) AddReadWrite(fd int) error {
+	return syscall.EpollCtl(p.fd, syscall.EPOLL_CTL_ADD, fd,
 		&syscall.EpollEvent{Fd: int32(fd),
-			Events: syscall.EPOLLIN | syscall.EPOLLOUT,
+			Events: p.events(syscall.EPOLLIN | syscall.EPOLLOUT),
 		},
-	); err != nil {
-		panic(err)
-	}
+	)
 }
 
 // AddRead ...
@@ -99,7 +158,7 @@ func (p *Poll) AddRead(fd int) {
 func (p *Poll) ModRead(fd int) {
 	if err := syscall.EpollCtl(p.fd, syscall.EPOLL_CTL_MOD, fd,
 		&syscall.EpollEvent{Fd: int32(fd),
-			Events: syscall.EPOLLIN,
+			Events: p.events(syscall.EPOLLIN),
 		},
 	); err != nil {
 		panic(err)
@@ -110,7 +169,19 @@ func (p *Poll) ModRead(fd int) {
 func (p *Poll) ModReadWrite(fd int) {
 	if err := syscall.EpollCtl(p.fd, syscall.EPOLL_CTL_MOD, fd,
 		&syscall.EpollEvent{Fd: int32(fd),
-			Events: syscall.EPOLLIN | syscall.EPOLLOUT,
+			Events: p.events(syscall.EPOLLIN | syscall.EPOLLOUT),
+		},
+	); err != nil {
+		panic(err)
+	}
+}
+
+// ModEdge sets the fd to edge-triggered reading and writing. The current
+// readiness of the fd is reported again, even when it's already reported.
+func (p *Poll) ModEdge(fd int) {
+	if err := syscall.EpollCtl(p.fd, syscall.EPOLL_CTL_MOD, fd,
+		&syscall.EpollEvent{Fd: int32(fd),
+			Events: p.events(syscall.EPOLLIN | syscall.EPOLLOUT | syscall.EPOLLET&0xffffffff),
 		},
 	); err != nil {
 		panic(err)
@@ -127,3 +198,25 @@ func (p *Poll) ModDetach(fd int) {
 		panic(err)
 	}
 }
+
+// SetCork sets the TCP_CORK option, which holds the partial frames of the
+// socket until it's cleared.
+func SetCork(fd int, on bool) error {
+	var v int
+	if on {
+		v = 1
+	}
+	return syscall.SetsockoptInt(fd, syscall.IPPROTO_TCP, syscall.TCP_CORK, v)
+}
+
+// SetAffinity pins the current thread to the cpu.
+func SetAffinity(cpu int) error {
+	var mask [1024 / 64]uint64
+	mask[cpu/64%len(mask)] |= 1 << uint(cpu%64)
+	_, _, e0 := syscall.RawSyscall(syscall.SYS_SCHED_SETAFFINITY, 0,
+		uintptr(len(mask)*8), uintptr(unsafe.Pointer(&mask[0])))
+	if e0 != 0 {
+		return e0
+	}
+	return nil
+}
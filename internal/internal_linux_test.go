@@ -0,0 +1,47 @@
+// Copyright 2018 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package internal
+
+import (
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+func TestTriggerAfterClose(t *testing.T) {
+	p := OpenPoll()
+	// a full eventfd counter blocks the write of the next trigger
+	max := uint64(1<<64 - 2)
+	if _, err := syscall.Write(p.wfd, (*[8]byte)(unsafe.Pointer(&max))[:]); err != nil {
+		t.Fatal(err)
+	}
+	triggered := make(chan error, 1)
+	go func() { triggered <- p.Trigger(1) }()
+	time.Sleep(time.Second / 20)
+	closed := make(chan error, 1)
+	go func() { closed <- p.Close() }()
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected Close not to wait for a blocked trigger")
+	}
+	if err := p.Trigger(2); err != syscall.EBADF {
+		t.Fatalf("expected EBADF after closing, got %v", err)
+	}
+	// the wake fd is kept open for the blocked trigger, until it returns
+	if _, err := syscall.Read(p.wfd, make([]byte, 8)); err != nil {
+		t.Fatalf("expected the wake fd open, got %v", err)
+	}
+	if err := <-triggered; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := syscall.Read(p.wfd, make([]byte, 8)); err != syscall.EBADF {
+		t.Fatalf("expected the wake fd closed by the trigger, got %v", err)
+	}
+}
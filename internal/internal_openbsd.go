@@ -4,8 +4,18 @@
 
 package internal
 
+import "syscall"
+
 // SetKeepAlive sets the keepalive for the connection
 func SetKeepAlive(fd, secs int) error {
 	// OpenBSD has no user-settable per-socket TCP keepalive options.
 	return nil
 }
+
+// SetKeepAliveProbes sets the interval and the count of the keepalive probes
+func SetKeepAliveProbes(fd, intvl, cnt int) error {
+	if intvl > 0 || cnt > 0 {
+		return syscall.ENOPROTOOPT
+	}
+	return nil
+}
@@ -17,3 +17,17 @@ func SetKeepAlive(fd, secs int) error {
 	}
 	return syscall.SetsockoptInt(fd, syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE, secs)
 }
+
+// SetKeepAliveProbes sets the interval and the count of the keepalive
+// probes, the zero values are left unchanged
+func SetKeepAliveProbes(fd, intvl, cnt int) error {
+	if intvl > 0 {
+		if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_TCP, syscall.TCP_KEEPINTVL, intvl); err != nil {
+			return err
+		}
+	}
+	if cnt > 0 {
+		return syscall.SetsockoptInt(fd, syscall.IPPROTO_TCP, syscall.TCP_KEEPCNT, cnt)
+	}
+	return nil
+}
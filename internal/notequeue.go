@@ -9,6 +9,18 @@ import (
 	"sync/atomic"
 )
 
+type hangup struct{}
+
+// Hangup is the note which is passed along with the fd of a hang up or error
+// event, the remaining data of the fd should be read before closing it.
+var Hangup interface{} = hangup{}
+
+type urgent struct{}
+
+// Urgent is the note which is passed along with the fd of a connection which
+// has TCP urgent data, which is read by MSG_OOB. See Poll.Urgent.
+var Urgent interface{} = urgent{}
+
 // this is a good candiate for a lock-free structure.
 
 type spinlock struct{ lock uintptr }
@@ -0,0 +1,38 @@
+// Copyright 2018 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package internal
+
+// ranker orders the ready events of a wait by the Rank of their fds.
+type ranker struct {
+	// Rank is the priority of the fd, the events of the higher ranks are
+	// iterated first, and the equal ranks keep the order of the kernel.
+	// It's called on the goroutine of Wait, nil keeps the kernel order.
+	Rank  func(fd int) int
+	order []int
+	ranks []int
+}
+
+// sort returns the indexes of the n events in the iteration order, the fd
+// returns the fd of an event.
+func (r *ranker) sort(n int, fd func(i int) int) []int {
+	r.order, r.ranks = r.order[:0], r.ranks[:0]
+	for i := 0; i < n; i++ {
+		r.order = append(r.order, i)
+		if r.Rank != nil {
+			r.ranks = append(r.ranks, r.Rank(fd(i)))
+		}
+	}
+	if r.Rank == nil {
+		return r.order
+	}
+	// insertion sort, which is stable and linear for the equal ranks
+	for i := 1; i < n; i++ {
+		for j := i; j > 0 && r.ranks[j] > r.ranks[j-1]; j-- {
+			r.ranks[j], r.ranks[j-1] = r.ranks[j-1], r.ranks[j]
+			r.order[j], r.order[j-1] = r.order[j-1], r.order[j]
+		}
+	}
+	return r.order
+}
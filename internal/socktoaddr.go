@@ -37,3 +37,13 @@ func SockaddrToAddr(sa syscall.Sockaddr) net.Addr {
 	}
 	return a
 }
+
+// SockaddrToUDPAddr is SockaddrToAddr for a datagram socket, the inet
+// addresses are *net.UDPAddr like the ones of a net.PacketConn.
+func SockaddrToUDPAddr(sa syscall.Sockaddr) net.Addr {
+	a := SockaddrToAddr(sa)
+	if tcpaddr, ok := a.(*net.TCPAddr); ok {
+		return &net.UDPAddr{IP: tcpaddr.IP, Port: tcpaddr.Port, Zone: tcpaddr.Zone}
+	}
+	return a
+}
@@ -0,0 +1,43 @@
+// Copyright 2018 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// +build darwin netbsd freebsd openbsd dragonfly linux
+
+package internal
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// maxIovecs is the maximum number of buffers passed to a single writev call.
+const maxIovecs = 1024
+
+// Writev writes the buffers to the file descriptor with a single syscall.
+func Writev(fd int, bufs [][]byte) (int, error) {
+	if len(bufs) == 1 {
+		return syscall.Write(fd, bufs[0])
+	}
+	if len(bufs) > maxIovecs {
+		bufs = bufs[:maxIovecs]
+	}
+	iovs := make([]syscall.Iovec, 0, len(bufs))
+	for _, b := range bufs {
+		if len(b) == 0 {
+			continue
+		}
+		iov := syscall.Iovec{Base: &b[0]}
+		iov.SetLen(len(b))
+		iovs = append(iovs, iov)
+	}
+	if len(iovs) == 0 {
+		return 0, nil
+	}
+	n, _, e := syscall.Syscall(syscall.SYS_WRITEV, uintptr(fd),
+		uintptr(unsafe.Pointer(&iovs[0])), uintptr(len(iovs)))
+	if e != 0 {
+		return 0, e
+	}
+	return int(n), nil
+}